@@ -18,12 +18,19 @@ func main() {
 	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
 		Level: slog.LevelDebug,
 	}))
-	device1 := mouse.NewGenericHIDMouseDevice(logger)
-	device2 := echo.NewHIDEchoDevice(logger)
 	deviceRegistrar := usb.NewDeviceRegistrar(usb.DeviceRegistrarConfig{
 		BusNum:         1,
 		MaxDeviceCount: 10,
 	})
+	// Devices on the same bus share its clock, so that their frame numbers agree
+	device1, err := mouse.NewGenericHIDMouseDevice(deviceRegistrar.Clock(), logger)
+	if err != nil {
+		panic(err)
+	}
+	device2, err := echo.NewHIDEchoDevice(deviceRegistrar.Clock(), logger)
+	if err != nil {
+		panic(err)
+	}
 	if err := deviceRegistrar.Register(device1); err != nil {
 		panic(err)
 	}
@@ -1,18 +1,15 @@
 package mouse
 
 import (
-	"bytes"
+	"context"
 	"fmt"
 	"log/slog"
-	"time"
-	"unicode/utf16"
+	"sync"
 
 	"github.com/ntchjb/usbip-virtual-device/usb"
 	usbprotocol "github.com/ntchjb/usbip-virtual-device/usb/protocol"
 	"github.com/ntchjb/usbip-virtual-device/usb/protocol/descriptor"
 	"github.com/ntchjb/usbip-virtual-device/usb/protocol/hid"
-	"github.com/ntchjb/usbip-virtual-device/usbip/protocol/command"
-	"github.com/ntchjb/usbip-virtual-device/usbip/protocol/op"
 )
 
 var (
@@ -46,321 +43,120 @@ var (
 	}
 )
 
-type genericHIDMouseDevice struct {
-	deviceInfo op.DeviceInfo
-	logger     *slog.Logger
-
-	state int
-}
-
-func NewGenericHIDMouseDevice(logger *slog.Logger) usb.Device {
-	return &genericHIDMouseDevice{
-		logger: logger,
-		deviceInfo: op.DeviceInfo{
-			DeviceInfoTruncated: op.DeviceInfoTruncated{
-				Speed:               usbprotocol.SPEED_USB2_HIGH,
-				IDVendor:            0x0ff0, // a random vendor ID
-				IDProduct:           0x0123, // a random product ID
-				BCDDevice:           1,
-				BDeviceClass:        usbprotocol.CLASS_BASEDON_INTERFACE,
-				BDeviceSubclass:     usbprotocol.SUBCLASS_NONE,
-				BDeviceProtocol:     usbprotocol.PROTOCOL_NONE,
-				BConfigurationValue: 1,
-				BNumConfigurations:  1,
-				BNumInterfaces:      1,
-			},
-			Interfaces: []op.DeviceInterface{
-				{
-					BInterfaceClass:    usbprotocol.CLASS_HID,
-					BInterfaceSubclass: usbprotocol.SUBCLASS_HID_BOOT_INTERFACE,
-					BInterfaceProtocol: usbprotocol.PROTOCOL_HID_MOUSE,
+var (
+	mouseDescriptors = descriptor.Device{
+		Speed:          usbprotocol.SPEED_USB2_HIGH,
+		BCDUSB:         usbprotocol.HID_SPEC_VERSION,
+		BDeviceClass:   usbprotocol.CLASS_BASEDON_INTERFACE,
+		BMaxPacketSize: 64,
+		IDVendor:       0x0ff0, // a random vendor ID
+		IDProduct:      0x0123, // a random product ID
+		BCDDevice:      1,
+		Manufacturer:   "ntch.dev",
+		Product:        "Virtual Mouse",
+		SerialNumber:   "1ABBA1BABA1",
+		Configurations: []descriptor.Configuration{
+			{
+				BMAttributes: 0b01000000,
+				BMaxPower:    0x32,
+				Name:         "Default Configuration",
+				Interfaces: []descriptor.Interface{
+					{
+						AltSettings: []descriptor.AltSetting{
+							{
+								BInterfaceClass:    usbprotocol.CLASS_HID,
+								BInterfaceSubClass: usbprotocol.SUBCLASS_HID_BOOT_INTERFACE,
+								BInterfaceProtocol: usbprotocol.PROTOCOL_HID_MOUSE,
+								Name:               "Default Interface",
+								ClassSpecific: []descriptor.ClassSpecificDescriptor{
+									&hid.HIDDescriptor{
+										BLength:              hid.HID_DESCRIPTOR_LENGTH,
+										BDescriptorType:      descriptor.DESCRIPTOR_TYPE_HID,
+										BCDHID:               usbprotocol.HID_CLASS_SPEC_VERSION,
+										BCountryCode:         0,
+										BNumDescriptors:      1,
+										BClassDescriptorType: descriptor.DESCRIPTOR_TYPE_HID_REPORT,
+										WDescriptorLength:    uint16(len(mouseHIDReport)),
+									},
+								},
+								Endpoints: []descriptor.Endpoint{
+									{
+										BEndpointAddress: 0b10000001,
+										BMAttributes:     0b00000011,
+										WMaxPacketSize:   8,
+										BInterval:        MOUSE_REPORT_BINTERVAL,
+									},
+								},
+							},
+						},
+					},
 				},
 			},
 		},
 	}
-}
-
-func (g *genericHIDMouseDevice) GetWorkerPoolProfile() usb.WorkerPoolProfile {
-	return usb.WorkerPoolProfile{
-		MaximumProcWorkers:        1,
-		MaximumReplyWorkers:       1,
-		MaximumUnlinkReplyWorkers: 1,
-	}
-}
-
-func (g *genericHIDMouseDevice) GetBusID() usbprotocol.BusID {
-	return g.deviceInfo.BusID
-}
-
-func (g *genericHIDMouseDevice) SetBusID(busNum, devNum uint) {
-	busIDString := fmt.Sprintf("%d-%d", busNum, devNum)
-	var busID usbprotocol.BusID
-	var path [256]byte
-	copy(busID[:], []byte(busIDString))
-	copy(path[:], []byte("/sys/devices/pci0000:00/0000:00:1d.1/usb3/"+busIDString))
-	g.deviceInfo.BusID = busID
-	g.deviceInfo.BusNum = uint32(busNum)
-	g.deviceInfo.DevNum = uint32(devNum)
-	g.deviceInfo.Path = path
-}
-
-func (g *genericHIDMouseDevice) GetDeviceInfo() op.DeviceInfo {
-	return g.deviceInfo
-}
-
-func (g *genericHIDMouseDevice) Process(data command.CmdSubmit) command.RetSubmit {
-	retTransferBuffer := make([]byte, data.TransferBufferLength)
-	switch data.EndpointNumber {
-	case usbprotocol.ENDPOINT_CONTROL:
-		{
-			var setupPacket usbprotocol.SetupPacket
-			if err := setupPacket.Decode(bytes.NewBuffer(data.Setup[:])); err != nil {
-				g.logger.Error("unable to decode SetupPacket", "err", err)
-				return g.createErrorRetSubmit(data.CmdHeader)
-			}
-
-			retData, err := g.processControlMsg(setupPacket)
-			if err != nil {
-				g.logger.Error("unable to process control message", "err", err)
-				return g.createErrorRetSubmit(data.CmdHeader)
-			}
-
-			copy(retTransferBuffer, retData)
-			return g.createSuccessRetSubmit(data.CmdHeader, retTransferBuffer)
-		}
-	case usbprotocol.ENDPOINT_DEV_TO_HOST:
-		{
-			retData, err := g.proceeHIDData(data)
-			if err != nil {
-				g.logger.Error("unable to process data message", "err", err)
-				return g.createErrorRetSubmit(data.CmdHeader)
-			}
-			copy(retTransferBuffer, retData)
-			return g.createSuccessRetSubmit(data.CmdHeader, retTransferBuffer)
-		}
-	default:
-		g.logger.Error("unknown endpoint number", "endpoint", data.EndpointNumber)
-
-		return g.createErrorRetSubmit(data.CmdHeader)
-	}
-}
-
-func (g *genericHIDMouseDevice) createErrorRetSubmit(header command.CmdHeader) command.RetSubmit {
-	return command.RetSubmit{
-		CmdHeader: command.CmdHeader{
-			Command: command.RET_SUBMIT,
-			SeqNum:  header.SeqNum,
-		},
-		Status: 99,
-	}
-}
-
-func (g *genericHIDMouseDevice) createSuccessRetSubmit(header command.CmdHeader, returnData []byte) command.RetSubmit {
-	return command.RetSubmit{
-		CmdHeader: command.CmdHeader{
-			Command: command.RET_SUBMIT,
-			SeqNum:  header.SeqNum,
-		},
-		Status:          0,
-		ActualLength:    uint32(len(returnData)),
-		StartFrame:      0,
-		NumberOfPackets: 0,
-		ErrorCount:      0,
-		Padding:         0,
-		TransferBuffer:  returnData,
-	}
-}
-
-func (g *genericHIDMouseDevice) getDeviceDescriptor() descriptor.StandardDeviceDescriptor {
-	return descriptor.StandardDeviceDescriptor{
-		BLength:            descriptor.STANDARD_DEVICE_DESCRIPTOR_LENGTH,
-		BDescriptorType:    descriptor.DESCRIPTOR_TYPE_DEVICE,
-		BCDUSB:             usbprotocol.HID_SPEC_VERSION,
-		BDeviceClass:       usbprotocol.CLASS_BASEDON_INTERFACE,
-		BDeviceSubClass:    usbprotocol.SUBCLASS_NONE,
-		BDeviceProtocol:    usbprotocol.PROTOCOL_NONE,
-		BMaxPacketSize:     64,
-		IDVendor:           g.deviceInfo.IDVendor,
-		IDProduct:          g.deviceInfo.IDProduct,
-		BCDDevice:          g.deviceInfo.BCDDevice,
-		IManufacturer:      1, // String descriptor
-		IProduct:           2, // String descriptor
-		ISerialNumber:      3, // String descriptor
-		BNumConfigurations: 1,
-	}
-}
+)
 
-func (g *genericHIDMouseDevice) getConfigurationDescriptor(totalDetailLength uint16) descriptor.StandardConfigurationDescriptor {
-	return descriptor.StandardConfigurationDescriptor{
-		BLength:             descriptor.STANDARD_CONFIGURATION_DESCRIPTOR_LENGTH,
-		BDescriptorType:     descriptor.DESCRIPTOR_TYPE_CONFIGURATION,
-		WTotalLength:        descriptor.STANDARD_CONFIGURATION_DESCRIPTOR_LENGTH + totalDetailLength,
-		BNumInterfaces:      1,
-		BMAttributes:        0b01000000,
-		BMaxPower:           0x32,
-		BConfigurationValue: 1,
-		IConfiguration:      4, // String descriptor
-	}
-}
+const (
+	// Host polls the mouse every 2^(10-1) microframes, which is 64ms or polling rate of ~15Hz
+	MOUSE_REPORT_BINTERVAL = 10
+)
 
-func (g *genericHIDMouseDevice) getInterfaceDescriptor() descriptor.StandardInterfaceDescriptor {
-	return descriptor.StandardInterfaceDescriptor{
-		BLength:            descriptor.STANDARD_INTERFACE_DESCRIPTOR_LENGTH,
-		BDescriptorType:    descriptor.DESCRIPTOR_TYPE_INTERFACE,
-		BInterfaceNumber:   0,
-		BAlternateSetting:  0,
-		BNumEndpoints:      1,
-		BInterfaceClass:    usbprotocol.CLASS_HID,
-		BInterfaceSubClass: usbprotocol.SUBCLASS_HID_BOOT_INTERFACE,
-		BInterfaceProtocol: usbprotocol.PROTOCOL_HID_MOUSE,
-		IInterface:         5, // String descriptor
-	}
-}
+type genericHIDMouseDevice struct {
+	usb.StandardDevice
 
-func (g *genericHIDMouseDevice) getEndpointDescriptor() []descriptor.StandardEndpointDescriptor {
-	return []descriptor.StandardEndpointDescriptor{
-		{
-			BLength:          descriptor.STANDARD_ENDPOINT_DESCRIPTOR_LENGTH,
-			BDescriptorType:  descriptor.DESCRIPTOR_TYPE_ENDPOINT,
-			BEndpointAddress: 0b10000001,
-			BMAttributes:     0b00000011,
-			WMaxPacketSize:   8,
-			BInterval:        255,
-		},
-	}
-}
+	state int
 
-func (g *genericHIDMouseDevice) getHIDDescriptor(hidReportLength uint16) hid.HIDDescriptor {
-	return hid.HIDDescriptor{
-		BLength:              hid.HID_DESCRIPTOR_LENGTH,
-		BDescriptorType:      descriptor.DESCRIPTOR_TYPE_HID,
-		BCDHID:               usbprotocol.HID_CLASS_SPEC_VERSION,
-		BCountryCode:         0,
-		BNumDescriptors:      1,
-		BClassDescriptorType: descriptor.DESCRIPTOR_TYPE_HID_REPORT,
-		WDescriptorLength:    hidReportLength,
-	}
+	reports usb.InterruptINEndpoint
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
 }
 
-func (g *genericHIDMouseDevice) getStringDescriptor(index uint8) descriptor.StringDescriptor {
-	var content []uint16
-	switch index {
-	case 0: // For zero index, it return list of supported LangIDs
-		content = []uint16{uint16(descriptor.LANGID_ENGLISH_UNITED_STATES)}
-	case 1: // Manufacturer
-		content = utf16.Encode([]rune("ntch.dev"))
-	case 2: // Product
-		content = utf16.Encode([]rune("Virtual Mouse"))
-	case 3: // Serial Number
-		content = utf16.Encode([]rune("1ABBA1BABA1"))
-	case 4: // First Configuration
-		content = utf16.Encode([]rune("Default Configuration"))
-	case 5: // First interface
-		content = utf16.Encode([]rune("Default Interface"))
-	default:
-		g.logger.Error("Unknown string descriptor index", "index", index)
-	}
-
-	return descriptor.StringDescriptor{
-		BLength:         uint8(2 + len(content)*2),
-		BDescriptorType: descriptor.DESCRIPTOR_TYPE_STRING,
-		Content:         content,
+func NewGenericHIDMouseDevice(clock usb.Clock, logger *slog.Logger) (usb.AsyncDevice, error) {
+	descriptors, err := mouseDescriptors.Build()
+	if err != nil {
+		return nil, fmt.Errorf("unable to build mouse descriptors: %w", err)
 	}
-}
-
-func (g *genericHIDMouseDevice) getDescriptor(descriptorType descriptor.DescriptorType, index uint8) ([]byte, error) {
-	switch descriptorType {
-	case descriptor.DESCRIPTOR_TYPE_DEVICE:
-		desc := g.getDeviceDescriptor()
-		buf := new(bytes.Buffer)
-		if err := desc.Encode(buf); err != nil {
-			return nil, fmt.Errorf("unable to encode standard device descriptor: %w", err)
-		}
-		return buf.Bytes(), nil
-	case descriptor.DESCRIPTOR_TYPE_CONFIGURATION:
-		hidDesc := g.getHIDDescriptor(uint16(len(mouseHIDReport)))
-		intfDesc := g.getInterfaceDescriptor()
-		endpointDescs := g.getEndpointDescriptor()
-		configDescBuf := new(bytes.Buffer)
-		configDescDetailBuf := new(bytes.Buffer)
 
-		if err := intfDesc.Encode(configDescDetailBuf); err != nil {
-			return nil, fmt.Errorf("unable to encode interface descriptor: %w", err)
-		}
-		if err := hidDesc.Encode(configDescDetailBuf); err != nil {
-			return nil, fmt.Errorf("unable to encode HID descriptor: %w", err)
-		}
-		for _, endpointDesc := range endpointDescs {
-			if err := endpointDesc.Encode(configDescDetailBuf); err != nil {
-				return nil, fmt.Errorf("unable to encode HID descriptor: %w", err)
-			}
-		}
-
-		configDesc := g.getConfigurationDescriptor(uint16(configDescDetailBuf.Len()))
-		if err := configDesc.Encode(configDescBuf); err != nil {
-			return nil, fmt.Errorf("unable to encode configuration descriptor: %w", err)
-		}
-
-		// They are appended because USB/IP client requests 2 times as follow
-		// 1. Request for Configuration Descriptor only (9 bytes), and this result will be sliced
-		// 	  based on CmdSubmit's TransferBufferLength
-		// 2. The client side learn the actual length of data, it request again.
-		//    This time, it request the whole data (34 bytes), so no data is sliced out.
-		return append(configDescBuf.Bytes(), configDescDetailBuf.Bytes()...), nil
-	case descriptor.DESCRIPTOR_TYPE_STRING:
-		stringDescBuf := new(bytes.Buffer)
-		stringContent := g.getStringDescriptor(index)
-		if err := stringContent.Encode(stringDescBuf); err != nil {
-			return nil, fmt.Errorf("unable to encode string descriptor: %w", err)
-		}
-		return stringDescBuf.Bytes(), nil
-	case descriptor.DESCRIPTOR_TYPE_HID_REPORT:
+	g := &genericHIDMouseDevice{
+		StandardDevice: usb.NewStandardDevice(usb.StandardDeviceConfig{
+			Descriptors: descriptors,
+			Clock:       clock,
+			WorkerPoolProfile: usb.WorkerPoolProfile{
+				MaximumProcWorkers:        1,
+				MaximumReplyWorkers:       1,
+				MaximumUnlinkReplyWorkers: 1,
+			},
+		}, logger),
+	}
+	// Generating a report is blocked until the previous one is sent, so the mouse moves at polling rate
+	g.reports = usb.NewInterruptINEndpoint(usb.InterruptINEndpointConfig{
+		Clock:          g.Clock(),
+		Interval:       usb.ServiceInterval(mouseDescriptors.Speed, descriptor.ENDPOINT_TRANSFER_TYPE_INTERRUPT, MOUSE_REPORT_BINTERVAL),
+		Depth:          1,
+		OverflowPolicy: usb.OVERFLOW_POLICY_BLOCK,
+	}, logger)
+	g.HandleDescriptor(descriptor.DESCRIPTOR_TYPE_HID_REPORT, func(_ context.Context, _ usbprotocol.SetupPacket, _ []byte) ([]byte, error) {
 		return mouseHIDReport, nil
-	default:
-		return nil, fmt.Errorf("unknown or unimplemented descriptor type for getting descriptor: type: %d, index: %d", descriptorType, index)
-	}
-}
+	})
+	g.HandleClassRequest(g.processHIDRequest)
+	g.HandleEndpointAsync(0x81, g.reports.Handle)
 
-func (g *genericHIDMouseDevice) processControlMsg(setup usbprotocol.SetupPacket) ([]byte, error) {
-	g.logger.Debug("Received control message SetupPacket", "setup", setup)
-	switch setup.BMRequestType.Recipient() {
-	case usbprotocol.SETUP_RECIPIENT_DEVICE:
-		return g.processControlDeviceMsg(setup)
-	case usbprotocol.SETUP_RECIPIENT_INTERFACE:
-		return g.processControlInterfaceMsg(setup)
-	default:
-		return nil, fmt.Errorf("unknown or unimplemented SetupPacket's BMRequestType: %x", setup.BMRequestType)
-	}
-}
+	ctx, cancel := context.WithCancel(context.Background())
+	g.cancel = cancel
+	g.wg.Add(1)
+	go g.reportLoop(ctx)
 
-// processControlDeviceMsg processes requests that are sent to Device, which should be all standard requests
-func (g *genericHIDMouseDevice) processControlDeviceMsg(setup usbprotocol.SetupPacket) ([]byte, error) {
-	g.logger.Debug("Processing control device msg")
-	switch setup.BRequest {
-	case usbprotocol.REQUEST_GET_DESCRIPTOR:
-		descriptorType, index := descriptor.GetDescriptorTypeAndIndex(setup.WValue)
-		return g.getDescriptor(descriptorType, index)
-	case usbprotocol.REQUEST_GET_STATUS:
-		// It's a self-powered device, in little-endian form
-		return []byte{0x01, 0x00}, nil
-	case usbprotocol.REQUEST_SET_CONFIGURATION:
-		// Configuration only have one and cannot be changed, so no-op
-		return nil, nil
-	default:
-		return nil, fmt.Errorf("unknown or unimplemented SetupPacket's BRequest: %d", setup.BRequest)
-	}
+	return g, nil
 }
 
-// processControlInterfaceMsg processes requests that are sent to Interface, which should be HID requests
-func (g *genericHIDMouseDevice) processControlInterfaceMsg(setup usbprotocol.SetupPacket) ([]byte, error) {
-	g.logger.Debug("Processing control interface msg")
+// processHIDRequest processes HID class requests sent to the interface
+func (g *genericHIDMouseDevice) processHIDRequest(_ context.Context, setup usbprotocol.SetupPacket, _ []byte) ([]byte, error) {
 	switch setup.BRequest {
-	case usbprotocol.REQUEST_GET_DESCRIPTOR:
-		descriptorType, index := descriptor.GetDescriptorTypeAndIndex(setup.WValue)
-		return g.getDescriptor(descriptorType, index)
 	case usbprotocol.REQUEST_HID_SET_IDLE:
-		// this is software device, so no-op
+		g.reports.SetIdleRate(uint8(setup.WValue >> 8))
 		return nil, nil
+	case usbprotocol.REQUEST_HID_GET_IDLE:
+		return []byte{g.reports.GetIdleRate()}, nil
 	case usbprotocol.REQUEST_HID_SET_PROTOCOL:
 		// we always use boot protocol
 		return nil, nil
@@ -369,10 +165,18 @@ func (g *genericHIDMouseDevice) processControlInterfaceMsg(setup usbprotocol.Set
 	}
 }
 
-func (g *genericHIDMouseDevice) proceeHIDData(_ command.CmdSubmit) ([]byte, error) {
-	// Use Sleep to replies every 100ms, which is polling rate of 10Hz
-	time.Sleep(100 * time.Millisecond)
+// reportLoop pushes mouse reports to interrupt IN endpoint, waiting for each report to be sent to host
+func (g *genericHIDMouseDevice) reportLoop(ctx context.Context) {
+	defer g.wg.Done()
 
+	for {
+		if err := g.reports.Push(ctx, g.proceeHIDData()); err != nil {
+			return
+		}
+	}
+}
+
+func (g *genericHIDMouseDevice) proceeHIDData() []byte {
 	buf := make([]byte, 3)
 	var minusFive int8 = -5
 
@@ -392,10 +196,15 @@ func (g *genericHIDMouseDevice) proceeHIDData(_ command.CmdSubmit) ([]byte, erro
 
 	g.state = (g.state + 1) % 10
 
-	return buf, nil
+	return buf
 }
 
 func (g *genericHIDMouseDevice) Close() error {
-	// We have nothing to clear
-	return nil
+	g.cancel()
+	g.wg.Wait()
+	if err := g.reports.Close(); err != nil {
+		return fmt.Errorf("unable to close mouse report endpoint: %w", err)
+	}
+
+	return g.StandardDevice.Close()
 }
@@ -0,0 +1,421 @@
+package usb
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"sync"
+
+	"github.com/ntchjb/usbip-virtual-device/usbip/protocol/command"
+)
+
+type BulkPipeConfig struct {
+	// wMaxPacketSize of the endpoint, set to 1 if it's zero
+	MaxPacketSize uint16
+	// For IN pipe, whether a transfer with length of a multiple of MaxPacketSize is terminated by a zero-length packet,
+	// as required by protocols such as CDC, where host would otherwise wait for more data of the transfer.
+	// A transfer ending in the middle of an IN URB always completes the URB with a short length.
+	ZeroLengthPacket bool
+}
+
+// BulkOUTPipe is a bulk OUT endpoint read as a stream. OUT URBs are held until their data is read,
+// so host can't send more data than the application consumes.
+type BulkOUTPipe interface {
+	// Read reads data sent by host, waiting until there is any. A read never spans more than one transfer.
+	// It returns io.EOF after the pipe is closed.
+	io.ReadCloser
+	// Handle holds OUT URB until its data is read, to be registered by StandardDevice.HandleEndpointAsync
+	Handle(ctx context.Context, data command.CmdSubmit, completer URBCompleter)
+	// ReadTransfer reads the rest of the current transfer, until a short packet or zero-length packet ends it.
+	// If ctx is done in the middle of the transfer, data read so far is returned with the error.
+	ReadTransfer(ctx context.Context) ([]byte, error)
+}
+
+// BulkINPipe is a bulk IN endpoint written as a stream. IN URBs are held until data is written,
+// and each Write is a transfer split into IN URBs at multiples of wMaxPacketSize.
+type BulkINPipe interface {
+	// Write blocks until all of p is taken by IN URBs, or until the pipe is closed.
+	// Writing empty p sends a zero-length packet.
+	io.WriteCloser
+	// Handle holds IN URB until data is written, to be registered by StandardDevice.HandleEndpointAsync
+	Handle(ctx context.Context, data command.CmdSubmit, completer URBCompleter)
+}
+
+type bulkURB struct {
+	ctx       context.Context
+	data      command.CmdSubmit
+	completer URBCompleter
+	// number of bytes of OUT URB read by application
+	offset int
+	// whether OUT URB is the last one of its transfer
+	last bool
+	// stops completing the URB when ctx is done
+	stop func() bool
+}
+
+// complete completes URB which is no longer waiting to be unlinked
+func (u *bulkURB) complete(ret command.RetSubmit) {
+	u.stop()
+	u.completer(ret)
+}
+
+// removeBulkURB removes URB from queue, and returns whether it's found
+func removeBulkURB(urbs []*bulkURB, urb *bulkURB) ([]*bulkURB, bool) {
+	for i, queued := range urbs {
+		if queued == urb {
+			return append(urbs[:i], urbs[i+1:]...), true
+		}
+	}
+
+	return urbs, false
+}
+
+type bulkOUTPipeImpl struct {
+	maxPacketSize int
+	logger        *slog.Logger
+
+	lock   sync.Mutex
+	urbs   []*bulkURB
+	closed bool
+	// closed and replaced whenever URBs are queued or the pipe is closed
+	changed chan struct{}
+}
+
+func NewBulkOUTPipe(config BulkPipeConfig, logger *slog.Logger) BulkOUTPipe {
+	return &bulkOUTPipeImpl{
+		maxPacketSize: int(max(config.MaxPacketSize, 1)),
+		logger:        logger,
+		changed:       make(chan struct{}),
+	}
+}
+
+func (o *bulkOUTPipeImpl) Handle(ctx context.Context, data command.CmdSubmit, completer URBCompleter) {
+	o.lock.Lock()
+	if o.closed {
+		o.lock.Unlock()
+		completer(command.NewRetSubmit(data, command.URB_STATUS_SHUTDOWN, nil))
+		return
+	}
+	length := len(data.TransferBuffer)
+	urb := &bulkURB{
+		ctx:       ctx,
+		data:      data,
+		completer: completer,
+		last:      length == 0 || length%o.maxPacketSize != 0 || data.TransferFlags.ZeroPacket(),
+	}
+	urb.stop = context.AfterFunc(ctx, func() {
+		o.unlink(urb)
+	})
+	o.urbs = append(o.urbs, urb)
+	o.notifyLocked()
+	o.lock.Unlock()
+}
+
+// unlink removes URB unlinked by host, and completes it so that worker pool releases it
+func (o *bulkOUTPipeImpl) unlink(urb *bulkURB) {
+	o.lock.Lock()
+	o.urbs, _ = removeBulkURB(o.urbs, urb)
+	o.lock.Unlock()
+
+	urb.completer(command.NewErrorRetSubmit(urb.data, urb.ctx.Err()))
+}
+
+func (o *bulkOUTPipeImpl) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	for {
+		o.lock.Lock()
+		if err := o.waitLocked(context.Background()); err != nil {
+			o.lock.Unlock()
+			return 0, err
+		}
+
+		var n int
+		var completed []*bulkURB
+		for n < len(p) {
+			o.dropUnlinkedLocked()
+			if len(o.urbs) == 0 {
+				break
+			}
+			urb := o.urbs[0]
+			copied := copy(p[n:], urb.data.TransferBuffer[urb.offset:])
+			n += copied
+			urb.offset += copied
+			if urb.offset < len(urb.data.TransferBuffer) {
+				break
+			}
+			o.urbs = o.urbs[1:]
+			completed = append(completed, urb)
+			if urb.last {
+				break
+			}
+		}
+		o.lock.Unlock()
+
+		for _, urb := range completed {
+			urb.complete(command.NewSuccessRetSubmit(urb.data, nil))
+		}
+		// zero-length packets end transfers without data
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+func (o *bulkOUTPipeImpl) ReadTransfer(ctx context.Context) ([]byte, error) {
+	var transfer []byte
+	for {
+		o.lock.Lock()
+		if err := o.waitLocked(ctx); err != nil {
+			o.lock.Unlock()
+			return transfer, err
+		}
+		urb := o.urbs[0]
+		o.urbs = o.urbs[1:]
+		o.lock.Unlock()
+
+		transfer = append(transfer, urb.data.TransferBuffer[urb.offset:]...)
+		urb.complete(command.NewSuccessRetSubmit(urb.data, nil))
+		if urb.last {
+			return transfer, nil
+		}
+	}
+}
+
+func (o *bulkOUTPipeImpl) Close() error {
+	o.lock.Lock()
+	if o.closed {
+		o.lock.Unlock()
+		return nil
+	}
+	o.closed = true
+	urbs := o.urbs
+	o.urbs = nil
+	o.notifyLocked()
+	o.lock.Unlock()
+
+	for _, urb := range urbs {
+		urb.complete(command.NewRetSubmit(urb.data, command.URB_STATUS_SHUTDOWN, nil))
+	}
+
+	return nil
+}
+
+// waitLocked waits until there is a queued URB, lock must be held.
+// It returns io.EOF if the pipe is closed.
+func (o *bulkOUTPipeImpl) waitLocked(ctx context.Context) error {
+	for {
+		o.dropUnlinkedLocked()
+		if len(o.urbs) > 0 {
+			return nil
+		}
+		if o.closed {
+			return io.EOF
+		}
+
+		changed := o.changed
+		o.lock.Unlock()
+		select {
+		case <-ctx.Done():
+			o.lock.Lock()
+			return ctx.Err()
+		case <-changed:
+		}
+		o.lock.Lock()
+	}
+}
+
+// dropUnlinkedLocked removes URBs unlinked by host, whose data is not delivered.
+// They're completed by unlink.
+func (o *bulkOUTPipeImpl) dropUnlinkedLocked() {
+	urbs := o.urbs[:0]
+	for _, urb := range o.urbs {
+		if urb.ctx.Err() == nil {
+			urbs = append(urbs, urb)
+		} else {
+			o.logger.Debug("dropping unlinked bulk OUT URB", "seqNum", urb.data.SeqNum, "unread", len(urb.data.TransferBuffer)-urb.offset)
+		}
+	}
+	clear(o.urbs[len(urbs):])
+	o.urbs = urbs
+}
+
+func (o *bulkOUTPipeImpl) notifyLocked() {
+	close(o.changed)
+	o.changed = make(chan struct{})
+}
+
+type bulkINTransfer struct {
+	data []byte
+	// number of bytes taken by IN URBs
+	offset int
+	// whether all data is taken, and the transfer waits for an IN URB to send zero-length packet
+	zlpPending bool
+	err        error
+	done       chan struct{}
+}
+
+type bulkINPipeImpl struct {
+	maxPacketSize    int
+	zeroLengthPacket bool
+	logger           *slog.Logger
+
+	lock      sync.Mutex
+	urbs      []*bulkURB
+	transfers []*bulkINTransfer
+	closed    bool
+}
+
+func NewBulkINPipe(config BulkPipeConfig, logger *slog.Logger) BulkINPipe {
+	return &bulkINPipeImpl{
+		maxPacketSize:    int(max(config.MaxPacketSize, 1)),
+		zeroLengthPacket: config.ZeroLengthPacket,
+		logger:           logger,
+	}
+}
+
+func (i *bulkINPipeImpl) Handle(ctx context.Context, data command.CmdSubmit, completer URBCompleter) {
+	i.lock.Lock()
+	if i.closed {
+		i.lock.Unlock()
+		completer(command.NewRetSubmit(data, command.URB_STATUS_SHUTDOWN, nil))
+		return
+	}
+	urb := &bulkURB{
+		ctx:       ctx,
+		data:      data,
+		completer: completer,
+	}
+	urb.stop = context.AfterFunc(ctx, func() {
+		i.unlink(urb)
+	})
+	i.urbs = append(i.urbs, urb)
+	rets, finished := i.dispatchLocked()
+	i.lock.Unlock()
+
+	i.complete(rets, finished)
+}
+
+// unlink removes URB unlinked by host, and completes it so that worker pool releases it
+func (i *bulkINPipeImpl) unlink(urb *bulkURB) {
+	i.lock.Lock()
+	i.urbs, _ = removeBulkURB(i.urbs, urb)
+	i.lock.Unlock()
+
+	urb.completer(command.NewErrorRetSubmit(urb.data, urb.ctx.Err()))
+}
+
+func (i *bulkINPipeImpl) Write(p []byte) (int, error) {
+	transfer := &bulkINTransfer{
+		data: append([]byte(nil), p...),
+		done: make(chan struct{}),
+	}
+
+	i.lock.Lock()
+	if i.closed {
+		i.lock.Unlock()
+		return 0, ErrEndpointClosed
+	}
+	i.transfers = append(i.transfers, transfer)
+	rets, finished := i.dispatchLocked()
+	i.lock.Unlock()
+
+	i.complete(rets, finished)
+	<-transfer.done
+
+	return transfer.offset, transfer.err
+}
+
+func (i *bulkINPipeImpl) Close() error {
+	i.lock.Lock()
+	if i.closed {
+		i.lock.Unlock()
+		return nil
+	}
+	i.closed = true
+	urbs := i.urbs
+	transfers := i.transfers
+	i.urbs = nil
+	i.transfers = nil
+	for _, transfer := range transfers {
+		transfer.err = ErrEndpointClosed
+	}
+	i.lock.Unlock()
+
+	rets := make([]bulkINReply, len(urbs))
+	for j, urb := range urbs {
+		rets[j] = bulkINReply{
+			urb: urb,
+			ret: command.NewRetSubmit(urb.data, command.URB_STATUS_SHUTDOWN, nil),
+		}
+	}
+	i.complete(rets, transfers)
+
+	return nil
+}
+
+type bulkINReply struct {
+	urb *bulkURB
+	ret command.RetSubmit
+}
+
+// dispatchLocked hands written data to pending IN URBs in order, lock must be held.
+// It returns replies of the URBs and transfers whose data are all taken, to be completed after unlocking.
+func (i *bulkINPipeImpl) dispatchLocked() ([]bulkINReply, []*bulkINTransfer) {
+	var rets []bulkINReply
+	var finished []*bulkINTransfer
+	for len(i.transfers) > 0 && len(i.urbs) > 0 {
+		transfer := i.transfers[0]
+		urb := i.urbs[0]
+		i.urbs = i.urbs[1:]
+		if urb.ctx.Err() != nil {
+			// completed by unlink
+			i.logger.Debug("dropping unlinked bulk IN URB", "seqNum", urb.data.SeqNum)
+			continue
+		}
+
+		urbLength := int(urb.data.TransferBufferLength)
+		remaining := len(transfer.data) - transfer.offset
+		n := min(remaining, urbLength)
+		if n < remaining {
+			// only the last packet of a transfer can be short
+			n -= n % i.maxPacketSize
+			if n == 0 {
+				rets = append(rets, bulkINReply{
+					urb: urb,
+					ret: command.NewRetSubmit(urb.data, command.URB_STATUS_OVERFLOW, nil),
+				})
+				continue
+			}
+		}
+		rets = append(rets, bulkINReply{
+			urb: urb,
+			ret: command.NewSuccessRetSubmit(urb.data, transfer.data[transfer.offset:transfer.offset+n]),
+		})
+		transfer.offset += n
+		if transfer.offset < len(transfer.data) {
+			continue
+		}
+
+		// a transfer filling the URB exactly on packet boundary is not ended yet, until a zero-length packet is sent
+		if !transfer.zlpPending && i.zeroLengthPacket && n > 0 && n == urbLength && len(transfer.data)%i.maxPacketSize == 0 {
+			transfer.zlpPending = true
+			continue
+		}
+		i.transfers = i.transfers[1:]
+		finished = append(finished, transfer)
+	}
+
+	return rets, finished
+}
+
+func (i *bulkINPipeImpl) complete(rets []bulkINReply, finished []*bulkINTransfer) {
+	for _, ret := range rets {
+		ret.urb.complete(ret.ret)
+	}
+	for _, transfer := range finished {
+		close(transfer.done)
+	}
+}
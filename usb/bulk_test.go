@@ -0,0 +1,367 @@
+package usb_test
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/ntchjb/usbip-virtual-device/usb"
+	"github.com/ntchjb/usbip-virtual-device/usbip/protocol/command"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newBulkCmdSubmit(direction command.Direction, seqNum uint32, length uint32, flags command.TransferFlags, data []byte) command.CmdSubmit {
+	return command.CmdSubmit{
+		CmdHeader: command.CmdHeader{
+			Command:        command.CMD_SUBMIT,
+			SeqNum:         seqNum,
+			Direction:      direction,
+			EndpointNumber: 2,
+		},
+		TransferFlags:        flags,
+		TransferBufferLength: length,
+		NumberOfPackets:      0xffffffff,
+		TransferBuffer:       data,
+	}
+}
+
+func submitBulk(ctx context.Context, handle usb.AsyncEndpointHandler, cmd command.CmdSubmit, rets chan command.RetSubmit) {
+	handle(ctx, cmd, func(ret command.RetSubmit) {
+		rets <- ret
+	})
+}
+
+func submitBulkOUT(ctx context.Context, pipe usb.BulkOUTPipe, seqNum uint32, flags command.TransferFlags, data []byte, rets chan command.RetSubmit) {
+	submitBulk(ctx, pipe.Handle, newBulkCmdSubmit(command.DIR_OUT, seqNum, uint32(len(data)), flags, data), rets)
+}
+
+func submitBulkIN(ctx context.Context, pipe usb.BulkINPipe, seqNum uint32, length uint32, rets chan command.RetSubmit) {
+	submitBulk(ctx, pipe.Handle, newBulkCmdSubmit(command.DIR_IN, seqNum, length, 0, nil), rets)
+}
+
+func newTestBulkOUTPipe(t *testing.T, config usb.BulkPipeConfig) usb.BulkOUTPipe {
+	pipe := usb.NewBulkOUTPipe(config, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	t.Cleanup(func() {
+		require.NoError(t, pipe.Close())
+	})
+
+	return pipe
+}
+
+func newTestBulkINPipe(t *testing.T, config usb.BulkPipeConfig) usb.BulkINPipe {
+	pipe := usb.NewBulkINPipe(config, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	t.Cleanup(func() {
+		require.NoError(t, pipe.Close())
+	})
+
+	return pipe
+}
+
+func TestBulkOUTPipeRead(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	pipe := newTestBulkOUTPipe(t, usb.BulkPipeConfig{MaxPacketSize: 4})
+	rets := make(chan command.RetSubmit, 16)
+
+	// URB is held until its data is read
+	submitBulkOUT(ctx, pipe, 1, 0, []byte{0x01, 0x02, 0x03, 0x04}, rets)
+	submitBulkOUT(ctx, pipe, 2, 0, []byte{0x05, 0x06}, rets)
+	submitBulkOUT(ctx, pipe, 3, 0, []byte{0x07, 0x08, 0x09, 0x0A}, rets)
+	assertNotCompleted(t, rets)
+
+	buf := make([]byte, 3)
+	n, err := pipe.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x01, 0x02, 0x03}, buf[:n])
+	assertNotCompleted(t, rets)
+
+	// Read stops at short packet ending the transfer
+	buf = make([]byte, 16)
+	n, err = pipe.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x04, 0x05, 0x06}, buf[:n])
+	for _, seqNum := range []uint32{1, 2} {
+		ret := receiveRetSubmit(t, rets)
+		assert.Equal(t, seqNum, ret.SeqNum)
+		assert.Equal(t, command.URB_STATUS_OK, ret.Status)
+	}
+
+	// Zero-length packet ends the transfer without data
+	submitBulkOUT(ctx, pipe, 4, 0, nil, rets)
+	submitBulkOUT(ctx, pipe, 5, 0, []byte{0x0B}, rets)
+	n, err = pipe.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x07, 0x08, 0x09, 0x0A}, buf[:n])
+	assert.Equal(t, uint32(3), receiveRetSubmit(t, rets).SeqNum)
+	assert.Equal(t, uint32(4), receiveRetSubmit(t, rets).SeqNum)
+	assertNotCompleted(t, rets)
+	n, err = pipe.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x0B}, buf[:n])
+	assert.Equal(t, uint32(5), receiveRetSubmit(t, rets).SeqNum)
+
+	// Read waits for data
+	read := make(chan []byte, 1)
+	go func() {
+		buf := make([]byte, 16)
+		n, _ := pipe.Read(buf)
+		read <- buf[:n]
+	}()
+	select {
+	case <-read:
+		t.Fatal("read does not wait for data")
+	case <-time.After(20 * time.Millisecond):
+	}
+	submitBulkOUT(ctx, pipe, 6, 0, []byte{0x0C, 0x0D}, rets)
+	assert.Equal(t, []byte{0x0C, 0x0D}, <-read)
+	assert.Equal(t, uint32(6), receiveRetSubmit(t, rets).SeqNum)
+}
+
+func TestBulkOUTPipeReadTransfer(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	pipe := newTestBulkOUTPipe(t, usb.BulkPipeConfig{MaxPacketSize: 2})
+	rets := make(chan command.RetSubmit, 16)
+
+	submitBulkOUT(ctx, pipe, 1, 0, []byte{0x01, 0x02}, rets)
+	submitBulkOUT(ctx, pipe, 2, 0, []byte{0x03, 0x04}, rets)
+	submitBulkOUT(ctx, pipe, 3, 0, nil, rets)
+	submitBulkOUT(ctx, pipe, 4, command.URB_ZERO_PACKET, []byte{0x05, 0x06}, rets)
+
+	buf := make([]byte, 1)
+	_, err := pipe.Read(buf)
+	require.NoError(t, err)
+	transfer, err := pipe.ReadTransfer(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x02, 0x03, 0x04}, transfer)
+
+	// URB_ZERO_PACKET ends the transfer at the end of URB
+	transfer, err = pipe.ReadTransfer(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x05, 0x06}, transfer)
+	for _, seqNum := range []uint32{1, 2, 3, 4} {
+		assert.Equal(t, seqNum, receiveRetSubmit(t, rets).SeqNum)
+	}
+
+	// Unfinished transfer is returned with error
+	submitBulkOUT(ctx, pipe, 5, 0, []byte{0x07, 0x08}, rets)
+	readCtx, readCancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer readCancel()
+	transfer, err = pipe.ReadTransfer(readCtx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, []byte{0x07, 0x08}, transfer)
+}
+
+func TestBulkOUTPipeUnlinkedAndClose(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	pipe := newTestBulkOUTPipe(t, usb.BulkPipeConfig{MaxPacketSize: 4})
+	rets := make(chan command.RetSubmit, 16)
+
+	// Data of unlinked URB is not delivered, and the URB is completed so that worker pool releases it
+	urbCtx, urbCancel := context.WithCancel(ctx)
+	submitBulkOUT(urbCtx, pipe, 1, 0, []byte{0x01}, rets)
+	urbCancel()
+	ret := receiveRetSubmit(t, rets)
+	assert.Equal(t, uint32(1), ret.SeqNum)
+	assert.Equal(t, command.URB_STATUS_UNLINKED, ret.Status)
+	submitBulkOUT(ctx, pipe, 2, 0, []byte{0x02}, rets)
+	buf := make([]byte, 16)
+	n, err := pipe.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x02}, buf[:n])
+	assert.Equal(t, uint32(2), receiveRetSubmit(t, rets).SeqNum)
+
+	submitBulkOUT(ctx, pipe, 3, 0, []byte{0x03}, rets)
+	require.NoError(t, pipe.Close())
+	ret = receiveRetSubmit(t, rets)
+	assert.Equal(t, uint32(3), ret.SeqNum)
+	assert.Equal(t, command.URB_STATUS_SHUTDOWN, ret.Status)
+	_, err = pipe.Read(buf)
+	assert.ErrorIs(t, err, io.EOF)
+
+	submitBulkOUT(ctx, pipe, 4, 0, []byte{0x04}, rets)
+	assert.Equal(t, command.URB_STATUS_SHUTDOWN, receiveRetSubmit(t, rets).Status)
+}
+
+func writeBulkIN(pipe usb.BulkINPipe, data []byte) chan error {
+	written := make(chan error, 1)
+	go func() {
+		n, err := pipe.Write(data)
+		if err == nil && n != len(data) {
+			err = io.ErrShortWrite
+		}
+		written <- err
+	}()
+
+	return written
+}
+
+func assertWriteBlocked(t *testing.T, written chan error) {
+	select {
+	case err := <-written:
+		assert.Failf(t, "write is not blocked", "err %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestBulkINPipeWrite(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	pipe := newTestBulkINPipe(t, usb.BulkPipeConfig{MaxPacketSize: 4})
+	rets := make(chan command.RetSubmit, 16)
+
+	// URB waits for written data
+	submitBulkIN(ctx, pipe, 1, 8, rets)
+	assertNotCompleted(t, rets)
+
+	// Write waits until all data is taken by URBs
+	written := writeBulkIN(pipe, []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0A})
+	ret := receiveRetSubmit(t, rets)
+	assert.Equal(t, command.URB_STATUS_OK, ret.Status)
+	assert.Equal(t, []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}, ret.TransferBuffer)
+	assertWriteBlocked(t, written)
+	submitBulkIN(ctx, pipe, 2, 8, rets)
+	assert.Equal(t, []byte{0x09, 0x0A}, receiveRetSubmit(t, rets).TransferBuffer)
+	assert.NoError(t, <-written)
+
+	// Data in the middle of a transfer is split at multiples of wMaxPacketSize
+	submitBulkIN(ctx, pipe, 3, 6, rets)
+	submitBulkIN(ctx, pipe, 4, 6, rets)
+	written = writeBulkIN(pipe, []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0A})
+	assert.Equal(t, []byte{0x01, 0x02, 0x03, 0x04}, receiveRetSubmit(t, rets).TransferBuffer)
+	assert.Equal(t, []byte{0x05, 0x06, 0x07, 0x08, 0x09, 0x0A}, receiveRetSubmit(t, rets).TransferBuffer)
+	assert.NoError(t, <-written)
+
+	// URB shorter than wMaxPacketSize overflows in the middle of a transfer
+	submitBulkIN(ctx, pipe, 5, 2, rets)
+	submitBulkIN(ctx, pipe, 6, 8, rets)
+	written = writeBulkIN(pipe, []byte{0x01, 0x02, 0x03, 0x04, 0x05})
+	assert.Equal(t, command.URB_STATUS_OVERFLOW, receiveRetSubmit(t, rets).Status)
+	assert.Equal(t, []byte{0x01, 0x02, 0x03, 0x04, 0x05}, receiveRetSubmit(t, rets).TransferBuffer)
+	assert.NoError(t, <-written)
+
+	// Empty write sends zero-length packet
+	submitBulkIN(ctx, pipe, 7, 8, rets)
+	written = writeBulkIN(pipe, nil)
+	ret = receiveRetSubmit(t, rets)
+	assert.Equal(t, command.URB_STATUS_OK, ret.Status)
+	assert.Empty(t, ret.TransferBuffer)
+	assert.NoError(t, <-written)
+}
+
+func TestBulkINPipeZeroLengthPacket(t *testing.T) {
+	tests := []struct {
+		name             string
+		zeroLengthPacket bool
+		data             []byte
+		zlp              bool
+	}{
+		{
+			name:             "Transfer filling URB on packet boundary",
+			zeroLengthPacket: true,
+			data:             []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08},
+			zlp:              true,
+		},
+		{
+			name:             "Transfer ending in the middle of URB",
+			zeroLengthPacket: true,
+			data:             []byte{0x01, 0x02, 0x03, 0x04},
+		},
+		{
+			name:             "Short transfer",
+			zeroLengthPacket: true,
+			data:             []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07},
+		},
+		{
+			name: "Zero-length packet disabled",
+			data: []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			pipe := newTestBulkINPipe(t, usb.BulkPipeConfig{
+				MaxPacketSize:    4,
+				ZeroLengthPacket: test.zeroLengthPacket,
+			})
+			rets := make(chan command.RetSubmit, 16)
+
+			submitBulkIN(ctx, pipe, 1, 8, rets)
+			written := writeBulkIN(pipe, test.data)
+			assert.Equal(t, test.data, receiveRetSubmit(t, rets).TransferBuffer)
+			if test.zlp {
+				assertWriteBlocked(t, written)
+				submitBulkIN(ctx, pipe, 2, 8, rets)
+				ret := receiveRetSubmit(t, rets)
+				assert.Equal(t, command.URB_STATUS_OK, ret.Status)
+				assert.Empty(t, ret.TransferBuffer)
+			}
+			assert.NoError(t, <-written)
+
+			// The next transfer is not merged into the previous one
+			submitBulkIN(ctx, pipe, 3, 8, rets)
+			written = writeBulkIN(pipe, []byte{0x09})
+			assert.Equal(t, []byte{0x09}, receiveRetSubmit(t, rets).TransferBuffer)
+			assert.NoError(t, <-written)
+		})
+	}
+}
+
+func TestBulkINPipeUnlinkedAndClose(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	pipe := newTestBulkINPipe(t, usb.BulkPipeConfig{MaxPacketSize: 4})
+	rets := make(chan command.RetSubmit, 16)
+
+	// Unlinked URB does not take data, and it's completed so that worker pool releases it
+	urbCtx, urbCancel := context.WithCancel(ctx)
+	submitBulkIN(urbCtx, pipe, 1, 8, rets)
+	urbCancel()
+	ret := receiveRetSubmit(t, rets)
+	assert.Equal(t, uint32(1), ret.SeqNum)
+	assert.Equal(t, command.URB_STATUS_UNLINKED, ret.Status)
+	submitBulkIN(ctx, pipe, 2, 8, rets)
+	written := writeBulkIN(pipe, []byte{0x01})
+	ret = receiveRetSubmit(t, rets)
+	assert.Equal(t, uint32(2), ret.SeqNum)
+	assert.Equal(t, []byte{0x01}, ret.TransferBuffer)
+	assert.NoError(t, <-written)
+
+	// Close fails blocked writes and pending URBs
+	written = writeBulkIN(pipe, []byte{0x02})
+	assertWriteBlocked(t, written)
+	require.NoError(t, pipe.Close())
+	assert.ErrorIs(t, <-written, usb.ErrEndpointClosed)
+	_, err := pipe.Write([]byte{0x03})
+	assert.ErrorIs(t, err, usb.ErrEndpointClosed)
+
+	submitBulkIN(ctx, pipe, 3, 8, rets)
+	assert.Equal(t, command.URB_STATUS_SHUTDOWN, receiveRetSubmit(t, rets).Status)
+}
+
+func TestBulkINPipeStandardDevice(t *testing.T) {
+	device := newTestStandardDevice(t)
+	pipe := newTestBulkINPipe(t, usb.BulkPipeConfig{MaxPacketSize: 512})
+	device.HandleEndpointAsync(0x81, pipe.Handle)
+	setTestStandardDeviceInterface(t, device, 1, 1)
+
+	written := writeBulkIN(pipe, []byte("hello"))
+	cmd := newBulkCmdSubmit(command.DIR_IN, 1, 512, 0, nil)
+	cmd.EndpointNumber = 1
+	rets := make(chan command.RetSubmit, 1)
+	device.ProcessAsync(context.Background(), cmd, func(ret command.RetSubmit) {
+		rets <- ret
+	})
+	ret := receiveRetSubmit(t, rets)
+	assert.Equal(t, command.URB_STATUS_OK, ret.Status)
+	assert.Equal(t, []byte("hello"), ret.TransferBuffer)
+	assert.NoError(t, <-written)
+}
@@ -0,0 +1,247 @@
+package usb
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	usbprotocol "github.com/ntchjb/usbip-virtual-device/usb/protocol"
+	"github.com/ntchjb/usbip-virtual-device/usb/protocol/descriptor"
+)
+
+const (
+	// Duration of a frame of low-speed and full-speed bus
+	FRAME_DURATION = time.Millisecond
+	// Duration of a microframe of high-speed and faster bus
+	MICROFRAME_DURATION = 125 * time.Microsecond
+)
+
+// Clock is time source of a virtual bus, measured from when the bus started.
+// Devices schedule periodic transfers by Clock instead of wall clock, so that tests can swap it with FakeClock.
+// Devices on the same bus should share a Clock, so that their frame numbers agree.
+type Clock interface {
+	// Now returns time elapsed since the bus started
+	Now() time.Duration
+	// SleepUntil blocks until elapsed time reaches t, or until ctx is done
+	SleepUntil(ctx context.Context, t time.Duration) error
+}
+
+type realClockImpl struct {
+	start time.Time
+}
+
+// NewClock creates Clock driven by wall clock, starting at zero
+func NewClock() Clock {
+	return &realClockImpl{
+		start: time.Now(),
+	}
+}
+
+func (c *realClockImpl) Now() time.Duration {
+	return time.Since(c.start)
+}
+
+func (c *realClockImpl) SleepUntil(ctx context.Context, t time.Duration) error {
+	d := t - c.Now()
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+type fakeSleeper struct {
+	until time.Duration
+	wake  chan struct{}
+}
+
+// FakeClock is Clock which only moves when advanced manually, making timing of devices deterministic in tests
+type FakeClock struct {
+	lock     sync.Mutex
+	now      time.Duration
+	sleepers []*fakeSleeper
+	// closed and replaced whenever sleepers change
+	changed chan struct{}
+}
+
+// NewFakeClock creates FakeClock starting at zero
+func NewFakeClock() *FakeClock {
+	return &FakeClock{
+		changed: make(chan struct{}),
+	}
+}
+
+func (c *FakeClock) Now() time.Duration {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.now
+}
+
+func (c *FakeClock) SleepUntil(ctx context.Context, t time.Duration) error {
+	c.lock.Lock()
+	if t <= c.now {
+		c.lock.Unlock()
+		return nil
+	}
+	sleeper := &fakeSleeper{
+		until: t,
+		wake:  make(chan struct{}),
+	}
+	c.sleepers = append(c.sleepers, sleeper)
+	c.notifyLocked()
+	c.lock.Unlock()
+
+	select {
+	case <-sleeper.wake:
+		return nil
+	case <-ctx.Done():
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for i, s := range c.sleepers {
+		if s == sleeper {
+			c.sleepers = append(c.sleepers[:i], c.sleepers[i+1:]...)
+			c.notifyLocked()
+			return ctx.Err()
+		}
+	}
+
+	// woken by Advance while ctx is done
+	return nil
+}
+
+// Advance moves the clock forward by d, and wakes sleepers whose time is reached
+func (c *FakeClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.now += d
+	sleepers := c.sleepers[:0]
+	woken := false
+	for _, s := range c.sleepers {
+		if s.until <= c.now {
+			close(s.wake)
+			woken = true
+			continue
+		}
+		sleepers = append(sleepers, s)
+	}
+	c.sleepers = sleepers
+	if woken {
+		c.notifyLocked()
+	}
+}
+
+// WaitForSleepers blocks until at least n goroutines are sleeping on the clock, or until ctx is done.
+// Tests call it before Advance, so that the clock is not advanced before device starts waiting.
+func (c *FakeClock) WaitForSleepers(ctx context.Context, n int) error {
+	for {
+		c.lock.Lock()
+		count := len(c.sleepers)
+		changed := c.changed
+		c.lock.Unlock()
+		if count >= n {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// Sleepers returns number of goroutines sleeping on the clock
+func (c *FakeClock) Sleepers() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return len(c.sleepers)
+}
+
+func (c *FakeClock) notifyLocked() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// FrameDuration returns unit of frame numbers of device speed,
+// which is frame for low-speed and full-speed devices, or microframe otherwise
+func FrameDuration(speed uint32) time.Duration {
+	switch speed {
+	case usbprotocol.SPEED_USB1_LOW, usbprotocol.SPEED_USB1_FULL:
+		return FRAME_DURATION
+	default:
+		return MICROFRAME_DURATION
+	}
+}
+
+// FrameNumber returns current frame number of clock for device speed, in frames or microframes by FrameDuration
+func FrameNumber(clock Clock, speed uint32) uint32 {
+	return uint32(clock.Now() / FrameDuration(speed))
+}
+
+// ServiceInterval returns period at which host polls an endpoint of device speed, from its bmAttributes and bInterval.
+// Interrupt endpoints of low-speed and full-speed devices are polled every bInterval frames, and other
+// interrupt and ISO endpoints every 2^(bInterval-1) frames or microframes. Zero is returned for control and bulk endpoints.
+func ServiceInterval(speed uint32, bmAttributes uint8, bInterval uint8) time.Duration {
+	transferType := bmAttributes & descriptor.ENDPOINT_TRANSFER_TYPE_MASK
+	switch transferType {
+	case descriptor.ENDPOINT_TRANSFER_TYPE_INTERRUPT, descriptor.ENDPOINT_TRANSFER_TYPE_ISOCHRONOUS:
+	default:
+		return 0
+	}
+
+	frameDuration := FrameDuration(speed)
+	if frameDuration == FRAME_DURATION && transferType == descriptor.ENDPOINT_TRANSFER_TYPE_INTERRUPT {
+		return time.Duration(max(bInterval, 1)) * frameDuration
+	}
+	bInterval = min(max(bInterval, 1), 16)
+
+	return time.Duration(1<<(bInterval-1)) * frameDuration
+}
+
+// IntervalTimer paces completions of a periodic endpoint at its service interval on Clock,
+// as host controller services interrupt and ISO endpoints at most once per interval.
+type IntervalTimer struct {
+	clock    Clock
+	interval time.Duration
+
+	lock sync.Mutex
+	next time.Duration
+}
+
+// NewIntervalTimer creates IntervalTimer with given interval, such as from ServiceInterval
+func NewIntervalTimer(clock Clock, interval time.Duration) *IntervalTimer {
+	return &IntervalTimer{
+		clock:    clock,
+		interval: interval,
+	}
+}
+
+// Wait blocks until the next service interval, which starts at a multiple of the interval
+// and after the previous one, or until ctx is done. Each call takes its own service interval.
+func (t *IntervalTimer) Wait(ctx context.Context) error {
+	if t.interval <= 0 {
+		return ctx.Err()
+	}
+
+	t.lock.Lock()
+	slot := max(t.clock.Now(), t.next)
+	if remain := slot % t.interval; remain != 0 {
+		slot += t.interval - remain
+	}
+	t.next = slot + t.interval
+	t.lock.Unlock()
+
+	return t.clock.SleepUntil(ctx, slot)
+}
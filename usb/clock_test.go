@@ -0,0 +1,141 @@
+package usb_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ntchjb/usbip-virtual-device/usb"
+	"github.com/ntchjb/usbip-virtual-device/usb/protocol"
+	"github.com/ntchjb/usbip-virtual-device/usb/protocol/descriptor"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFakeClock(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	clock := usb.NewFakeClock()
+
+	assert.Equal(t, time.Duration(0), clock.Now())
+	assert.NoError(t, clock.SleepUntil(ctx, 0))
+
+	done := make(chan error, 1)
+	go func() {
+		done <- clock.SleepUntil(ctx, 10*time.Millisecond)
+	}()
+	require.NoError(t, clock.WaitForSleepers(ctx, 1))
+	clock.Advance(9 * time.Millisecond)
+	select {
+	case <-done:
+		t.Fatal("sleeper is woken before its time")
+	default:
+	}
+	clock.Advance(time.Millisecond)
+	assert.NoError(t, <-done)
+	assert.Equal(t, 10*time.Millisecond, clock.Now())
+
+	sleepCtx, sleepCancel := context.WithCancel(ctx)
+	go func() {
+		done <- clock.SleepUntil(sleepCtx, time.Second)
+	}()
+	require.NoError(t, clock.WaitForSleepers(ctx, 1))
+	sleepCancel()
+	assert.ErrorIs(t, <-done, context.Canceled)
+	require.NoError(t, clock.WaitForSleepers(ctx, 0))
+}
+
+func TestClock(t *testing.T) {
+	clock := usb.NewClock()
+
+	start := clock.Now()
+	require.NoError(t, clock.SleepUntil(context.Background(), start+time.Millisecond))
+	assert.GreaterOrEqual(t, clock.Now(), start+time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, clock.SleepUntil(ctx, clock.Now()+time.Hour), context.Canceled)
+}
+
+func TestFrameNumber(t *testing.T) {
+	clock := usb.NewFakeClock()
+	clock.Advance(10*time.Millisecond + 300*time.Microsecond)
+
+	assert.Equal(t, uint32(10), usb.FrameNumber(clock, protocol.SPEED_USB1_LOW))
+	assert.Equal(t, uint32(10), usb.FrameNumber(clock, protocol.SPEED_USB1_FULL))
+	assert.Equal(t, uint32(82), usb.FrameNumber(clock, protocol.SPEED_USB2_HIGH))
+	assert.Equal(t, uint32(82), usb.FrameNumber(clock, protocol.SPEED_USB3_SUPER))
+}
+
+func TestServiceInterval(t *testing.T) {
+	tests := []struct {
+		name         string
+		speed        uint32
+		bmAttributes uint8
+		bInterval    uint8
+		expected     time.Duration
+	}{
+		{"Full-speed interrupt", protocol.SPEED_USB1_FULL, descriptor.ENDPOINT_TRANSFER_TYPE_INTERRUPT, 10, 10 * time.Millisecond},
+		{"Low-speed interrupt", protocol.SPEED_USB1_LOW, descriptor.ENDPOINT_TRANSFER_TYPE_INTERRUPT, 255, 255 * time.Millisecond},
+		{"Full-speed interrupt with zero bInterval", protocol.SPEED_USB1_FULL, descriptor.ENDPOINT_TRANSFER_TYPE_INTERRUPT, 0, time.Millisecond},
+		{"Full-speed ISO", protocol.SPEED_USB1_FULL, descriptor.ENDPOINT_TRANSFER_TYPE_ISOCHRONOUS, 4, 8 * time.Millisecond},
+		{"High-speed interrupt", protocol.SPEED_USB2_HIGH, descriptor.ENDPOINT_TRANSFER_TYPE_INTERRUPT, 4, time.Millisecond},
+		{"High-speed interrupt with large bInterval", protocol.SPEED_USB2_HIGH, descriptor.ENDPOINT_TRANSFER_TYPE_INTERRUPT, 255, 4096 * time.Millisecond},
+		{"SuperSpeed ISO", protocol.SPEED_USB3_SUPER, descriptor.ENDPOINT_TRANSFER_TYPE_ISOCHRONOUS | 0b1100, 1, 125 * time.Microsecond},
+		{"Bulk", protocol.SPEED_USB2_HIGH, descriptor.ENDPOINT_TRANSFER_TYPE_BULK, 1, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			assert.Equal(t, test.expected, usb.ServiceInterval(test.speed, test.bmAttributes, test.bInterval))
+		})
+	}
+}
+
+func TestIntervalTimer(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	clock := usb.NewFakeClock()
+	timer := usb.NewIntervalTimer(clock, 8*time.Millisecond)
+
+	// The first service interval starts at the current time, which is a multiple of the interval
+	require.NoError(t, timer.Wait(ctx))
+	assert.Equal(t, time.Duration(0), clock.Now())
+
+	clock.Advance(3 * time.Millisecond)
+	var woken []time.Duration
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 2; i++ {
+			if err := timer.Wait(ctx); err != nil {
+				return
+			}
+			woken = append(woken, clock.Now())
+		}
+	}()
+	for i := 0; i < 2; i++ {
+		require.NoError(t, clock.WaitForSleepers(ctx, 1))
+		clock.Advance(8*time.Millisecond - clock.Now()%(8*time.Millisecond))
+	}
+	<-done
+	assert.Equal(t, []time.Duration{8 * time.Millisecond, 16 * time.Millisecond}, woken)
+
+	// Service intervals missed while nobody waits are skipped
+	clock.Advance(20 * time.Millisecond)
+	done = make(chan struct{})
+	go func() {
+		defer close(done)
+		assert.NoError(t, timer.Wait(ctx))
+	}()
+	require.NoError(t, clock.WaitForSleepers(ctx, 1))
+	clock.Advance(4 * time.Millisecond)
+	<-done
+	assert.Equal(t, 40*time.Millisecond, clock.Now())
+
+	waitCtx, waitCancel := context.WithCancel(ctx)
+	waitCancel()
+	assert.ErrorIs(t, usb.NewIntervalTimer(clock, 0).Wait(waitCtx), context.Canceled)
+}
@@ -0,0 +1,451 @@
+package usb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	usbprotocol "github.com/ntchjb/usbip-virtual-device/usb/protocol"
+	"github.com/ntchjb/usbip-virtual-device/usb/protocol/descriptor"
+	"github.com/ntchjb/usbip-virtual-device/usb/protocol/msos"
+	"github.com/ntchjb/usbip-virtual-device/usb/protocol/webusb"
+)
+
+var (
+	ErrInvalidCompositeDevice = errors.New("invalid composite device")
+	ErrEndpointNotOwned       = errors.New("endpoint is not owned by function")
+)
+
+// Function is an independent function of composite device, such as HID keyboard or CDC-ACM serial port.
+// Each function owns its interfaces and endpoints, and receives only traffic addressed to them.
+type Function interface {
+	// Descriptor returns descriptor tree of the function. Interface numbers are assigned by composite device,
+	// and endpoint addresses with endpoint number 0 are allocated by composite device.
+	Descriptor() descriptor.Function
+	// Bind is called once when composite device is created, to register handlers of the function.
+	// Assigned interface numbers and endpoint addresses are available from binding.
+	Bind(binding FunctionBinding) error
+}
+
+// MSOS20Function is a Function having Microsoft OS 2.0 features, such as WinUSB compatible ID.
+// Its features are placed in function subset of Microsoft OS 2.0 descriptor set of composite device.
+type MSOS20Function interface {
+	Function
+	MSOS20Features() []msos.Feature
+}
+
+type webUSBFunction struct {
+	Function
+}
+
+// NewWebUSBFunction marks interfaces of given function as accessible by browsers through WebUSB.
+// Unless the function has its own compatible ID, WinUSB compatible ID is added to its Microsoft OS 2.0 features, so that Windows binds WinUSB driver
+// to the function if composite device has MSOS20 descriptor set. Binding fails if any interface of the function
+// has a class protected from WebUSB, such as HID.
+func NewWebUSBFunction(function Function) MSOS20Function {
+	return &webUSBFunction{
+		Function: function,
+	}
+}
+
+func (f *webUSBFunction) Bind(binding FunctionBinding) error {
+	for i, intf := range f.Function.Descriptor().Interfaces {
+		for _, altSetting := range intf.AltSettings {
+			if webusb.IsProtectedClass(altSetting.BInterfaceClass) {
+				return fmt.Errorf("%w: interface %d has class 0x%02x protected from WebUSB", ErrInvalidCompositeDevice, binding.InterfaceNumber(i), altSetting.BInterfaceClass)
+			}
+		}
+	}
+
+	return f.Function.Bind(binding)
+}
+
+// MSOS20Features returns features of the function, with WinUSB compatible ID if the function has no compatible ID
+func (f *webUSBFunction) MSOS20Features() []msos.Feature {
+	var features []msos.Feature
+	if msos20Function, ok := f.Function.(MSOS20Function); ok {
+		features = msos20Function.MSOS20Features()
+	}
+	for _, feature := range features {
+		if _, ok := feature.(*msos.CompatibleIDDescriptor); ok {
+			return features
+		}
+	}
+	compatibleID := msos.NewWinUSBCompatibleID()
+
+	return append([]msos.Feature{&compatibleID}, features...)
+}
+
+// FunctionBinding registers handlers of a function to composite device,
+// and provides interface numbers and endpoint addresses assigned to the function
+type FunctionBinding interface {
+	// InterfaceNumber returns interface number of given interface index of the function, starting from 0
+	InterfaceNumber(interfaceIndex int) uint8
+	// EndpointAddress returns endpoint address of an endpoint, by its position in descriptor tree of the function
+	EndpointAddress(interfaceIndex, alternateSetting, endpointIndex int) uint8
+	// HandleClassRequest registers handler for class-specific control requests
+	// addressed to interfaces or endpoints of the function
+	HandleClassRequest(handler ControlHandler)
+	// HandleVendorRequest registers handler for vendor-specific control requests
+	// addressed to interfaces or endpoints of the function
+	HandleVendorRequest(handler ControlHandler)
+	// HandleDescriptor registers handler for GET_DESCRIPTOR request of descriptor type not in descriptor set,
+	// addressed to interfaces of the function, such as HID report descriptor
+	HandleDescriptor(descriptorType descriptor.DescriptorType, handler ControlHandler)
+	// HandleSetConfiguration registers handler called when active configuration changes
+	HandleSetConfiguration(handler ConfigurationHandler)
+	// HandleSetInterface registers handler called when active alternate setting of an interface of the function changes
+	HandleSetInterface(handler InterfaceHandler)
+	// HandleEndpoint registers handler for URBs of given endpoint address of the function.
+	// It returns ErrEndpointNotOwned if the endpoint belongs to other function.
+	HandleEndpoint(endpointAddress uint8, handler EndpointHandler) error
+	// HandleEndpointAsync registers handler for URBs of given endpoint address of the function, which completes URBs later.
+	// It returns ErrEndpointNotOwned if the endpoint belongs to other function.
+	HandleEndpointAsync(endpointAddress uint8, handler AsyncEndpointHandler) error
+	// Device returns composite device the function is bound to, e.g. for halting endpoints
+	Device() StandardDevice
+}
+
+type CompositeDeviceConfig struct {
+	// Device descriptor tree with at most one configuration, to which interfaces of functions are appended.
+	// A configuration is added if there is none.
+	Device    descriptor.Device
+	Functions []Function
+	// Optional Microsoft OS 2.0 descriptor set, to which function subsets of MSOS20Function are appended.
+	// Its platform capability is added to BOS descriptor, which is queried by host only if bcdUSB is 0x0201 or higher.
+	MSOS20 *msos.DescriptorSet
+	// Optional WebUSB descriptor set. Its platform capability is added to BOS descriptor.
+	WebUSB *webusb.DescriptorSet
+	// Reply workers are set to 1 if they're zero
+	WorkerPoolProfile WorkerPoolProfile
+	// Optional clock of the bus, see StandardDeviceConfig
+	Clock Clock
+}
+
+type functionBindingImpl struct {
+	device    *compositeDeviceImpl
+	function  descriptor.Function
+	endpoints map[uint8]bool
+
+	handlersLock       sync.RWMutex
+	classHandler       ControlHandler
+	vendorHandler      ControlHandler
+	descriptorHandlers map[descriptor.DescriptorType]ControlHandler
+	configHandler      ConfigurationHandler
+	interfaceHandler   InterfaceHandler
+}
+
+type compositeDeviceImpl struct {
+	StandardDevice
+	logger *slog.Logger
+
+	bindings        []*functionBindingImpl
+	interfaceOwners map[uint8]*functionBindingImpl
+	endpointOwners  map[uint8]*functionBindingImpl
+
+	descriptorTypesLock sync.Mutex
+	descriptorTypes     map[descriptor.DescriptorType]bool
+}
+
+// NewCompositeDevice creates a device composed of given functions. Interface numbers and endpoint addresses
+// are assigned to functions, and class, vendor, descriptor and endpoint traffic is dispatched
+// to the function owning the interface or endpoint it's addressed to.
+func NewCompositeDevice(config CompositeDeviceConfig, logger *slog.Logger) (StandardDevice, error) {
+	tree := config.Device
+	switch len(tree.Configurations) {
+	case 0:
+		tree.Configurations = []descriptor.Configuration{
+			{
+				BMAttributes: 0b10000000,
+				BMaxPower:    0x32,
+			},
+		}
+	case 1:
+		tree.Configurations = append([]descriptor.Configuration(nil), tree.Configurations...)
+		// Functions are appended below, which must not modify backing array of the caller
+		tree.Configurations[0].Functions = append([]descriptor.Function(nil), tree.Configurations[0].Functions...)
+	default:
+		return nil, fmt.Errorf("%w: composite device supports only one configuration", ErrInvalidCompositeDevice)
+	}
+	functionsOffset := len(tree.Configurations[0].Functions)
+	var msos20Set msos.DescriptorSet
+	if config.MSOS20 != nil {
+		msos20Set = *config.MSOS20
+		msos20Set.Functions = append([]msos.Function(nil), msos20Set.Functions...)
+	}
+	// Interface numbers are assigned in order of interfaces, then functions
+	firstInterface := len(tree.Configurations[0].Interfaces)
+	for _, function := range tree.Configurations[0].Functions {
+		firstInterface += len(function.Interfaces)
+	}
+	for _, function := range config.Functions {
+		functionDesc := function.Descriptor()
+		if msos20Function, ok := function.(MSOS20Function); ok && config.MSOS20 != nil {
+			msos20Set.Functions = append(msos20Set.Functions, msos.Function{
+				FirstInterface: uint8(firstInterface),
+				Features:       msos20Function.MSOS20Features(),
+			})
+		}
+		firstInterface += len(functionDesc.Interfaces)
+		tree.Configurations[0].Functions = append(tree.Configurations[0].Functions, functionDesc)
+	}
+
+	var msos20Descriptors *msos.Descriptors
+	if config.MSOS20 != nil {
+		var err error
+		if msos20Descriptors, err = msos20Set.Build(); err != nil {
+			return nil, fmt.Errorf("unable to build MS OS 2.0 descriptors of composite device: %w", err)
+		}
+		tree.Capabilities = append(append([]descriptor.DeviceCapability(nil), tree.Capabilities...), msos20Descriptors.Capability())
+	}
+	var webUSBDescriptors *webusb.Descriptors
+	if config.WebUSB != nil {
+		var err error
+		if webUSBDescriptors, err = config.WebUSB.Build(); err != nil {
+			return nil, fmt.Errorf("unable to build WebUSB descriptors of composite device: %w", err)
+		}
+		tree.Capabilities = append(append([]descriptor.DeviceCapability(nil), tree.Capabilities...), webUSBDescriptors.Capability())
+	}
+
+	set, err := tree.Build()
+	if err != nil {
+		return nil, fmt.Errorf("unable to build descriptors of composite device: %w", err)
+	}
+	configTree, _ := set.ConfigurationTree(set.DeviceInfo().BConfigurationValue)
+
+	device := &compositeDeviceImpl{
+		StandardDevice: NewStandardDevice(StandardDeviceConfig{
+			Descriptors:       set,
+			MSOS20Descriptors: msos20Descriptors,
+			WebUSBDescriptors: webUSBDescriptors,
+			WorkerPoolProfile: config.WorkerPoolProfile,
+			Clock:             config.Clock,
+		}, logger),
+		logger:          logger,
+		interfaceOwners: make(map[uint8]*functionBindingImpl),
+		endpointOwners:  make(map[uint8]*functionBindingImpl),
+		descriptorTypes: make(map[descriptor.DescriptorType]bool),
+	}
+	for i := range config.Functions {
+		binding := &functionBindingImpl{
+			device:             device,
+			function:           configTree.Functions[functionsOffset+i],
+			endpoints:          make(map[uint8]bool),
+			descriptorHandlers: make(map[descriptor.DescriptorType]ControlHandler),
+		}
+		for j, intf := range binding.function.Interfaces {
+			device.interfaceOwners[binding.InterfaceNumber(j)] = binding
+			for _, altSetting := range intf.AltSettings {
+				for _, endpoint := range altSetting.Endpoints {
+					device.endpointOwners[endpoint.BEndpointAddress] = binding
+					binding.endpoints[endpoint.BEndpointAddress] = true
+				}
+			}
+		}
+		device.bindings = append(device.bindings, binding)
+	}
+
+	device.StandardDevice.HandleClassRequest(device.processClassRequest)
+	device.StandardDevice.HandleVendorRequest(device.processVendorRequest)
+	device.StandardDevice.HandleSetConfiguration(device.processSetConfiguration)
+	device.StandardDevice.HandleSetInterface(device.processSetInterface)
+
+	for i, function := range config.Functions {
+		if err := function.Bind(device.bindings[i]); err != nil {
+			return nil, fmt.Errorf("unable to bind function %d: %w", i, err)
+		}
+	}
+
+	return device, nil
+}
+
+// owner returns function owning interface or endpoint that given control request is addressed to
+func (d *compositeDeviceImpl) owner(setup usbprotocol.SetupPacket) (*functionBindingImpl, bool) {
+	var binding *functionBindingImpl
+	var ok bool
+	switch setup.BMRequestType.Recipient() {
+	case usbprotocol.SETUP_RECIPIENT_INTERFACE:
+		binding, ok = d.interfaceOwners[uint8(setup.WIndex)]
+	case usbprotocol.SETUP_RECIPIENT_ENDPOINT:
+		binding, ok = d.endpointOwners[uint8(setup.WIndex)]
+	}
+
+	return binding, ok
+}
+
+// routeControl calls handler of function owning recipient of the request.
+// Requests addressed to device are passed to the first function having a handler.
+func (d *compositeDeviceImpl) routeControl(ctx context.Context, setup usbprotocol.SetupPacket, data []byte, getHandler func(binding *functionBindingImpl) ControlHandler) ([]byte, error) {
+	if setup.BMRequestType.Recipient() == usbprotocol.SETUP_RECIPIENT_DEVICE {
+		for _, binding := range d.bindings {
+			if handler := getHandler(binding); handler != nil {
+				return handler(ctx, setup, data)
+			}
+		}
+		return nil, fmt.Errorf("no function handles request type %x, request %d", setup.BMRequestType, setup.BRequest)
+	}
+
+	binding, ok := d.owner(setup)
+	if !ok {
+		return nil, fmt.Errorf("no function owns recipient %d of request type %x", setup.WIndex, setup.BMRequestType)
+	}
+	handler := getHandler(binding)
+	if handler == nil {
+		return nil, fmt.Errorf("function of recipient %d has no handler for request type %x", setup.WIndex, setup.BMRequestType)
+	}
+
+	return handler(ctx, setup, data)
+}
+
+func (d *compositeDeviceImpl) processClassRequest(ctx context.Context, setup usbprotocol.SetupPacket, data []byte) ([]byte, error) {
+	return d.routeControl(ctx, setup, data, func(binding *functionBindingImpl) ControlHandler {
+		binding.handlersLock.RLock()
+		defer binding.handlersLock.RUnlock()
+
+		return binding.classHandler
+	})
+}
+
+func (d *compositeDeviceImpl) processVendorRequest(ctx context.Context, setup usbprotocol.SetupPacket, data []byte) ([]byte, error) {
+	return d.routeControl(ctx, setup, data, func(binding *functionBindingImpl) ControlHandler {
+		binding.handlersLock.RLock()
+		defer binding.handlersLock.RUnlock()
+
+		return binding.vendorHandler
+	})
+}
+
+func (d *compositeDeviceImpl) processDescriptor(ctx context.Context, setup usbprotocol.SetupPacket, data []byte) ([]byte, error) {
+	descriptorType, index := descriptor.GetDescriptorTypeAndIndex(setup.WValue)
+	retData, err := d.routeControl(ctx, setup, data, func(binding *functionBindingImpl) ControlHandler {
+		binding.handlersLock.RLock()
+		defer binding.handlersLock.RUnlock()
+
+		return binding.descriptorHandlers[descriptorType]
+	})
+	if err != nil && setup.BMRequestType.Recipient() == usbprotocol.SETUP_RECIPIENT_DEVICE {
+		// Descriptor type is handled by functions, but not for device, so descriptor set is used
+		return d.Descriptors().GetDescriptor(descriptorType, index, descriptor.LangID(setup.WIndex))
+	}
+
+	return retData, err
+}
+
+// registerDescriptorType routes GET_DESCRIPTOR of given type to functions, once for each type
+func (d *compositeDeviceImpl) registerDescriptorType(descriptorType descriptor.DescriptorType) {
+	d.descriptorTypesLock.Lock()
+	defer d.descriptorTypesLock.Unlock()
+
+	if d.descriptorTypes[descriptorType] {
+		return
+	}
+	d.descriptorTypes[descriptorType] = true
+	d.StandardDevice.HandleDescriptor(descriptorType, d.processDescriptor)
+}
+
+func (d *compositeDeviceImpl) processSetConfiguration(ctx context.Context, configValue uint8) error {
+	for i, binding := range d.bindings {
+		binding.handlersLock.RLock()
+		handler := binding.configHandler
+		binding.handlersLock.RUnlock()
+		if handler == nil {
+			continue
+		}
+		if err := handler(ctx, configValue); err != nil {
+			return fmt.Errorf("function %d rejected configuration %d: %w", i, configValue, err)
+		}
+	}
+
+	return nil
+}
+
+func (d *compositeDeviceImpl) processSetInterface(ctx context.Context, interfaceNumber, alternateSetting uint8) error {
+	binding, ok := d.interfaceOwners[interfaceNumber]
+	if !ok {
+		return nil
+	}
+	binding.handlersLock.RLock()
+	handler := binding.interfaceHandler
+	binding.handlersLock.RUnlock()
+	if handler == nil {
+		return nil
+	}
+
+	return handler(ctx, interfaceNumber, alternateSetting)
+}
+
+func (b *functionBindingImpl) InterfaceNumber(interfaceIndex int) uint8 {
+	return b.function.FirstInterface + uint8(interfaceIndex)
+}
+
+func (b *functionBindingImpl) EndpointAddress(interfaceIndex, alternateSetting, endpointIndex int) uint8 {
+	if interfaceIndex < 0 || interfaceIndex >= len(b.function.Interfaces) {
+		return 0
+	}
+	altSettings := b.function.Interfaces[interfaceIndex].AltSettings
+	if alternateSetting < 0 || alternateSetting >= len(altSettings) {
+		return 0
+	}
+	endpoints := altSettings[alternateSetting].Endpoints
+	if endpointIndex < 0 || endpointIndex >= len(endpoints) {
+		return 0
+	}
+
+	return endpoints[endpointIndex].BEndpointAddress
+}
+
+func (b *functionBindingImpl) HandleClassRequest(handler ControlHandler) {
+	b.handlersLock.Lock()
+	defer b.handlersLock.Unlock()
+	b.classHandler = handler
+}
+
+func (b *functionBindingImpl) HandleVendorRequest(handler ControlHandler) {
+	b.handlersLock.Lock()
+	defer b.handlersLock.Unlock()
+	b.vendorHandler = handler
+}
+
+func (b *functionBindingImpl) HandleDescriptor(descriptorType descriptor.DescriptorType, handler ControlHandler) {
+	b.handlersLock.Lock()
+	b.descriptorHandlers[descriptorType] = handler
+	b.handlersLock.Unlock()
+
+	b.device.registerDescriptorType(descriptorType)
+}
+
+func (b *functionBindingImpl) HandleSetConfiguration(handler ConfigurationHandler) {
+	b.handlersLock.Lock()
+	defer b.handlersLock.Unlock()
+	b.configHandler = handler
+}
+
+func (b *functionBindingImpl) HandleSetInterface(handler InterfaceHandler) {
+	b.handlersLock.Lock()
+	defer b.handlersLock.Unlock()
+	b.interfaceHandler = handler
+}
+
+func (b *functionBindingImpl) HandleEndpoint(endpointAddress uint8, handler EndpointHandler) error {
+	if !b.endpoints[endpointAddress] {
+		return fmt.Errorf("%w: endpoint 0x%02x", ErrEndpointNotOwned, endpointAddress)
+	}
+	b.device.StandardDevice.HandleEndpoint(endpointAddress, handler)
+
+	return nil
+}
+
+func (b *functionBindingImpl) HandleEndpointAsync(endpointAddress uint8, handler AsyncEndpointHandler) error {
+	if !b.endpoints[endpointAddress] {
+		return fmt.Errorf("%w: endpoint 0x%02x", ErrEndpointNotOwned, endpointAddress)
+	}
+	b.device.StandardDevice.HandleEndpointAsync(endpointAddress, handler)
+
+	return nil
+}
+
+func (b *functionBindingImpl) Device() StandardDevice {
+	return b.device
+}
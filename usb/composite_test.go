@@ -0,0 +1,407 @@
+package usb_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+
+	"github.com/ntchjb/usbip-virtual-device/usb"
+	"github.com/ntchjb/usbip-virtual-device/usb/protocol"
+	"github.com/ntchjb/usbip-virtual-device/usb/protocol/descriptor"
+	"github.com/ntchjb/usbip-virtual-device/usb/protocol/msos"
+	"github.com/ntchjb/usbip-virtual-device/usb/protocol/webusb"
+	"github.com/ntchjb/usbip-virtual-device/usbip/protocol/command"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testHIDFunction struct {
+	classRequests []uint16
+}
+
+func (f *testHIDFunction) Descriptor() descriptor.Function {
+	return descriptor.Function{
+		Interfaces: []descriptor.Interface{
+			{
+				AltSettings: []descriptor.AltSetting{
+					{
+						BInterfaceClass: protocol.CLASS_HID,
+						Endpoints: []descriptor.Endpoint{
+							{BEndpointAddress: 0x80, BMAttributes: 0x03, WMaxPacketSize: 8, BInterval: 10},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func (f *testHIDFunction) Bind(binding usb.FunctionBinding) error {
+	binding.HandleDescriptor(descriptor.DESCRIPTOR_TYPE_HID_REPORT, func(ctx context.Context, setup protocol.SetupPacket, data []byte) ([]byte, error) {
+		return []byte{0x05, 0x01, 0xc0}, nil
+	})
+	binding.HandleClassRequest(func(ctx context.Context, setup protocol.SetupPacket, data []byte) ([]byte, error) {
+		f.classRequests = append(f.classRequests, setup.WIndex)
+		return nil, nil
+	})
+
+	return nil
+}
+
+type testSerialFunction struct {
+	dataIn        uint8
+	classRequests []uint16
+	altSettings   []uint8
+	bindErr       error
+}
+
+func (f *testSerialFunction) Descriptor() descriptor.Function {
+	return descriptor.Function{
+		BFunctionClass:    protocol.CLASS_CDC_CONTROL,
+		BFunctionSubClass: 0x02,
+		Interfaces: []descriptor.Interface{
+			{
+				AltSettings: []descriptor.AltSetting{
+					{
+						BInterfaceClass:    protocol.CLASS_CDC_CONTROL,
+						BInterfaceSubClass: 0x02,
+						Endpoints: []descriptor.Endpoint{
+							{BEndpointAddress: 0x80, BMAttributes: 0x03, WMaxPacketSize: 8, BInterval: 16},
+						},
+					},
+				},
+			},
+			{
+				AltSettings: []descriptor.AltSetting{
+					{BInterfaceClass: protocol.CLASS_CDC_DATA},
+					{
+						BInterfaceClass: protocol.CLASS_CDC_DATA,
+						Endpoints: []descriptor.Endpoint{
+							{BEndpointAddress: 0x80, BMAttributes: 0x02, WMaxPacketSize: 64},
+							{BEndpointAddress: 0x00, BMAttributes: 0x02, WMaxPacketSize: 64},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func (f *testSerialFunction) Bind(binding usb.FunctionBinding) error {
+	if f.bindErr != nil {
+		return f.bindErr
+	}
+	f.dataIn = binding.EndpointAddress(1, 1, 0)
+	binding.HandleClassRequest(func(ctx context.Context, setup protocol.SetupPacket, data []byte) ([]byte, error) {
+		f.classRequests = append(f.classRequests, setup.WIndex)
+		return nil, nil
+	})
+	binding.HandleSetInterface(func(ctx context.Context, interfaceNumber, alternateSetting uint8) error {
+		f.altSettings = append(f.altSettings, interfaceNumber, alternateSetting)
+		return nil
+	})
+	return binding.HandleEndpoint(f.dataIn, func(ctx context.Context, data command.CmdSubmit) command.RetSubmit {
+		return command.NewSuccessRetSubmit(data, []byte("serial"))
+	})
+}
+
+// testForeignEndpointFunction registers handlers for an endpoint it does not own
+type testForeignEndpointFunction struct {
+	endpointAddress uint8
+	asyncErr        error
+}
+
+func (f *testForeignEndpointFunction) Descriptor() descriptor.Function {
+	return descriptor.Function{
+		Interfaces: []descriptor.Interface{
+			{
+				AltSettings: []descriptor.AltSetting{
+					{
+						BInterfaceClass: protocol.CLASS_VENDOR_SPECIFIC,
+						Endpoints: []descriptor.Endpoint{
+							{BEndpointAddress: 0x00, BMAttributes: 0x02, WMaxPacketSize: 64},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func (f *testForeignEndpointFunction) Bind(binding usb.FunctionBinding) error {
+	f.asyncErr = binding.HandleEndpointAsync(f.endpointAddress, func(ctx context.Context, data command.CmdSubmit, completer usb.URBCompleter) {
+		completer(command.NewSuccessRetSubmit(data, nil))
+	})
+
+	return binding.HandleEndpoint(f.endpointAddress, func(ctx context.Context, data command.CmdSubmit) command.RetSubmit {
+		return command.NewSuccessRetSubmit(data, nil)
+	})
+}
+
+func TestCompositeDevice(t *testing.T) {
+	hidFunction := &testHIDFunction{}
+	serialFunction := &testSerialFunction{}
+	device, err := usb.NewCompositeDevice(usb.CompositeDeviceConfig{
+		Device: descriptor.Device{
+			Speed:          protocol.SPEED_USB1_FULL,
+			BCDUSB:         0x0200,
+			BMaxPacketSize: 64,
+			IDVendor:       0x1234,
+			IDProduct:      0x5679,
+		},
+		Functions: []usb.Function{hidFunction, serialFunction},
+	}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	info := device.GetDeviceInfo()
+	assert.Equal(t, protocol.CLASS_MISCELLANEOUS, info.BDeviceClass)
+	assert.Equal(t, uint8(3), info.BNumInterfaces)
+	assert.Equal(t, uint8(0x83), serialFunction.dataIn)
+
+	// HID report descriptor is routed to HID function only
+	ret := device.Process(ctx, newControlCmdSubmit(t, protocol.SetupPacket{
+		BMRequestType: 0x81,
+		BRequest:      protocol.REQUEST_GET_DESCRIPTOR,
+		WValue:        0x2200,
+		WIndex:        0,
+		WLength:       0xff,
+	}, nil))
+	assert.Equal(t, command.URB_STATUS_OK, ret.Status)
+	assert.Equal(t, []byte{0x05, 0x01, 0xc0}, ret.TransferBuffer)
+	ret = device.Process(ctx, newControlCmdSubmit(t, protocol.SetupPacket{
+		BMRequestType: 0x81,
+		BRequest:      protocol.REQUEST_GET_DESCRIPTOR,
+		WValue:        0x2200,
+		WIndex:        1,
+		WLength:       0xff,
+	}, nil))
+	assert.Equal(t, command.URB_STATUS_STALL, ret.Status)
+
+	// Class requests are routed by interface number
+	for _, interfaceNumber := range []uint16{0, 1, 2, 3} {
+		device.Process(ctx, newControlCmdSubmit(t, protocol.SetupPacket{
+			BMRequestType: 0x21,
+			BRequest:      0x20,
+			WIndex:        interfaceNumber,
+		}, nil))
+	}
+	assert.Equal(t, []uint16{0}, hidFunction.classRequests)
+	assert.Equal(t, []uint16{1, 2}, serialFunction.classRequests)
+
+	// Endpoint traffic is routed to the function owning the endpoint
+	setTestStandardDeviceInterface(t, device, 1, 0)
+	ret = device.Process(ctx, newControlCmdSubmit(t, protocol.SetupPacket{
+		BMRequestType: 0x01,
+		BRequest:      protocol.REQUEST_SET_INTERFACE,
+		WValue:        1,
+		WIndex:        2,
+	}, nil))
+	require.Equal(t, command.URB_STATUS_OK, ret.Status)
+	assert.Equal(t, []uint8{2, 1}, serialFunction.altSettings)
+
+	ret = device.Process(ctx, command.CmdSubmit{
+		CmdHeader: command.CmdHeader{
+			Command:        command.CMD_SUBMIT,
+			SeqNum:         2,
+			Direction:      command.DIR_IN,
+			EndpointNumber: 3,
+		},
+		TransferBufferLength: 64,
+		NumberOfPackets:      0xffffffff,
+	})
+	assert.Equal(t, command.URB_STATUS_OK, ret.Status)
+	assert.Equal(t, []byte("serial"), ret.TransferBuffer)
+}
+
+func TestCompositeDeviceSharedConfig(t *testing.T) {
+	// Functions of configuration have spare capacity, which must not be written by composite devices
+	functions := make([]descriptor.Function, 1, 4)
+	functions[0] = (&testHIDFunction{}).Descriptor()
+	config := usb.CompositeDeviceConfig{
+		Device: descriptor.Device{
+			Speed:          protocol.SPEED_USB1_FULL,
+			BCDUSB:         0x0200,
+			BMaxPacketSize: 64,
+			Configurations: []descriptor.Configuration{
+				{
+					BMAttributes: 0b10000000,
+					Functions:    functions,
+				},
+			},
+		},
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	config.Functions = []usb.Function{&testSerialFunction{}}
+	serialDevice, err := usb.NewCompositeDevice(config, logger)
+	require.NoError(t, err)
+	config.Functions = []usb.Function{&testHIDFunction{}}
+	hidDevice, err := usb.NewCompositeDevice(config, logger)
+	require.NoError(t, err)
+
+	assert.Equal(t, []descriptor.Function{{}, {}, {}}, functions[1:4])
+	assert.Len(t, config.Device.Configurations[0].Functions, 1)
+	assert.Equal(t, uint8(3), serialDevice.GetDeviceInfo().BNumInterfaces)
+	assert.Equal(t, uint8(2), hidDevice.GetDeviceInfo().BNumInterfaces)
+}
+
+func TestCompositeDeviceInvalid(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	_, err := usb.NewCompositeDevice(usb.CompositeDeviceConfig{
+		Device: descriptor.Device{
+			Configurations: []descriptor.Configuration{{}, {}},
+		},
+		Functions: []usb.Function{&testHIDFunction{}},
+	}, logger)
+	assert.ErrorIs(t, err, usb.ErrInvalidCompositeDevice)
+
+	bindErr := errors.New("bind error")
+	_, err = usb.NewCompositeDevice(usb.CompositeDeviceConfig{
+		Functions: []usb.Function{&testSerialFunction{bindErr: bindErr}},
+	}, logger)
+	assert.ErrorIs(t, err, bindErr)
+
+	foreignFunction := &testForeignEndpointFunction{endpointAddress: 0x81}
+	_, err = usb.NewCompositeDevice(usb.CompositeDeviceConfig{
+		Functions: []usb.Function{&testHIDFunction{}, foreignFunction},
+	}, logger)
+	assert.ErrorIs(t, err, usb.ErrEndpointNotOwned)
+	assert.ErrorIs(t, foreignFunction.asyncErr, usb.ErrEndpointNotOwned)
+}
+
+type testWinUSBFunction struct{}
+
+func (f *testWinUSBFunction) Descriptor() descriptor.Function {
+	return descriptor.Function{
+		Interfaces: []descriptor.Interface{
+			{
+				AltSettings: []descriptor.AltSetting{
+					{BInterfaceClass: protocol.CLASS_VENDOR_SPECIFIC},
+				},
+			},
+		},
+	}
+}
+
+func (f *testWinUSBFunction) Bind(binding usb.FunctionBinding) error {
+	return nil
+}
+
+func (f *testWinUSBFunction) MSOS20Features() []msos.Feature {
+	compatibleID := msos.NewWinUSBCompatibleID()
+
+	return []msos.Feature{&compatibleID}
+}
+
+func TestCompositeDeviceMSOS20(t *testing.T) {
+	device, err := usb.NewCompositeDevice(usb.CompositeDeviceConfig{
+		Device: descriptor.Device{
+			BCDUSB:         0x0210,
+			BMaxPacketSize: 64,
+		},
+		Functions: []usb.Function{&testHIDFunction{}, &testWinUSBFunction{}},
+		MSOS20: &msos.DescriptorSet{
+			VendorCode: 0x20,
+		},
+	}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	ret := device.Process(ctx, newControlCmdSubmit(t, protocol.SetupPacket{
+		BMRequestType: 0x80,
+		BRequest:      protocol.REQUEST_GET_DESCRIPTOR,
+		WValue:        uint16(descriptor.DESCRIPTOR_TYPE_BOS) << 8,
+		WLength:       0xff,
+	}, nil))
+	assert.Equal(t, command.URB_STATUS_OK, ret.Status)
+	capabilities, err := descriptor.DecodeDeviceCapabilities(ret.TransferBuffer[descriptor.BOS_DESCRIPTOR_LENGTH:])
+	require.NoError(t, err)
+	require.Len(t, capabilities, 1)
+	capability := capabilities[0].(*descriptor.PlatformCapability)
+	assert.Equal(t, msos.PLATFORM_CAPABILITY_UUID, capability.PlatformCapabilityUUID)
+	assert.Equal(t, uint8(0x20), capability.CapabilityData[6])
+
+	ret = device.Process(ctx, newControlCmdSubmit(t, protocol.SetupPacket{
+		BMRequestType: 0xC0,
+		BRequest:      0x20,
+		WIndex:        msos.MS_OS_20_DESCRIPTOR_INDEX,
+		WLength:       0xff,
+	}, nil))
+	assert.Equal(t, command.URB_STATUS_OK, ret.Status)
+	assert.Equal(t, []byte{
+		0x0A, 0x00, 0x00, 0x00, 0x00, 0x00, 0x03, 0x06, 0x2E, 0x00, // Set header
+		0x08, 0x00, 0x01, 0x00, 0x00, 0x00, 0x24, 0x00, // Configuration subset
+		0x08, 0x00, 0x02, 0x00, 0x01, 0x00, 0x1C, 0x00, // Function subset of interface 1
+		0x14, 0x00, 0x03, 0x00, 'W', 'I', 'N', 'U', 'S', 'B', 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	}, ret.TransferBuffer)
+}
+
+func TestCompositeDeviceWebUSB(t *testing.T) {
+	device, err := usb.NewCompositeDevice(usb.CompositeDeviceConfig{
+		Device: descriptor.Device{
+			BCDUSB:         0x0210,
+			BMaxPacketSize: 64,
+		},
+		Functions: []usb.Function{
+			&testHIDFunction{},
+			usb.NewWebUSBFunction(&testWinUSBFunction{}),
+		},
+		MSOS20: &msos.DescriptorSet{
+			VendorCode: 0x20,
+		},
+		WebUSB: &webusb.DescriptorSet{
+			VendorCode:  0x21,
+			LandingPage: "https://ntch.dev",
+		},
+	}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	bos, err := device.Descriptors().GetDescriptor(descriptor.DESCRIPTOR_TYPE_BOS, 0, 0)
+	require.NoError(t, err)
+	capabilities, err := descriptor.DecodeDeviceCapabilities(bos[descriptor.BOS_DESCRIPTOR_LENGTH:])
+	require.NoError(t, err)
+	require.Len(t, capabilities, 2)
+	assert.Equal(t, webusb.PLATFORM_CAPABILITY_UUID, capabilities[1].(*descriptor.PlatformCapability).PlatformCapabilityUUID)
+
+	ret := device.Process(ctx, newControlCmdSubmit(t, protocol.SetupPacket{
+		BMRequestType: 0xC0,
+		BRequest:      0x21,
+		WValue:        1,
+		WIndex:        webusb.WEBUSB_REQUEST_GET_URL,
+		WLength:       0xff,
+	}, nil))
+	assert.Equal(t, command.URB_STATUS_OK, ret.Status)
+	assert.Equal(t, []byte{0x0B, 0x03, 0x01, 'n', 't', 'c', 'h', '.', 'd', 'e', 'v'}, ret.TransferBuffer)
+
+	ret = device.Process(ctx, newControlCmdSubmit(t, protocol.SetupPacket{
+		BMRequestType: 0xC0,
+		BRequest:      0x21,
+		WValue:        2,
+		WIndex:        webusb.WEBUSB_REQUEST_GET_URL,
+		WLength:       0xff,
+	}, nil))
+	assert.Equal(t, command.URB_STATUS_STALL, ret.Status)
+
+	// WebUSB function gets WinUSB compatible ID
+	ret = device.Process(ctx, newControlCmdSubmit(t, protocol.SetupPacket{
+		BMRequestType: 0xC0,
+		BRequest:      0x20,
+		WIndex:        msos.MS_OS_20_DESCRIPTOR_INDEX,
+		WLength:       0xff,
+	}, nil))
+	assert.Equal(t, command.URB_STATUS_OK, ret.Status)
+	assert.Len(t, ret.TransferBuffer, 0x2E)
+	assert.Equal(t, []byte("WINUSB"), ret.TransferBuffer[30:36])
+
+	// Function having protected class cannot be WebUSB function
+	_, err = usb.NewCompositeDevice(usb.CompositeDeviceConfig{
+		Functions: []usb.Function{usb.NewWebUSBFunction(&testHIDFunction{})},
+	}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	assert.ErrorIs(t, err, usb.ErrInvalidCompositeDevice)
+}
@@ -1,23 +1,44 @@
 package usb
 
 import (
+	"context"
+
 	usbprotocol "github.com/ntchjb/usbip-virtual-device/usb/protocol"
 	"github.com/ntchjb/usbip-virtual-device/usbip/protocol/command"
 	"github.com/ntchjb/usbip-virtual-device/usbip/protocol/op"
 )
 
 type WorkerPoolProfile struct {
-	// Maximum number of goroutines to process incoming URBs in parallel.
-	// Set this to 1 to process all incoming URBs in sequence.
+	// Maximum number of goroutines to process incoming URBs of each endpoint in parallel.
+	// Each endpoint and direction has its own queue, so URBs of an endpoint never block other endpoints.
+	// Set this to 1 to process incoming URBs of each endpoint in sequence. Zero is treated as 1.
 	MaximumProcWorkers int
+	// EndpointProcWorkers overrides MaximumProcWorkers for specific endpoints, keyed by endpoint address,
+	// which is endpoint number with direction bit, such as 0x81 for endpoint 1 IN and 0x01 for endpoint 1 OUT.
+	// Control endpoint uses address 0 for both directions.
+	EndpointProcWorkers map[uint8]int
 	// Maximum number of goroutines to reply return data in parallel.
 	// Set this to 1 to reply return data one-by-one in sequence.
+	// Note that replies of the same endpoint can be reordered if it's more than 1.
 	MaximumReplyWorkers int
 	// Maximum number of goroutines to reply unlink data in parallel.
 	// Set this to 1 to reply return data one-by-one in sequence.
 	MaximumUnlinkReplyWorkers int
 }
 
+// GetEndpointProcWorkers returns number of goroutines processing URBs of given endpoint address
+func (w WorkerPoolProfile) GetEndpointProcWorkers(endpointAddress uint8) int {
+	workers := w.MaximumProcWorkers
+	if endpointWorkers, ok := w.EndpointProcWorkers[endpointAddress]; ok {
+		workers = endpointWorkers
+	}
+	if workers < 1 {
+		return 1
+	}
+
+	return workers
+}
+
 // Device represents a USB device and its logic
 type Device interface {
 	// SetBusID assigns bus ID to this device. BusID should be assigned by device registrar
@@ -26,10 +47,31 @@ type Device interface {
 	GetBusID() usbprotocol.BusID
 	// GetDeviceInfo returns device information used by OpDevList
 	GetDeviceInfo() op.DeviceInfo
-	// GetURBProcessor returns an instance of processor of this device, used by handler's worker pool
-	Process(data command.CmdSubmit) command.RetSubmit
+	// Process processes a URB and returns its result, used by handler's worker pool.
+	// ctx is cancelled when the URB is unlinked by client or the connection is closed,
+	// so device waiting for external events should return as soon as ctx is done.
+	Process(ctx context.Context, data command.CmdSubmit) command.RetSubmit
 	// GetWorkerPoolProfile indicates how worker pool behave for this device, such as, set worker count to 1 to process URB requests in sequences
 	GetWorkerPoolProfile() WorkerPoolProfile
 	// Close device to release all associated resources
 	Close() error
 }
+
+// URBCompleter completes a URB submitted to AsyncDevice with its RetSubmit.
+// It can be called from any goroutine, and only the first call of each URB takes effect.
+type URBCompleter func(ret command.RetSubmit)
+
+// AsyncDevice is an optional interface of Device, for devices holding URBs until data is available,
+// such as interrupt IN endpoint of HID devices, or bulk IN endpoint of CDC devices.
+//
+// If a device implements AsyncDevice, worker pool calls ProcessAsync instead of Process,
+// so that pending URBs do not block worker goroutines.
+type AsyncDevice interface {
+	Device
+	// ProcessAsync receives a submitted URB and should return immediately.
+	// The device completes the URB later by calling completer from any goroutine.
+	// ctx is cancelled when the URB is unlinked or the connection is closed, then the device should release the URB
+	// by completing it, such as with command.NewErrorRetSubmit. Completion of an unlinked URB is not replied to client,
+	// but its transfer buffer stays counted in in-flight bytes of the connection until it's completed.
+	ProcessAsync(ctx context.Context, data command.CmdSubmit, completer URBCompleter)
+}
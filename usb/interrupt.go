@@ -0,0 +1,334 @@
+package usb
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/ntchjb/usbip-virtual-device/usbip/protocol/command"
+)
+
+// OverflowPolicy decides what happens to a report pushed into a full report queue
+type OverflowPolicy uint8
+
+const (
+	// The oldest queued report is dropped to make room for the pushed report
+	OVERFLOW_POLICY_DROP_OLDEST OverflowPolicy = iota
+	// The pushed report is dropped, and Push returns ErrReportDropped
+	OVERFLOW_POLICY_DROP_NEWEST
+	// Push blocks until a queued report is sent
+	OVERFLOW_POLICY_BLOCK
+)
+
+const (
+	// Unit of idle rate of HID SET_IDLE and GET_IDLE requests
+	HID_IDLE_RATE_UNIT = 4 * time.Millisecond
+)
+
+var (
+	ErrReportDropped  = errors.New("report queue is full, report is dropped")
+	ErrEndpointClosed = errors.New("endpoint is closed")
+)
+
+// InterruptINEndpoint is an interrupt IN endpoint to which application pushes reports, such as of HID devices.
+// IN URBs are completed with queued reports in order, at most one per service interval of the endpoint.
+// If no report is queued, IN URBs wait for the next report, or for the last report to be repeated by HID idle rate.
+type InterruptINEndpoint interface {
+	// Handle holds IN URB until a report is available, to be registered by StandardDevice.HandleEndpointAsync
+	Handle(ctx context.Context, data command.CmdSubmit, completer URBCompleter)
+	// Push queues a report to be sent to host. If the queue is full, the report is handled by overflow policy,
+	// where ctx cancels waiting of OVERFLOW_POLICY_BLOCK.
+	Push(ctx context.Context, report []byte) error
+	// SetIdleRate sets HID idle rate in units of HID_IDLE_RATE_UNIT, as requested by SET_IDLE.
+	// The last report is repeated if no new report is pushed within the idle duration. Zero disables repeating.
+	// Idle rate applies to all reports regardless of their report IDs.
+	SetIdleRate(rate uint8)
+	// GetIdleRate returns HID idle rate, as replied to GET_IDLE
+	GetIdleRate() uint8
+	// Close completes pending URBs with URB_STATUS_SHUTDOWN, and unblocks pushes waiting for queue space
+	Close() error
+}
+
+type InterruptINEndpointConfig struct {
+	// Clock pacing completions, such as StandardDevice.Clock. A new clock is used if it's nil.
+	Clock Clock
+	// Service interval of the endpoint, such as from ServiceInterval with its bInterval.
+	// Completions are not paced if it's zero.
+	Interval time.Duration
+	// Maximum number of queued reports, set to 1 if it's zero
+	Depth          int
+	OverflowPolicy OverflowPolicy
+}
+
+type interruptINURB struct {
+	ctx       context.Context
+	data      command.CmdSubmit
+	completer URBCompleter
+	// stops signaling run loop when ctx is done
+	stop func() bool
+}
+
+type interruptINEndpointImpl struct {
+	clock  Clock
+	timer  *IntervalTimer
+	depth  int
+	policy OverflowPolicy
+	logger *slog.Logger
+
+	lock       sync.Mutex
+	reports    [][]byte
+	pending    []interruptINURB
+	idleRate   uint8
+	lastReport []byte
+	lastSent   time.Duration
+	closed     bool
+	// closed and replaced whenever a queued report is taken, waking blocked pushes
+	dequeued chan struct{}
+	// signaled whenever reports, pending URBs or idle rate change
+	notify chan struct{}
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func NewInterruptINEndpoint(config InterruptINEndpointConfig, logger *slog.Logger) InterruptINEndpoint {
+	clock := config.Clock
+	if clock == nil {
+		clock = NewClock()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+
+	e := &interruptINEndpointImpl{
+		clock:    clock,
+		timer:    NewIntervalTimer(clock, config.Interval),
+		depth:    max(config.Depth, 1),
+		policy:   config.OverflowPolicy,
+		logger:   logger,
+		dequeued: make(chan struct{}),
+		notify:   make(chan struct{}, 1),
+		cancel:   cancel,
+	}
+	e.wg.Add(1)
+	go e.run(ctx)
+
+	return e
+}
+
+func (e *interruptINEndpointImpl) Handle(ctx context.Context, data command.CmdSubmit, completer URBCompleter) {
+	e.lock.Lock()
+	if e.closed {
+		e.lock.Unlock()
+		completer(command.NewRetSubmit(data, command.URB_STATUS_SHUTDOWN, nil))
+		return
+	}
+	e.pending = append(e.pending, interruptINURB{
+		ctx:       ctx,
+		data:      data,
+		completer: completer,
+		// URB unlinked by host is dropped without waiting for the next report
+		stop: context.AfterFunc(ctx, e.signal),
+	})
+	e.signal()
+	e.lock.Unlock()
+}
+
+func (e *interruptINEndpointImpl) Push(ctx context.Context, report []byte) error {
+	report = append(make([]byte, 0, len(report)), report...)
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	for !e.closed && len(e.reports) >= e.depth {
+		switch e.policy {
+		case OVERFLOW_POLICY_DROP_OLDEST:
+			e.logger.Debug("report queue is full, dropping the oldest report")
+			e.reports = e.reports[1:]
+		case OVERFLOW_POLICY_DROP_NEWEST:
+			return ErrReportDropped
+		default:
+			dequeued := e.dequeued
+			e.lock.Unlock()
+			select {
+			case <-ctx.Done():
+				e.lock.Lock()
+				return ctx.Err()
+			case <-dequeued:
+			}
+			e.lock.Lock()
+		}
+	}
+	if e.closed {
+		return ErrEndpointClosed
+	}
+	e.reports = append(e.reports, report)
+	e.signal()
+
+	return nil
+}
+
+func (e *interruptINEndpointImpl) SetIdleRate(rate uint8) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.idleRate = rate
+	e.signal()
+}
+
+func (e *interruptINEndpointImpl) GetIdleRate() uint8 {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	return e.idleRate
+}
+
+func (e *interruptINEndpointImpl) Close() error {
+	e.lock.Lock()
+	var pending []interruptINURB
+	if !e.closed {
+		e.closed = true
+		close(e.dequeued)
+		pending = e.pending
+		e.pending = nil
+	}
+	e.lock.Unlock()
+
+	e.cancel()
+	e.wg.Wait()
+
+	for _, urb := range pending {
+		urb.stop()
+		urb.completer(command.NewRetSubmit(urb.data, command.URB_STATUS_SHUTDOWN, nil))
+	}
+
+	return nil
+}
+
+// signal wakes the run loop to re-check the queue
+func (e *interruptINEndpointImpl) signal() {
+	select {
+	case e.notify <- struct{}{}:
+	default:
+	}
+}
+
+// run completes pending URBs with reports, one per service interval, until ctx is done
+func (e *interruptINEndpointImpl) run(ctx context.Context) {
+	defer e.wg.Done()
+
+	for {
+		e.lock.Lock()
+		unlinked := e.dropUnlinkedLocked()
+		ready, deadline, hasDeadline := e.readyLocked()
+		e.lock.Unlock()
+		completeUnlinked(unlinked)
+		if !ready {
+			if err := e.waitSignal(ctx, deadline, hasDeadline); err != nil {
+				return
+			}
+			continue
+		}
+
+		if err := e.timer.Wait(ctx); err != nil {
+			return
+		}
+
+		e.lock.Lock()
+		if e.closed {
+			e.lock.Unlock()
+			return
+		}
+		unlinked = e.dropUnlinkedLocked()
+		if ready, _, _ = e.readyLocked(); !ready {
+			e.lock.Unlock()
+			completeUnlinked(unlinked)
+			continue
+		}
+		urb := e.pending[0]
+		e.pending = e.pending[1:]
+		urb.stop()
+		if len(e.reports) > 0 {
+			e.lastReport = e.reports[0]
+			e.reports = e.reports[1:]
+			close(e.dequeued)
+			e.dequeued = make(chan struct{})
+		}
+		report := e.lastReport
+		e.lastSent = e.clock.Now()
+		e.lock.Unlock()
+
+		completeUnlinked(unlinked)
+		urb.completer(command.NewSuccessRetSubmit(urb.data, report))
+	}
+}
+
+// readyLocked returns whether a pending URB can be completed now. Otherwise, it returns time when
+// the last report is due to be repeated by idle rate, if there is a pending URB waiting for it.
+func (e *interruptINEndpointImpl) readyLocked() (bool, time.Duration, bool) {
+	if len(e.pending) == 0 {
+		return false, 0, false
+	}
+	if len(e.reports) > 0 {
+		return true, 0, false
+	}
+	if e.idleRate == 0 || e.lastReport == nil {
+		return false, 0, false
+	}
+	repeatAt := e.lastSent + time.Duration(e.idleRate)*HID_IDLE_RATE_UNIT
+
+	return e.clock.Now() >= repeatAt, repeatAt, true
+}
+
+// dropUnlinkedLocked removes pending URBs unlinked by host, so they don't consume reports.
+// Removed URBs are returned to be completed after unlocking.
+func (e *interruptINEndpointImpl) dropUnlinkedLocked() []interruptINURB {
+	var unlinked []interruptINURB
+	pending := e.pending[:0]
+	for _, urb := range e.pending {
+		if urb.ctx.Err() == nil {
+			pending = append(pending, urb)
+		} else {
+			e.logger.Debug("dropping unlinked interrupt IN URB", "seqNum", urb.data.SeqNum)
+			unlinked = append(unlinked, urb)
+		}
+	}
+	clear(e.pending[len(pending):])
+	e.pending = pending
+
+	return unlinked
+}
+
+// completeUnlinked completes URBs unlinked by host, so that worker pool releases them
+func completeUnlinked(urbs []interruptINURB) {
+	for _, urb := range urbs {
+		urb.completer(command.NewErrorRetSubmit(urb.data, urb.ctx.Err()))
+	}
+}
+
+// waitSignal blocks until run loop is signaled, or until deadline on clock if hasDeadline
+func (e *interruptINEndpointImpl) waitSignal(ctx context.Context, deadline time.Duration, hasDeadline bool) error {
+	if !hasDeadline {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-e.notify:
+			return nil
+		}
+	}
+
+	sleepCtx, cancel := context.WithCancel(ctx)
+	signaled := make(chan struct{})
+	go func() {
+		defer close(signaled)
+		select {
+		case <-sleepCtx.Done():
+		case <-e.notify:
+			cancel()
+		}
+	}()
+	_ = e.clock.SleepUntil(sleepCtx, deadline)
+	cancel()
+	// a signal taken by the goroutine is seen by re-checking the queue after it ends
+	<-signaled
+
+	return ctx.Err()
+}
@@ -0,0 +1,293 @@
+package usb_test
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/ntchjb/usbip-virtual-device/usb"
+	"github.com/ntchjb/usbip-virtual-device/usbip/protocol/command"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newInterruptINCmdSubmit(seqNum uint32) command.CmdSubmit {
+	return command.CmdSubmit{
+		CmdHeader: command.CmdHeader{
+			Command:        command.CMD_SUBMIT,
+			SeqNum:         seqNum,
+			Direction:      command.DIR_IN,
+			EndpointNumber: 1,
+		},
+		TransferBufferLength: 8,
+		NumberOfPackets:      0xffffffff,
+	}
+}
+
+func newTestInterruptINEndpoint(t *testing.T, config usb.InterruptINEndpointConfig) (usb.InterruptINEndpoint, chan command.RetSubmit) {
+	endpoint := usb.NewInterruptINEndpoint(config, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	t.Cleanup(func() {
+		require.NoError(t, endpoint.Close())
+	})
+
+	return endpoint, make(chan command.RetSubmit, 16)
+}
+
+func submitInterruptIN(ctx context.Context, endpoint usb.InterruptINEndpoint, seqNum uint32, rets chan command.RetSubmit) {
+	endpoint.Handle(ctx, newInterruptINCmdSubmit(seqNum), func(ret command.RetSubmit) {
+		rets <- ret
+	})
+}
+
+func receiveRetSubmit(t *testing.T, rets chan command.RetSubmit) command.RetSubmit {
+	select {
+	case ret := <-rets:
+		return ret
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "URB is not completed")
+		return command.RetSubmit{}
+	}
+}
+
+func assertNotCompleted(t *testing.T, rets chan command.RetSubmit) {
+	select {
+	case ret := <-rets:
+		assert.Failf(t, "URB is completed unexpectedly", "seqNum %d", ret.SeqNum)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestInterruptINEndpointInterval(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	clock := usb.NewFakeClock()
+	clock.Advance(3 * time.Millisecond)
+	endpoint, rets := newTestInterruptINEndpoint(t, usb.InterruptINEndpointConfig{
+		Clock:    clock,
+		Interval: 8 * time.Millisecond,
+		Depth:    4,
+	})
+
+	// URB waits for report
+	submitInterruptIN(ctx, endpoint, 1, rets)
+	assertNotCompleted(t, rets)
+
+	// Reports are sent at service intervals, one per interval
+	require.NoError(t, endpoint.Push(ctx, []byte{0x01}))
+	require.NoError(t, endpoint.Push(ctx, []byte{0x02}))
+	submitInterruptIN(ctx, endpoint, 2, rets)
+	require.NoError(t, clock.WaitForSleepers(ctx, 1))
+	assertNotCompleted(t, rets)
+	clock.Advance(5 * time.Millisecond)
+	ret := receiveRetSubmit(t, rets)
+	assert.Equal(t, uint32(1), ret.SeqNum)
+	assert.Equal(t, command.URB_STATUS_OK, ret.Status)
+	assert.Equal(t, []byte{0x01}, ret.TransferBuffer)
+
+	require.NoError(t, clock.WaitForSleepers(ctx, 1))
+	assertNotCompleted(t, rets)
+	clock.Advance(8 * time.Millisecond)
+	ret = receiveRetSubmit(t, rets)
+	assert.Equal(t, uint32(2), ret.SeqNum)
+	assert.Equal(t, []byte{0x02}, ret.TransferBuffer)
+	assert.Equal(t, 16*time.Millisecond, clock.Now())
+}
+
+func TestInterruptINEndpointIdleRate(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	clock := usb.NewFakeClock()
+	endpoint, rets := newTestInterruptINEndpoint(t, usb.InterruptINEndpointConfig{
+		Clock: clock,
+	})
+
+	// Nothing is repeated before the first report
+	endpoint.SetIdleRate(2)
+	assert.Equal(t, uint8(2), endpoint.GetIdleRate())
+	submitInterruptIN(ctx, endpoint, 1, rets)
+	assertNotCompleted(t, rets)
+
+	require.NoError(t, endpoint.Push(ctx, []byte{0x01, 0x02}))
+	assert.Equal(t, []byte{0x01, 0x02}, receiveRetSubmit(t, rets).TransferBuffer)
+
+	// The last report is repeated after idle duration
+	submitInterruptIN(ctx, endpoint, 2, rets)
+	require.NoError(t, clock.WaitForSleepers(ctx, 1))
+	clock.Advance(7 * time.Millisecond)
+	assertNotCompleted(t, rets)
+	clock.Advance(time.Millisecond)
+	ret := receiveRetSubmit(t, rets)
+	assert.Equal(t, uint32(2), ret.SeqNum)
+	assert.Equal(t, []byte{0x01, 0x02}, ret.TransferBuffer)
+
+	// Zero idle rate disables repeating
+	submitInterruptIN(ctx, endpoint, 3, rets)
+	require.NoError(t, clock.WaitForSleepers(ctx, 1))
+	endpoint.SetIdleRate(0)
+	require.Eventually(t, func() bool {
+		return clock.Sleepers() == 0
+	}, time.Second, time.Millisecond)
+	clock.Advance(time.Second)
+	assertNotCompleted(t, rets)
+	require.NoError(t, endpoint.Push(ctx, []byte{0x03}))
+	assert.Equal(t, []byte{0x03}, receiveRetSubmit(t, rets).TransferBuffer)
+}
+
+func TestInterruptINEndpointOverflowPolicy(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   usb.OverflowPolicy
+		err      error
+		expected [][]byte
+	}{
+		{
+			name:     "Drop oldest",
+			policy:   usb.OVERFLOW_POLICY_DROP_OLDEST,
+			expected: [][]byte{{0x02}, {0x03}},
+		},
+		{
+			name:     "Drop newest",
+			policy:   usb.OVERFLOW_POLICY_DROP_NEWEST,
+			err:      usb.ErrReportDropped,
+			expected: [][]byte{{0x01}, {0x02}},
+		},
+		{
+			name:     "Block",
+			policy:   usb.OVERFLOW_POLICY_BLOCK,
+			err:      context.DeadlineExceeded,
+			expected: [][]byte{{0x01}, {0x02}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			endpoint, rets := newTestInterruptINEndpoint(t, usb.InterruptINEndpointConfig{
+				Clock:          usb.NewFakeClock(),
+				Depth:          2,
+				OverflowPolicy: test.policy,
+			})
+
+			require.NoError(t, endpoint.Push(ctx, []byte{0x01}))
+			require.NoError(t, endpoint.Push(ctx, []byte{0x02}))
+			pushCtx, pushCancel := context.WithTimeout(ctx, 20*time.Millisecond)
+			defer pushCancel()
+			assert.ErrorIs(t, endpoint.Push(pushCtx, []byte{0x03}), test.err)
+
+			for i, expected := range test.expected {
+				submitInterruptIN(ctx, endpoint, uint32(i), rets)
+				assert.Equal(t, expected, receiveRetSubmit(t, rets).TransferBuffer)
+			}
+		})
+	}
+}
+
+func TestInterruptINEndpointBlockedPush(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	endpoint, rets := newTestInterruptINEndpoint(t, usb.InterruptINEndpointConfig{
+		Clock:          usb.NewFakeClock(),
+		OverflowPolicy: usb.OVERFLOW_POLICY_BLOCK,
+	})
+
+	require.NoError(t, endpoint.Push(ctx, []byte{0x01}))
+	pushed := make(chan error, 2)
+	go func() {
+		pushed <- endpoint.Push(ctx, []byte{0x02})
+	}()
+	select {
+	case <-pushed:
+		t.Fatal("push is not blocked by full queue")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	submitInterruptIN(ctx, endpoint, 1, rets)
+	assert.Equal(t, []byte{0x01}, receiveRetSubmit(t, rets).TransferBuffer)
+	assert.NoError(t, <-pushed)
+
+	// Close unblocks pushes
+	go func() {
+		pushed <- endpoint.Push(ctx, []byte{0x03})
+	}()
+	require.NoError(t, endpoint.Close())
+	assert.ErrorIs(t, <-pushed, usb.ErrEndpointClosed)
+	assert.ErrorIs(t, endpoint.Push(ctx, []byte{0x04}), usb.ErrEndpointClosed)
+
+	submitInterruptIN(ctx, endpoint, 2, rets)
+	assert.Equal(t, command.URB_STATUS_SHUTDOWN, receiveRetSubmit(t, rets).Status)
+}
+
+func TestInterruptINEndpointUnlinkedURB(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	endpoint, rets := newTestInterruptINEndpoint(t, usb.InterruptINEndpointConfig{
+		Clock: usb.NewFakeClock(),
+		Depth: 2,
+	})
+
+	urbCtx, urbCancel := context.WithCancel(ctx)
+	submitInterruptIN(urbCtx, endpoint, 1, rets)
+	urbCancel()
+	submitInterruptIN(ctx, endpoint, 2, rets)
+
+	// Unlinked URB is completed without report, so that worker pool releases it
+	require.NoError(t, endpoint.Push(ctx, []byte{0x01}))
+	ret := receiveRetSubmit(t, rets)
+	assert.Equal(t, uint32(1), ret.SeqNum)
+	assert.Equal(t, command.URB_STATUS_UNLINKED, ret.Status)
+	assert.Empty(t, ret.TransferBuffer)
+	ret = receiveRetSubmit(t, rets)
+	assert.Equal(t, uint32(2), ret.SeqNum)
+	assert.Equal(t, []byte{0x01}, ret.TransferBuffer)
+	assertNotCompleted(t, rets)
+}
+
+func TestInterruptINEndpointUnlinkedURBWakesLoop(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	clock := usb.NewFakeClock()
+	endpoint, rets := newTestInterruptINEndpoint(t, usb.InterruptINEndpointConfig{
+		Clock: clock,
+	})
+	endpoint.SetIdleRate(1)
+	require.NoError(t, endpoint.Push(ctx, []byte{0x01}))
+	submitInterruptIN(ctx, endpoint, 1, rets)
+	assert.Equal(t, []byte{0x01}, receiveRetSubmit(t, rets).TransferBuffer)
+
+	// Pending URB waits for the last report to be repeated, until it's unlinked
+	urbCtx, urbCancel := context.WithCancel(ctx)
+	submitInterruptIN(urbCtx, endpoint, 2, rets)
+	require.NoError(t, clock.WaitForSleepers(ctx, 1))
+	urbCancel()
+	assert.Equal(t, command.URB_STATUS_UNLINKED, receiveRetSubmit(t, rets).Status)
+	require.Eventually(t, func() bool {
+		return clock.Sleepers() == 0
+	}, time.Second, time.Millisecond)
+	clock.Advance(time.Second)
+	assertNotCompleted(t, rets)
+}
+
+func TestInterruptINEndpointClosePendingURB(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	endpoint, rets := newTestInterruptINEndpoint(t, usb.InterruptINEndpointConfig{
+		Clock: usb.NewFakeClock(),
+	})
+
+	submitInterruptIN(ctx, endpoint, 1, rets)
+	submitInterruptIN(ctx, endpoint, 2, rets)
+	assertNotCompleted(t, rets)
+
+	require.NoError(t, endpoint.Close())
+	for _, seqNum := range []uint32{1, 2} {
+		ret := receiveRetSubmit(t, rets)
+		assert.Equal(t, seqNum, ret.SeqNum)
+		assert.Equal(t, command.URB_STATUS_SHUTDOWN, ret.Status)
+	}
+	assertNotCompleted(t, rets)
+}
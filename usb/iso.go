@@ -0,0 +1,125 @@
+package usb
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ntchjb/usbip-virtual-device/usbip/protocol/command"
+)
+
+// ISOHandler processes packets of an ISO URB starting at startFrame, and returns result of each packet.
+// For OUT endpoint, packets are data of each packet sent by host. For IN endpoint, packets are nil,
+// and Data of results are placed back-to-back in the reply.
+type ISOHandler func(ctx context.Context, startFrame uint32, packets [][]byte) []command.ISOPacketResult
+
+// ISOStream assigns start frames to ISO URBs of an endpoint as host controller does, by a virtual frame counter
+// advanced by packets of scheduled URBs, so that device can tell which frames its packets belong to.
+// Frame numbers are in frames (1 ms) for low-speed and full-speed devices, and in microframes (125 µs) otherwise.
+//
+// ISOStream created by NewClockedISOStream follows frame number of a Clock instead,
+// and its URBs complete only after their frames have passed.
+type ISOStream struct {
+	clock         Clock
+	frameDuration time.Duration
+
+	lock      sync.Mutex
+	interval  uint32
+	nextFrame uint32
+}
+
+// NewISOStream creates ISOStream of an ISO endpoint with given bInterval, where packets are 2^(bInterval-1) frames apart
+func NewISOStream(bInterval uint8) *ISOStream {
+	bInterval = min(max(bInterval, 1), 16)
+
+	return &ISOStream{
+		interval: 1 << (bInterval - 1),
+	}
+}
+
+// NewClockedISOStream creates ISOStream of an ISO endpoint of device speed with given bInterval, following frame number of clock.
+// A URB with URB_ISO_ASAP starts at the current frame if the previous URB of the stream has ended before it.
+func NewClockedISOStream(clock Clock, speed uint32, bInterval uint8) *ISOStream {
+	stream := NewISOStream(bInterval)
+	stream.clock = clock
+	stream.frameDuration = FrameDuration(speed)
+	stream.nextFrame = FrameNumber(clock, speed)
+
+	return stream
+}
+
+// Schedule returns start frame of given ISO URB, and advances virtual frame counter past its packets.
+// URB with URB_ISO_ASAP starts right after the previous URB of the stream, otherwise it starts at its StartFrame.
+func (s *ISOStream) Schedule(cmd command.CmdSubmit) uint32 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	startFrame := s.nextFrame
+	if s.clock != nil {
+		if currentFrame := uint32(s.clock.Now() / s.frameDuration); int32(startFrame-currentFrame) < 0 {
+			startFrame = currentFrame
+		}
+	}
+	if !cmd.TransferFlags.ISOASAP() {
+		startFrame = cmd.StartFrame
+	}
+	s.nextFrame = s.EndFrame(cmd, startFrame)
+
+	return startFrame
+}
+
+// NextFrame returns start frame of the next URB with URB_ISO_ASAP
+func (s *ISOStream) NextFrame() uint32 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.nextFrame
+}
+
+// EndFrame returns frame right after the last packet of ISO URB starting at startFrame
+func (s *ISOStream) EndFrame(cmd command.CmdSubmit, startFrame uint32) uint32 {
+	return startFrame + uint32(len(cmd.ISOPacketDescriptors))*s.interval
+}
+
+// WaitFrame blocks until given frame starts on clock of the stream, or until ctx is done.
+// It returns immediately if the stream has no clock.
+func (s *ISOStream) WaitFrame(ctx context.Context, frame uint32) error {
+	if s.clock == nil {
+		return nil
+	}
+	now := s.clock.Now()
+	delta := int32(frame - uint32(now/s.frameDuration))
+	if delta <= 0 {
+		return nil
+	}
+
+	return s.clock.SleepUntil(ctx, now-now%s.frameDuration+time.Duration(delta)*s.frameDuration)
+}
+
+// Reset restarts virtual frame counter at given frame, such as when host selects another alternate setting
+func (s *ISOStream) Reset(frame uint32) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.nextFrame = frame
+}
+
+// NewISOEndpointHandler returns EndpointHandler processing ISO URBs by given handler, which can be registered by
+// StandardDevice.HandleEndpoint. URBs are scheduled on given stream, and their packets are split by CmdSubmit.ISOPackets.
+// If the stream has a clock, URBs are replied after their last frame has passed.
+// Non-ISO URBs and URBs with malformed packets are replied with URB_STATUS_PROTOCOL_ERROR.
+func NewISOEndpointHandler(stream *ISOStream, handler ISOHandler) EndpointHandler {
+	return func(ctx context.Context, data command.CmdSubmit) command.RetSubmit {
+		packets, err := data.ISOPackets()
+		if err != nil {
+			return command.NewRetSubmit(data, command.URB_STATUS_PROTOCOL_ERROR, nil)
+		}
+		startFrame := stream.Schedule(data)
+		results := handler(ctx, startFrame, packets)
+		if err := stream.WaitFrame(ctx, stream.EndFrame(data, startFrame)); err != nil {
+			return command.NewErrorRetSubmit(data, err)
+		}
+
+		return command.NewISORetSubmit(data, startFrame, results)
+	}
+}
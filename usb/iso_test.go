@@ -0,0 +1,133 @@
+package usb_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ntchjb/usbip-virtual-device/usb"
+	"github.com/ntchjb/usbip-virtual-device/usb/protocol"
+	"github.com/ntchjb/usbip-virtual-device/usbip/protocol/command"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newISOCmdSubmit(direction command.Direction, flags command.TransferFlags, startFrame uint32, data []byte) command.CmdSubmit {
+	return command.CmdSubmit{
+		CmdHeader: command.CmdHeader{
+			Command:        command.CMD_SUBMIT,
+			SeqNum:         1,
+			Direction:      direction,
+			EndpointNumber: 1,
+		},
+		TransferFlags:        flags,
+		TransferBufferLength: 8,
+		StartFrame:           startFrame,
+		NumberOfPackets:      2,
+		TransferBuffer:       data,
+		ISOPacketDescriptors: []command.ISOPacketDescriptor{
+			{Offset: 0, ExpectedLength: 4},
+			{Offset: 4, ExpectedLength: 4},
+		},
+	}
+}
+
+func TestISOStream(t *testing.T) {
+	stream := usb.NewISOStream(4)
+
+	assert.Equal(t, uint32(0), stream.Schedule(newISOCmdSubmit(command.DIR_IN, command.URB_ISO_ASAP, 999, nil)))
+	assert.Equal(t, uint32(16), stream.NextFrame())
+	assert.Equal(t, uint32(16), stream.Schedule(newISOCmdSubmit(command.DIR_IN, command.URB_ISO_ASAP, 0, nil)))
+	assert.Equal(t, uint32(100), stream.Schedule(newISOCmdSubmit(command.DIR_IN, 0, 100, nil)))
+	assert.Equal(t, uint32(116), stream.Schedule(newISOCmdSubmit(command.DIR_IN, command.URB_ISO_ASAP, 0, nil)))
+
+	stream.Reset(1000)
+	assert.Equal(t, uint32(1000), stream.Schedule(newISOCmdSubmit(command.DIR_IN, command.URB_ISO_ASAP, 0, nil)))
+
+	// bInterval is limited from 1 to 16
+	stream = usb.NewISOStream(0)
+	stream.Schedule(newISOCmdSubmit(command.DIR_IN, command.URB_ISO_ASAP, 0, nil))
+	assert.Equal(t, uint32(2), stream.NextFrame())
+}
+
+func TestISOEndpointHandler(t *testing.T) {
+	stream := usb.NewISOStream(1)
+	var received [][]byte
+	outHandler := usb.NewISOEndpointHandler(stream, func(ctx context.Context, startFrame uint32, packets [][]byte) []command.ISOPacketResult {
+		received = packets
+		return []command.ISOPacketResult{{}, {ActualLength: 2}}
+	})
+
+	ret := outHandler(context.Background(), newISOCmdSubmit(command.DIR_OUT, command.URB_ISO_ASAP, 0, []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}))
+	assert.Equal(t, [][]byte{{0x01, 0x02, 0x03, 0x04}, {0x05, 0x06, 0x07, 0x08}}, received)
+	assert.Equal(t, command.URB_STATUS_OK, ret.Status)
+	assert.Equal(t, uint32(6), ret.ActualLength)
+	assert.Equal(t, uint32(0), ret.StartFrame)
+
+	var frames []uint32
+	inHandler := usb.NewISOEndpointHandler(stream, func(ctx context.Context, startFrame uint32, packets [][]byte) []command.ISOPacketResult {
+		frames = append(frames, startFrame)
+		return []command.ISOPacketResult{{Data: []byte{0x01}}, {Data: []byte{0x02, 0x03}}}
+	})
+	ret = inHandler(context.Background(), newISOCmdSubmit(command.DIR_IN, command.URB_ISO_ASAP, 0, nil))
+	assert.Equal(t, uint32(2), ret.StartFrame)
+	assert.Equal(t, []byte{0x01, 0x02, 0x03}, ret.TransferBuffer)
+	assert.Equal(t, []command.ISOPacketDescriptor{
+		{Offset: 0, ExpectedLength: 4, ActualLength: 1},
+		{Offset: 4, ExpectedLength: 4, ActualLength: 2},
+	}, ret.ISOPacketDescriptors)
+
+	ret = inHandler(context.Background(), command.CmdSubmit{NumberOfPackets: 0xffffffff})
+	assert.Equal(t, command.URB_STATUS_PROTOCOL_ERROR, ret.Status)
+	assert.Equal(t, []uint32{2}, frames)
+}
+
+func TestClockedISOStream(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	clock := usb.NewFakeClock()
+	clock.Advance(10 * time.Millisecond)
+	stream := usb.NewClockedISOStream(clock, protocol.SPEED_USB2_HIGH, 2)
+
+	// Stream starts at the current microframe, and continues from the previous URB while it's ahead of the clock
+	assert.Equal(t, uint32(80), stream.NextFrame())
+	assert.Equal(t, uint32(80), stream.Schedule(newISOCmdSubmit(command.DIR_IN, command.URB_ISO_ASAP, 0, nil)))
+	assert.Equal(t, uint32(84), stream.Schedule(newISOCmdSubmit(command.DIR_IN, command.URB_ISO_ASAP, 0, nil)))
+	clock.Advance(time.Millisecond)
+	assert.Equal(t, uint32(88), stream.Schedule(newISOCmdSubmit(command.DIR_IN, command.URB_ISO_ASAP, 0, nil)))
+	assert.Equal(t, uint32(50), stream.Schedule(newISOCmdSubmit(command.DIR_IN, 0, 50, nil)))
+
+	// URB is replied after its last microframe has passed
+	var frames []uint32
+	handler := usb.NewISOEndpointHandler(stream, func(ctx context.Context, startFrame uint32, packets [][]byte) []command.ISOPacketResult {
+		frames = append(frames, startFrame)
+		return []command.ISOPacketResult{{Data: []byte{0x01}}, {Data: []byte{0x02}}}
+	})
+	rets := make(chan command.RetSubmit, 1)
+	go func() {
+		rets <- handler(ctx, newISOCmdSubmit(command.DIR_IN, command.URB_ISO_ASAP, 0, nil))
+	}()
+	require.NoError(t, clock.WaitForSleepers(ctx, 1))
+	clock.Advance(375 * time.Microsecond)
+	select {
+	case <-rets:
+		t.Fatal("URB is replied before its frames have passed")
+	default:
+	}
+	clock.Advance(125 * time.Microsecond)
+	ret := <-rets
+	assert.Equal(t, command.URB_STATUS_OK, ret.Status)
+	assert.Equal(t, uint32(88), ret.StartFrame)
+	assert.Equal(t, []uint32{88}, frames)
+	assert.Equal(t, uint32(92), usb.FrameNumber(clock, protocol.SPEED_USB2_HIGH))
+
+	// Unlinked URB stops waiting for its frames
+	handlerCtx, handlerCancel := context.WithCancel(ctx)
+	go func() {
+		rets <- handler(handlerCtx, newISOCmdSubmit(command.DIR_IN, command.URB_ISO_ASAP, 0, nil))
+	}()
+	require.NoError(t, clock.WaitForSleepers(ctx, 1))
+	handlerCancel()
+	ret = <-rets
+	assert.NotEqual(t, command.URB_STATUS_OK, ret.Status)
+}
@@ -10,6 +10,7 @@
 package usb
 
 import (
+	context "context"
 	reflect "reflect"
 
 	protocol "github.com/ntchjb/usbip-virtual-device/usb/protocol"
@@ -98,17 +99,17 @@ func (mr *MockDeviceMockRecorder) GetWorkerPoolProfile() *gomock.Call {
 }
 
 // Process mocks base method.
-func (m *MockDevice) Process(data command.CmdSubmit) command.RetSubmit {
+func (m *MockDevice) Process(ctx context.Context, data command.CmdSubmit) command.RetSubmit {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "Process", data)
+	ret := m.ctrl.Call(m, "Process", ctx, data)
 	ret0, _ := ret[0].(command.RetSubmit)
 	return ret0
 }
 
 // Process indicates an expected call of Process.
-func (mr *MockDeviceMockRecorder) Process(data any) *gomock.Call {
+func (mr *MockDeviceMockRecorder) Process(ctx, data any) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Process", reflect.TypeOf((*MockDevice)(nil).Process), data)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Process", reflect.TypeOf((*MockDevice)(nil).Process), ctx, data)
 }
 
 // SetBusID mocks base method.
@@ -122,3 +123,120 @@ func (mr *MockDeviceMockRecorder) SetBusID(busNum, devNum any) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetBusID", reflect.TypeOf((*MockDevice)(nil).SetBusID), busNum, devNum)
 }
+
+// MockAsyncDevice is a mock of AsyncDevice interface.
+type MockAsyncDevice struct {
+	ctrl     *gomock.Controller
+	recorder *MockAsyncDeviceMockRecorder
+}
+
+// MockAsyncDeviceMockRecorder is the mock recorder for MockAsyncDevice.
+type MockAsyncDeviceMockRecorder struct {
+	mock *MockAsyncDevice
+}
+
+// NewMockAsyncDevice creates a new mock instance.
+func NewMockAsyncDevice(ctrl *gomock.Controller) *MockAsyncDevice {
+	mock := &MockAsyncDevice{ctrl: ctrl}
+	mock.recorder = &MockAsyncDeviceMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockAsyncDevice) EXPECT() *MockAsyncDeviceMockRecorder {
+	return m.recorder
+}
+
+// Close mocks base method.
+func (m *MockAsyncDevice) Close() error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Close")
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Close indicates an expected call of Close.
+func (mr *MockAsyncDeviceMockRecorder) Close() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Close", reflect.TypeOf((*MockAsyncDevice)(nil).Close))
+}
+
+// GetBusID mocks base method.
+func (m *MockAsyncDevice) GetBusID() protocol.BusID {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetBusID")
+	ret0, _ := ret[0].(protocol.BusID)
+	return ret0
+}
+
+// GetBusID indicates an expected call of GetBusID.
+func (mr *MockAsyncDeviceMockRecorder) GetBusID() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetBusID", reflect.TypeOf((*MockAsyncDevice)(nil).GetBusID))
+}
+
+// GetDeviceInfo mocks base method.
+func (m *MockAsyncDevice) GetDeviceInfo() op.DeviceInfo {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetDeviceInfo")
+	ret0, _ := ret[0].(op.DeviceInfo)
+	return ret0
+}
+
+// GetDeviceInfo indicates an expected call of GetDeviceInfo.
+func (mr *MockAsyncDeviceMockRecorder) GetDeviceInfo() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetDeviceInfo", reflect.TypeOf((*MockAsyncDevice)(nil).GetDeviceInfo))
+}
+
+// GetWorkerPoolProfile mocks base method.
+func (m *MockAsyncDevice) GetWorkerPoolProfile() WorkerPoolProfile {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetWorkerPoolProfile")
+	ret0, _ := ret[0].(WorkerPoolProfile)
+	return ret0
+}
+
+// GetWorkerPoolProfile indicates an expected call of GetWorkerPoolProfile.
+func (mr *MockAsyncDeviceMockRecorder) GetWorkerPoolProfile() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetWorkerPoolProfile", reflect.TypeOf((*MockAsyncDevice)(nil).GetWorkerPoolProfile))
+}
+
+// Process mocks base method.
+func (m *MockAsyncDevice) Process(ctx context.Context, data command.CmdSubmit) command.RetSubmit {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Process", ctx, data)
+	ret0, _ := ret[0].(command.RetSubmit)
+	return ret0
+}
+
+// Process indicates an expected call of Process.
+func (mr *MockAsyncDeviceMockRecorder) Process(ctx, data any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Process", reflect.TypeOf((*MockAsyncDevice)(nil).Process), ctx, data)
+}
+
+// ProcessAsync mocks base method.
+func (m *MockAsyncDevice) ProcessAsync(ctx context.Context, data command.CmdSubmit, completer URBCompleter) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "ProcessAsync", ctx, data, completer)
+}
+
+// ProcessAsync indicates an expected call of ProcessAsync.
+func (mr *MockAsyncDeviceMockRecorder) ProcessAsync(ctx, data, completer any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ProcessAsync", reflect.TypeOf((*MockAsyncDevice)(nil).ProcessAsync), ctx, data, completer)
+}
+
+// SetBusID mocks base method.
+func (m *MockAsyncDevice) SetBusID(busNum, devNum uint) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "SetBusID", busNum, devNum)
+}
+
+// SetBusID indicates an expected call of SetBusID.
+func (mr *MockAsyncDeviceMockRecorder) SetBusID(busNum, devNum any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetBusID", reflect.TypeOf((*MockAsyncDevice)(nil).SetBusID), busNum, devNum)
+}
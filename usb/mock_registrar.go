@@ -39,6 +39,20 @@ func (m *MockDeviceRegistrar) EXPECT() *MockDeviceRegistrarMockRecorder {
 	return m.recorder
 }
 
+// Clock mocks base method.
+func (m *MockDeviceRegistrar) Clock() Clock {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Clock")
+	ret0, _ := ret[0].(Clock)
+	return ret0
+}
+
+// Clock indicates an expected call of Clock.
+func (mr *MockDeviceRegistrarMockRecorder) Clock() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Clock", reflect.TypeOf((*MockDeviceRegistrar)(nil).Clock))
+}
+
 // Close mocks base method.
 func (m *MockDeviceRegistrar) Close() error {
 	m.ctrl.T.Helper()
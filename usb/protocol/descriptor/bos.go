@@ -0,0 +1,425 @@
+package descriptor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ntchjb/usbip-virtual-device/usbip/stream"
+)
+
+type DeviceCapabilityType uint8
+
+const (
+	DEVICE_CAPABILITY_TYPE_WIRELESS_USB      DeviceCapabilityType = 0x01
+	DEVICE_CAPABILITY_TYPE_USB_2_0_EXTENSION DeviceCapabilityType = 0x02
+	DEVICE_CAPABILITY_TYPE_SUPERSPEED_USB    DeviceCapabilityType = 0x03
+	DEVICE_CAPABILITY_TYPE_CONTAINER_ID      DeviceCapabilityType = 0x04
+	DEVICE_CAPABILITY_TYPE_PLATFORM          DeviceCapabilityType = 0x05
+	DEVICE_CAPABILITY_TYPE_SUPERSPEED_PLUS   DeviceCapabilityType = 0x0A
+)
+
+const (
+	USB_2_0_EXTENSION_CAPABILITY_LENGTH   = 7
+	SUPERSPEED_USB_CAPABILITY_LENGTH      = 10
+	CONTAINER_ID_CAPABILITY_LENGTH        = 20
+	SUPERSPEED_PLUS_CAPABILITY_MIN_LENGTH = 12
+	PLATFORM_CAPABILITY_MIN_LENGTH        = 20
+)
+
+// Attributes of USB 2.0 extension capability
+const (
+	// Link Power Management is supported
+	USB_2_0_EXTENSION_ATTRIBUTE_LPM uint32 = 1 << 1
+	// BESL and alternate HIRD definitions are supported
+	USB_2_0_EXTENSION_ATTRIBUTE_BESL uint32 = 1 << 2
+	// Recommended baseline BESL value is valid (D11..8)
+	USB_2_0_EXTENSION_ATTRIBUTE_BASELINE_BESL_VALID uint32 = 1 << 3
+	// Recommended deep BESL value is valid (D15..12)
+	USB_2_0_EXTENSION_ATTRIBUTE_DEEP_BESL_VALID uint32 = 1 << 4
+)
+
+// Speeds supported by SuperSpeed USB device, used in wSpeedsSupported
+const (
+	SUPERSPEED_USB_SPEED_LOW   uint16 = 1 << 0
+	SUPERSPEED_USB_SPEED_FULL  uint16 = 1 << 1
+	SUPERSPEED_USB_SPEED_HIGH  uint16 = 1 << 2
+	SUPERSPEED_USB_SPEED_SUPER uint16 = 1 << 3
+)
+
+// DeviceCapability is a device capability descriptor, placed in BOS descriptor
+type DeviceCapability interface {
+	Encode(writer io.Writer) error
+}
+
+// BOSDescriptor is the header of Binary device Object Store, followed by device capability descriptors
+type BOSDescriptor struct {
+	// Size of this descriptor in bytes.
+	BLength uint8
+	// BOS descriptor type (assigned by USB).
+	BDescriptorType DescriptorType
+	// Length of this descriptor and all of its device capability descriptors.
+	WTotalLength uint16
+	// Number of device capability descriptors in the BOS.
+	BNumDeviceCaps uint8
+}
+
+func (s *BOSDescriptor) Decode(reader io.Reader) error {
+	buf, err := stream.Read(reader, BOS_DESCRIPTOR_LENGTH)
+	if err != nil {
+		return fmt.Errorf("unable to read BOS descriptor from stream: %w", err)
+	}
+
+	s.BLength = buf[0]
+	s.BDescriptorType = DescriptorType(buf[1])
+	s.WTotalLength = binary.LittleEndian.Uint16(buf[2:4])
+	s.BNumDeviceCaps = buf[4]
+
+	return nil
+}
+
+func (s *BOSDescriptor) Encode(writer io.Writer) error {
+	buf := make([]byte, BOS_DESCRIPTOR_LENGTH)
+
+	buf[0] = s.BLength
+	buf[1] = byte(s.BDescriptorType)
+	binary.LittleEndian.PutUint16(buf[2:4], s.WTotalLength)
+	buf[4] = s.BNumDeviceCaps
+
+	if err := stream.Write(writer, buf); err != nil {
+		return fmt.Errorf("unable to write BOS descriptor to stream: %w", err)
+	}
+
+	return nil
+}
+
+// USB20ExtensionCapability indicates that device supports USB 2.0 Link Power Management
+type USB20ExtensionCapability struct {
+	BLength            uint8
+	BDescriptorType    DescriptorType
+	BDevCapabilityType DeviceCapabilityType
+	// Bitmap of supported features, such as USB_2_0_EXTENSION_ATTRIBUTE_LPM
+	BMAttributes uint32
+}
+
+func (s *USB20ExtensionCapability) Decode(reader io.Reader) error {
+	buf, err := stream.Read(reader, USB_2_0_EXTENSION_CAPABILITY_LENGTH)
+	if err != nil {
+		return fmt.Errorf("unable to read USB 2.0 extension capability from stream: %w", err)
+	}
+
+	s.BLength = buf[0]
+	s.BDescriptorType = DescriptorType(buf[1])
+	s.BDevCapabilityType = DeviceCapabilityType(buf[2])
+	s.BMAttributes = binary.LittleEndian.Uint32(buf[3:7])
+
+	return nil
+}
+
+func (s *USB20ExtensionCapability) Encode(writer io.Writer) error {
+	buf := make([]byte, USB_2_0_EXTENSION_CAPABILITY_LENGTH)
+
+	buf[0] = s.BLength
+	buf[1] = byte(s.BDescriptorType)
+	buf[2] = byte(s.BDevCapabilityType)
+	binary.LittleEndian.PutUint32(buf[3:7], s.BMAttributes)
+
+	if err := stream.Write(writer, buf); err != nil {
+		return fmt.Errorf("unable to write USB 2.0 extension capability to stream: %w", err)
+	}
+
+	return nil
+}
+
+// SuperSpeedUSBCapability describes SuperSpeed capabilities of device
+type SuperSpeedUSBCapability struct {
+	BLength            uint8
+	BDescriptorType    DescriptorType
+	BDevCapabilityType DeviceCapabilityType
+	// Bitmap of supported features (D1: Latency Tolerance Messages)
+	BMAttributes uint8
+	// Bitmap of supported speeds, such as SUPERSPEED_USB_SPEED_SUPER
+	WSpeedsSupported uint16
+	// The lowest speed at which all the functionality of the device is available
+	BFunctionalitySupport uint8
+	// U1 device exit latency, in microseconds
+	BU1DevExitLat uint8
+	// U2 device exit latency, in microseconds
+	WU2DevExitLat uint16
+}
+
+func (s *SuperSpeedUSBCapability) Decode(reader io.Reader) error {
+	buf, err := stream.Read(reader, SUPERSPEED_USB_CAPABILITY_LENGTH)
+	if err != nil {
+		return fmt.Errorf("unable to read SuperSpeed USB capability from stream: %w", err)
+	}
+
+	s.BLength = buf[0]
+	s.BDescriptorType = DescriptorType(buf[1])
+	s.BDevCapabilityType = DeviceCapabilityType(buf[2])
+	s.BMAttributes = buf[3]
+	s.WSpeedsSupported = binary.LittleEndian.Uint16(buf[4:6])
+	s.BFunctionalitySupport = buf[6]
+	s.BU1DevExitLat = buf[7]
+	s.WU2DevExitLat = binary.LittleEndian.Uint16(buf[8:10])
+
+	return nil
+}
+
+func (s *SuperSpeedUSBCapability) Encode(writer io.Writer) error {
+	buf := make([]byte, SUPERSPEED_USB_CAPABILITY_LENGTH)
+
+	buf[0] = s.BLength
+	buf[1] = byte(s.BDescriptorType)
+	buf[2] = byte(s.BDevCapabilityType)
+	buf[3] = s.BMAttributes
+	binary.LittleEndian.PutUint16(buf[4:6], s.WSpeedsSupported)
+	buf[6] = s.BFunctionalitySupport
+	buf[7] = s.BU1DevExitLat
+	binary.LittleEndian.PutUint16(buf[8:10], s.WU2DevExitLat)
+
+	if err := stream.Write(writer, buf); err != nil {
+		return fmt.Errorf("unable to write SuperSpeed USB capability to stream: %w", err)
+	}
+
+	return nil
+}
+
+// SuperSpeedPlusCapability describes SuperSpeedPlus capabilities of device, with its sublink speed attributes
+type SuperSpeedPlusCapability struct {
+	BLength            uint8
+	BDescriptorType    DescriptorType
+	BDevCapabilityType DeviceCapabilityType
+	BReserved          uint8
+	// D4..0: Sublink Speed Attribute Count (SSAC), number of sublink speed attributes minus one,
+	// D8..5: Sublink Speed ID Count (SSIC)
+	BMAttributes uint32
+	// D3..0: Sublink Speed Attribute ID of the lowest speed with full functionality,
+	// D11..8: Min Rx lane count, D15..12: Min Tx lane count
+	WFunctionalitySupport uint16
+	WReserved             uint16
+	// Sublink speed attributes, there must be SSAC + 1 of them
+	BMSublinkSpeedAttr []uint32
+}
+
+func (s *SuperSpeedPlusCapability) Decode(reader io.Reader) error {
+	buf, err := readDeviceCapability(reader, SUPERSPEED_PLUS_CAPABILITY_MIN_LENGTH)
+	if err != nil {
+		return fmt.Errorf("unable to read SuperSpeedPlus capability from stream: %w", err)
+	}
+
+	s.BLength = buf[0]
+	s.BDescriptorType = DescriptorType(buf[1])
+	s.BDevCapabilityType = DeviceCapabilityType(buf[2])
+	s.BReserved = buf[3]
+	s.BMAttributes = binary.LittleEndian.Uint32(buf[4:8])
+	s.WFunctionalitySupport = binary.LittleEndian.Uint16(buf[8:10])
+	s.WReserved = binary.LittleEndian.Uint16(buf[10:12])
+	s.BMSublinkSpeedAttr = make([]uint32, (len(buf)-SUPERSPEED_PLUS_CAPABILITY_MIN_LENGTH)/4)
+	for i := range s.BMSublinkSpeedAttr {
+		offset := SUPERSPEED_PLUS_CAPABILITY_MIN_LENGTH + i*4
+		s.BMSublinkSpeedAttr[i] = binary.LittleEndian.Uint32(buf[offset : offset+4])
+	}
+
+	return nil
+}
+
+func (s *SuperSpeedPlusCapability) Encode(writer io.Writer) error {
+	buf := make([]byte, SUPERSPEED_PLUS_CAPABILITY_MIN_LENGTH+len(s.BMSublinkSpeedAttr)*4)
+
+	buf[0] = s.BLength
+	buf[1] = byte(s.BDescriptorType)
+	buf[2] = byte(s.BDevCapabilityType)
+	buf[3] = s.BReserved
+	binary.LittleEndian.PutUint32(buf[4:8], s.BMAttributes)
+	binary.LittleEndian.PutUint16(buf[8:10], s.WFunctionalitySupport)
+	binary.LittleEndian.PutUint16(buf[10:12], s.WReserved)
+	for i, attr := range s.BMSublinkSpeedAttr {
+		offset := SUPERSPEED_PLUS_CAPABILITY_MIN_LENGTH + i*4
+		binary.LittleEndian.PutUint32(buf[offset:offset+4], attr)
+	}
+
+	if err := stream.Write(writer, buf); err != nil {
+		return fmt.Errorf("unable to write SuperSpeedPlus capability to stream: %w", err)
+	}
+
+	return nil
+}
+
+// ContainerIDCapability is a UUID identifying the device instance, same across all ports the device is connected to
+type ContainerIDCapability struct {
+	BLength            uint8
+	BDescriptorType    DescriptorType
+	BDevCapabilityType DeviceCapabilityType
+	BReserved          uint8
+	// UUID in little-endian GUID layout, see ParseUUID
+	ContainerID [16]byte
+}
+
+func (s *ContainerIDCapability) Decode(reader io.Reader) error {
+	buf, err := stream.Read(reader, CONTAINER_ID_CAPABILITY_LENGTH)
+	if err != nil {
+		return fmt.Errorf("unable to read container ID capability from stream: %w", err)
+	}
+
+	s.BLength = buf[0]
+	s.BDescriptorType = DescriptorType(buf[1])
+	s.BDevCapabilityType = DeviceCapabilityType(buf[2])
+	s.BReserved = buf[3]
+	copy(s.ContainerID[:], buf[4:20])
+
+	return nil
+}
+
+func (s *ContainerIDCapability) Encode(writer io.Writer) error {
+	buf := make([]byte, CONTAINER_ID_CAPABILITY_LENGTH)
+
+	buf[0] = s.BLength
+	buf[1] = byte(s.BDescriptorType)
+	buf[2] = byte(s.BDevCapabilityType)
+	buf[3] = s.BReserved
+	copy(buf[4:20], s.ContainerID[:])
+
+	if err := stream.Write(writer, buf); err != nil {
+		return fmt.Errorf("unable to write container ID capability to stream: %w", err)
+	}
+
+	return nil
+}
+
+// PlatformCapability is a platform or operating system specific capability, identified by UUID,
+// such as Microsoft OS 2.0 and WebUSB platform capabilities
+type PlatformCapability struct {
+	BLength            uint8
+	BDescriptorType    DescriptorType
+	BDevCapabilityType DeviceCapabilityType
+	BReserved          uint8
+	// UUID in little-endian GUID layout, see ParseUUID
+	PlatformCapabilityUUID [16]byte
+	// Platform specific data
+	CapabilityData []byte
+}
+
+func (s *PlatformCapability) Decode(reader io.Reader) error {
+	buf, err := readDeviceCapability(reader, PLATFORM_CAPABILITY_MIN_LENGTH)
+	if err != nil {
+		return fmt.Errorf("unable to read platform capability from stream: %w", err)
+	}
+
+	s.BLength = buf[0]
+	s.BDescriptorType = DescriptorType(buf[1])
+	s.BDevCapabilityType = DeviceCapabilityType(buf[2])
+	s.BReserved = buf[3]
+	copy(s.PlatformCapabilityUUID[:], buf[4:20])
+	s.CapabilityData = buf[20:]
+
+	return nil
+}
+
+func (s *PlatformCapability) Encode(writer io.Writer) error {
+	buf := make([]byte, PLATFORM_CAPABILITY_MIN_LENGTH+len(s.CapabilityData))
+
+	buf[0] = s.BLength
+	buf[1] = byte(s.BDescriptorType)
+	buf[2] = byte(s.BDevCapabilityType)
+	buf[3] = s.BReserved
+	copy(buf[4:20], s.PlatformCapabilityUUID[:])
+	copy(buf[20:], s.CapabilityData)
+
+	if err := stream.Write(writer, buf); err != nil {
+		return fmt.Errorf("unable to write platform capability to stream: %w", err)
+	}
+
+	return nil
+}
+
+// NewPlatformCapability returns platform capability of given UUID and data, with computed bLength
+func NewPlatformCapability(uuid [16]byte, data []byte) PlatformCapability {
+	return PlatformCapability{
+		BLength:                uint8(PLATFORM_CAPABILITY_MIN_LENGTH + len(data)),
+		BDescriptorType:        DESCRIPTOR_TYPE_DEVICE_CAPABILITY,
+		BDevCapabilityType:     DEVICE_CAPABILITY_TYPE_PLATFORM,
+		PlatformCapabilityUUID: uuid,
+		CapabilityData:         data,
+	}
+}
+
+// readDeviceCapability reads variable-length device capability, which has bLength at least minLength
+func readDeviceCapability(reader io.Reader, minLength int) ([]byte, error) {
+	lengthBuf, err := stream.Read(reader, 1)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read bLength: %w", err)
+	}
+	if int(lengthBuf[0]) < minLength {
+		return nil, fmt.Errorf("invalid bLength: %d", lengthBuf[0])
+	}
+	buf, err := stream.Read(reader, int(lengthBuf[0])-1)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read descriptor: %w", err)
+	}
+
+	return append(lengthBuf, buf...), nil
+}
+
+// DecodeDeviceCapabilities decodes device capability descriptors following BOS descriptor header.
+// Capabilities of unknown type are returned as RawDescriptor.
+func DecodeDeviceCapabilities(data []byte) ([]DeviceCapability, error) {
+	var capabilities []DeviceCapability
+	for len(data) > 0 {
+		if len(data) < 3 || int(data[0]) < 3 || int(data[0]) > len(data) {
+			return nil, fmt.Errorf("invalid device capability descriptor at length %d", len(data))
+		}
+		capData := data[:data[0]]
+		data = data[data[0]:]
+
+		var capability interface {
+			DeviceCapability
+			Decode(reader io.Reader) error
+		}
+		switch DeviceCapabilityType(capData[2]) {
+		case DEVICE_CAPABILITY_TYPE_USB_2_0_EXTENSION:
+			capability = &USB20ExtensionCapability{}
+		case DEVICE_CAPABILITY_TYPE_SUPERSPEED_USB:
+			capability = &SuperSpeedUSBCapability{}
+		case DEVICE_CAPABILITY_TYPE_SUPERSPEED_PLUS:
+			capability = &SuperSpeedPlusCapability{}
+		case DEVICE_CAPABILITY_TYPE_CONTAINER_ID:
+			capability = &ContainerIDCapability{}
+		case DEVICE_CAPABILITY_TYPE_PLATFORM:
+			capability = &PlatformCapability{}
+		default:
+			capabilities = append(capabilities, RawDescriptor(capData))
+			continue
+		}
+		if err := capability.Decode(bytes.NewReader(capData)); err != nil {
+			return nil, fmt.Errorf("unable to decode device capability type %d: %w", capData[2], err)
+		}
+		capabilities = append(capabilities, capability)
+	}
+
+	return capabilities, nil
+}
+
+// ParseUUID parses UUID string, such as "D8DD60DF-4589-4CC7-9CD2-659D9E648A9F",
+// into little-endian GUID layout used by container ID and platform capabilities
+func ParseUUID(s string) ([16]byte, error) {
+	var uuid [16]byte
+	raw, err := hex.DecodeString(strings.ReplaceAll(strings.Trim(s, "{}"), "-", ""))
+	if err != nil {
+		return uuid, fmt.Errorf("unable to decode UUID %q: %w", s, err)
+	}
+	if len(raw) != 16 {
+		return uuid, fmt.Errorf("invalid UUID length of %q: %d", s, len(raw))
+	}
+
+	// First 3 fields of GUID are little-endian, the rest is stored as is
+	binary.LittleEndian.PutUint32(uuid[0:4], binary.BigEndian.Uint32(raw[0:4]))
+	binary.LittleEndian.PutUint16(uuid[4:6], binary.BigEndian.Uint16(raw[4:6]))
+	binary.LittleEndian.PutUint16(uuid[6:8], binary.BigEndian.Uint16(raw[6:8]))
+	copy(uuid[8:], raw[8:])
+
+	return uuid, nil
+}
@@ -0,0 +1,200 @@
+package descriptor_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ntchjb/usbip-virtual-device/usb/protocol/descriptor"
+	usbipprot "github.com/ntchjb/usbip-virtual-device/usbip/protocol"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var msOS20PlatformUUID = [16]byte{
+	0xDF, 0x60, 0xDD, 0xD8, 0x89, 0x45, 0xC7, 0x4C,
+	0x9C, 0xD2, 0x65, 0x9D, 0x9E, 0x64, 0x8A, 0x9F,
+}
+
+func TestBOSDescriptor(t *testing.T) {
+	tests := []struct {
+		name   string
+		obj    usbipprot.Serializer
+		bin    []byte
+		newObj func() usbipprot.Serializer
+		encErr error
+		decErr error
+	}{
+		{
+			name: "BOSDescriptor",
+			obj: &descriptor.BOSDescriptor{
+				BLength:         descriptor.BOS_DESCRIPTOR_LENGTH,
+				BDescriptorType: descriptor.DESCRIPTOR_TYPE_BOS,
+				WTotalLength:    0x000C,
+				BNumDeviceCaps:  1,
+			},
+			bin: []byte{0x05, 0x0F, 0x0C, 0x00, 0x01},
+			newObj: func() usbipprot.Serializer {
+				return &descriptor.BOSDescriptor{}
+			},
+		},
+		{
+			name: "USB20ExtensionCapability",
+			obj: &descriptor.USB20ExtensionCapability{
+				BLength:            descriptor.USB_2_0_EXTENSION_CAPABILITY_LENGTH,
+				BDescriptorType:    descriptor.DESCRIPTOR_TYPE_DEVICE_CAPABILITY,
+				BDevCapabilityType: descriptor.DEVICE_CAPABILITY_TYPE_USB_2_0_EXTENSION,
+				BMAttributes:       descriptor.USB_2_0_EXTENSION_ATTRIBUTE_LPM | descriptor.USB_2_0_EXTENSION_ATTRIBUTE_BESL,
+			},
+			bin: []byte{0x07, 0x10, 0x02, 0x06, 0x00, 0x00, 0x00},
+			newObj: func() usbipprot.Serializer {
+				return &descriptor.USB20ExtensionCapability{}
+			},
+		},
+		{
+			name: "SuperSpeedUSBCapability",
+			obj: &descriptor.SuperSpeedUSBCapability{
+				BLength:               descriptor.SUPERSPEED_USB_CAPABILITY_LENGTH,
+				BDescriptorType:       descriptor.DESCRIPTOR_TYPE_DEVICE_CAPABILITY,
+				BDevCapabilityType:    descriptor.DEVICE_CAPABILITY_TYPE_SUPERSPEED_USB,
+				WSpeedsSupported:      descriptor.SUPERSPEED_USB_SPEED_FULL | descriptor.SUPERSPEED_USB_SPEED_HIGH | descriptor.SUPERSPEED_USB_SPEED_SUPER,
+				BFunctionalitySupport: 1,
+				BU1DevExitLat:         0x0A,
+				WU2DevExitLat:         0x07FF,
+			},
+			bin: []byte{0x0A, 0x10, 0x03, 0x00, 0x0E, 0x00, 0x01, 0x0A, 0xFF, 0x07},
+			newObj: func() usbipprot.Serializer {
+				return &descriptor.SuperSpeedUSBCapability{}
+			},
+		},
+		{
+			name: "SuperSpeedPlusCapability",
+			obj: &descriptor.SuperSpeedPlusCapability{
+				BLength:               20,
+				BDescriptorType:       descriptor.DESCRIPTOR_TYPE_DEVICE_CAPABILITY,
+				BDevCapabilityType:    descriptor.DEVICE_CAPABILITY_TYPE_SUPERSPEED_PLUS,
+				BMAttributes:          0x00000001,
+				WFunctionalitySupport: 0x1100,
+				BMSublinkSpeedAttr:    []uint32{0x000A4030, 0x000A40B0},
+			},
+			bin: []byte{
+				0x14, 0x10, 0x0A, 0x00,
+				0x01, 0x00, 0x00, 0x00,
+				0x00, 0x11, 0x00, 0x00,
+				0x30, 0x40, 0x0A, 0x00,
+				0xB0, 0x40, 0x0A, 0x00,
+			},
+			newObj: func() usbipprot.Serializer {
+				return &descriptor.SuperSpeedPlusCapability{}
+			},
+		},
+		{
+			name: "ContainerIDCapability",
+			obj: &descriptor.ContainerIDCapability{
+				BLength:            descriptor.CONTAINER_ID_CAPABILITY_LENGTH,
+				BDescriptorType:    descriptor.DESCRIPTOR_TYPE_DEVICE_CAPABILITY,
+				BDevCapabilityType: descriptor.DEVICE_CAPABILITY_TYPE_CONTAINER_ID,
+				ContainerID:        [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
+			},
+			bin: []byte{
+				0x14, 0x10, 0x04, 0x00,
+				1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16,
+			},
+			newObj: func() usbipprot.Serializer {
+				return &descriptor.ContainerIDCapability{}
+			},
+		},
+		{
+			name: "PlatformCapability",
+			obj: func() usbipprot.Serializer {
+				capability := descriptor.NewPlatformCapability(msOS20PlatformUUID, []byte{0x00, 0x00, 0x03, 0x06, 0xB2, 0x00, 0x01, 0x00})
+				return &capability
+			}(),
+			bin: []byte{
+				0x1C, 0x10, 0x05, 0x00,
+				0xDF, 0x60, 0xDD, 0xD8, 0x89, 0x45, 0xC7, 0x4C, 0x9C, 0xD2, 0x65, 0x9D, 0x9E, 0x64, 0x8A, 0x9F,
+				0x00, 0x00, 0x03, 0x06, 0xB2, 0x00, 0x01, 0x00,
+			},
+			newObj: func() usbipprot.Serializer {
+				return &descriptor.PlatformCapability{}
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			writer := new(bytes.Buffer)
+			err := test.obj.Encode(writer)
+
+			assert.ErrorIs(t, err, test.encErr)
+			assert.Equal(t, test.bin, writer.Bytes())
+
+			newObj := test.newObj()
+			err = newObj.Decode(writer)
+
+			assert.ErrorIs(t, err, test.decErr)
+			assert.Equal(t, test.obj, newObj)
+		})
+	}
+}
+
+func TestDecodeDeviceCapabilities(t *testing.T) {
+	capabilities, err := descriptor.DecodeDeviceCapabilities([]byte{
+		0x07, 0x10, 0x02, 0x02, 0x00, 0x00, 0x00,
+		0x04, 0x10, 0x7F, 0xAA,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []descriptor.DeviceCapability{
+		&descriptor.USB20ExtensionCapability{
+			BLength:            descriptor.USB_2_0_EXTENSION_CAPABILITY_LENGTH,
+			BDescriptorType:    descriptor.DESCRIPTOR_TYPE_DEVICE_CAPABILITY,
+			BDevCapabilityType: descriptor.DEVICE_CAPABILITY_TYPE_USB_2_0_EXTENSION,
+			BMAttributes:       descriptor.USB_2_0_EXTENSION_ATTRIBUTE_LPM,
+		},
+		descriptor.RawDescriptor{0x04, 0x10, 0x7F, 0xAA},
+	}, capabilities)
+
+	_, err = descriptor.DecodeDeviceCapabilities([]byte{0x07, 0x10, 0x02})
+	assert.Error(t, err)
+}
+
+func TestParseUUID(t *testing.T) {
+	uuid, err := descriptor.ParseUUID("{D8DD60DF-4589-4CC7-9CD2-659D9E648A9F}")
+	assert.NoError(t, err)
+	assert.Equal(t, msOS20PlatformUUID, uuid)
+
+	_, err = descriptor.ParseUUID("D8DD60DF-4589")
+	assert.Error(t, err)
+}
+
+func TestDeviceBuildBOS(t *testing.T) {
+	tree := newMouseDeviceTree()
+	set, err := tree.Build()
+	require.NoError(t, err)
+	_, err = set.GetDescriptor(descriptor.DESCRIPTOR_TYPE_BOS, 0, 0)
+	assert.ErrorIs(t, err, descriptor.ErrDescriptorNotFound)
+
+	tree.BCDUSB = 0x0210
+	tree.Capabilities = []descriptor.DeviceCapability{
+		&descriptor.USB20ExtensionCapability{
+			BLength:            descriptor.USB_2_0_EXTENSION_CAPABILITY_LENGTH,
+			BDescriptorType:    descriptor.DESCRIPTOR_TYPE_DEVICE_CAPABILITY,
+			BDevCapabilityType: descriptor.DEVICE_CAPABILITY_TYPE_USB_2_0_EXTENSION,
+			BMAttributes:       descriptor.USB_2_0_EXTENSION_ATTRIBUTE_LPM,
+		},
+		&descriptor.ContainerIDCapability{
+			BLength:            descriptor.CONTAINER_ID_CAPABILITY_LENGTH,
+			BDescriptorType:    descriptor.DESCRIPTOR_TYPE_DEVICE_CAPABILITY,
+			BDevCapabilityType: descriptor.DEVICE_CAPABILITY_TYPE_CONTAINER_ID,
+		},
+	}
+	set, err = tree.Build()
+	require.NoError(t, err)
+
+	bos, err := set.GetDescriptor(descriptor.DESCRIPTOR_TYPE_BOS, 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{
+		0x05, 0x0F, 0x20, 0x00, 0x02, // BOS
+		0x07, 0x10, 0x02, 0x02, 0x00, 0x00, 0x00, // USB 2.0 extension
+		0x14, 0x10, 0x04, 0x00, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, // Container ID
+	}, bos)
+}
@@ -0,0 +1,1001 @@
+package descriptor
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"unicode/utf16"
+
+	usbprotocol "github.com/ntchjb/usbip-virtual-device/usb/protocol"
+	"github.com/ntchjb/usbip-virtual-device/usbip/protocol/op"
+)
+
+var (
+	ErrInvalidDescriptorTree = errors.New("invalid descriptor tree")
+	ErrDescriptorNotFound    = errors.New("descriptor not found")
+)
+
+const (
+	// Maximum number of characters of string descriptor, as bLength is 1 byte
+	MAX_STRING_DESCRIPTOR_LENGTH = (255 - 2) / 2
+	// Index 0 is reserved for list of LangIDs
+	MAX_STRING_DESCRIPTOR_COUNT = 255
+)
+
+// ClassSpecificDescriptor is a descriptor placed in configuration descriptor
+// after the standard descriptor it belongs to, such as HID descriptor
+type ClassSpecificDescriptor interface {
+	Encode(writer io.Writer) error
+}
+
+// RawDescriptor is a class-specific descriptor that is already serialized, including bLength and bDescriptorType
+type RawDescriptor []byte
+
+func (r RawDescriptor) Encode(writer io.Writer) error {
+	if _, err := writer.Write(r); err != nil {
+		return fmt.Errorf("unable to write raw descriptor to stream: %w", err)
+	}
+
+	return nil
+}
+
+// Device is the root of descriptor tree, which is built into DescriptorSet by Build.
+// Lengths, counts, interface numbers and string indexes are computed by Build,
+// so they are not part of the tree.
+type Device struct {
+	// USB/IP speed of the device, reported in device list
+	Speed uint32
+	// USB Specification Release, in BCD
+	BCDUSB          uint16
+	BDeviceClass    uint8
+	BDeviceSubClass uint8
+	BDeviceProtocol uint8
+	// Maximum packet size for endpoint zero (only 8, 16, 32, or 64 are valid).
+	// For SuperSpeed device, it is exponent of 2 and must be 9 (512 bytes).
+	BMaxPacketSize uint8
+	IDVendor       uint16
+	IDProduct      uint16
+	BCDDevice      uint16
+	// Strings are allocated to string descriptor indexes, empty string has no string descriptor
+	Manufacturer string
+	Product      string
+	SerialNumber string
+	// Supported languages of string descriptors, defaults to English (United States)
+	LangIDs []LangID
+	// Configurations of the device, the first one is reported in device list
+	Configurations []Configuration
+	// Device capabilities published in BOS descriptor, there is no BOS descriptor if empty.
+	// Host queries BOS descriptor if bcdUSB is 0x0201 or higher.
+	Capabilities []DeviceCapability
+}
+
+type Configuration struct {
+	// Value to use as an argument to Set Configuration, defaults to position of the configuration, starting from 1
+	BConfigurationValue uint8
+	// Configuration characteristics
+	// (D7: Reserved (set to 1), D6: Self Powered, D5: Remote Wakeup, D4..0: Reserved (reset to 0))
+	BMAttributes uint8
+	// Maximum power consumption, expressed in 2 mA units
+	BMaxPower uint8
+	Name      string
+	// Class-specific descriptors placed after configuration descriptor
+	ClassSpecific []ClassSpecificDescriptor
+	// Interfaces are numbered by their position, starting from 0
+	Interfaces []Interface
+	// Functions of composite device. Their interfaces are numbered after Interfaces,
+	// in order of functions, and preceded by interface association descriptor
+	// if the function has more than one interface.
+	Functions []Function
+}
+
+// Function is a group of interfaces working together as one device function, such as CDC-ACM serial port
+type Function struct {
+	BFunctionClass    uint8
+	BFunctionSubClass uint8
+	BFunctionProtocol uint8
+	Name              string
+	// Interfaces of the function. Endpoint addresses with endpoint number 0 are allocated by Build,
+	// from the lowest endpoint number unused in the configuration for the same direction.
+	// The n-th allocated endpoint of each direction has the same address in all alternate settings of an interface.
+	Interfaces []Interface
+	// Interface number of the first interface of the function, assigned by Build
+	FirstInterface uint8
+}
+
+type Interface struct {
+	// Interface number, assigned by Build from position of the interface.
+	// Trees of RawDevice keep numbers of captured descriptors, which may have gaps.
+	BInterfaceNumber uint8
+	// Alternate settings are numbered by their position, starting from 0
+	AltSettings []AltSetting
+}
+
+type AltSetting struct {
+	// Alternate setting number, assigned by Build from position of the alternate setting.
+	// Trees of RawDevice keep numbers of captured descriptors, which may have gaps.
+	BAlternateSetting  uint8
+	BInterfaceClass    uint8
+	BInterfaceSubClass uint8
+	BInterfaceProtocol uint8
+	Name               string
+	// Class-specific descriptors placed after interface descriptor, such as HID descriptor
+	ClassSpecific []ClassSpecificDescriptor
+	Endpoints     []Endpoint
+}
+
+type Endpoint struct {
+	// Endpoint number with direction bit (D7: 1 for IN, 0 for OUT)
+	BEndpointAddress uint8
+	// Transfer type and, for isochronous endpoint, synchronization and usage type
+	BMAttributes   uint8
+	WMaxPacketSize uint16
+	BInterval      uint8
+	// Companion of the endpoint, required by SuperSpeed device and not allowed otherwise
+	SuperSpeedCompanion *SuperSpeedCompanion
+	// Values of high-speed device endpoint when operating at full speed, reported in other speed configuration.
+	// They're derived from WMaxPacketSize and BInterval if nil.
+	OtherSpeed *OtherSpeedEndpoint
+	// Class-specific descriptors placed after endpoint descriptor
+	ClassSpecific []ClassSpecificDescriptor
+}
+
+// SuperSpeedCompanion is SuperSpeed endpoint companion descriptor of an endpoint,
+// placed right after its endpoint descriptor
+type SuperSpeedCompanion struct {
+	// Maximum number of packets in a burst minus one, from 0 to 15
+	MaxBurst uint8
+	// Bulk endpoint only: maximum number of streams as exponent of 2, from 0 (no stream) to 16
+	MaxStreams uint8
+	// Isochronous endpoint only: maximum number of bursts in a service interval minus one, from 0 to 2
+	Mult uint8
+	// Periodic endpoint only: total number of bytes transferred every service interval
+	BytesPerInterval uint16
+	// SuperSpeedPlus isochronous endpoint only: total number of bytes transferred every service interval,
+	// placed in SuperSpeedPlus isochronous endpoint companion descriptor if non-zero
+	SuperSpeedPlusBytesPerInterval uint32
+}
+
+// InterfaceRelativeDescriptor is a serialized class-specific descriptor containing interface numbers,
+// such as CDC union functional descriptor. Inside a function, interface numbers at given byte offsets
+// are relative to the first interface of the function, and are resolved by Build.
+type InterfaceRelativeDescriptor struct {
+	Data                   []byte
+	InterfaceNumberOffsets []int
+}
+
+func (r *InterfaceRelativeDescriptor) Encode(writer io.Writer) error {
+	return RawDescriptor(r.Data).Encode(writer)
+}
+
+func (r *InterfaceRelativeDescriptor) resolve(firstInterface uint8) (RawDescriptor, error) {
+	data := append([]byte(nil), r.Data...)
+	for _, offset := range r.InterfaceNumberOffsets {
+		if offset < 0 || offset >= len(data) {
+			return nil, fmt.Errorf("%w: interface number offset %d is out of descriptor length %d", ErrInvalidDescriptorTree, offset, len(data))
+		}
+		data[offset] += firstInterface
+	}
+
+	return RawDescriptor(data), nil
+}
+
+// DescriptorSet is serialized descriptors of a device, built from Device
+type DescriptorSet struct {
+	device         StandardDeviceDescriptor
+	configurations [][]byte
+	configValues   []uint8
+	configTrees    []Configuration
+	bos            []byte
+	// Descriptors of high-speed device operating at full speed
+	deviceQualifier          *DeviceQualifierDescriptor
+	otherSpeedConfigurations [][]byte
+	strings                  []string
+	langIDs                  []LangID
+	deviceInfo               op.DeviceInfo
+}
+
+// stringTable allocates string descriptor indexes, identical strings share the same index
+type stringTable struct {
+	strings []string
+	indexes map[string]uint8
+}
+
+func (t *stringTable) allocate(s string) (uint8, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if index, ok := t.indexes[s]; ok {
+		return index, nil
+	}
+	if len(utf16.Encode([]rune(s))) > MAX_STRING_DESCRIPTOR_LENGTH {
+		return 0, fmt.Errorf("%w: string %q is longer than %d characters", ErrInvalidDescriptorTree, s, MAX_STRING_DESCRIPTOR_LENGTH)
+	}
+	if len(t.strings) >= MAX_STRING_DESCRIPTOR_COUNT {
+		return 0, fmt.Errorf("%w: number of strings exceeds %d", ErrInvalidDescriptorTree, MAX_STRING_DESCRIPTOR_COUNT)
+	}
+
+	t.strings = append(t.strings, s)
+	index := uint8(len(t.strings))
+	t.indexes[s] = index
+
+	return index, nil
+}
+
+// Build validates descriptor tree and serializes it into DescriptorSet
+func (d *Device) Build() (*DescriptorSet, error) {
+	if len(d.Configurations) == 0 {
+		return nil, fmt.Errorf("%w: device has no configuration", ErrInvalidDescriptorTree)
+	}
+	if len(d.Configurations) > 255 {
+		return nil, fmt.Errorf("%w: number of configurations exceeds 255", ErrInvalidDescriptorTree)
+	}
+	if err := d.validateSuperSpeedDevice(); err != nil {
+		return nil, err
+	}
+
+	table := &stringTable{
+		indexes: make(map[string]uint8),
+	}
+	set := &DescriptorSet{
+		langIDs: d.LangIDs,
+	}
+	if len(set.langIDs) == 0 {
+		set.langIDs = []LangID{LANGID_ENGLISH_UNITED_STATES}
+	}
+
+	var err error
+	set.device = StandardDeviceDescriptor{
+		BLength:            STANDARD_DEVICE_DESCRIPTOR_LENGTH,
+		BDescriptorType:    DESCRIPTOR_TYPE_DEVICE,
+		BCDUSB:             d.BCDUSB,
+		BDeviceClass:       d.BDeviceClass,
+		BDeviceSubClass:    d.BDeviceSubClass,
+		BDeviceProtocol:    d.BDeviceProtocol,
+		BMaxPacketSize:     d.BMaxPacketSize,
+		IDVendor:           d.IDVendor,
+		IDProduct:          d.IDProduct,
+		BCDDevice:          d.BCDDevice,
+		BNumConfigurations: uint8(len(d.Configurations)),
+	}
+	if set.device.IManufacturer, err = table.allocate(d.Manufacturer); err != nil {
+		return nil, err
+	}
+	if set.device.IProduct, err = table.allocate(d.Product); err != nil {
+		return nil, err
+	}
+	if set.device.ISerialNumber, err = table.allocate(d.SerialNumber); err != nil {
+		return nil, err
+	}
+
+	for i, config := range d.Configurations {
+		configValue := config.BConfigurationValue
+		if configValue == 0 {
+			configValue = uint8(i + 1)
+		}
+		if _, ok := set.ConfigurationByValue(configValue); ok {
+			return nil, fmt.Errorf("%w: duplicated configuration value %d", ErrInvalidDescriptorTree, configValue)
+		}
+
+		resolved, err := config.resolve()
+		if err != nil {
+			return nil, fmt.Errorf("unable to resolve configuration %d: %w", configValue, err)
+		}
+		if err := d.validateSpeed(&resolved); err != nil {
+			return nil, fmt.Errorf("invalid configuration %d: %w", configValue, err)
+		}
+		buf, err := resolved.build(configValue, DESCRIPTOR_TYPE_CONFIGURATION, table)
+		if err != nil {
+			return nil, fmt.Errorf("unable to build configuration %d: %w", configValue, err)
+		}
+		set.configurations = append(set.configurations, buf)
+		set.configValues = append(set.configValues, configValue)
+		set.configTrees = append(set.configTrees, resolved)
+
+		// Interface association descriptor requires Miscellaneous Device Class with IAD device protocol,
+		// unless device class is explicitly set.
+		if resolved.hasInterfaceAssociation() && d.BDeviceClass == 0 && d.BDeviceSubClass == 0 && d.BDeviceProtocol == 0 {
+			set.device.BDeviceClass = usbprotocol.CLASS_MISCELLANEOUS
+			set.device.BDeviceSubClass = usbprotocol.SUBCLASS_MISCELLANEOUS_COMMON
+			set.device.BDeviceProtocol = usbprotocol.PROTOCOL_MISCELLANEOUS_INTERFACE_ASSOCIATION
+		}
+	}
+	if d.isHighSpeed() {
+		if err := d.buildOtherSpeed(set, table); err != nil {
+			return nil, err
+		}
+	}
+	set.strings = table.strings
+
+	if len(d.Capabilities) > 0 {
+		if set.bos, err = buildBOS(d.Capabilities); err != nil {
+			return nil, fmt.Errorf("unable to build BOS descriptor: %w", err)
+		}
+	}
+
+	firstConfig := set.configTrees[0]
+	set.deviceInfo = op.DeviceInfo{
+		DeviceInfoTruncated: op.DeviceInfoTruncated{
+			Speed:               d.Speed,
+			IDVendor:            d.IDVendor,
+			IDProduct:           d.IDProduct,
+			BCDDevice:           d.BCDDevice,
+			BDeviceClass:        set.device.BDeviceClass,
+			BDeviceSubclass:     set.device.BDeviceSubClass,
+			BDeviceProtocol:     set.device.BDeviceProtocol,
+			BConfigurationValue: set.configValues[0],
+			BNumConfigurations:  uint8(len(d.Configurations)),
+			BNumInterfaces:      uint8(len(firstConfig.Interfaces)),
+		},
+		Interfaces: make([]op.DeviceInterface, len(firstConfig.Interfaces)),
+	}
+	for i, intf := range firstConfig.Interfaces {
+		set.deviceInfo.Interfaces[i] = op.DeviceInterface{
+			BInterfaceClass:    intf.AltSettings[0].BInterfaceClass,
+			BInterfaceSubclass: intf.AltSettings[0].BInterfaceSubClass,
+			BInterfaceProtocol: intf.AltSettings[0].BInterfaceProtocol,
+		}
+	}
+
+	return set, nil
+}
+
+// resolve returns a copy of configuration with function interfaces appended to Interfaces,
+// endpoint addresses allocated and interface-relative descriptors resolved
+func (c *Configuration) resolve() (Configuration, error) {
+	resolved := *c
+	resolved.Interfaces = make([]Interface, 0, len(c.Interfaces))
+	resolved.Functions = make([]Function, len(c.Functions))
+	for _, intf := range c.Interfaces {
+		resolved.Interfaces = append(resolved.Interfaces, intf.clone())
+	}
+	for i, function := range c.Functions {
+		if len(function.Interfaces) == 0 {
+			return Configuration{}, fmt.Errorf("%w: function %d has no interface", ErrInvalidDescriptorTree, i)
+		}
+		if len(resolved.Interfaces)+len(function.Interfaces) > 255 {
+			return Configuration{}, fmt.Errorf("%w: number of interfaces exceeds 255", ErrInvalidDescriptorTree)
+		}
+		resolved.Functions[i] = function
+		resolved.Functions[i].FirstInterface = uint8(len(resolved.Interfaces))
+		for _, intf := range function.Interfaces {
+			resolved.Interfaces = append(resolved.Interfaces, intf.clone())
+		}
+	}
+
+	for i := range resolved.Interfaces {
+		intf := &resolved.Interfaces[i]
+		intf.BInterfaceNumber = uint8(i)
+		for j := range intf.AltSettings {
+			intf.AltSettings[j].BAlternateSetting = uint8(j)
+		}
+	}
+
+	// Owner interface of each endpoint address, an endpoint cannot be shared between interfaces
+	owners := make(map[uint8]int)
+	for i, intf := range resolved.Interfaces {
+		for _, altSetting := range intf.AltSettings {
+			for _, endpoint := range altSetting.Endpoints {
+				if endpoint.BEndpointAddress&0x0F == 0 {
+					continue
+				}
+				if owner, ok := owners[endpoint.BEndpointAddress]; ok && owner != i {
+					return Configuration{}, fmt.Errorf("%w: endpoint 0x%02x is used by interface %d and %d", ErrInvalidDescriptorTree, endpoint.BEndpointAddress, owner, i)
+				}
+				owners[endpoint.BEndpointAddress] = i
+			}
+		}
+	}
+
+	for i := range resolved.Functions {
+		function := &resolved.Functions[i]
+		function.Interfaces = resolved.Interfaces[function.FirstInterface : int(function.FirstInterface)+len(function.Interfaces)]
+		for j := range function.Interfaces {
+			interfaceNumber := int(function.FirstInterface) + j
+			if err := function.Interfaces[j].allocateEndpoints(interfaceNumber, owners); err != nil {
+				return Configuration{}, fmt.Errorf("unable to allocate endpoints of interface %d: %w", interfaceNumber, err)
+			}
+			if err := function.Interfaces[j].resolveClassSpecific(function.FirstInterface); err != nil {
+				return Configuration{}, fmt.Errorf("unable to resolve descriptors of interface %d: %w", interfaceNumber, err)
+			}
+		}
+	}
+
+	return resolved, nil
+}
+
+// Interface returns interface having given bInterfaceNumber
+func (c *Configuration) Interface(interfaceNumber uint8) (Interface, bool) {
+	for _, intf := range c.Interfaces {
+		if intf.BInterfaceNumber == interfaceNumber {
+			return intf, true
+		}
+	}
+
+	return Interface{}, false
+}
+
+// AltSetting returns alternate setting having given bAlternateSetting
+func (i *Interface) AltSetting(alternateSetting uint8) (AltSetting, bool) {
+	for _, altSetting := range i.AltSettings {
+		if altSetting.BAlternateSetting == alternateSetting {
+			return altSetting, true
+		}
+	}
+
+	return AltSetting{}, false
+}
+
+func (c *Configuration) hasInterfaceAssociation() bool {
+	for _, function := range c.Functions {
+		if len(function.Interfaces) > 1 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// clone returns a copy of interface, which alternate settings and endpoints can be modified
+func (i Interface) clone() Interface {
+	cloned := i
+	cloned.AltSettings = make([]AltSetting, len(i.AltSettings))
+	for j, altSetting := range i.AltSettings {
+		cloned.AltSettings[j] = altSetting
+		cloned.AltSettings[j].ClassSpecific = append([]ClassSpecificDescriptor(nil), altSetting.ClassSpecific...)
+		cloned.AltSettings[j].Endpoints = make([]Endpoint, len(altSetting.Endpoints))
+		for k, endpoint := range altSetting.Endpoints {
+			cloned.AltSettings[j].Endpoints[k] = endpoint
+			cloned.AltSettings[j].Endpoints[k].ClassSpecific = append([]ClassSpecificDescriptor(nil), endpoint.ClassSpecific...)
+		}
+	}
+
+	return cloned
+}
+
+func (i *Interface) allocateEndpoints(interfaceNumber int, owners map[uint8]int) error {
+	// Allocated addresses of the interface by direction, shared by all alternate settings
+	allocated := make(map[uint8][]uint8)
+	for _, altSetting := range i.AltSettings {
+		counts := make(map[uint8]int)
+		for k := range altSetting.Endpoints {
+			endpoint := &altSetting.Endpoints[k]
+			if endpoint.BEndpointAddress&0x0F != 0 {
+				continue
+			}
+			direction := endpoint.BEndpointAddress & 0x80
+			n := counts[direction]
+			counts[direction]++
+			if n < len(allocated[direction]) {
+				endpoint.BEndpointAddress = allocated[direction][n]
+				continue
+			}
+
+			address, err := allocateEndpointAddress(direction, owners)
+			if err != nil {
+				return err
+			}
+			owners[address] = interfaceNumber
+			allocated[direction] = append(allocated[direction], address)
+			endpoint.BEndpointAddress = address
+		}
+	}
+
+	return nil
+}
+
+func allocateEndpointAddress(direction uint8, owners map[uint8]int) (uint8, error) {
+	for number := uint8(1); number <= 15; number++ {
+		if _, ok := owners[direction|number]; !ok {
+			return direction | number, nil
+		}
+	}
+
+	return 0, fmt.Errorf("%w: no endpoint number left for direction 0x%02x", ErrInvalidDescriptorTree, direction)
+}
+
+func (i *Interface) resolveClassSpecific(firstInterface uint8) error {
+	resolveAll := func(descs []ClassSpecificDescriptor) error {
+		for k, desc := range descs {
+			relative, ok := desc.(*InterfaceRelativeDescriptor)
+			if !ok {
+				continue
+			}
+			raw, err := relative.resolve(firstInterface)
+			if err != nil {
+				return err
+			}
+			descs[k] = raw
+		}
+		return nil
+	}
+
+	for _, altSetting := range i.AltSettings {
+		if err := resolveAll(altSetting.ClassSpecific); err != nil {
+			return err
+		}
+		for _, endpoint := range altSetting.Endpoints {
+			if err := resolveAll(endpoint.ClassSpecific); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// build serializes resolved configuration, where descriptorType is either configuration or other speed configuration
+func (c *Configuration) build(configValue uint8, descriptorType DescriptorType, table *stringTable) ([]byte, error) {
+	if len(c.Interfaces) > 255 {
+		return nil, fmt.Errorf("%w: number of interfaces exceeds 255", ErrInvalidDescriptorTree)
+	}
+
+	configDesc := StandardConfigurationDescriptor{
+		BLength:             STANDARD_CONFIGURATION_DESCRIPTOR_LENGTH,
+		BDescriptorType:     descriptorType,
+		BNumInterfaces:      uint8(len(c.Interfaces)),
+		BConfigurationValue: configValue,
+		BMAttributes:        c.BMAttributes,
+		BMaxPower:           c.BMaxPower,
+	}
+	var err error
+	if configDesc.IConfiguration, err = table.allocate(c.Name); err != nil {
+		return nil, err
+	}
+
+	detailBuf := new(bytes.Buffer)
+	for _, classDesc := range c.ClassSpecific {
+		if err := classDesc.Encode(detailBuf); err != nil {
+			return nil, fmt.Errorf("unable to encode class-specific descriptor of configuration: %w", err)
+		}
+	}
+
+	associations := make(map[int]Function)
+	for _, function := range c.Functions {
+		if len(function.Interfaces) > 1 {
+			associations[int(function.FirstInterface)] = function
+		}
+	}
+
+	for i, intf := range c.Interfaces {
+		if function, ok := associations[i]; ok {
+			iadDesc := InterfaceAssociationDescriptor{
+				BLength:           INTERFACE_ASSOCIATION_DESCRIPTOR_LENGTH,
+				BDescriptorType:   DESCRIPTOR_TYPE_INTERFACE_ASSOCIATION,
+				BFirstInterface:   function.FirstInterface,
+				BInterfaceCount:   uint8(len(function.Interfaces)),
+				BFunctionClass:    function.BFunctionClass,
+				BFunctionSubClass: function.BFunctionSubClass,
+				BFunctionProtocol: function.BFunctionProtocol,
+			}
+			if iadDesc.IFunction, err = table.allocate(function.Name); err != nil {
+				return nil, err
+			}
+			if err := iadDesc.Encode(detailBuf); err != nil {
+				return nil, fmt.Errorf("unable to encode interface association descriptor: %w", err)
+			}
+		}
+		if len(intf.AltSettings) == 0 {
+			return nil, fmt.Errorf("%w: interface %d has no alternate setting", ErrInvalidDescriptorTree, i)
+		}
+		if len(intf.AltSettings) > 256 {
+			return nil, fmt.Errorf("%w: number of alternate settings of interface %d exceeds 256", ErrInvalidDescriptorTree, i)
+		}
+		for j, altSetting := range intf.AltSettings {
+			if err := altSetting.encode(detailBuf, uint8(i), uint8(j), table); err != nil {
+				return nil, fmt.Errorf("unable to encode interface %d alternate setting %d: %w", i, j, err)
+			}
+		}
+	}
+
+	totalLength := STANDARD_CONFIGURATION_DESCRIPTOR_LENGTH + detailBuf.Len()
+	if totalLength > 0xFFFF {
+		return nil, fmt.Errorf("%w: total length of configuration %d exceeds 65535", ErrInvalidDescriptorTree, totalLength)
+	}
+	configDesc.WTotalLength = uint16(totalLength)
+
+	buf := new(bytes.Buffer)
+	if err := configDesc.Encode(buf); err != nil {
+		return nil, fmt.Errorf("unable to encode configuration descriptor: %w", err)
+	}
+	buf.Write(detailBuf.Bytes())
+
+	return buf.Bytes(), nil
+}
+
+func (a *AltSetting) encode(writer io.Writer, interfaceNumber, alternateSetting uint8, table *stringTable) error {
+	if len(a.Endpoints) > 30 {
+		return fmt.Errorf("%w: number of endpoints exceeds 30", ErrInvalidDescriptorTree)
+	}
+
+	intfDesc := StandardInterfaceDescriptor{
+		BLength:            STANDARD_INTERFACE_DESCRIPTOR_LENGTH,
+		BDescriptorType:    DESCRIPTOR_TYPE_INTERFACE,
+		BInterfaceNumber:   interfaceNumber,
+		BAlternateSetting:  alternateSetting,
+		BNumEndpoints:      uint8(len(a.Endpoints)),
+		BInterfaceClass:    a.BInterfaceClass,
+		BInterfaceSubClass: a.BInterfaceSubClass,
+		BInterfaceProtocol: a.BInterfaceProtocol,
+	}
+	var err error
+	if intfDesc.IInterface, err = table.allocate(a.Name); err != nil {
+		return err
+	}
+
+	if err := intfDesc.Encode(writer); err != nil {
+		return fmt.Errorf("unable to encode interface descriptor: %w", err)
+	}
+	for _, classDesc := range a.ClassSpecific {
+		if err := classDesc.Encode(writer); err != nil {
+			return fmt.Errorf("unable to encode class-specific descriptor of interface: %w", err)
+		}
+	}
+
+	endpointAddresses := make(map[uint8]bool)
+	for _, endpoint := range a.Endpoints {
+		if endpoint.BEndpointAddress&0x0F == 0 {
+			return fmt.Errorf("%w: endpoint 0 cannot be declared in interface", ErrInvalidDescriptorTree)
+		}
+		if endpointAddresses[endpoint.BEndpointAddress] {
+			return fmt.Errorf("%w: duplicated endpoint address 0x%02x", ErrInvalidDescriptorTree, endpoint.BEndpointAddress)
+		}
+		endpointAddresses[endpoint.BEndpointAddress] = true
+
+		endpointDesc := StandardEndpointDescriptor{
+			BLength:          STANDARD_ENDPOINT_DESCRIPTOR_LENGTH,
+			BDescriptorType:  DESCRIPTOR_TYPE_ENDPOINT,
+			BEndpointAddress: endpoint.BEndpointAddress,
+			BMAttributes:     endpoint.BMAttributes,
+			WMaxPacketSize:   endpoint.WMaxPacketSize,
+			BInterval:        endpoint.BInterval,
+		}
+		if err := endpointDesc.Encode(writer); err != nil {
+			return fmt.Errorf("unable to encode endpoint descriptor: %w", err)
+		}
+		if endpoint.SuperSpeedCompanion != nil {
+			if err := endpoint.SuperSpeedCompanion.encode(writer, endpoint.BMAttributes); err != nil {
+				return err
+			}
+		}
+		for _, classDesc := range endpoint.ClassSpecific {
+			if err := classDesc.Encode(writer); err != nil {
+				return fmt.Errorf("unable to encode class-specific descriptor of endpoint: %w", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (c *SuperSpeedCompanion) encode(writer io.Writer, endpointAttributes uint8) error {
+	companionDesc := SuperSpeedEndpointCompanionDescriptor{
+		BLength:           SUPERSPEED_ENDPOINT_COMPANION_DESCRIPTOR_LENGTH,
+		BDescriptorType:   DESCRIPTOR_TYPE_SUPER_SPEED_USB_ENDPOINT_COMPANION,
+		BMaxBurst:         c.MaxBurst,
+		WBytesPerInterval: c.BytesPerInterval,
+	}
+	switch endpointAttributes & ENDPOINT_TRANSFER_TYPE_MASK {
+	case ENDPOINT_TRANSFER_TYPE_BULK:
+		companionDesc.BMAttributes = c.MaxStreams
+	case ENDPOINT_TRANSFER_TYPE_ISOCHRONOUS:
+		companionDesc.BMAttributes = c.Mult
+		if c.SuperSpeedPlusBytesPerInterval != 0 {
+			// wBytesPerInterval must be 1 when SuperSpeedPlus isochronous endpoint companion follows
+			companionDesc.BMAttributes |= 0b10000000
+			companionDesc.WBytesPerInterval = 1
+		}
+	}
+	if err := companionDesc.Encode(writer); err != nil {
+		return fmt.Errorf("unable to encode SuperSpeed endpoint companion descriptor: %w", err)
+	}
+
+	if companionDesc.BMAttributes&0b10000000 != 0 {
+		sspDesc := SuperSpeedPlusIsochronousEndpointCompanionDescriptor{
+			BLength:            SUPERSPEED_PLUS_ISOCHRONOUS_ENDPOINT_COMPANION_DESCRIPTOR_LENGTH,
+			BDescriptorType:    DESCRIPTOR_TYPE_SUPER_SPEED_PLUS_ISOCHRONOUS_ENDPOINT_COMPANION,
+			DWBytesPerInterval: c.SuperSpeedPlusBytesPerInterval,
+		}
+		if err := sspDesc.Encode(writer); err != nil {
+			return fmt.Errorf("unable to encode SuperSpeedPlus isochronous endpoint companion descriptor: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (d *Device) isSuperSpeed() bool {
+	return d.Speed == usbprotocol.SPEED_USB3_SUPER || d.Speed == usbprotocol.SPEED_USB3_SUPER_PLUS
+}
+
+// validateSpeed checks SuperSpeed rules of resolved configuration: SuperSpeed device must have
+// 512-byte endpoint zero, bcdUSB 3.0 or higher, SuperSpeed USB device capability and endpoint companion of every endpoint,
+// and non-SuperSpeed device must not have endpoint companion.
+func (d *Device) validateSpeed(config *Configuration) error {
+	for i, intf := range config.Interfaces {
+		for j, alt := range intf.AltSettings {
+			for _, endpoint := range alt.Endpoints {
+				var err error
+				if d.isSuperSpeed() {
+					err = d.validateSuperSpeedEndpoint(&endpoint)
+				} else if endpoint.SuperSpeedCompanion != nil {
+					err = fmt.Errorf("%w: SuperSpeed endpoint companion requires SuperSpeed device", ErrInvalidDescriptorTree)
+				}
+				if err == nil && endpoint.OtherSpeed != nil && !d.isHighSpeed() {
+					err = fmt.Errorf("%w: other speed endpoint values require high-speed device", ErrInvalidDescriptorTree)
+				}
+				if err != nil {
+					return fmt.Errorf("endpoint 0x%02x of interface %d alternate setting %d: %w", endpoint.BEndpointAddress, i, j, err)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func (d *Device) validateSuperSpeedEndpoint(endpoint *Endpoint) error {
+	companion := endpoint.SuperSpeedCompanion
+	if companion == nil {
+		return fmt.Errorf("%w: SuperSpeed endpoint requires endpoint companion", ErrInvalidDescriptorTree)
+	}
+	if companion.MaxBurst > SUPERSPEED_MAX_BURST {
+		return fmt.Errorf("%w: max burst %d exceeds %d", ErrInvalidDescriptorTree, companion.MaxBurst, SUPERSPEED_MAX_BURST)
+	}
+
+	transferType := endpoint.BMAttributes & ENDPOINT_TRANSFER_TYPE_MASK
+	if transferType != ENDPOINT_TRANSFER_TYPE_BULK && companion.MaxStreams != 0 {
+		return fmt.Errorf("%w: streams are supported by bulk endpoint only", ErrInvalidDescriptorTree)
+	}
+	if transferType != ENDPOINT_TRANSFER_TYPE_ISOCHRONOUS && (companion.Mult != 0 || companion.SuperSpeedPlusBytesPerInterval != 0) {
+		return fmt.Errorf("%w: mult and SuperSpeedPlus bytes per interval are supported by isochronous endpoint only", ErrInvalidDescriptorTree)
+	}
+
+	switch transferType {
+	case ENDPOINT_TRANSFER_TYPE_BULK:
+		if endpoint.WMaxPacketSize != SUPERSPEED_MAX_PACKET_SIZE {
+			return fmt.Errorf("%w: max packet size of SuperSpeed bulk endpoint must be %d", ErrInvalidDescriptorTree, SUPERSPEED_MAX_PACKET_SIZE)
+		}
+		if companion.MaxStreams > SUPERSPEED_MAX_STREAMS {
+			return fmt.Errorf("%w: max streams %d exceeds %d", ErrInvalidDescriptorTree, companion.MaxStreams, SUPERSPEED_MAX_STREAMS)
+		}
+	case ENDPOINT_TRANSFER_TYPE_ISOCHRONOUS, ENDPOINT_TRANSFER_TYPE_INTERRUPT:
+		if endpoint.WMaxPacketSize > SUPERSPEED_MAX_PACKET_SIZE {
+			return fmt.Errorf("%w: max packet size of SuperSpeed endpoint exceeds %d", ErrInvalidDescriptorTree, SUPERSPEED_MAX_PACKET_SIZE)
+		}
+		if companion.MaxBurst > 0 && endpoint.WMaxPacketSize != SUPERSPEED_MAX_PACKET_SIZE {
+			return fmt.Errorf("%w: max packet size of bursting periodic endpoint must be %d", ErrInvalidDescriptorTree, SUPERSPEED_MAX_PACKET_SIZE)
+		}
+		if companion.Mult > SUPERSPEED_MAX_MULT {
+			return fmt.Errorf("%w: mult %d exceeds %d", ErrInvalidDescriptorTree, companion.Mult, SUPERSPEED_MAX_MULT)
+		}
+		if companion.Mult > 0 && companion.MaxBurst == 0 {
+			return fmt.Errorf("%w: mult requires max burst", ErrInvalidDescriptorTree)
+		}
+		if companion.SuperSpeedPlusBytesPerInterval != 0 && d.Speed != usbprotocol.SPEED_USB3_SUPER_PLUS {
+			return fmt.Errorf("%w: SuperSpeedPlus isochronous endpoint companion requires SuperSpeedPlus device", ErrInvalidDescriptorTree)
+		}
+	}
+
+	return nil
+}
+
+// validateSuperSpeedDevice checks device-level SuperSpeed rules
+func (d *Device) validateSuperSpeedDevice() error {
+	if !d.isSuperSpeed() {
+		return nil
+	}
+	if d.BMaxPacketSize != SUPERSPEED_MAX_PACKET_SIZE_0 {
+		return fmt.Errorf("%w: bMaxPacketSize0 of SuperSpeed device must be %d", ErrInvalidDescriptorTree, SUPERSPEED_MAX_PACKET_SIZE_0)
+	}
+	if d.BCDUSB < 0x0300 {
+		return fmt.Errorf("%w: bcdUSB of SuperSpeed device must be 0x0300 or higher", ErrInvalidDescriptorTree)
+	}
+	for _, capability := range d.Capabilities {
+		if _, ok := capability.(*SuperSpeedUSBCapability); ok {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: SuperSpeed device requires SuperSpeed USB device capability", ErrInvalidDescriptorTree)
+}
+
+func buildBOS(capabilities []DeviceCapability) ([]byte, error) {
+	if len(capabilities) > 255 {
+		return nil, fmt.Errorf("%w: number of device capabilities exceeds 255", ErrInvalidDescriptorTree)
+	}
+
+	capsBuf := new(bytes.Buffer)
+	for i, capability := range capabilities {
+		if err := capability.Encode(capsBuf); err != nil {
+			return nil, fmt.Errorf("unable to encode device capability %d: %w", i, err)
+		}
+	}
+	totalLength := BOS_DESCRIPTOR_LENGTH + capsBuf.Len()
+	if totalLength > 0xFFFF {
+		return nil, fmt.Errorf("%w: total length of BOS descriptor %d exceeds 65535", ErrInvalidDescriptorTree, totalLength)
+	}
+
+	bosDesc := BOSDescriptor{
+		BLength:         BOS_DESCRIPTOR_LENGTH,
+		BDescriptorType: DESCRIPTOR_TYPE_BOS,
+		WTotalLength:    uint16(totalLength),
+		BNumDeviceCaps:  uint8(len(capabilities)),
+	}
+	buf := new(bytes.Buffer)
+	if err := bosDesc.Encode(buf); err != nil {
+		return nil, fmt.Errorf("unable to encode BOS descriptor: %w", err)
+	}
+	buf.Write(capsBuf.Bytes())
+
+	return buf.Bytes(), nil
+}
+
+// DeviceInfo returns device information reported in USB/IP device list, matching the descriptors.
+// BusID, BusNum, DevNum and Path are left empty, as they're assigned by registrar.
+func (s *DescriptorSet) DeviceInfo() op.DeviceInfo {
+	info := s.deviceInfo
+	info.Interfaces = append([]op.DeviceInterface(nil), s.deviceInfo.Interfaces...)
+
+	return info
+}
+
+// DeviceDescriptor returns standard device descriptor
+func (s *DescriptorSet) DeviceDescriptor() StandardDeviceDescriptor {
+	return s.device
+}
+
+// Configuration returns serialized configuration descriptor, with all descriptors of the configuration,
+// at given index, starting from 0
+func (s *DescriptorSet) Configuration(index uint8) ([]byte, bool) {
+	if int(index) >= len(s.configurations) {
+		return nil, false
+	}
+
+	return s.configurations[index], true
+}
+
+// ConfigurationByValue returns serialized configuration descriptor having given bConfigurationValue
+func (s *DescriptorSet) ConfigurationByValue(configValue uint8) ([]byte, bool) {
+	for i, value := range s.configValues {
+		if value == configValue {
+			return s.configurations[i], true
+		}
+	}
+
+	return nil, false
+}
+
+// ConfigurationTree returns descriptor tree of configuration having given bConfigurationValue
+func (s *DescriptorSet) ConfigurationTree(configValue uint8) (Configuration, bool) {
+	for i, value := range s.configValues {
+		if value == configValue {
+			return s.configTrees[i], true
+		}
+	}
+
+	return Configuration{}, false
+}
+
+// Interface returns interface having given bInterfaceNumber in configuration having given bConfigurationValue
+func (s *DescriptorSet) Interface(configValue, interfaceNumber uint8) (Interface, bool) {
+	config, ok := s.ConfigurationTree(configValue)
+	if !ok {
+		return Interface{}, false
+	}
+
+	return config.Interface(interfaceNumber)
+}
+
+// AltSetting returns alternate setting of an interface in configuration having given bConfigurationValue
+func (s *DescriptorSet) AltSetting(configValue, interfaceNumber, alternateSetting uint8) (AltSetting, bool) {
+	intf, ok := s.Interface(configValue, interfaceNumber)
+	if !ok {
+		return AltSetting{}, false
+	}
+
+	return intf.AltSetting(alternateSetting)
+}
+
+// BOS returns serialized BOS descriptor with all device capabilities, if the device has any capability
+func (s *DescriptorSet) BOS() ([]byte, bool) {
+	return s.bos, s.bos != nil
+}
+
+// DeviceQualifier returns device qualifier descriptor, which only exists for high-speed device
+func (s *DescriptorSet) DeviceQualifier() (DeviceQualifierDescriptor, bool) {
+	if s.deviceQualifier == nil {
+		return DeviceQualifierDescriptor{}, false
+	}
+
+	return *s.deviceQualifier, true
+}
+
+// OtherSpeedConfiguration returns serialized other speed configuration descriptor at given index, starting from 0
+func (s *DescriptorSet) OtherSpeedConfiguration(index uint8) ([]byte, bool) {
+	if int(index) >= len(s.otherSpeedConfigurations) {
+		return nil, false
+	}
+
+	return s.otherSpeedConfigurations[index], true
+}
+
+// String returns string at given string descriptor index
+func (s *DescriptorSet) String(index uint8) (string, bool) {
+	if index == 0 || int(index) > len(s.strings) || s.strings[index-1] == "" {
+		return "", false
+	}
+
+	return s.strings[index-1], true
+}
+
+// GetDescriptor returns serialized descriptor for GET_DESCRIPTOR request.
+// Strings are the same for all supported languages, so langID is only checked against supported LangIDs.
+func (s *DescriptorSet) GetDescriptor(descriptorType DescriptorType, index uint8, langID LangID) ([]byte, error) {
+	buf := new(bytes.Buffer)
+
+	switch descriptorType {
+	case DESCRIPTOR_TYPE_DEVICE:
+		if err := s.device.Encode(buf); err != nil {
+			return nil, fmt.Errorf("unable to encode standard device descriptor: %w", err)
+		}
+		return buf.Bytes(), nil
+	case DESCRIPTOR_TYPE_CONFIGURATION:
+		config, ok := s.Configuration(index)
+		if !ok {
+			return nil, fmt.Errorf("%w: configuration index %d", ErrDescriptorNotFound, index)
+		}
+		return config, nil
+	case DESCRIPTOR_TYPE_DEVICE_QUALIFIER:
+		qualifier, ok := s.DeviceQualifier()
+		if !ok {
+			return nil, fmt.Errorf("%w: device is not high-speed device", ErrDescriptorNotFound)
+		}
+		if err := qualifier.Encode(buf); err != nil {
+			return nil, fmt.Errorf("unable to encode device qualifier descriptor: %w", err)
+		}
+		return buf.Bytes(), nil
+	case DESCRIPTOR_TYPE_OTHER_SPEED_CONFIGURATION:
+		config, ok := s.OtherSpeedConfiguration(index)
+		if !ok {
+			return nil, fmt.Errorf("%w: other speed configuration index %d", ErrDescriptorNotFound, index)
+		}
+		return config, nil
+	case DESCRIPTOR_TYPE_BOS:
+		bos, ok := s.BOS()
+		if !ok {
+			return nil, fmt.Errorf("%w: device has no BOS descriptor", ErrDescriptorNotFound)
+		}
+		return bos, nil
+	case DESCRIPTOR_TYPE_STRING:
+		var stringDesc StringDescriptor
+		if index == 0 {
+			stringDesc = NewLangIDsDescriptor(s.langIDs)
+		} else {
+			str, ok := s.String(index)
+			if !ok {
+				return nil, fmt.Errorf("%w: string index %d", ErrDescriptorNotFound, index)
+			}
+			if !s.supportLangID(langID) {
+				return nil, fmt.Errorf("%w: string index %d with LangID 0x%04x", ErrDescriptorNotFound, index, langID)
+			}
+			stringDesc = NewStringDescriptor(str)
+		}
+		if err := stringDesc.Encode(buf); err != nil {
+			return nil, fmt.Errorf("unable to encode string descriptor: %w", err)
+		}
+		return buf.Bytes(), nil
+	default:
+		return nil, fmt.Errorf("%w: type %d, index %d", ErrDescriptorNotFound, descriptorType, index)
+	}
+}
+
+func (s *DescriptorSet) supportLangID(langID LangID) bool {
+	for _, supported := range s.langIDs {
+		if supported == langID {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,744 @@
+package descriptor_test
+
+import (
+	"testing"
+
+	"github.com/ntchjb/usbip-virtual-device/usb/protocol"
+	"github.com/ntchjb/usbip-virtual-device/usb/protocol/descriptor"
+	"github.com/ntchjb/usbip-virtual-device/usb/protocol/hid"
+	"github.com/ntchjb/usbip-virtual-device/usbip/protocol/op"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newMouseDeviceTree() descriptor.Device {
+	return descriptor.Device{
+		Speed:          2,
+		BCDUSB:         0x0200,
+		BMaxPacketSize: 64,
+		IDVendor:       0x0ff0,
+		IDProduct:      0x0123,
+		BCDDevice:      0x0001,
+		Manufacturer:   "ntch.dev",
+		Product:        "Virtual Mouse",
+		SerialNumber:   "1ABBA1BABA1",
+		Configurations: []descriptor.Configuration{
+			{
+				BMAttributes: 0b10100000,
+				BMaxPower:    0x32,
+				Name:         "Default Configuration",
+				Interfaces: []descriptor.Interface{
+					{
+						AltSettings: []descriptor.AltSetting{
+							{
+								BInterfaceClass:    0x03,
+								BInterfaceSubClass: 0x01,
+								BInterfaceProtocol: 0x02,
+								Name:               "Default Interface",
+								ClassSpecific: []descriptor.ClassSpecificDescriptor{
+									&hid.HIDDescriptor{
+										BLength:              hid.HID_DESCRIPTOR_LENGTH,
+										BDescriptorType:      descriptor.DESCRIPTOR_TYPE_HID,
+										BCDHID:               0x0111,
+										BNumDescriptors:      1,
+										BClassDescriptorType: descriptor.DESCRIPTOR_TYPE_HID_REPORT,
+										WDescriptorLength:    0x0034,
+									},
+								},
+								Endpoints: []descriptor.Endpoint{
+									{
+										BEndpointAddress: 0x81,
+										BMAttributes:     0x03,
+										WMaxPacketSize:   8,
+										BInterval:        10,
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestDeviceBuild(t *testing.T) {
+	tree := newMouseDeviceTree()
+	set, err := tree.Build()
+	require.NoError(t, err)
+
+	deviceDesc, err := set.GetDescriptor(descriptor.DESCRIPTOR_TYPE_DEVICE, 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{
+		0x12, 0x01, 0x00, 0x02, 0x00, 0x00, 0x00, 0x40,
+		0xf0, 0x0f, 0x23, 0x01, 0x01, 0x00,
+		0x01, 0x02, 0x03, // String indexes
+		0x01, // BNumConfigurations
+	}, deviceDesc)
+
+	configDesc, err := set.GetDescriptor(descriptor.DESCRIPTOR_TYPE_CONFIGURATION, 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{
+		0x09, 0x02, 0x22, 0x00, 0x01, 0x01, 0x04, 0b10100000, 0x32, // Configuration
+		0x09, 0x04, 0x00, 0x00, 0x01, 0x03, 0x01, 0x02, 0x05, // Interface
+		0x09, 0x21, 0x11, 0x01, 0x00, 0x01, 0x22, 0x34, 0x00, // HID
+		0x07, 0x05, 0x81, 0x03, 0x08, 0x00, 0x0a, // Endpoint
+	}, configDesc)
+
+	langIDs, err := set.GetDescriptor(descriptor.DESCRIPTOR_TYPE_STRING, 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0x04, 0x03, 0x09, 0x04}, langIDs)
+
+	stringDesc, err := set.GetDescriptor(descriptor.DESCRIPTOR_TYPE_STRING, 1, descriptor.LANGID_ENGLISH_UNITED_STATES)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{
+		0x12, 0x03,
+		'n', 0x00, 't', 0x00, 'c', 0x00, 'h', 0x00, '.', 0x00, 'd', 0x00, 'e', 0x00, 'v', 0x00,
+	}, stringDesc)
+
+	_, err = set.GetDescriptor(descriptor.DESCRIPTOR_TYPE_STRING, 6, descriptor.LANGID_ENGLISH_UNITED_STATES)
+	assert.ErrorIs(t, err, descriptor.ErrDescriptorNotFound)
+	_, err = set.GetDescriptor(descriptor.DESCRIPTOR_TYPE_STRING, 1, descriptor.LANGID_THAI)
+	assert.ErrorIs(t, err, descriptor.ErrDescriptorNotFound)
+	_, err = set.GetDescriptor(descriptor.DESCRIPTOR_TYPE_CONFIGURATION, 1, 0)
+	assert.ErrorIs(t, err, descriptor.ErrDescriptorNotFound)
+
+	assert.Equal(t, op.DeviceInfo{
+		DeviceInfoTruncated: op.DeviceInfoTruncated{
+			Speed:               2,
+			IDVendor:            0x0ff0,
+			IDProduct:           0x0123,
+			BCDDevice:           0x0001,
+			BConfigurationValue: 1,
+			BNumConfigurations:  1,
+			BNumInterfaces:      1,
+		},
+		Interfaces: []op.DeviceInterface{
+			{
+				BInterfaceClass:    0x03,
+				BInterfaceSubclass: 0x01,
+				BInterfaceProtocol: 0x02,
+			},
+		},
+	}, set.DeviceInfo())
+}
+
+func TestDeviceBuildStringIndexes(t *testing.T) {
+	tree := newMouseDeviceTree()
+	// Identical strings share the same index
+	tree.Configurations[0].Interfaces[0].AltSettings[0].Name = "Virtual Mouse"
+	tree.SerialNumber = ""
+	set, err := tree.Build()
+	require.NoError(t, err)
+
+	deviceDesc := set.DeviceDescriptor()
+	assert.Equal(t, uint8(1), deviceDesc.IManufacturer)
+	assert.Equal(t, uint8(2), deviceDesc.IProduct)
+	assert.Equal(t, uint8(0), deviceDesc.ISerialNumber)
+
+	configDesc, ok := set.ConfigurationByValue(1)
+	require.True(t, ok)
+	assert.Equal(t, uint8(3), configDesc[6])
+	assert.Equal(t, uint8(2), configDesc[17])
+
+	str, ok := set.String(3)
+	assert.True(t, ok)
+	assert.Equal(t, "Default Configuration", str)
+}
+
+func TestDeviceBuildInvalidTree(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(tree *descriptor.Device)
+	}{
+		{
+			name: "No configuration",
+			modify: func(tree *descriptor.Device) {
+				tree.Configurations = nil
+			},
+		},
+		{
+			name: "Duplicated configuration value",
+			modify: func(tree *descriptor.Device) {
+				tree.Configurations = append(tree.Configurations, descriptor.Configuration{
+					BConfigurationValue: 1,
+				})
+			},
+		},
+		{
+			name: "Interface without alternate setting",
+			modify: func(tree *descriptor.Device) {
+				tree.Configurations[0].Interfaces = append(tree.Configurations[0].Interfaces, descriptor.Interface{})
+			},
+		},
+		{
+			name: "Duplicated endpoint address",
+			modify: func(tree *descriptor.Device) {
+				altSetting := &tree.Configurations[0].Interfaces[0].AltSettings[0]
+				altSetting.Endpoints = append(altSetting.Endpoints, altSetting.Endpoints[0])
+			},
+		},
+		{
+			name: "Endpoint zero",
+			modify: func(tree *descriptor.Device) {
+				altSetting := &tree.Configurations[0].Interfaces[0].AltSettings[0]
+				altSetting.Endpoints[0].BEndpointAddress = 0x80
+			},
+		},
+		{
+			name: "Total length exceeds 65535",
+			modify: func(tree *descriptor.Device) {
+				tree.Configurations[0].ClassSpecific = []descriptor.ClassSpecificDescriptor{
+					descriptor.RawDescriptor(make([]byte, 0x10000)),
+				}
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			tree := newMouseDeviceTree()
+			test.modify(&tree)
+			_, err := tree.Build()
+			assert.ErrorIs(t, err, descriptor.ErrInvalidDescriptorTree)
+		})
+	}
+}
+
+func newCompositeDeviceTree() descriptor.Device {
+	return descriptor.Device{
+		Speed:          2,
+		BCDUSB:         0x0200,
+		BMaxPacketSize: 64,
+		IDVendor:       0x0ff0,
+		IDProduct:      0x0124,
+		Configurations: []descriptor.Configuration{
+			{
+				BMAttributes: 0b10000000,
+				BMaxPower:    0x32,
+				Functions: []descriptor.Function{
+					{
+						Interfaces: []descriptor.Interface{
+							{
+								AltSettings: []descriptor.AltSetting{
+									{
+										BInterfaceClass: 0x03,
+										Endpoints: []descriptor.Endpoint{
+											{BEndpointAddress: 0x80, BMAttributes: 0x03, WMaxPacketSize: 8, BInterval: 10},
+										},
+									},
+								},
+							},
+						},
+					},
+					{
+						BFunctionClass:    0x02,
+						BFunctionSubClass: 0x02,
+						Name:              "Serial",
+						Interfaces: []descriptor.Interface{
+							{
+								AltSettings: []descriptor.AltSetting{
+									{
+										BInterfaceClass:    0x02,
+										BInterfaceSubClass: 0x02,
+										ClassSpecific: []descriptor.ClassSpecificDescriptor{
+											&descriptor.InterfaceRelativeDescriptor{
+												Data:                   []byte{0x05, 0x24, 0x06, 0x00, 0x01},
+												InterfaceNumberOffsets: []int{3, 4},
+											},
+										},
+										Endpoints: []descriptor.Endpoint{
+											{BEndpointAddress: 0x80, BMAttributes: 0x03, WMaxPacketSize: 8, BInterval: 16},
+										},
+									},
+								},
+							},
+							{
+								AltSettings: []descriptor.AltSetting{
+									{BInterfaceClass: 0x0A},
+									{
+										BInterfaceClass: 0x0A,
+										Endpoints: []descriptor.Endpoint{
+											{BEndpointAddress: 0x80, BMAttributes: 0x02, WMaxPacketSize: 64},
+											{BEndpointAddress: 0x00, BMAttributes: 0x02, WMaxPacketSize: 64},
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestDeviceBuildComposite(t *testing.T) {
+	tree := newCompositeDeviceTree()
+	set, err := tree.Build()
+	require.NoError(t, err)
+
+	deviceDesc := set.DeviceDescriptor()
+	assert.Equal(t, protocol.CLASS_MISCELLANEOUS, deviceDesc.BDeviceClass)
+	assert.Equal(t, protocol.SUBCLASS_MISCELLANEOUS_COMMON, deviceDesc.BDeviceSubClass)
+	assert.Equal(t, protocol.PROTOCOL_MISCELLANEOUS_INTERFACE_ASSOCIATION, deviceDesc.BDeviceProtocol)
+
+	configDesc, ok := set.ConfigurationByValue(1)
+	require.True(t, ok)
+	assert.Equal(t, []byte{
+		0x09, 0x02, 0x56, 0x00, 0x03, 0x01, 0x00, 0b10000000, 0x32, // Configuration
+		0x09, 0x04, 0x00, 0x00, 0x01, 0x03, 0x00, 0x00, 0x00, // HID interface
+		0x07, 0x05, 0x81, 0x03, 0x08, 0x00, 0x0a, // HID endpoint
+		0x08, 0x0b, 0x01, 0x02, 0x02, 0x02, 0x00, 0x01, // Interface association
+		0x09, 0x04, 0x01, 0x00, 0x01, 0x02, 0x02, 0x00, 0x00, // Communication interface
+		0x05, 0x24, 0x06, 0x01, 0x02, // Union functional descriptor
+		0x07, 0x05, 0x82, 0x03, 0x08, 0x00, 0x10, // Notification endpoint
+		0x09, 0x04, 0x02, 0x00, 0x00, 0x0a, 0x00, 0x00, 0x00, // Data interface, zero bandwidth
+		0x09, 0x04, 0x02, 0x01, 0x02, 0x0a, 0x00, 0x00, 0x00, // Data interface
+		0x07, 0x05, 0x83, 0x02, 0x40, 0x00, 0x00, // Bulk IN endpoint
+		0x07, 0x05, 0x01, 0x02, 0x40, 0x00, 0x00, // Bulk OUT endpoint
+	}, configDesc)
+
+	config, ok := set.ConfigurationTree(1)
+	require.True(t, ok)
+	assert.Len(t, config.Interfaces, 3)
+	require.Len(t, config.Functions, 2)
+	assert.Equal(t, uint8(0), config.Functions[0].FirstInterface)
+	assert.Equal(t, uint8(1), config.Functions[1].FirstInterface)
+	assert.Equal(t, uint8(0x83), config.Functions[1].Interfaces[1].AltSettings[1].Endpoints[0].BEndpointAddress)
+
+	// Tree given to Build is not modified
+	assert.Equal(t, uint8(0x80), tree.Configurations[0].Functions[1].Interfaces[1].AltSettings[1].Endpoints[0].BEndpointAddress)
+
+	info := set.DeviceInfo()
+	assert.Equal(t, uint8(3), info.BNumInterfaces)
+	assert.Equal(t, protocol.CLASS_MISCELLANEOUS, info.BDeviceClass)
+}
+
+func TestDeviceBuildCompositeEndpointAllocation(t *testing.T) {
+	tree := newCompositeDeviceTree()
+	config := &tree.Configurations[0]
+	// Explicit address is skipped by allocation
+	config.Functions[0].Interfaces[0].AltSettings[0].Endpoints[0].BEndpointAddress = 0x82
+	// Endpoints of each direction share addresses among alternate settings
+	dataInterface := &config.Functions[1].Interfaces[1]
+	dataInterface.AltSettings[0].Endpoints = []descriptor.Endpoint{
+		{BEndpointAddress: 0x00, BMAttributes: 0x02, WMaxPacketSize: 64},
+	}
+	set, err := tree.Build()
+	require.NoError(t, err)
+
+	resolved, ok := set.ConfigurationTree(1)
+	require.True(t, ok)
+	assert.Equal(t, uint8(0x82), resolved.Interfaces[0].AltSettings[0].Endpoints[0].BEndpointAddress)
+	assert.Equal(t, uint8(0x81), resolved.Interfaces[1].AltSettings[0].Endpoints[0].BEndpointAddress)
+	assert.Equal(t, uint8(0x01), resolved.Interfaces[2].AltSettings[0].Endpoints[0].BEndpointAddress)
+	assert.Equal(t, uint8(0x83), resolved.Interfaces[2].AltSettings[1].Endpoints[0].BEndpointAddress)
+	assert.Equal(t, uint8(0x01), resolved.Interfaces[2].AltSettings[1].Endpoints[1].BEndpointAddress)
+
+	// Explicit device class is kept
+	tree.BDeviceClass = 0xFF
+	set, err = tree.Build()
+	require.NoError(t, err)
+	assert.Equal(t, uint8(0xFF), set.DeviceDescriptor().BDeviceClass)
+}
+
+func TestDeviceBuildInvalidCompositeTree(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(tree *descriptor.Device)
+	}{
+		{
+			name: "Function without interface",
+			modify: func(tree *descriptor.Device) {
+				tree.Configurations[0].Functions = append(tree.Configurations[0].Functions, descriptor.Function{})
+			},
+		},
+		{
+			name: "Endpoint shared by interfaces",
+			modify: func(tree *descriptor.Device) {
+				functions := tree.Configurations[0].Functions
+				functions[0].Interfaces[0].AltSettings[0].Endpoints[0].BEndpointAddress = 0x81
+				functions[1].Interfaces[0].AltSettings[0].Endpoints[0].BEndpointAddress = 0x81
+			},
+		},
+		{
+			name: "No endpoint number left",
+			modify: func(tree *descriptor.Device) {
+				altSetting := &tree.Configurations[0].Functions[0].Interfaces[0].AltSettings[0]
+				altSetting.Endpoints = nil
+				for i := 0; i < 16; i++ {
+					altSetting.Endpoints = append(altSetting.Endpoints, descriptor.Endpoint{BEndpointAddress: 0x80})
+				}
+			},
+		},
+		{
+			name: "Interface number offset out of descriptor",
+			modify: func(tree *descriptor.Device) {
+				altSetting := &tree.Configurations[0].Functions[1].Interfaces[0].AltSettings[0]
+				altSetting.ClassSpecific = []descriptor.ClassSpecificDescriptor{
+					&descriptor.InterfaceRelativeDescriptor{
+						Data:                   []byte{0x03, 0x24, 0x06},
+						InterfaceNumberOffsets: []int{3},
+					},
+				}
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			tree := newCompositeDeviceTree()
+			test.modify(&tree)
+			_, err := tree.Build()
+			assert.ErrorIs(t, err, descriptor.ErrInvalidDescriptorTree)
+		})
+	}
+}
+
+func newSuperSpeedMassStorageTree() descriptor.Device {
+	return descriptor.Device{
+		Speed:          protocol.SPEED_USB3_SUPER,
+		BCDUSB:         0x0320,
+		BMaxPacketSize: descriptor.SUPERSPEED_MAX_PACKET_SIZE_0,
+		IDVendor:       0x0ff0,
+		IDProduct:      0x0125,
+		BCDDevice:      0x0001,
+		Configurations: []descriptor.Configuration{
+			{
+				BMAttributes: 0b10000000,
+				BMaxPower:    0x32,
+				Interfaces: []descriptor.Interface{
+					{
+						AltSettings: []descriptor.AltSetting{
+							{
+								BInterfaceClass:    protocol.CLASS_MASS_STORAGE,
+								BInterfaceSubClass: 0x06,
+								BInterfaceProtocol: 0x50,
+								Endpoints: []descriptor.Endpoint{
+									{
+										BEndpointAddress:    0x81,
+										BMAttributes:        descriptor.ENDPOINT_TRANSFER_TYPE_BULK,
+										WMaxPacketSize:      1024,
+										SuperSpeedCompanion: &descriptor.SuperSpeedCompanion{MaxBurst: 15},
+									},
+									{
+										BEndpointAddress:    0x02,
+										BMAttributes:        descriptor.ENDPOINT_TRANSFER_TYPE_BULK,
+										WMaxPacketSize:      1024,
+										SuperSpeedCompanion: &descriptor.SuperSpeedCompanion{MaxBurst: 15, MaxStreams: 4},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		Capabilities: []descriptor.DeviceCapability{
+			&descriptor.SuperSpeedUSBCapability{
+				BLength:               descriptor.SUPERSPEED_USB_CAPABILITY_LENGTH,
+				BDescriptorType:       descriptor.DESCRIPTOR_TYPE_DEVICE_CAPABILITY,
+				BDevCapabilityType:    descriptor.DEVICE_CAPABILITY_TYPE_SUPERSPEED_USB,
+				WSpeedsSupported:      descriptor.SUPERSPEED_USB_SPEED_HIGH | descriptor.SUPERSPEED_USB_SPEED_SUPER,
+				BFunctionalitySupport: 1,
+				BU1DevExitLat:         0x0A,
+				WU2DevExitLat:         0x07FF,
+			},
+		},
+	}
+}
+
+func TestDeviceBuildSuperSpeed(t *testing.T) {
+	tree := newSuperSpeedMassStorageTree()
+	set, err := tree.Build()
+	require.NoError(t, err)
+
+	assert.Equal(t, uint8(9), set.DeviceDescriptor().BMaxPacketSize)
+	assert.Equal(t, protocol.SPEED_USB3_SUPER, set.DeviceInfo().Speed)
+
+	configDesc, ok := set.ConfigurationByValue(1)
+	require.True(t, ok)
+	assert.Equal(t, []byte{
+		0x09, 0x02, 0x2c, 0x00, 0x01, 0x01, 0x00, 0b10000000, 0x32, // Configuration
+		0x09, 0x04, 0x00, 0x00, 0x02, 0x08, 0x06, 0x50, 0x00, // Mass storage interface
+		0x07, 0x05, 0x81, 0x02, 0x00, 0x04, 0x00, // Bulk IN endpoint
+		0x06, 0x30, 0x0f, 0x00, 0x00, 0x00, // Endpoint companion
+		0x07, 0x05, 0x02, 0x02, 0x00, 0x04, 0x00, // Bulk OUT endpoint
+		0x06, 0x30, 0x0f, 0x04, 0x00, 0x00, // Endpoint companion with 16 streams
+	}, configDesc)
+}
+
+func TestDeviceBuildSuperSpeedPlusIsochronous(t *testing.T) {
+	tree := newSuperSpeedMassStorageTree()
+	tree.Speed = protocol.SPEED_USB3_SUPER_PLUS
+	tree.Configurations[0].Interfaces[0].AltSettings[0].Endpoints = []descriptor.Endpoint{
+		{
+			BEndpointAddress: 0x81,
+			BMAttributes:     descriptor.ENDPOINT_TRANSFER_TYPE_ISOCHRONOUS,
+			WMaxPacketSize:   1024,
+			BInterval:        1,
+			SuperSpeedCompanion: &descriptor.SuperSpeedCompanion{
+				MaxBurst:                       15,
+				SuperSpeedPlusBytesPerInterval: 0x00012000,
+			},
+		},
+	}
+	set, err := tree.Build()
+	require.NoError(t, err)
+
+	configDesc, ok := set.ConfigurationByValue(1)
+	require.True(t, ok)
+	assert.Equal(t, []byte{
+		0x07, 0x05, 0x81, 0x01, 0x00, 0x04, 0x01, // Isochronous IN endpoint
+		0x06, 0x30, 0x0f, 0x80, 0x01, 0x00, // Endpoint companion followed by SuperSpeedPlus companion
+		0x08, 0x31, 0x00, 0x00, 0x00, 0x20, 0x01, 0x00, // SuperSpeedPlus isochronous endpoint companion
+	}, configDesc[descriptor.STANDARD_CONFIGURATION_DESCRIPTOR_LENGTH+descriptor.STANDARD_INTERFACE_DESCRIPTOR_LENGTH:])
+}
+
+func TestDeviceBuildInvalidSuperSpeedTree(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(tree *descriptor.Device)
+	}{
+		{
+			name: "Endpoint zero max packet size is not 512 bytes",
+			modify: func(tree *descriptor.Device) {
+				tree.BMaxPacketSize = 64
+			},
+		},
+		{
+			name: "USB 2.0 bcdUSB",
+			modify: func(tree *descriptor.Device) {
+				tree.BCDUSB = 0x0210
+			},
+		},
+		{
+			name: "No SuperSpeed USB device capability",
+			modify: func(tree *descriptor.Device) {
+				tree.Capabilities = nil
+			},
+		},
+		{
+			name: "Endpoint without companion",
+			modify: func(tree *descriptor.Device) {
+				tree.Configurations[0].Interfaces[0].AltSettings[0].Endpoints[0].SuperSpeedCompanion = nil
+			},
+		},
+		{
+			name: "Bulk endpoint max packet size is not 1024 bytes",
+			modify: func(tree *descriptor.Device) {
+				tree.Configurations[0].Interfaces[0].AltSettings[0].Endpoints[0].WMaxPacketSize = 512
+			},
+		},
+		{
+			name: "Max burst exceeds 15",
+			modify: func(tree *descriptor.Device) {
+				tree.Configurations[0].Interfaces[0].AltSettings[0].Endpoints[0].SuperSpeedCompanion.MaxBurst = 16
+			},
+		},
+		{
+			name: "Max streams exceeds 16",
+			modify: func(tree *descriptor.Device) {
+				tree.Configurations[0].Interfaces[0].AltSettings[0].Endpoints[1].SuperSpeedCompanion.MaxStreams = 17
+			},
+		},
+		{
+			name: "Mult of bulk endpoint",
+			modify: func(tree *descriptor.Device) {
+				tree.Configurations[0].Interfaces[0].AltSettings[0].Endpoints[0].SuperSpeedCompanion.Mult = 1
+			},
+		},
+		{
+			name: "Streams of interrupt endpoint",
+			modify: func(tree *descriptor.Device) {
+				endpoint := &tree.Configurations[0].Interfaces[0].AltSettings[0].Endpoints[0]
+				endpoint.BMAttributes = descriptor.ENDPOINT_TRANSFER_TYPE_INTERRUPT
+				endpoint.SuperSpeedCompanion.MaxStreams = 1
+			},
+		},
+		{
+			name: "Mult exceeds 2",
+			modify: func(tree *descriptor.Device) {
+				endpoint := &tree.Configurations[0].Interfaces[0].AltSettings[0].Endpoints[0]
+				endpoint.BMAttributes = descriptor.ENDPOINT_TRANSFER_TYPE_ISOCHRONOUS
+				endpoint.SuperSpeedCompanion.Mult = 3
+			},
+		},
+		{
+			name: "Bursting periodic endpoint max packet size is not 1024 bytes",
+			modify: func(tree *descriptor.Device) {
+				endpoint := &tree.Configurations[0].Interfaces[0].AltSettings[0].Endpoints[0]
+				endpoint.BMAttributes = descriptor.ENDPOINT_TRANSFER_TYPE_INTERRUPT
+				endpoint.WMaxPacketSize = 64
+			},
+		},
+		{
+			name: "SuperSpeedPlus isochronous companion on SuperSpeed device",
+			modify: func(tree *descriptor.Device) {
+				endpoint := &tree.Configurations[0].Interfaces[0].AltSettings[0].Endpoints[0]
+				endpoint.BMAttributes = descriptor.ENDPOINT_TRANSFER_TYPE_ISOCHRONOUS
+				endpoint.SuperSpeedCompanion.SuperSpeedPlusBytesPerInterval = 0x00012000
+			},
+		},
+		{
+			name: "Companion on high speed device",
+			modify: func(tree *descriptor.Device) {
+				tree.Speed = protocol.SPEED_USB2_HIGH
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			tree := newSuperSpeedMassStorageTree()
+			test.modify(&tree)
+			_, err := tree.Build()
+			assert.ErrorIs(t, err, descriptor.ErrInvalidDescriptorTree)
+		})
+	}
+}
+
+func TestDeviceBuildOtherSpeed(t *testing.T) {
+	tree := newMouseDeviceTree()
+	set, err := tree.Build()
+	require.NoError(t, err)
+
+	qualifier, err := set.GetDescriptor(descriptor.DESCRIPTOR_TYPE_DEVICE_QUALIFIER, 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0x0a, 0x06, 0x00, 0x02, 0x00, 0x00, 0x00, 0x40, 0x01, 0x00}, qualifier)
+
+	otherSpeedConfig, err := set.GetDescriptor(descriptor.DESCRIPTOR_TYPE_OTHER_SPEED_CONFIGURATION, 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{
+		0x09, 0x07, 0x22, 0x00, 0x01, 0x01, 0x04, 0b10100000, 0x32, // Other speed configuration
+		0x09, 0x04, 0x00, 0x00, 0x01, 0x03, 0x01, 0x02, 0x05, // Interface
+		0x09, 0x21, 0x11, 0x01, 0x00, 0x01, 0x22, 0x34, 0x00, // HID
+		0x07, 0x05, 0x81, 0x03, 0x08, 0x00, 0x40, // Endpoint polled every 64 frames
+	}, otherSpeedConfig)
+
+	_, err = set.GetDescriptor(descriptor.DESCRIPTOR_TYPE_OTHER_SPEED_CONFIGURATION, 1, 0)
+	assert.ErrorIs(t, err, descriptor.ErrDescriptorNotFound)
+
+	// Full-speed device has no other speed
+	tree.Speed = protocol.SPEED_USB1_FULL
+	set, err = tree.Build()
+	require.NoError(t, err)
+	_, err = set.GetDescriptor(descriptor.DESCRIPTOR_TYPE_DEVICE_QUALIFIER, 0, 0)
+	assert.ErrorIs(t, err, descriptor.ErrDescriptorNotFound)
+	_, err = set.GetDescriptor(descriptor.DESCRIPTOR_TYPE_OTHER_SPEED_CONFIGURATION, 0, 0)
+	assert.ErrorIs(t, err, descriptor.ErrDescriptorNotFound)
+}
+
+func TestDeviceBuildOtherSpeedEndpoint(t *testing.T) {
+	tests := []struct {
+		name     string
+		endpoint descriptor.Endpoint
+		expected []byte
+	}{
+		{
+			name:     "Bulk",
+			endpoint: descriptor.Endpoint{BEndpointAddress: 0x81, BMAttributes: 0x02, WMaxPacketSize: 512, BInterval: 1},
+			expected: []byte{0x07, 0x05, 0x81, 0x02, 0x40, 0x00, 0x00},
+		},
+		{
+			name:     "Interrupt every microframe",
+			endpoint: descriptor.Endpoint{BEndpointAddress: 0x81, BMAttributes: 0x03, WMaxPacketSize: 1024, BInterval: 1},
+			expected: []byte{0x07, 0x05, 0x81, 0x03, 0x40, 0x00, 0x01},
+		},
+		{
+			name:     "Interrupt with longest interval",
+			endpoint: descriptor.Endpoint{BEndpointAddress: 0x81, BMAttributes: 0x03, WMaxPacketSize: 64, BInterval: 16},
+			expected: []byte{0x07, 0x05, 0x81, 0x03, 0x40, 0x00, 0xff},
+		},
+		{
+			name:     "High-bandwidth isochronous",
+			endpoint: descriptor.Endpoint{BEndpointAddress: 0x81, BMAttributes: 0x05, WMaxPacketSize: 0x1400, BInterval: 4},
+			expected: []byte{0x07, 0x05, 0x81, 0x05, 0xff, 0x03, 0x01},
+		},
+		{
+			name:     "Isochronous every 8 frames",
+			endpoint: descriptor.Endpoint{BEndpointAddress: 0x81, BMAttributes: 0x01, WMaxPacketSize: 192, BInterval: 7},
+			expected: []byte{0x07, 0x05, 0x81, 0x01, 0xc0, 0x00, 0x04},
+		},
+		{
+			name: "Explicit full-speed values",
+			endpoint: descriptor.Endpoint{
+				BEndpointAddress: 0x81,
+				BMAttributes:     0x03,
+				WMaxPacketSize:   64,
+				BInterval:        4,
+				OtherSpeed:       &descriptor.OtherSpeedEndpoint{WMaxPacketSize: 32, BInterval: 10},
+			},
+			expected: []byte{0x07, 0x05, 0x81, 0x03, 0x20, 0x00, 0x0a},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			tree := newMouseDeviceTree()
+			tree.Configurations[0].Interfaces[0].AltSettings[0].Endpoints = []descriptor.Endpoint{test.endpoint}
+			set, err := tree.Build()
+			require.NoError(t, err)
+
+			otherSpeedConfig, ok := set.OtherSpeedConfiguration(0)
+			require.True(t, ok)
+			assert.Equal(t, test.expected, otherSpeedConfig[len(otherSpeedConfig)-descriptor.STANDARD_ENDPOINT_DESCRIPTOR_LENGTH:])
+
+			// Configuration descriptor keeps high-speed values
+			config, ok := set.Configuration(0)
+			require.True(t, ok)
+			endpointDesc := config[len(config)-descriptor.STANDARD_ENDPOINT_DESCRIPTOR_LENGTH:]
+			assert.Equal(t, test.endpoint.BInterval, endpointDesc[6])
+		})
+	}
+}
+
+func TestDeviceBuildInvalidOtherSpeedTree(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(tree *descriptor.Device)
+	}{
+		{
+			name: "Other speed values of full-speed device",
+			modify: func(tree *descriptor.Device) {
+				tree.Speed = protocol.SPEED_USB1_FULL
+				endpoint := &tree.Configurations[0].Interfaces[0].AltSettings[0].Endpoints[0]
+				endpoint.OtherSpeed = &descriptor.OtherSpeedEndpoint{WMaxPacketSize: 8, BInterval: 10}
+			},
+		},
+		{
+			name: "Full-speed max packet size exceeds 64",
+			modify: func(tree *descriptor.Device) {
+				endpoint := &tree.Configurations[0].Interfaces[0].AltSettings[0].Endpoints[0]
+				endpoint.OtherSpeed = &descriptor.OtherSpeedEndpoint{WMaxPacketSize: 512, BInterval: 10}
+			},
+		},
+		{
+			name: "Full-speed interrupt interval is zero",
+			modify: func(tree *descriptor.Device) {
+				endpoint := &tree.Configurations[0].Interfaces[0].AltSettings[0].Endpoints[0]
+				endpoint.OtherSpeed = &descriptor.OtherSpeedEndpoint{WMaxPacketSize: 8}
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			tree := newMouseDeviceTree()
+			test.modify(&tree)
+			_, err := tree.Build()
+			assert.ErrorIs(t, err, descriptor.ErrInvalidDescriptorTree)
+		})
+	}
+}
@@ -8,6 +8,8 @@ const (
 	DESCRIPTOR_TYPE_STRING                                          DescriptorType = 3
 	DESCRIPTOR_TYPE_INTERFACE                                       DescriptorType = 4
 	DESCRIPTOR_TYPE_ENDPOINT                                        DescriptorType = 5
+	DESCRIPTOR_TYPE_DEVICE_QUALIFIER                                DescriptorType = 6
+	DESCRIPTOR_TYPE_OTHER_SPEED_CONFIGURATION                       DescriptorType = 7
 	DESCRIPTOR_TYPE_INTERFACE_POWER                                 DescriptorType = 8
 	DESCRIPTOR_TYPE_OTG                                             DescriptorType = 9
 	DESCRIPTOR_TYPE_DEBUG                                           DescriptorType = 10
@@ -29,6 +31,9 @@ const (
 	STANDARD_CONFIGURATION_DESCRIPTOR_LENGTH = 9
 	STANDARD_INTERFACE_DESCRIPTOR_LENGTH     = 9
 	STANDARD_ENDPOINT_DESCRIPTOR_LENGTH      = 7
+	INTERFACE_ASSOCIATION_DESCRIPTOR_LENGTH  = 8
+	BOS_DESCRIPTOR_LENGTH                    = 5
+	DEVICE_QUALIFIER_DESCRIPTOR_LENGTH       = 10
 )
 
 type LangID uint16
@@ -0,0 +1,110 @@
+package descriptor
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/ntchjb/usbip-virtual-device/usbip/stream"
+)
+
+// DeviceQualifierDescriptor describes information of high-speed capable device
+// that would change if the device were operating at the other speed
+type DeviceQualifierDescriptor struct {
+	// Size of this descriptor in bytes.
+	BLength uint8
+	// Device qualifier descriptor type.
+	BDescriptorType DescriptorType
+	// USB Specification Release, in BCD (must be at least 0x0200).
+	BCDUSB uint16
+	// Class code at the other speed.
+	BDeviceClass uint8
+	// Subclass code at the other speed.
+	BDeviceSubClass uint8
+	// Protocol code at the other speed.
+	BDeviceProtocol uint8
+	// Maximum packet size for endpoint zero at the other speed.
+	BMaxPacketSize0 uint8
+	// Number of other-speed configurations.
+	BNumConfigurations uint8
+	// Reserved for future use, must be zero.
+	BReserved uint8
+}
+
+func (s *DeviceQualifierDescriptor) Decode(reader io.Reader) error {
+	buf, err := stream.Read(reader, DEVICE_QUALIFIER_DESCRIPTOR_LENGTH)
+	if err != nil {
+		return fmt.Errorf("unable to read device qualifier descriptor from stream: %w", err)
+	}
+
+	s.BLength = buf[0]
+	s.BDescriptorType = DescriptorType(buf[1])
+	s.BCDUSB = binary.LittleEndian.Uint16(buf[2:4])
+	s.BDeviceClass = buf[4]
+	s.BDeviceSubClass = buf[5]
+	s.BDeviceProtocol = buf[6]
+	s.BMaxPacketSize0 = buf[7]
+	s.BNumConfigurations = buf[8]
+	s.BReserved = buf[9]
+
+	return nil
+}
+
+func (s *DeviceQualifierDescriptor) Encode(writer io.Writer) error {
+	buf := make([]byte, DEVICE_QUALIFIER_DESCRIPTOR_LENGTH)
+
+	buf[0] = s.BLength
+	buf[1] = byte(s.BDescriptorType)
+	binary.LittleEndian.PutUint16(buf[2:4], s.BCDUSB)
+	buf[4] = s.BDeviceClass
+	buf[5] = s.BDeviceSubClass
+	buf[6] = s.BDeviceProtocol
+	buf[7] = s.BMaxPacketSize0
+	buf[8] = s.BNumConfigurations
+	buf[9] = s.BReserved
+
+	if err := stream.Write(writer, buf); err != nil {
+		return fmt.Errorf("unable to write device qualifier descriptor to stream: %w", err)
+	}
+
+	return nil
+}
+
+// OtherSpeedConfigurationDescriptor describes a configuration of high-speed capable device
+// if it were operating at the other speed. Its layout is the same as configuration descriptor,
+// and it is followed by interface and endpoint descriptors of the other speed.
+type OtherSpeedConfigurationDescriptor struct {
+	// Size of this descriptor in bytes.
+	BLength uint8
+	// Other speed configuration descriptor type.
+	BDescriptorType DescriptorType
+	// Total length of data returned for this configuration.
+	WTotalLength uint16
+	// Number of interfaces supported by this configuration.
+	BNumInterfaces uint8
+	// Value to use as an argument to Set Configuration to select this configuration.
+	BConfigurationValue uint8
+	// Index of string descriptor describing this configuration.
+	IConfiguration uint8
+	// Configuration characteristics
+	// (D7: Reserved (set to 1), D6: Self Powered, D5: Remote Wakeup, D4..0: Reserved (reset to 0))
+	BMAttributes uint8
+	// Maximum power consumption, expressed in 2 mA units
+	BMaxPower uint8
+}
+
+func (s *OtherSpeedConfigurationDescriptor) Decode(reader io.Reader) error {
+	if err := (*StandardConfigurationDescriptor)(s).Decode(reader); err != nil {
+		return fmt.Errorf("unable to decode other speed configuration descriptor: %w", err)
+	}
+
+	return nil
+}
+
+func (s *OtherSpeedConfigurationDescriptor) Encode(writer io.Writer) error {
+	if err := (*StandardConfigurationDescriptor)(s).Encode(writer); err != nil {
+		return fmt.Errorf("unable to encode other speed configuration descriptor: %w", err)
+	}
+
+	return nil
+}
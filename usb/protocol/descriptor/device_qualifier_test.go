@@ -0,0 +1,95 @@
+package descriptor_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ntchjb/usbip-virtual-device/usb/protocol/descriptor"
+	usbipprot "github.com/ntchjb/usbip-virtual-device/usbip/protocol"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeviceQualifierDescriptors(t *testing.T) {
+	tests := []struct {
+		name   string
+		obj    usbipprot.Serializer
+		bin    []byte
+		newObj func() usbipprot.Serializer
+		encErr error
+		decErr error
+	}{
+		{
+			name: "DeviceQualifierDescriptor",
+			obj: &descriptor.DeviceQualifierDescriptor{
+				BLength:            descriptor.DEVICE_QUALIFIER_DESCRIPTOR_LENGTH,
+				BDescriptorType:    descriptor.DESCRIPTOR_TYPE_DEVICE_QUALIFIER,
+				BCDUSB:             0x0200,
+				BDeviceClass:       0xEF,
+				BDeviceSubClass:    0x02,
+				BDeviceProtocol:    0x01,
+				BMaxPacketSize0:    64,
+				BNumConfigurations: 1,
+			},
+			bin: []byte{
+				0x0a,
+				0x06,
+				0x00, 0x02,
+				0xef,
+				0x02,
+				0x01,
+				0x40,
+				0x01,
+				0x00,
+			},
+			newObj: func() usbipprot.Serializer {
+				return &descriptor.DeviceQualifierDescriptor{}
+			},
+			encErr: nil,
+			decErr: nil,
+		},
+		{
+			name: "OtherSpeedConfigurationDescriptor",
+			obj: &descriptor.OtherSpeedConfigurationDescriptor{
+				BLength:             descriptor.STANDARD_CONFIGURATION_DESCRIPTOR_LENGTH,
+				BDescriptorType:     descriptor.DESCRIPTOR_TYPE_OTHER_SPEED_CONFIGURATION,
+				WTotalLength:        0x0022,
+				BNumInterfaces:      0x01,
+				BConfigurationValue: 0x01,
+				IConfiguration:      0x04,
+				BMAttributes:        0b10100000,
+				BMaxPower:           0x32,
+			},
+			bin: []byte{
+				0x09,
+				0x07,
+				0x22, 0x00,
+				0x01,
+				0x01,
+				0x04,
+				0b10100000,
+				0x32,
+			},
+			newObj: func() usbipprot.Serializer {
+				return &descriptor.OtherSpeedConfigurationDescriptor{}
+			},
+			encErr: nil,
+			decErr: nil,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			writer := new(bytes.Buffer)
+			err := test.obj.Encode(writer)
+
+			assert.ErrorIs(t, err, test.encErr)
+			assert.Equal(t, test.bin, writer.Bytes())
+
+			newObj := test.newObj()
+			err = newObj.Decode(writer)
+
+			assert.ErrorIs(t, err, test.decErr)
+			assert.Equal(t, test.obj, newObj)
+		})
+	}
+}
@@ -8,6 +8,15 @@ import (
 	"github.com/ntchjb/usbip-virtual-device/usbip/stream"
 )
 
+// Transfer types in D0..1 of endpoint bmAttributes
+const (
+	ENDPOINT_TRANSFER_TYPE_MASK        uint8 = 0b11
+	ENDPOINT_TRANSFER_TYPE_CONTROL     uint8 = 0b00
+	ENDPOINT_TRANSFER_TYPE_ISOCHRONOUS uint8 = 0b01
+	ENDPOINT_TRANSFER_TYPE_BULK        uint8 = 0b10
+	ENDPOINT_TRANSFER_TYPE_INTERRUPT   uint8 = 0b11
+)
+
 type StandardEndpointDescriptor struct {
 	// Size of this descriptor in bytes.
 	BLength uint8
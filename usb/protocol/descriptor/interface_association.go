@@ -0,0 +1,66 @@
+package descriptor
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/ntchjb/usbip-virtual-device/usbip/stream"
+)
+
+// InterfaceAssociationDescriptor groups consecutive interfaces of a function in composite device,
+// as defined by Interface Association Descriptor ECN of USB 2.0
+type InterfaceAssociationDescriptor struct {
+	// Size of this descriptor in bytes.
+	BLength uint8
+	// Interface association descriptor type (assigned by USB).
+	BDescriptorType DescriptorType
+	// Interface number of the first interface that is associated with this function.
+	BFirstInterface uint8
+	// Number of contiguous interfaces that are associated with this function.
+	BInterfaceCount uint8
+	// Class code (assigned by USB-IF) of this function.
+	BFunctionClass uint8
+	// Subclass code (assigned by USB-IF) of this function.
+	BFunctionSubClass uint8
+	// Protocol code (assigned by USB-IF) of this function.
+	BFunctionProtocol uint8
+	// Index of string descriptor describing this function.
+	IFunction uint8
+}
+
+func (s *InterfaceAssociationDescriptor) Decode(reader io.Reader) error {
+	buf, err := stream.Read(reader, INTERFACE_ASSOCIATION_DESCRIPTOR_LENGTH)
+	if err != nil {
+		return fmt.Errorf("unable to read interface association descriptor from stream: %w", err)
+	}
+
+	s.BLength = buf[0]
+	s.BDescriptorType = DescriptorType(buf[1])
+	s.BFirstInterface = buf[2]
+	s.BInterfaceCount = buf[3]
+	s.BFunctionClass = buf[4]
+	s.BFunctionSubClass = buf[5]
+	s.BFunctionProtocol = buf[6]
+	s.IFunction = buf[7]
+
+	return nil
+}
+
+func (s *InterfaceAssociationDescriptor) Encode(writer io.Writer) error {
+	buf := make([]byte, INTERFACE_ASSOCIATION_DESCRIPTOR_LENGTH)
+
+	buf[0] = s.BLength
+	buf[1] = uint8(s.BDescriptorType)
+	buf[2] = s.BFirstInterface
+	buf[3] = s.BInterfaceCount
+	buf[4] = s.BFunctionClass
+	buf[5] = s.BFunctionSubClass
+	buf[6] = s.BFunctionProtocol
+	buf[7] = s.IFunction
+
+	if err := stream.Write(writer, buf); err != nil {
+		return fmt.Errorf("unable to write interface association descriptor to stream: %w", err)
+	}
+
+	return nil
+}
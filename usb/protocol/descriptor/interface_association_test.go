@@ -0,0 +1,67 @@
+package descriptor_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ntchjb/usbip-virtual-device/usb/protocol"
+	"github.com/ntchjb/usbip-virtual-device/usb/protocol/descriptor"
+	usbipprot "github.com/ntchjb/usbip-virtual-device/usbip/protocol"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInterfaceAssociationDescriptor(t *testing.T) {
+	tests := []struct {
+		name   string
+		obj    usbipprot.Serializer
+		bin    []byte
+		newObj func() usbipprot.Serializer
+		encErr error
+		decErr error
+	}{
+		{
+			name: "InterfaceAssociationDescriptor",
+			obj: &descriptor.InterfaceAssociationDescriptor{
+				BLength:           descriptor.INTERFACE_ASSOCIATION_DESCRIPTOR_LENGTH,
+				BDescriptorType:   descriptor.DESCRIPTOR_TYPE_INTERFACE_ASSOCIATION,
+				BFirstInterface:   0x01,
+				BInterfaceCount:   0x02,
+				BFunctionClass:    protocol.CLASS_CDC_CONTROL,
+				BFunctionSubClass: 0x02,
+				BFunctionProtocol: 0x01,
+				IFunction:         0x04,
+			},
+			bin: []byte{
+				0x08,
+				0x0b,
+				0x01,
+				0x02,
+				0x02,
+				0x02,
+				0x01,
+				0x04,
+			},
+			newObj: func() usbipprot.Serializer {
+				return &descriptor.InterfaceAssociationDescriptor{}
+			},
+			encErr: nil,
+			decErr: nil,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			writer := new(bytes.Buffer)
+			err := test.obj.Encode(writer)
+
+			assert.ErrorIs(t, err, test.encErr)
+			assert.Equal(t, test.bin, writer.Bytes())
+
+			newObj := test.newObj()
+			err = newObj.Decode(writer)
+
+			assert.ErrorIs(t, err, test.decErr)
+			assert.Equal(t, test.obj, newObj)
+		})
+	}
+}
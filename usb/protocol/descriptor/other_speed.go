@@ -0,0 +1,135 @@
+package descriptor
+
+import (
+	"fmt"
+
+	usbprotocol "github.com/ntchjb/usbip-virtual-device/usb/protocol"
+)
+
+const (
+	// Maximum packet size of full-speed control, bulk and interrupt endpoints
+	FULL_SPEED_MAX_PACKET_SIZE = 64
+	// Maximum packet size of full-speed isochronous endpoint
+	FULL_SPEED_MAX_ISOCHRONOUS_PACKET_SIZE = 1023
+)
+
+// OtherSpeedEndpoint is values of an endpoint of high-speed device when it operates at full speed
+type OtherSpeedEndpoint struct {
+	WMaxPacketSize uint16
+	BInterval      uint8
+}
+
+func (d *Device) isHighSpeed() bool {
+	return d.Speed == usbprotocol.SPEED_USB2_HIGH
+}
+
+// otherSpeed returns a copy of resolved configuration with endpoint values of full speed
+func (c *Configuration) otherSpeed() (Configuration, error) {
+	otherSpeed := *c
+	otherSpeed.Interfaces = make([]Interface, len(c.Interfaces))
+	for i, intf := range c.Interfaces {
+		otherSpeed.Interfaces[i] = intf.clone()
+		for j := range otherSpeed.Interfaces[i].AltSettings {
+			endpoints := otherSpeed.Interfaces[i].AltSettings[j].Endpoints
+			for k := range endpoints {
+				fullSpeed := endpoints[k].fullSpeed()
+				if err := fullSpeed.validateFullSpeed(endpoints[k].BMAttributes); err != nil {
+					return Configuration{}, fmt.Errorf("endpoint 0x%02x of interface %d alternate setting %d: %w", endpoints[k].BEndpointAddress, i, j, err)
+				}
+				endpoints[k].WMaxPacketSize = fullSpeed.WMaxPacketSize
+				endpoints[k].BInterval = fullSpeed.BInterval
+				endpoints[k].OtherSpeed = nil
+			}
+		}
+	}
+
+	return otherSpeed, nil
+}
+
+// fullSpeed returns full-speed values of high-speed endpoint, derived from high-speed values if OtherSpeed is nil.
+// Packet sizes are limited to full-speed maximum, and intervals are converted from microframes to frames.
+func (e *Endpoint) fullSpeed() OtherSpeedEndpoint {
+	if e.OtherSpeed != nil {
+		return *e.OtherSpeed
+	}
+
+	// D12..11 of high-speed periodic endpoint is number of additional transactions per microframe
+	maxPacketSize := e.WMaxPacketSize & 0x07FF
+	switch e.BMAttributes & ENDPOINT_TRANSFER_TYPE_MASK {
+	case ENDPOINT_TRANSFER_TYPE_ISOCHRONOUS:
+		// Interval is 2^(bInterval-1) microframes at high speed and 2^(bInterval-1) frames at full speed
+		interval := uint8(1)
+		if e.BInterval > 4 {
+			interval = e.BInterval - 3
+		}
+		return OtherSpeedEndpoint{
+			WMaxPacketSize: min(maxPacketSize, FULL_SPEED_MAX_ISOCHRONOUS_PACKET_SIZE),
+			BInterval:      interval,
+		}
+	case ENDPOINT_TRANSFER_TYPE_INTERRUPT:
+		// Interval is 2^(bInterval-1) microframes at high speed and bInterval frames at full speed
+		interval := uint8(1)
+		if e.BInterval >= 12 {
+			interval = 255
+		} else if e.BInterval > 4 {
+			interval = 1 << (e.BInterval - 4)
+		}
+		return OtherSpeedEndpoint{
+			WMaxPacketSize: min(maxPacketSize, FULL_SPEED_MAX_PACKET_SIZE),
+			BInterval:      interval,
+		}
+	default:
+		// Interval of bulk endpoint is NAK rate at high speed, which is ignored at full speed
+		return OtherSpeedEndpoint{
+			WMaxPacketSize: min(maxPacketSize, FULL_SPEED_MAX_PACKET_SIZE),
+		}
+	}
+}
+
+func (e *OtherSpeedEndpoint) validateFullSpeed(attributes uint8) error {
+	maxPacketSize := uint16(FULL_SPEED_MAX_PACKET_SIZE)
+	transferType := attributes & ENDPOINT_TRANSFER_TYPE_MASK
+	if transferType == ENDPOINT_TRANSFER_TYPE_ISOCHRONOUS {
+		maxPacketSize = FULL_SPEED_MAX_ISOCHRONOUS_PACKET_SIZE
+	}
+	if e.WMaxPacketSize > maxPacketSize {
+		return fmt.Errorf("%w: max packet size %d of full-speed endpoint exceeds %d", ErrInvalidDescriptorTree, e.WMaxPacketSize, maxPacketSize)
+	}
+	if (transferType == ENDPOINT_TRANSFER_TYPE_ISOCHRONOUS || transferType == ENDPOINT_TRANSFER_TYPE_INTERRUPT) && e.BInterval == 0 {
+		return fmt.Errorf("%w: interval of full-speed periodic endpoint must not be zero", ErrInvalidDescriptorTree)
+	}
+	if transferType == ENDPOINT_TRANSFER_TYPE_ISOCHRONOUS && e.BInterval > 16 {
+		return fmt.Errorf("%w: interval %d of full-speed isochronous endpoint exceeds 16", ErrInvalidDescriptorTree, e.BInterval)
+	}
+
+	return nil
+}
+
+// buildOtherSpeed builds device qualifier and other speed configuration descriptors of high-speed device,
+// describing the device operating at full speed
+func (d *Device) buildOtherSpeed(set *DescriptorSet, table *stringTable) error {
+	set.deviceQualifier = &DeviceQualifierDescriptor{
+		BLength:            DEVICE_QUALIFIER_DESCRIPTOR_LENGTH,
+		BDescriptorType:    DESCRIPTOR_TYPE_DEVICE_QUALIFIER,
+		BCDUSB:             set.device.BCDUSB,
+		BDeviceClass:       set.device.BDeviceClass,
+		BDeviceSubClass:    set.device.BDeviceSubClass,
+		BDeviceProtocol:    set.device.BDeviceProtocol,
+		BMaxPacketSize0:    set.device.BMaxPacketSize,
+		BNumConfigurations: set.device.BNumConfigurations,
+	}
+
+	for i, config := range set.configTrees {
+		otherSpeed, err := config.otherSpeed()
+		if err != nil {
+			return fmt.Errorf("invalid other speed configuration %d: %w", set.configValues[i], err)
+		}
+		buf, err := otherSpeed.build(set.configValues[i], DESCRIPTOR_TYPE_OTHER_SPEED_CONFIGURATION, table)
+		if err != nil {
+			return fmt.Errorf("unable to build other speed configuration %d: %w", set.configValues[i], err)
+		}
+		set.otherSpeedConfigurations = append(set.otherSpeedConfigurations, buf)
+	}
+
+	return nil
+}
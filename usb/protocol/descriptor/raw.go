@@ -0,0 +1,97 @@
+package descriptor
+
+import (
+	"fmt"
+
+	"github.com/ntchjb/usbip-virtual-device/usbip/protocol/op"
+)
+
+// RawDevice is descriptors captured from a real device, such as from Linux sysfs,
+// which is built into DescriptorSet replying GET_DESCRIPTOR with the same bytes as the real device.
+type RawDevice struct {
+	// Standard device descriptor, replied as is
+	Device StandardDeviceDescriptor
+	// Serialized configuration descriptors with all descriptors of each configuration, in order of configuration index
+	Configurations [][]byte
+	// Descriptor trees of Configurations, used by StandardDevice for SET_CONFIGURATION, SET_INTERFACE and endpoint routing.
+	// Interfaces and alternate settings are looked up by their BInterfaceNumber and BAlternateSetting, which must be unique.
+	ConfigurationTrees []Configuration
+	// Strings by string descriptor index. Indexes without string have no string descriptor.
+	Strings map[uint8]string
+	// Supported languages of string descriptors, defaults to English (United States)
+	LangIDs []LangID
+	// Serialized BOS descriptor, there is no BOS descriptor if empty
+	BOS []byte
+	// Device information reported in USB/IP device list
+	DeviceInfo op.DeviceInfo
+}
+
+// Build validates captured descriptors and builds them into DescriptorSet.
+// Device qualifier and other speed configuration descriptors are not built, as they're not derived from captured descriptors.
+func (d *RawDevice) Build() (*DescriptorSet, error) {
+	if len(d.Configurations) == 0 {
+		return nil, fmt.Errorf("%w: device has no configuration", ErrInvalidDescriptorTree)
+	}
+	if len(d.Configurations) != len(d.ConfigurationTrees) {
+		return nil, fmt.Errorf("%w: device has %d configurations, but %d configuration trees", ErrInvalidDescriptorTree, len(d.Configurations), len(d.ConfigurationTrees))
+	}
+
+	set := &DescriptorSet{
+		device:     d.Device,
+		langIDs:    d.LangIDs,
+		deviceInfo: d.DeviceInfo,
+	}
+	if len(set.langIDs) == 0 {
+		set.langIDs = []LangID{LANGID_ENGLISH_UNITED_STATES}
+	}
+	set.deviceInfo.Interfaces = append([]op.DeviceInterface(nil), d.DeviceInfo.Interfaces...)
+
+	for i, config := range d.Configurations {
+		if len(config) < STANDARD_CONFIGURATION_DESCRIPTOR_LENGTH || DescriptorType(config[1]) != DESCRIPTOR_TYPE_CONFIGURATION {
+			return nil, fmt.Errorf("%w: configuration %d is not configuration descriptor", ErrInvalidDescriptorTree, i)
+		}
+		configValue := config[5]
+		if _, ok := set.ConfigurationByValue(configValue); ok {
+			return nil, fmt.Errorf("%w: duplicated configuration value %d", ErrInvalidDescriptorTree, configValue)
+		}
+		tree := d.ConfigurationTrees[i]
+		interfaceNumbers := make(map[uint8]bool)
+		for _, intf := range tree.Interfaces {
+			if interfaceNumbers[intf.BInterfaceNumber] {
+				return nil, fmt.Errorf("%w: duplicated interface %d in configuration %d", ErrInvalidDescriptorTree, intf.BInterfaceNumber, configValue)
+			}
+			interfaceNumbers[intf.BInterfaceNumber] = true
+			if len(intf.AltSettings) == 0 {
+				return nil, fmt.Errorf("%w: interface %d of configuration %d has no alternate setting", ErrInvalidDescriptorTree, intf.BInterfaceNumber, configValue)
+			}
+			altSettings := make(map[uint8]bool)
+			for _, altSetting := range intf.AltSettings {
+				if altSettings[altSetting.BAlternateSetting] {
+					return nil, fmt.Errorf("%w: duplicated alternate setting %d of interface %d in configuration %d", ErrInvalidDescriptorTree, altSetting.BAlternateSetting, intf.BInterfaceNumber, configValue)
+				}
+				altSettings[altSetting.BAlternateSetting] = true
+			}
+		}
+		tree.BConfigurationValue = configValue
+
+		set.configurations = append(set.configurations, append([]byte(nil), config...))
+		set.configValues = append(set.configValues, configValue)
+		set.configTrees = append(set.configTrees, tree)
+	}
+
+	for index, s := range d.Strings {
+		if index == 0 || s == "" {
+			continue
+		}
+		if len(set.strings) < int(index) {
+			set.strings = append(set.strings, make([]string, int(index)-len(set.strings))...)
+		}
+		set.strings[index-1] = s
+	}
+
+	if len(d.BOS) > 0 {
+		set.bos = append([]byte(nil), d.BOS...)
+	}
+
+	return set, nil
+}
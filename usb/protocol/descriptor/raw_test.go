@@ -0,0 +1,170 @@
+package descriptor_test
+
+import (
+	"testing"
+
+	"github.com/ntchjb/usbip-virtual-device/usb/protocol"
+	"github.com/ntchjb/usbip-virtual-device/usb/protocol/descriptor"
+	"github.com/ntchjb/usbip-virtual-device/usbip/protocol/op"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newRawVendorDevice() descriptor.RawDevice {
+	info := op.DeviceInfo{
+		Interfaces: []op.DeviceInterface{{BInterfaceClass: protocol.CLASS_VENDOR_SPECIFIC}},
+	}
+	info.Speed = protocol.SPEED_USB2_HIGH
+	info.BConfigurationValue = 2
+
+	return descriptor.RawDevice{
+		Device: descriptor.StandardDeviceDescriptor{
+			BLength:            descriptor.STANDARD_DEVICE_DESCRIPTOR_LENGTH,
+			BDescriptorType:    descriptor.DESCRIPTOR_TYPE_DEVICE,
+			BCDUSB:             0x0200,
+			BMaxPacketSize:     64,
+			IProduct:           5,
+			BNumConfigurations: 1,
+		},
+		Configurations: [][]byte{
+			{
+				0x09, 0x02, 0x12, 0x00, 0x01, 0x02, 0x00, 0x80, 0x32,
+				0x09, 0x04, 0x00, 0x00, 0x00, 0xff, 0x00, 0x00, 0x00,
+			},
+		},
+		ConfigurationTrees: []descriptor.Configuration{
+			{
+				BMAttributes: 0x80,
+				Interfaces: []descriptor.Interface{
+					{AltSettings: []descriptor.AltSetting{{BInterfaceClass: protocol.CLASS_VENDOR_SPECIFIC}}},
+				},
+			},
+		},
+		Strings:    map[uint8]string{5: "Captured Device"},
+		DeviceInfo: info,
+	}
+}
+
+func TestRawDeviceBuild(t *testing.T) {
+	raw := newRawVendorDevice()
+
+	set, err := raw.Build()
+	require.NoError(t, err)
+
+	device, err := set.GetDescriptor(descriptor.DESCRIPTOR_TYPE_DEVICE, 0, 0)
+	require.NoError(t, err)
+	assert.Equal(t, uint8(5), device[15])
+	config, err := set.GetDescriptor(descriptor.DESCRIPTOR_TYPE_CONFIGURATION, 0, 0)
+	require.NoError(t, err)
+	assert.Equal(t, raw.Configurations[0], config)
+
+	tree, ok := set.ConfigurationTree(2)
+	require.True(t, ok)
+	assert.Equal(t, uint8(2), tree.BConfigurationValue)
+	assert.Equal(t, raw.DeviceInfo, set.DeviceInfo())
+
+	product, ok := set.String(5)
+	assert.True(t, ok)
+	assert.Equal(t, "Captured Device", product)
+	for _, index := range []uint8{1, 4, 6} {
+		_, err = set.GetDescriptor(descriptor.DESCRIPTOR_TYPE_STRING, index, descriptor.LANGID_ENGLISH_UNITED_STATES)
+		assert.ErrorIs(t, err, descriptor.ErrDescriptorNotFound)
+	}
+	_, err = set.GetDescriptor(descriptor.DESCRIPTOR_TYPE_BOS, 0, 0)
+	assert.ErrorIs(t, err, descriptor.ErrDescriptorNotFound)
+	_, ok = set.DeviceQualifier()
+	assert.False(t, ok)
+}
+
+func TestRawDeviceBuildNumberGap(t *testing.T) {
+	raw := newRawVendorDevice()
+	raw.ConfigurationTrees[0].Interfaces = []descriptor.Interface{
+		{
+			BInterfaceNumber: 2,
+			AltSettings: []descriptor.AltSetting{
+				{BInterfaceClass: protocol.CLASS_VENDOR_SPECIFIC},
+				{
+					BAlternateSetting: 3,
+					BInterfaceClass:   protocol.CLASS_VENDOR_SPECIFIC,
+					Endpoints:         []descriptor.Endpoint{{BEndpointAddress: 0x81, BMAttributes: 0x02, WMaxPacketSize: 512}},
+				},
+			},
+		},
+	}
+
+	set, err := raw.Build()
+	require.NoError(t, err)
+
+	altSetting, ok := set.AltSetting(2, 2, 3)
+	require.True(t, ok)
+	assert.Equal(t, uint8(0x81), altSetting.Endpoints[0].BEndpointAddress)
+	_, ok = set.AltSetting(2, 2, 1)
+	assert.False(t, ok)
+	_, ok = set.Interface(2, 0)
+	assert.False(t, ok)
+}
+
+func TestRawDeviceBuildInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(raw *descriptor.RawDevice)
+	}{
+		{
+			name: "No configuration",
+			modify: func(raw *descriptor.RawDevice) {
+				raw.Configurations = nil
+				raw.ConfigurationTrees = nil
+			},
+		},
+		{
+			name: "Missing configuration tree",
+			modify: func(raw *descriptor.RawDevice) {
+				raw.ConfigurationTrees = nil
+			},
+		},
+		{
+			name: "Not configuration descriptor",
+			modify: func(raw *descriptor.RawDevice) {
+				raw.Configurations[0][1] = byte(descriptor.DESCRIPTOR_TYPE_INTERFACE)
+			},
+		},
+		{
+			name: "Duplicated configuration value",
+			modify: func(raw *descriptor.RawDevice) {
+				raw.Configurations = append(raw.Configurations, raw.Configurations[0])
+				raw.ConfigurationTrees = append(raw.ConfigurationTrees, raw.ConfigurationTrees[0])
+			},
+		},
+		{
+			name: "Interface without alternate setting",
+			modify: func(raw *descriptor.RawDevice) {
+				raw.ConfigurationTrees[0].Interfaces = append(raw.ConfigurationTrees[0].Interfaces, descriptor.Interface{BInterfaceNumber: 1})
+			},
+		},
+		{
+			name: "Duplicated interface",
+			modify: func(raw *descriptor.RawDevice) {
+				raw.ConfigurationTrees[0].Interfaces = append(raw.ConfigurationTrees[0].Interfaces, raw.ConfigurationTrees[0].Interfaces[0])
+			},
+		},
+		{
+			name: "Duplicated alternate setting",
+			modify: func(raw *descriptor.RawDevice) {
+				intf := &raw.ConfigurationTrees[0].Interfaces[0]
+				intf.AltSettings = append(intf.AltSettings, intf.AltSettings[0])
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			raw := newRawVendorDevice()
+			test.modify(&raw)
+
+			_, err := raw.Build()
+			assert.ErrorIs(t, err, descriptor.ErrInvalidDescriptorTree)
+		})
+	}
+}
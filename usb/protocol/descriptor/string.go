@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"unicode/utf16"
 
 	"github.com/ntchjb/usbip-virtual-device/usbip/stream"
 )
@@ -20,6 +21,9 @@ func (s *StringDescriptor) Decode(reader io.Reader) error {
 		return fmt.Errorf("unable to read string descriptor bLength from stream: %w", err)
 	}
 	s.BLength = buf[0]
+	if s.BLength < 2 {
+		return fmt.Errorf("invalid string descriptor bLength: %d", s.BLength)
+	}
 
 	buf, err = stream.Read(reader, int(s.BLength)-1)
 	if err != nil {
@@ -52,3 +56,28 @@ func (s *StringDescriptor) Encode(writer io.Writer) error {
 
 	return nil
 }
+
+// NewStringDescriptor returns string descriptor of given string encoded in UTF-16LE
+func NewStringDescriptor(s string) StringDescriptor {
+	content := utf16.Encode([]rune(s))
+
+	return StringDescriptor{
+		BLength:         uint8(2 + len(content)*2),
+		BDescriptorType: DESCRIPTOR_TYPE_STRING,
+		Content:         content,
+	}
+}
+
+// NewLangIDsDescriptor returns string descriptor at index 0, which is list of supported LangIDs
+func NewLangIDsDescriptor(langIDs []LangID) StringDescriptor {
+	content := make([]uint16, len(langIDs))
+	for i, langID := range langIDs {
+		content[i] = uint16(langID)
+	}
+
+	return StringDescriptor{
+		BLength:         uint8(2 + len(content)*2),
+		BDescriptorType: DESCRIPTOR_TYPE_STRING,
+		Content:         content,
+	}
+}
@@ -0,0 +1,111 @@
+package descriptor
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/ntchjb/usbip-virtual-device/usbip/stream"
+)
+
+const (
+	SUPERSPEED_ENDPOINT_COMPANION_DESCRIPTOR_LENGTH                  = 6
+	SUPERSPEED_PLUS_ISOCHRONOUS_ENDPOINT_COMPANION_DESCRIPTOR_LENGTH = 8
+	// bMaxPacketSize0 of SuperSpeed device, as exponent of 2 (512 bytes)
+	SUPERSPEED_MAX_PACKET_SIZE_0 = 9
+	// Maximum packet size of SuperSpeed non-control endpoints
+	SUPERSPEED_MAX_PACKET_SIZE = 1024
+	// Maximum bMaxBurst, which is number of packets in a burst minus one
+	SUPERSPEED_MAX_BURST = 15
+	// Maximum number of streams of bulk endpoint, as exponent of 2
+	SUPERSPEED_MAX_STREAMS = 16
+	// Maximum Mult of isochronous endpoint, which is number of bursts in a service interval minus one
+	SUPERSPEED_MAX_MULT = 2
+)
+
+// SuperSpeedEndpointCompanionDescriptor follows endpoint descriptor of SuperSpeed device
+type SuperSpeedEndpointCompanionDescriptor struct {
+	// Size of this descriptor in bytes.
+	BLength uint8
+	// SuperSpeed endpoint companion descriptor type.
+	BDescriptorType DescriptorType
+	// Maximum number of packets the endpoint can send or receive as part of a burst, minus one.
+	BMaxBurst uint8
+	// Bulk: D4..0: MaxStreams, as exponent of 2.
+	// Isochronous: D1..0: Mult, D7: SuperSpeedPlus isochronous endpoint companion follows.
+	BMAttributes uint8
+	// Total number of bytes the periodic endpoint transfers every service interval.
+	WBytesPerInterval uint16
+}
+
+func (s *SuperSpeedEndpointCompanionDescriptor) Decode(reader io.Reader) error {
+	buf, err := stream.Read(reader, SUPERSPEED_ENDPOINT_COMPANION_DESCRIPTOR_LENGTH)
+	if err != nil {
+		return fmt.Errorf("unable to read SuperSpeed endpoint companion descriptor from stream: %w", err)
+	}
+
+	s.BLength = buf[0]
+	s.BDescriptorType = DescriptorType(buf[1])
+	s.BMaxBurst = buf[2]
+	s.BMAttributes = buf[3]
+	s.WBytesPerInterval = binary.LittleEndian.Uint16(buf[4:6])
+
+	return nil
+}
+
+func (s *SuperSpeedEndpointCompanionDescriptor) Encode(writer io.Writer) error {
+	buf := make([]byte, SUPERSPEED_ENDPOINT_COMPANION_DESCRIPTOR_LENGTH)
+
+	buf[0] = s.BLength
+	buf[1] = byte(s.BDescriptorType)
+	buf[2] = s.BMaxBurst
+	buf[3] = s.BMAttributes
+	binary.LittleEndian.PutUint16(buf[4:6], s.WBytesPerInterval)
+
+	if err := stream.Write(writer, buf); err != nil {
+		return fmt.Errorf("unable to write SuperSpeed endpoint companion descriptor to stream: %w", err)
+	}
+
+	return nil
+}
+
+// SuperSpeedPlusIsochronousEndpointCompanionDescriptor follows SuperSpeed endpoint companion descriptor
+// of isochronous endpoint requiring more than 48 KB per service interval
+type SuperSpeedPlusIsochronousEndpointCompanionDescriptor struct {
+	// Size of this descriptor in bytes.
+	BLength uint8
+	// SuperSpeedPlus isochronous endpoint companion descriptor type.
+	BDescriptorType DescriptorType
+	WReserved       uint16
+	// Total number of bytes the endpoint transfers every service interval.
+	DWBytesPerInterval uint32
+}
+
+func (s *SuperSpeedPlusIsochronousEndpointCompanionDescriptor) Decode(reader io.Reader) error {
+	buf, err := stream.Read(reader, SUPERSPEED_PLUS_ISOCHRONOUS_ENDPOINT_COMPANION_DESCRIPTOR_LENGTH)
+	if err != nil {
+		return fmt.Errorf("unable to read SuperSpeedPlus isochronous endpoint companion descriptor from stream: %w", err)
+	}
+
+	s.BLength = buf[0]
+	s.BDescriptorType = DescriptorType(buf[1])
+	s.WReserved = binary.LittleEndian.Uint16(buf[2:4])
+	s.DWBytesPerInterval = binary.LittleEndian.Uint32(buf[4:8])
+
+	return nil
+}
+
+func (s *SuperSpeedPlusIsochronousEndpointCompanionDescriptor) Encode(writer io.Writer) error {
+	buf := make([]byte, SUPERSPEED_PLUS_ISOCHRONOUS_ENDPOINT_COMPANION_DESCRIPTOR_LENGTH)
+
+	buf[0] = s.BLength
+	buf[1] = byte(s.BDescriptorType)
+	binary.LittleEndian.PutUint16(buf[2:4], s.WReserved)
+	binary.LittleEndian.PutUint32(buf[4:8], s.DWBytesPerInterval)
+
+	if err := stream.Write(writer, buf); err != nil {
+		return fmt.Errorf("unable to write SuperSpeedPlus isochronous endpoint companion descriptor to stream: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,80 @@
+package descriptor_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ntchjb/usbip-virtual-device/usb/protocol/descriptor"
+	usbipprot "github.com/ntchjb/usbip-virtual-device/usbip/protocol"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSuperSpeedEndpointCompanionDescriptors(t *testing.T) {
+	tests := []struct {
+		name   string
+		obj    usbipprot.Serializer
+		bin    []byte
+		newObj func() usbipprot.Serializer
+		encErr error
+		decErr error
+	}{
+		{
+			name: "SuperSpeedEndpointCompanionDescriptor",
+			obj: &descriptor.SuperSpeedEndpointCompanionDescriptor{
+				BLength:           descriptor.SUPERSPEED_ENDPOINT_COMPANION_DESCRIPTOR_LENGTH,
+				BDescriptorType:   descriptor.DESCRIPTOR_TYPE_SUPER_SPEED_USB_ENDPOINT_COMPANION,
+				BMaxBurst:         0x0F,
+				BMAttributes:      0x04,
+				WBytesPerInterval: 0x0000,
+			},
+			bin: []byte{
+				0x06,
+				0x30,
+				0x0F,
+				0x04,
+				0x00, 0x00,
+			},
+			newObj: func() usbipprot.Serializer {
+				return &descriptor.SuperSpeedEndpointCompanionDescriptor{}
+			},
+			encErr: nil,
+			decErr: nil,
+		},
+		{
+			name: "SuperSpeedPlusIsochronousEndpointCompanionDescriptor",
+			obj: &descriptor.SuperSpeedPlusIsochronousEndpointCompanionDescriptor{
+				BLength:            descriptor.SUPERSPEED_PLUS_ISOCHRONOUS_ENDPOINT_COMPANION_DESCRIPTOR_LENGTH,
+				BDescriptorType:    descriptor.DESCRIPTOR_TYPE_SUPER_SPEED_PLUS_ISOCHRONOUS_ENDPOINT_COMPANION,
+				WReserved:          0x0000,
+				DWBytesPerInterval: 0x00012000,
+			},
+			bin: []byte{
+				0x08,
+				0x31,
+				0x00, 0x00,
+				0x00, 0x20, 0x01, 0x00,
+			},
+			newObj: func() usbipprot.Serializer {
+				return &descriptor.SuperSpeedPlusIsochronousEndpointCompanionDescriptor{}
+			},
+			encErr: nil,
+			decErr: nil,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			writer := new(bytes.Buffer)
+			err := test.obj.Encode(writer)
+
+			assert.ErrorIs(t, err, test.encErr)
+			assert.Equal(t, test.bin, writer.Bytes())
+
+			newObj := test.newObj()
+			err = newObj.Decode(writer)
+
+			assert.ErrorIs(t, err, test.decErr)
+			assert.Equal(t, test.obj, newObj)
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/ntchjb/usbip-virtual-device/usbip/stream"
+)
+
+// SystemExitLatency is data stage of SET_SEL request, containing exit latencies of the path
+// from host to SuperSpeed device, in microseconds
+type SystemExitLatency struct {
+	// U1 system exit latency
+	U1SEL uint8
+	// U1 device to host path exit latency
+	U1PEL uint8
+	// U2 system exit latency
+	U2SEL uint16
+	// U2 device to host path exit latency
+	U2PEL uint16
+}
+
+func (s *SystemExitLatency) Decode(reader io.Reader) error {
+	buf, err := stream.Read(reader, SYSTEM_EXIT_LATENCY_LENGTH)
+	if err != nil {
+		return fmt.Errorf("unable to read SystemExitLatency from stream: %w", err)
+	}
+
+	s.U1SEL = buf[0]
+	s.U1PEL = buf[1]
+	s.U2SEL = binary.LittleEndian.Uint16(buf[2:4])
+	s.U2PEL = binary.LittleEndian.Uint16(buf[4:6])
+
+	return nil
+}
+
+func (s *SystemExitLatency) Encode(writer io.Writer) error {
+	buf := make([]byte, SYSTEM_EXIT_LATENCY_LENGTH)
+
+	buf[0] = s.U1SEL
+	buf[1] = s.U1PEL
+	binary.LittleEndian.PutUint16(buf[2:4], s.U2SEL)
+	binary.LittleEndian.PutUint16(buf[4:6], s.U2PEL)
+
+	if err := stream.Write(writer, buf); err != nil {
+		return fmt.Errorf("unable to write SystemExitLatency to stream: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,58 @@
+package protocol_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ntchjb/usbip-virtual-device/usb/protocol"
+	usbipprot "github.com/ntchjb/usbip-virtual-device/usbip/protocol"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSystemExitLatencySerializer(t *testing.T) {
+	tests := []struct {
+		name   string
+		obj    usbipprot.Serializer
+		bin    []byte
+		newObj func() usbipprot.Serializer
+		encErr error
+		decErr error
+	}{
+		{
+			name: "SystemExitLatency",
+			obj: &protocol.SystemExitLatency{
+				U1SEL: 0x12,
+				U1PEL: 0x34,
+				U2SEL: 0x1234,
+				U2PEL: 0x5678,
+			},
+			bin: []byte{
+				0x12,
+				0x34,
+				0x34, 0x12,
+				0x78, 0x56,
+			},
+			newObj: func() usbipprot.Serializer {
+				return &protocol.SystemExitLatency{}
+			},
+			encErr: nil,
+			decErr: nil,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			writer := new(bytes.Buffer)
+			err := test.obj.Encode(writer)
+
+			assert.ErrorIs(t, err, test.encErr)
+			assert.Equal(t, test.bin, writer.Bytes())
+
+			newObj := test.newObj()
+			err = newObj.Decode(writer)
+
+			assert.ErrorIs(t, err, test.decErr)
+			assert.Equal(t, test.obj, newObj)
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package msos
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	usbprotocol "github.com/ntchjb/usbip-virtual-device/usb/protocol"
+	"github.com/ntchjb/usbip-virtual-device/usb/protocol/descriptor"
+)
+
+var (
+	ErrInvalidDescriptorSet = errors.New("invalid MS OS 2.0 descriptor set")
+)
+
+// Feature is a feature descriptor of Microsoft OS 2.0 descriptor set, such as CompatibleIDDescriptor
+type Feature interface {
+	Encode(writer io.Writer) error
+}
+
+// DescriptorSet is the root of Microsoft OS 2.0 descriptor set, which is built into Descriptors by Build.
+// Lengths are computed by Build, so they are not part of the tree.
+type DescriptorSet struct {
+	// Minimum Windows version, defaults to Windows 8.1
+	WindowsVersion uint32
+	// bRequest of vendor request retrieving descriptor set, chosen by device
+	VendorCode uint8
+	// Non-zero if device supports alternate enumeration
+	AltEnumCode uint8
+	// Features applied to the whole device, such as WinUSB compatible ID of non-composite device
+	Features []Feature
+	// Features applied to functions of composite device, in the first configuration
+	Functions []Function
+}
+
+// Function is a subset of features applied to a function of composite device
+type Function struct {
+	// Interface number of the first interface of the function
+	FirstInterface uint8
+	Features       []Feature
+}
+
+// Descriptors is serialized Microsoft OS 2.0 descriptor set, built from DescriptorSet
+type Descriptors struct {
+	capability descriptor.PlatformCapability
+	set        []byte
+	vendorCode uint8
+}
+
+// Build serializes descriptor set and its platform capability
+func (s *DescriptorSet) Build() (*Descriptors, error) {
+	windowsVersion := s.WindowsVersion
+	if windowsVersion == 0 {
+		windowsVersion = WINDOWS_VERSION_8_1
+	}
+
+	detailBuf := new(bytes.Buffer)
+	if err := encodeFeatures(detailBuf, s.Features); err != nil {
+		return nil, err
+	}
+	if len(s.Functions) > 0 {
+		if err := s.encodeConfigurationSubset(detailBuf); err != nil {
+			return nil, err
+		}
+	}
+
+	totalLength := SET_HEADER_DESCRIPTOR_LENGTH + detailBuf.Len()
+	if totalLength > 0xFFFF {
+		return nil, fmt.Errorf("%w: total length %d exceeds 65535", ErrInvalidDescriptorSet, totalLength)
+	}
+	header := SetHeaderDescriptor{
+		WLength:          SET_HEADER_DESCRIPTOR_LENGTH,
+		WDescriptorType:  DESCRIPTOR_TYPE_SET_HEADER,
+		DWWindowsVersion: windowsVersion,
+		WTotalLength:     uint16(totalLength),
+	}
+	buf := new(bytes.Buffer)
+	if err := header.Encode(buf); err != nil {
+		return nil, fmt.Errorf("unable to encode set header: %w", err)
+	}
+	buf.Write(detailBuf.Bytes())
+
+	capabilityData := make([]byte, PLATFORM_CAPABILITY_DATA_LENGTH)
+	binary.LittleEndian.PutUint32(capabilityData[0:4], windowsVersion)
+	binary.LittleEndian.PutUint16(capabilityData[4:6], uint16(totalLength))
+	capabilityData[6] = s.VendorCode
+	capabilityData[7] = s.AltEnumCode
+
+	return &Descriptors{
+		capability: descriptor.NewPlatformCapability(PLATFORM_CAPABILITY_UUID, capabilityData),
+		set:        buf.Bytes(),
+		vendorCode: s.VendorCode,
+	}, nil
+}
+
+func (s *DescriptorSet) encodeConfigurationSubset(writer io.Writer) error {
+	functionsBuf := new(bytes.Buffer)
+	firstInterfaces := make(map[uint8]bool)
+	for _, function := range s.Functions {
+		if firstInterfaces[function.FirstInterface] {
+			return fmt.Errorf("%w: duplicated function subset of interface %d", ErrInvalidDescriptorSet, function.FirstInterface)
+		}
+		firstInterfaces[function.FirstInterface] = true
+
+		featuresBuf := new(bytes.Buffer)
+		if err := encodeFeatures(featuresBuf, function.Features); err != nil {
+			return err
+		}
+		header := FunctionSubsetHeader{
+			WLength:         FUNCTION_SUBSET_HEADER_LENGTH,
+			WDescriptorType: DESCRIPTOR_TYPE_SUBSET_HEADER_FUNCTION,
+			BFirstInterface: function.FirstInterface,
+			WSubsetLength:   uint16(FUNCTION_SUBSET_HEADER_LENGTH + featuresBuf.Len()),
+		}
+		if err := header.Encode(functionsBuf); err != nil {
+			return fmt.Errorf("unable to encode function subset header: %w", err)
+		}
+		functionsBuf.Write(featuresBuf.Bytes())
+	}
+
+	header := ConfigurationSubsetHeader{
+		WLength:         CONFIGURATION_SUBSET_HEADER_LENGTH,
+		WDescriptorType: DESCRIPTOR_TYPE_SUBSET_HEADER_CONFIGURATION,
+		WTotalLength:    uint16(CONFIGURATION_SUBSET_HEADER_LENGTH + functionsBuf.Len()),
+	}
+	if err := header.Encode(writer); err != nil {
+		return fmt.Errorf("unable to encode configuration subset header: %w", err)
+	}
+	if _, err := writer.Write(functionsBuf.Bytes()); err != nil {
+		return fmt.Errorf("unable to write function subsets: %w", err)
+	}
+
+	return nil
+}
+
+func encodeFeatures(writer io.Writer, features []Feature) error {
+	for i, feature := range features {
+		if err := feature.Encode(writer); err != nil {
+			return fmt.Errorf("unable to encode feature descriptor %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+// Capability returns platform capability of the descriptor set, to be added to BOS descriptor of the device
+func (d *Descriptors) Capability() *descriptor.PlatformCapability {
+	capability := d.capability
+
+	return &capability
+}
+
+// DescriptorSet returns serialized descriptor set
+func (d *Descriptors) DescriptorSet() []byte {
+	return d.set
+}
+
+// IsDescriptorSetRequest returns whether given setup packet is the device-to-host vendor request
+// retrieving descriptor set from the device
+func (d *Descriptors) IsDescriptorSetRequest(setup usbprotocol.SetupPacket) bool {
+	// bit 7 of bmRequestType is set for device-to-host transfers
+	return setup.BMRequestType&0x80 != 0 &&
+		setup.BMRequestType.Type() == usbprotocol.SETUP_DATA_TYPE_VENDOR &&
+		setup.BMRequestType.Recipient() == usbprotocol.SETUP_RECIPIENT_DEVICE &&
+		setup.BRequest == usbprotocol.SetupRequest(d.vendorCode) &&
+		setup.WIndex == MS_OS_20_DESCRIPTOR_INDEX
+}
@@ -0,0 +1,91 @@
+package msos_test
+
+import (
+	"testing"
+
+	"github.com/ntchjb/usbip-virtual-device/usb/protocol"
+	"github.com/ntchjb/usbip-virtual-device/usb/protocol/descriptor"
+	"github.com/ntchjb/usbip-virtual-device/usb/protocol/msos"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var winUSBCompatibleIDBytes = []byte{
+	0x14, 0x00, 0x03, 0x00,
+	'W', 'I', 'N', 'U', 'S', 'B', 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+}
+
+func TestDescriptorSetBuild(t *testing.T) {
+	compatibleID := msos.NewWinUSBCompatibleID()
+	set := msos.DescriptorSet{
+		VendorCode: 0x20,
+		Features:   []msos.Feature{&compatibleID},
+	}
+	descriptors, err := set.Build()
+	require.NoError(t, err)
+
+	assert.Equal(t, append([]byte{
+		0x0A, 0x00, 0x00, 0x00, 0x00, 0x00, 0x03, 0x06, 0x1E, 0x00, // Set header
+	}, winUSBCompatibleIDBytes...), descriptors.DescriptorSet())
+
+	capability := descriptor.NewPlatformCapability(msos.PLATFORM_CAPABILITY_UUID, []byte{
+		0x00, 0x00, 0x03, 0x06, // Windows version
+		0x1E, 0x00, // Total length
+		0x20, // Vendor code
+		0x00, // Alternate enumeration code
+	})
+	assert.Equal(t, &capability, descriptors.Capability())
+
+	assert.True(t, descriptors.IsDescriptorSetRequest(protocol.SetupPacket{
+		BMRequestType: 0xC0,
+		BRequest:      0x20,
+		WIndex:        msos.MS_OS_20_DESCRIPTOR_INDEX,
+	}))
+	assert.False(t, descriptors.IsDescriptorSetRequest(protocol.SetupPacket{
+		BMRequestType: 0xC0,
+		BRequest:      0x21,
+		WIndex:        msos.MS_OS_20_DESCRIPTOR_INDEX,
+	}))
+	assert.False(t, descriptors.IsDescriptorSetRequest(protocol.SetupPacket{
+		BMRequestType: 0xC0,
+		BRequest:      0x20,
+		WIndex:        msos.MS_OS_20_SET_ALT_ENUMERATION,
+	}))
+	assert.False(t, descriptors.IsDescriptorSetRequest(protocol.SetupPacket{
+		BMRequestType: 0x40,
+		BRequest:      0x20,
+		WIndex:        msos.MS_OS_20_DESCRIPTOR_INDEX,
+	}))
+	assert.False(t, descriptors.IsDescriptorSetRequest(protocol.SetupPacket{
+		BMRequestType: 0xC1,
+		BRequest:      0x20,
+		WIndex:        msos.MS_OS_20_DESCRIPTOR_INDEX,
+	}))
+}
+
+func TestDescriptorSetBuildFunctions(t *testing.T) {
+	compatibleID := msos.NewWinUSBCompatibleID()
+	set := msos.DescriptorSet{
+		VendorCode: 0x20,
+		Functions: []msos.Function{
+			{
+				FirstInterface: 2,
+				Features:       []msos.Feature{&compatibleID},
+			},
+		},
+	}
+	descriptors, err := set.Build()
+	require.NoError(t, err)
+
+	expected := []byte{
+		0x0A, 0x00, 0x00, 0x00, 0x00, 0x00, 0x03, 0x06, 0x2E, 0x00, // Set header
+		0x08, 0x00, 0x01, 0x00, 0x00, 0x00, 0x24, 0x00, // Configuration subset
+		0x08, 0x00, 0x02, 0x00, 0x02, 0x00, 0x1C, 0x00, // Function subset
+	}
+	assert.Equal(t, append(expected, winUSBCompatibleIDBytes...), descriptors.DescriptorSet())
+
+	set.Functions = append(set.Functions, set.Functions[0])
+	_, err = set.Build()
+	assert.ErrorIs(t, err, msos.ErrInvalidDescriptorSet)
+}
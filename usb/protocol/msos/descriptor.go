@@ -0,0 +1,356 @@
+package msos
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"unicode/utf16"
+
+	"github.com/ntchjb/usbip-virtual-device/usbip/stream"
+)
+
+// Platform capability UUID of Microsoft OS 2.0 descriptors, {D8DD60DF-4589-4CC7-9CD2-659D9E648A9F}
+var PLATFORM_CAPABILITY_UUID = [16]byte{
+	0xDF, 0x60, 0xDD, 0xD8, 0x89, 0x45, 0xC7, 0x4C,
+	0x9C, 0xD2, 0x65, 0x9D, 0x9E, 0x64, 0x8A, 0x9F,
+}
+
+type DescriptorType uint16
+
+const (
+	DESCRIPTOR_TYPE_SET_HEADER                  DescriptorType = 0x00
+	DESCRIPTOR_TYPE_SUBSET_HEADER_CONFIGURATION DescriptorType = 0x01
+	DESCRIPTOR_TYPE_SUBSET_HEADER_FUNCTION      DescriptorType = 0x02
+	DESCRIPTOR_TYPE_FEATURE_COMPATIBLE_ID       DescriptorType = 0x03
+	DESCRIPTOR_TYPE_FEATURE_REG_PROPERTY        DescriptorType = 0x04
+	DESCRIPTOR_TYPE_FEATURE_MIN_RESUME_TIME     DescriptorType = 0x05
+	DESCRIPTOR_TYPE_FEATURE_MODEL_ID            DescriptorType = 0x06
+	DESCRIPTOR_TYPE_FEATURE_CCGP_DEVICE         DescriptorType = 0x07
+	DESCRIPTOR_TYPE_FEATURE_VENDOR_REVISION     DescriptorType = 0x08
+)
+
+const (
+	SET_HEADER_DESCRIPTOR_LENGTH            = 10
+	CONFIGURATION_SUBSET_HEADER_LENGTH      = 8
+	FUNCTION_SUBSET_HEADER_LENGTH           = 8
+	COMPATIBLE_ID_DESCRIPTOR_LENGTH         = 20
+	REGISTRY_PROPERTY_DESCRIPTOR_MIN_LENGTH = 10
+	// Length of descriptor set information in platform capability
+	PLATFORM_CAPABILITY_DATA_LENGTH = 8
+)
+
+// Minimum Windows version supporting Microsoft OS 2.0 descriptors
+const (
+	WINDOWS_VERSION_8_1 uint32 = 0x06030000
+)
+
+// wIndex of vendor requests of Microsoft OS 2.0 descriptors
+const (
+	MS_OS_20_DESCRIPTOR_INDEX    uint16 = 0x07
+	MS_OS_20_SET_ALT_ENUMERATION uint16 = 0x08
+)
+
+type RegistryPropertyDataType uint16
+
+const (
+	REG_SZ                  RegistryPropertyDataType = 1
+	REG_EXPAND_SZ           RegistryPropertyDataType = 2
+	REG_BINARY              RegistryPropertyDataType = 3
+	REG_DWORD_LITTLE_ENDIAN RegistryPropertyDataType = 4
+	REG_DWORD_BIG_ENDIAN    RegistryPropertyDataType = 5
+	REG_LINK                RegistryPropertyDataType = 6
+	REG_MULTI_SZ            RegistryPropertyDataType = 7
+)
+
+// SetHeaderDescriptor is the header of Microsoft OS 2.0 descriptor set
+type SetHeaderDescriptor struct {
+	// Size of this header in bytes.
+	WLength uint16
+	// Set header descriptor type.
+	WDescriptorType DescriptorType
+	// Minimum Windows version of this descriptor set.
+	DWWindowsVersion uint32
+	// Size of entire descriptor set, including this header.
+	WTotalLength uint16
+}
+
+func (s *SetHeaderDescriptor) Decode(reader io.Reader) error {
+	buf, err := stream.Read(reader, SET_HEADER_DESCRIPTOR_LENGTH)
+	if err != nil {
+		return fmt.Errorf("unable to read MS OS 2.0 set header descriptor from stream: %w", err)
+	}
+
+	s.WLength = binary.LittleEndian.Uint16(buf[0:2])
+	s.WDescriptorType = DescriptorType(binary.LittleEndian.Uint16(buf[2:4]))
+	s.DWWindowsVersion = binary.LittleEndian.Uint32(buf[4:8])
+	s.WTotalLength = binary.LittleEndian.Uint16(buf[8:10])
+
+	return nil
+}
+
+func (s *SetHeaderDescriptor) Encode(writer io.Writer) error {
+	buf := make([]byte, SET_HEADER_DESCRIPTOR_LENGTH)
+
+	binary.LittleEndian.PutUint16(buf[0:2], s.WLength)
+	binary.LittleEndian.PutUint16(buf[2:4], uint16(s.WDescriptorType))
+	binary.LittleEndian.PutUint32(buf[4:8], s.DWWindowsVersion)
+	binary.LittleEndian.PutUint16(buf[8:10], s.WTotalLength)
+
+	if err := stream.Write(writer, buf); err != nil {
+		return fmt.Errorf("unable to write MS OS 2.0 set header descriptor to stream: %w", err)
+	}
+
+	return nil
+}
+
+// ConfigurationSubsetHeader is the header of descriptors applied to a configuration
+type ConfigurationSubsetHeader struct {
+	// Size of this header in bytes.
+	WLength uint16
+	// Configuration subset header descriptor type.
+	WDescriptorType DescriptorType
+	// Configuration the subset applies to. Despite its name, Windows uses index of the configuration, starting from 0.
+	BConfigurationValue uint8
+	BReserved           uint8
+	// Size of entire configuration subset, including this header.
+	WTotalLength uint16
+}
+
+func (s *ConfigurationSubsetHeader) Decode(reader io.Reader) error {
+	buf, err := stream.Read(reader, CONFIGURATION_SUBSET_HEADER_LENGTH)
+	if err != nil {
+		return fmt.Errorf("unable to read MS OS 2.0 configuration subset header from stream: %w", err)
+	}
+
+	s.WLength = binary.LittleEndian.Uint16(buf[0:2])
+	s.WDescriptorType = DescriptorType(binary.LittleEndian.Uint16(buf[2:4]))
+	s.BConfigurationValue = buf[4]
+	s.BReserved = buf[5]
+	s.WTotalLength = binary.LittleEndian.Uint16(buf[6:8])
+
+	return nil
+}
+
+func (s *ConfigurationSubsetHeader) Encode(writer io.Writer) error {
+	buf := make([]byte, CONFIGURATION_SUBSET_HEADER_LENGTH)
+
+	binary.LittleEndian.PutUint16(buf[0:2], s.WLength)
+	binary.LittleEndian.PutUint16(buf[2:4], uint16(s.WDescriptorType))
+	buf[4] = s.BConfigurationValue
+	buf[5] = s.BReserved
+	binary.LittleEndian.PutUint16(buf[6:8], s.WTotalLength)
+
+	if err := stream.Write(writer, buf); err != nil {
+		return fmt.Errorf("unable to write MS OS 2.0 configuration subset header to stream: %w", err)
+	}
+
+	return nil
+}
+
+// FunctionSubsetHeader is the header of descriptors applied to a function of composite device
+type FunctionSubsetHeader struct {
+	// Size of this header in bytes.
+	WLength uint16
+	// Function subset header descriptor type.
+	WDescriptorType DescriptorType
+	// Interface number of the first interface of the function.
+	BFirstInterface uint8
+	BReserved       uint8
+	// Size of entire function subset, including this header.
+	WSubsetLength uint16
+}
+
+func (s *FunctionSubsetHeader) Decode(reader io.Reader) error {
+	buf, err := stream.Read(reader, FUNCTION_SUBSET_HEADER_LENGTH)
+	if err != nil {
+		return fmt.Errorf("unable to read MS OS 2.0 function subset header from stream: %w", err)
+	}
+
+	s.WLength = binary.LittleEndian.Uint16(buf[0:2])
+	s.WDescriptorType = DescriptorType(binary.LittleEndian.Uint16(buf[2:4]))
+	s.BFirstInterface = buf[4]
+	s.BReserved = buf[5]
+	s.WSubsetLength = binary.LittleEndian.Uint16(buf[6:8])
+
+	return nil
+}
+
+func (s *FunctionSubsetHeader) Encode(writer io.Writer) error {
+	buf := make([]byte, FUNCTION_SUBSET_HEADER_LENGTH)
+
+	binary.LittleEndian.PutUint16(buf[0:2], s.WLength)
+	binary.LittleEndian.PutUint16(buf[2:4], uint16(s.WDescriptorType))
+	buf[4] = s.BFirstInterface
+	buf[5] = s.BReserved
+	binary.LittleEndian.PutUint16(buf[6:8], s.WSubsetLength)
+
+	if err := stream.Write(writer, buf); err != nil {
+		return fmt.Errorf("unable to write MS OS 2.0 function subset header to stream: %w", err)
+	}
+
+	return nil
+}
+
+// CompatibleIDDescriptor defines compatible ID used by Windows to load a driver, such as WINUSB
+type CompatibleIDDescriptor struct {
+	// Size of this descriptor in bytes.
+	WLength uint16
+	// Compatible ID descriptor type.
+	WDescriptorType DescriptorType
+	// Compatible ID in ASCII, padded with zeros.
+	CompatibleID [8]byte
+	// Sub-compatible ID in ASCII, padded with zeros.
+	SubCompatibleID [8]byte
+}
+
+func (s *CompatibleIDDescriptor) Decode(reader io.Reader) error {
+	buf, err := stream.Read(reader, COMPATIBLE_ID_DESCRIPTOR_LENGTH)
+	if err != nil {
+		return fmt.Errorf("unable to read MS OS 2.0 compatible ID descriptor from stream: %w", err)
+	}
+
+	s.WLength = binary.LittleEndian.Uint16(buf[0:2])
+	s.WDescriptorType = DescriptorType(binary.LittleEndian.Uint16(buf[2:4]))
+	copy(s.CompatibleID[:], buf[4:12])
+	copy(s.SubCompatibleID[:], buf[12:20])
+
+	return nil
+}
+
+func (s *CompatibleIDDescriptor) Encode(writer io.Writer) error {
+	buf := make([]byte, COMPATIBLE_ID_DESCRIPTOR_LENGTH)
+
+	binary.LittleEndian.PutUint16(buf[0:2], s.WLength)
+	binary.LittleEndian.PutUint16(buf[2:4], uint16(s.WDescriptorType))
+	copy(buf[4:12], s.CompatibleID[:])
+	copy(buf[12:20], s.SubCompatibleID[:])
+
+	if err := stream.Write(writer, buf); err != nil {
+		return fmt.Errorf("unable to write MS OS 2.0 compatible ID descriptor to stream: %w", err)
+	}
+
+	return nil
+}
+
+// RegistryPropertyDescriptor adds a registry property of device, such as DeviceInterfaceGUIDs
+type RegistryPropertyDescriptor struct {
+	// Size of this descriptor in bytes.
+	WLength uint16
+	// Registry property descriptor type.
+	WDescriptorType DescriptorType
+	// Type of registry property.
+	WPropertyDataType RegistryPropertyDataType
+	// Name of registry property, in null-terminated UTF-16LE.
+	PropertyName []byte
+	// Data of registry property.
+	PropertyData []byte
+}
+
+func (s *RegistryPropertyDescriptor) Decode(reader io.Reader) error {
+	buf, err := stream.Read(reader, 8)
+	if err != nil {
+		return fmt.Errorf("unable to read MS OS 2.0 registry property descriptor from stream: %w", err)
+	}
+	s.WLength = binary.LittleEndian.Uint16(buf[0:2])
+	s.WDescriptorType = DescriptorType(binary.LittleEndian.Uint16(buf[2:4]))
+	s.WPropertyDataType = RegistryPropertyDataType(binary.LittleEndian.Uint16(buf[4:6]))
+	nameLength := binary.LittleEndian.Uint16(buf[6:8])
+
+	if s.PropertyName, err = stream.Read(reader, int(nameLength)); err != nil {
+		return fmt.Errorf("unable to read MS OS 2.0 registry property name from stream: %w", err)
+	}
+	if buf, err = stream.Read(reader, 2); err != nil {
+		return fmt.Errorf("unable to read MS OS 2.0 registry property data length from stream: %w", err)
+	}
+	if s.PropertyData, err = stream.Read(reader, int(binary.LittleEndian.Uint16(buf))); err != nil {
+		return fmt.Errorf("unable to read MS OS 2.0 registry property data from stream: %w", err)
+	}
+
+	return nil
+}
+
+func (s *RegistryPropertyDescriptor) Encode(writer io.Writer) error {
+	buf := make([]byte, REGISTRY_PROPERTY_DESCRIPTOR_MIN_LENGTH+len(s.PropertyName)+len(s.PropertyData))
+
+	binary.LittleEndian.PutUint16(buf[0:2], s.WLength)
+	binary.LittleEndian.PutUint16(buf[2:4], uint16(s.WDescriptorType))
+	binary.LittleEndian.PutUint16(buf[4:6], uint16(s.WPropertyDataType))
+	binary.LittleEndian.PutUint16(buf[6:8], uint16(len(s.PropertyName)))
+	offset := 8 + copy(buf[8:], s.PropertyName)
+	binary.LittleEndian.PutUint16(buf[offset:offset+2], uint16(len(s.PropertyData)))
+	copy(buf[offset+2:], s.PropertyData)
+
+	if err := stream.Write(writer, buf); err != nil {
+		return fmt.Errorf("unable to write MS OS 2.0 registry property descriptor to stream: %w", err)
+	}
+
+	return nil
+}
+
+// NewCompatibleID returns compatible ID descriptor of given IDs, which are truncated to 8 characters
+func NewCompatibleID(compatibleID, subCompatibleID string) CompatibleIDDescriptor {
+	desc := CompatibleIDDescriptor{
+		WLength:         COMPATIBLE_ID_DESCRIPTOR_LENGTH,
+		WDescriptorType: DESCRIPTOR_TYPE_FEATURE_COMPATIBLE_ID,
+	}
+	copy(desc.CompatibleID[:], compatibleID)
+	copy(desc.SubCompatibleID[:], subCompatibleID)
+
+	return desc
+}
+
+// NewWinUSBCompatibleID returns compatible ID descriptor binding WinUSB driver to the device or function
+func NewWinUSBCompatibleID() CompatibleIDDescriptor {
+	return NewCompatibleID("WINUSB", "")
+}
+
+// NewRegistryProperty returns registry property descriptor of given type, name and raw data
+func NewRegistryProperty(dataType RegistryPropertyDataType, name string, data []byte) RegistryPropertyDescriptor {
+	propertyName := encodeUTF16String(name)
+
+	return RegistryPropertyDescriptor{
+		WLength:           uint16(REGISTRY_PROPERTY_DESCRIPTOR_MIN_LENGTH + len(propertyName) + len(data)),
+		WDescriptorType:   DESCRIPTOR_TYPE_FEATURE_REG_PROPERTY,
+		WPropertyDataType: dataType,
+		PropertyName:      propertyName,
+		PropertyData:      data,
+	}
+}
+
+// NewStringRegistryProperty returns registry property descriptor of REG_SZ type
+func NewStringRegistryProperty(name, value string) RegistryPropertyDescriptor {
+	return NewRegistryProperty(REG_SZ, name, encodeUTF16String(value))
+}
+
+// NewMultiStringRegistryProperty returns registry property descriptor of REG_MULTI_SZ type
+func NewMultiStringRegistryProperty(name string, values ...string) RegistryPropertyDescriptor {
+	var data []byte
+	for _, value := range values {
+		data = append(data, encodeUTF16String(value)...)
+	}
+	data = append(data, 0, 0)
+
+	return NewRegistryProperty(REG_MULTI_SZ, name, data)
+}
+
+// NewDWORDRegistryProperty returns registry property descriptor of REG_DWORD_LITTLE_ENDIAN type
+func NewDWORDRegistryProperty(name string, value uint32) RegistryPropertyDescriptor {
+	return NewRegistryProperty(REG_DWORD_LITTLE_ENDIAN, name, binary.LittleEndian.AppendUint32(nil, value))
+}
+
+// NewDeviceInterfaceGUIDs returns DeviceInterfaceGUIDs registry property, which lets applications
+// find WinUSB device by interface GUIDs, such as "{9A3A2B1C-1D2E-4F50-8A9B-0C1D2E3F4A5B}"
+func NewDeviceInterfaceGUIDs(guids ...string) RegistryPropertyDescriptor {
+	return NewMultiStringRegistryProperty("DeviceInterfaceGUIDs", guids...)
+}
+
+// encodeUTF16String returns null-terminated UTF-16LE bytes of given string
+func encodeUTF16String(s string) []byte {
+	content := utf16.Encode([]rune(s))
+	buf := make([]byte, (len(content)+1)*2)
+	for i, c := range content {
+		binary.LittleEndian.PutUint16(buf[i*2:i*2+2], c)
+	}
+
+	return buf
+}
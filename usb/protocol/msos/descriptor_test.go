@@ -0,0 +1,119 @@
+package msos_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ntchjb/usbip-virtual-device/usb/protocol/msos"
+	usbipprot "github.com/ntchjb/usbip-virtual-device/usbip/protocol"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMSOS20Descriptors(t *testing.T) {
+	tests := []struct {
+		name   string
+		obj    usbipprot.Serializer
+		bin    []byte
+		newObj func() usbipprot.Serializer
+		encErr error
+		decErr error
+	}{
+		{
+			name: "SetHeaderDescriptor",
+			obj: &msos.SetHeaderDescriptor{
+				WLength:          msos.SET_HEADER_DESCRIPTOR_LENGTH,
+				WDescriptorType:  msos.DESCRIPTOR_TYPE_SET_HEADER,
+				DWWindowsVersion: msos.WINDOWS_VERSION_8_1,
+				WTotalLength:     0x001E,
+			},
+			bin: []byte{0x0A, 0x00, 0x00, 0x00, 0x00, 0x00, 0x03, 0x06, 0x1E, 0x00},
+			newObj: func() usbipprot.Serializer {
+				return &msos.SetHeaderDescriptor{}
+			},
+		},
+		{
+			name: "ConfigurationSubsetHeader",
+			obj: &msos.ConfigurationSubsetHeader{
+				WLength:         msos.CONFIGURATION_SUBSET_HEADER_LENGTH,
+				WDescriptorType: msos.DESCRIPTOR_TYPE_SUBSET_HEADER_CONFIGURATION,
+				WTotalLength:    0x0024,
+			},
+			bin: []byte{0x08, 0x00, 0x01, 0x00, 0x00, 0x00, 0x24, 0x00},
+			newObj: func() usbipprot.Serializer {
+				return &msos.ConfigurationSubsetHeader{}
+			},
+		},
+		{
+			name: "FunctionSubsetHeader",
+			obj: &msos.FunctionSubsetHeader{
+				WLength:         msos.FUNCTION_SUBSET_HEADER_LENGTH,
+				WDescriptorType: msos.DESCRIPTOR_TYPE_SUBSET_HEADER_FUNCTION,
+				BFirstInterface: 2,
+				WSubsetLength:   0x001C,
+			},
+			bin: []byte{0x08, 0x00, 0x02, 0x00, 0x02, 0x00, 0x1C, 0x00},
+			newObj: func() usbipprot.Serializer {
+				return &msos.FunctionSubsetHeader{}
+			},
+		},
+		{
+			name: "CompatibleIDDescriptor",
+			obj: func() usbipprot.Serializer {
+				desc := msos.NewWinUSBCompatibleID()
+				return &desc
+			}(),
+			bin: []byte{
+				0x14, 0x00, 0x03, 0x00,
+				'W', 'I', 'N', 'U', 'S', 'B', 0x00, 0x00,
+				0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			},
+			newObj: func() usbipprot.Serializer {
+				return &msos.CompatibleIDDescriptor{}
+			},
+		},
+		{
+			name: "RegistryPropertyDescriptor",
+			obj: func() usbipprot.Serializer {
+				desc := msos.NewMultiStringRegistryProperty("ID", "A", "B")
+				return &desc
+			}(),
+			bin: []byte{
+				0x1A, 0x00, 0x04, 0x00,
+				0x07, 0x00, // REG_MULTI_SZ
+				0x06, 0x00, 'I', 0x00, 'D', 0x00, 0x00, 0x00,
+				0x0A, 0x00, 'A', 0x00, 0x00, 0x00, 'B', 0x00, 0x00, 0x00, 0x00, 0x00,
+			},
+			newObj: func() usbipprot.Serializer {
+				return &msos.RegistryPropertyDescriptor{}
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			writer := new(bytes.Buffer)
+			err := test.obj.Encode(writer)
+
+			assert.ErrorIs(t, err, test.encErr)
+			assert.Equal(t, test.bin, writer.Bytes())
+
+			newObj := test.newObj()
+			err = newObj.Decode(writer)
+
+			assert.ErrorIs(t, err, test.decErr)
+			assert.Equal(t, test.obj, newObj)
+		})
+	}
+}
+
+func TestDWORDRegistryProperty(t *testing.T) {
+	desc := msos.NewDWORDRegistryProperty("S", 1)
+	writer := new(bytes.Buffer)
+	assert.NoError(t, desc.Encode(writer))
+	assert.Equal(t, []byte{
+		0x12, 0x00, 0x04, 0x00,
+		0x04, 0x00, // REG_DWORD_LITTLE_ENDIAN
+		0x04, 0x00, 'S', 0x00, 0x00, 0x00,
+		0x04, 0x00, 0x01, 0x00, 0x00, 0x00,
+	}, writer.Bytes())
+}
@@ -0,0 +1,394 @@
+package parser
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	usbprotocol "github.com/ntchjb/usbip-virtual-device/usb/protocol"
+	"github.com/ntchjb/usbip-virtual-device/usb/protocol/descriptor"
+	"github.com/ntchjb/usbip-virtual-device/usb/protocol/hid"
+)
+
+var (
+	ErrInvalidDescriptor = errors.New("invalid descriptor")
+)
+
+// Descriptor is a descriptor inside configuration, such as *hid.HIDDescriptor,
+// or descriptor.RawDescriptor for descriptors unknown to the parser
+type Descriptor interface {
+	Encode(writer io.Writer) error
+}
+
+// Configuration is a parsed GET_DESCRIPTOR(CONFIGURATION) response. Descriptors are kept in order of appearance,
+// so encoding the tree reproduces the parsed bytes.
+type Configuration struct {
+	// Configuration or other speed configuration descriptor
+	Descriptor descriptor.StandardConfigurationDescriptor
+	// Bytes after standard fields, if bLength is larger than standard length
+	Extra []byte
+	// Descriptors between configuration descriptor and the first interface descriptor
+	ClassSpecific []Descriptor
+	// Interface descriptors in order of appearance, each of them is an alternate setting of an interface
+	AltSettings []AltSetting
+}
+
+type AltSetting struct {
+	// Interface association descriptor placed right before interface descriptor, if any
+	InterfaceAssociation *descriptor.InterfaceAssociationDescriptor
+	Descriptor           descriptor.StandardInterfaceDescriptor
+	// Bytes after standard fields, if bLength is larger than standard length
+	Extra []byte
+	// Descriptors between interface descriptor and the first endpoint descriptor.
+	// HID descriptor of HID interface is decoded as *hid.HIDDescriptor.
+	ClassSpecific []Descriptor
+	Endpoints     []Endpoint
+}
+
+type Endpoint struct {
+	Descriptor descriptor.StandardEndpointDescriptor
+	// Bytes after standard fields, if bLength is larger than standard length,
+	// such as bRefresh and bSynchAddress of USB Audio 1.0 endpoint
+	Extra                              []byte
+	SuperSpeedCompanion                *descriptor.SuperSpeedEndpointCompanionDescriptor
+	SuperSpeedPlusIsochronousCompanion *descriptor.SuperSpeedPlusIsochronousEndpointCompanionDescriptor
+	// Descriptors after endpoint descriptor and its companions, until the next endpoint or interface descriptor
+	ClassSpecific []Descriptor
+}
+
+// Interface is alternate settings of the same interface number, in order of appearance
+type Interface struct {
+	Number      uint8
+	AltSettings []*AltSetting
+}
+
+// ParseConfiguration parses a configuration descriptor followed by all descriptors of the configuration,
+// where data length must equal to wTotalLength
+func ParseConfiguration(data []byte) (*Configuration, error) {
+	configs, err := ParseConfigurations(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(configs) != 1 {
+		return nil, fmt.Errorf("%w: expected 1 configuration, got %d", ErrInvalidDescriptor, len(configs))
+	}
+
+	return &configs[0], nil
+}
+
+// ParseConfigurations parses concatenated configurations, each of them is wTotalLength long
+func ParseConfigurations(data []byte) ([]Configuration, error) {
+	var configs []Configuration
+	for len(data) > 0 {
+		if len(data) < descriptor.STANDARD_CONFIGURATION_DESCRIPTOR_LENGTH {
+			return nil, fmt.Errorf("%w: configuration descriptor is truncated", ErrInvalidDescriptor)
+		}
+		var configDesc descriptor.StandardConfigurationDescriptor
+		if err := configDesc.Decode(bytes.NewBuffer(data)); err != nil {
+			return nil, fmt.Errorf("unable to decode configuration descriptor: %w", err)
+		}
+		if configDesc.WTotalLength < descriptor.STANDARD_CONFIGURATION_DESCRIPTOR_LENGTH || configDesc.WTotalLength < uint16(configDesc.BLength) {
+			return nil, fmt.Errorf("%w: wTotalLength %d is shorter than configuration descriptor", ErrInvalidDescriptor, configDesc.WTotalLength)
+		}
+		if int(configDesc.WTotalLength) > len(data) {
+			return nil, fmt.Errorf("%w: wTotalLength %d exceeds data length %d", ErrInvalidDescriptor, configDesc.WTotalLength, len(data))
+		}
+
+		config, err := parseConfiguration(data[:configDesc.WTotalLength])
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse configuration %d: %w", len(configs), err)
+		}
+		configs = append(configs, *config)
+		data = data[configDesc.WTotalLength:]
+	}
+
+	return configs, nil
+}
+
+// split splits data into descriptors by their bLength
+func split(data []byte) ([][]byte, error) {
+	var descs [][]byte
+	for offset := 0; offset < len(data); {
+		length := int(data[offset])
+		if length < 2 {
+			return nil, fmt.Errorf("%w: bLength %d at offset %d", ErrInvalidDescriptor, length, offset)
+		}
+		if offset+length > len(data) {
+			return nil, fmt.Errorf("%w: descriptor at offset %d is truncated", ErrInvalidDescriptor, offset)
+		}
+		descs = append(descs, data[offset:offset+length])
+		offset += length
+	}
+
+	return descs, nil
+}
+
+func parseConfiguration(data []byte) (*Configuration, error) {
+	descs, err := split(data)
+	if err != nil {
+		return nil, err
+	}
+	configData := descs[0]
+	descriptorType := descriptor.DescriptorType(configData[1])
+	if descriptorType != descriptor.DESCRIPTOR_TYPE_CONFIGURATION && descriptorType != descriptor.DESCRIPTOR_TYPE_OTHER_SPEED_CONFIGURATION {
+		return nil, fmt.Errorf("%w: expected configuration descriptor, got type %d", ErrInvalidDescriptor, descriptorType)
+	}
+	if len(configData) < descriptor.STANDARD_CONFIGURATION_DESCRIPTOR_LENGTH {
+		return nil, fmt.Errorf("%w: configuration descriptor is shorter than %d bytes", ErrInvalidDescriptor, descriptor.STANDARD_CONFIGURATION_DESCRIPTOR_LENGTH)
+	}
+
+	config := &Configuration{}
+	if err := config.Descriptor.Decode(bytes.NewBuffer(configData)); err != nil {
+		return nil, fmt.Errorf("unable to decode configuration descriptor: %w", err)
+	}
+	config.Extra = extra(configData, descriptor.STANDARD_CONFIGURATION_DESCRIPTOR_LENGTH)
+
+	p := configurationParser{
+		config: config,
+	}
+	for _, desc := range descs[1:] {
+		if err := p.parse(desc); err != nil {
+			return nil, err
+		}
+	}
+	p.flushInterfaceAssociation()
+
+	return config, nil
+}
+
+// configurationParser places descriptors into configuration tree, one by one
+type configurationParser struct {
+	config *Configuration
+	// Interface association descriptor waiting for the next interface descriptor
+	pendingAssociation *descriptor.InterfaceAssociationDescriptor
+}
+
+func (p *configurationParser) altSetting() *AltSetting {
+	if len(p.config.AltSettings) == 0 {
+		return nil
+	}
+
+	return &p.config.AltSettings[len(p.config.AltSettings)-1]
+}
+
+func (p *configurationParser) endpoint() *Endpoint {
+	altSetting := p.altSetting()
+	if altSetting == nil || len(altSetting.Endpoints) == 0 {
+		return nil
+	}
+
+	return &altSetting.Endpoints[len(altSetting.Endpoints)-1]
+}
+
+// appendClassSpecific appends descriptor to the innermost descriptor seen so far
+func (p *configurationParser) appendClassSpecific(desc Descriptor) {
+	if endpoint := p.endpoint(); endpoint != nil {
+		endpoint.ClassSpecific = append(endpoint.ClassSpecific, desc)
+	} else if altSetting := p.altSetting(); altSetting != nil {
+		altSetting.ClassSpecific = append(altSetting.ClassSpecific, desc)
+	} else {
+		p.config.ClassSpecific = append(p.config.ClassSpecific, desc)
+	}
+}
+
+// flushInterfaceAssociation keeps interface association descriptor not followed by interface descriptor as raw descriptor
+func (p *configurationParser) flushInterfaceAssociation() {
+	if p.pendingAssociation == nil {
+		return
+	}
+	buf := new(bytes.Buffer)
+	// Encoding to bytes.Buffer never fails
+	_ = p.pendingAssociation.Encode(buf)
+	p.appendClassSpecific(descriptor.RawDescriptor(buf.Bytes()))
+	p.pendingAssociation = nil
+}
+
+func (p *configurationParser) parse(data []byte) error {
+	descriptorType := descriptor.DescriptorType(data[1])
+	if descriptorType == descriptor.DESCRIPTOR_TYPE_INTERFACE && len(data) >= descriptor.STANDARD_INTERFACE_DESCRIPTOR_LENGTH {
+		altSetting := AltSetting{
+			InterfaceAssociation: p.pendingAssociation,
+			Extra:                extra(data, descriptor.STANDARD_INTERFACE_DESCRIPTOR_LENGTH),
+		}
+		if err := altSetting.Descriptor.Decode(bytes.NewBuffer(data)); err != nil {
+			return fmt.Errorf("unable to decode interface descriptor: %w", err)
+		}
+		p.config.AltSettings = append(p.config.AltSettings, altSetting)
+		p.pendingAssociation = nil
+		return nil
+	}
+	p.flushInterfaceAssociation()
+
+	altSetting := p.altSetting()
+	endpoint := p.endpoint()
+	switch {
+	case descriptorType == descriptor.DESCRIPTOR_TYPE_INTERFACE_ASSOCIATION && len(data) == descriptor.INTERFACE_ASSOCIATION_DESCRIPTOR_LENGTH:
+		p.pendingAssociation = &descriptor.InterfaceAssociationDescriptor{}
+		if err := p.pendingAssociation.Decode(bytes.NewBuffer(data)); err != nil {
+			return fmt.Errorf("unable to decode interface association descriptor: %w", err)
+		}
+		return nil
+	case descriptorType == descriptor.DESCRIPTOR_TYPE_ENDPOINT && altSetting != nil && len(data) >= descriptor.STANDARD_ENDPOINT_DESCRIPTOR_LENGTH:
+		newEndpoint := Endpoint{
+			Extra: extra(data, descriptor.STANDARD_ENDPOINT_DESCRIPTOR_LENGTH),
+		}
+		if err := newEndpoint.Descriptor.Decode(bytes.NewBuffer(data)); err != nil {
+			return fmt.Errorf("unable to decode endpoint descriptor: %w", err)
+		}
+		altSetting.Endpoints = append(altSetting.Endpoints, newEndpoint)
+		return nil
+	case descriptorType == descriptor.DESCRIPTOR_TYPE_SUPER_SPEED_USB_ENDPOINT_COMPANION && endpoint != nil &&
+		endpoint.SuperSpeedCompanion == nil && len(endpoint.ClassSpecific) == 0 &&
+		len(data) == descriptor.SUPERSPEED_ENDPOINT_COMPANION_DESCRIPTOR_LENGTH:
+		endpoint.SuperSpeedCompanion = &descriptor.SuperSpeedEndpointCompanionDescriptor{}
+		if err := endpoint.SuperSpeedCompanion.Decode(bytes.NewBuffer(data)); err != nil {
+			return fmt.Errorf("unable to decode SuperSpeed endpoint companion descriptor: %w", err)
+		}
+		return nil
+	case descriptorType == descriptor.DESCRIPTOR_TYPE_SUPER_SPEED_PLUS_ISOCHRONOUS_ENDPOINT_COMPANION && endpoint != nil &&
+		endpoint.SuperSpeedCompanion != nil && endpoint.SuperSpeedPlusIsochronousCompanion == nil && len(endpoint.ClassSpecific) == 0 &&
+		len(data) == descriptor.SUPERSPEED_PLUS_ISOCHRONOUS_ENDPOINT_COMPANION_DESCRIPTOR_LENGTH:
+		endpoint.SuperSpeedPlusIsochronousCompanion = &descriptor.SuperSpeedPlusIsochronousEndpointCompanionDescriptor{}
+		if err := endpoint.SuperSpeedPlusIsochronousCompanion.Decode(bytes.NewBuffer(data)); err != nil {
+			return fmt.Errorf("unable to decode SuperSpeedPlus isochronous endpoint companion descriptor: %w", err)
+		}
+		return nil
+	case descriptorType == descriptor.DESCRIPTOR_TYPE_HID && endpoint == nil && altSetting != nil &&
+		altSetting.Descriptor.BInterfaceClass == usbprotocol.CLASS_HID && isHIDDescriptorLength(data):
+		hidDesc := &hid.HIDDescriptor{}
+		if err := hidDesc.Decode(bytes.NewBuffer(data)); err != nil {
+			return fmt.Errorf("unable to decode HID descriptor: %w", err)
+		}
+		altSetting.ClassSpecific = append(altSetting.ClassSpecific, hidDesc)
+		return nil
+	}
+
+	// Unknown descriptors, and known descriptors that cannot be re-encoded to the same bytes, are kept as they are
+	p.appendClassSpecific(descriptor.RawDescriptor(bytes.Clone(data)))
+
+	return nil
+}
+
+// isHIDDescriptorLength returns whether bLength of HID descriptor matches its number of class descriptors
+func isHIDDescriptorLength(data []byte) bool {
+	if len(data) < hid.HID_DESCRIPTOR_LENGTH {
+		return false
+	}
+	numDescriptors := int(data[5])
+
+	return numDescriptors >= 1 && len(data) == hid.HID_DESCRIPTOR_LENGTH+(numDescriptors-1)*3
+}
+
+func extra(data []byte, standardLength int) []byte {
+	if len(data) <= standardLength {
+		return nil
+	}
+
+	return bytes.Clone(data[standardLength:])
+}
+
+// Encode serializes configuration tree back to GET_DESCRIPTOR(CONFIGURATION) response
+func (c *Configuration) Encode(writer io.Writer) error {
+	if err := c.Descriptor.Encode(writer); err != nil {
+		return fmt.Errorf("unable to encode configuration descriptor: %w", err)
+	}
+	if err := writeExtra(writer, c.Extra); err != nil {
+		return err
+	}
+	if err := encodeDescriptors(writer, c.ClassSpecific); err != nil {
+		return err
+	}
+	for i := range c.AltSettings {
+		if err := c.AltSettings[i].Encode(writer); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (a *AltSetting) Encode(writer io.Writer) error {
+	if a.InterfaceAssociation != nil {
+		if err := a.InterfaceAssociation.Encode(writer); err != nil {
+			return fmt.Errorf("unable to encode interface association descriptor: %w", err)
+		}
+	}
+	if err := a.Descriptor.Encode(writer); err != nil {
+		return fmt.Errorf("unable to encode interface descriptor: %w", err)
+	}
+	if err := writeExtra(writer, a.Extra); err != nil {
+		return err
+	}
+	if err := encodeDescriptors(writer, a.ClassSpecific); err != nil {
+		return err
+	}
+	for i := range a.Endpoints {
+		if err := a.Endpoints[i].Encode(writer); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (e *Endpoint) Encode(writer io.Writer) error {
+	if err := e.Descriptor.Encode(writer); err != nil {
+		return fmt.Errorf("unable to encode endpoint descriptor: %w", err)
+	}
+	if err := writeExtra(writer, e.Extra); err != nil {
+		return err
+	}
+	if e.SuperSpeedCompanion != nil {
+		if err := e.SuperSpeedCompanion.Encode(writer); err != nil {
+			return fmt.Errorf("unable to encode SuperSpeed endpoint companion descriptor: %w", err)
+		}
+	}
+	if e.SuperSpeedPlusIsochronousCompanion != nil {
+		if err := e.SuperSpeedPlusIsochronousCompanion.Encode(writer); err != nil {
+			return fmt.Errorf("unable to encode SuperSpeedPlus isochronous endpoint companion descriptor: %w", err)
+		}
+	}
+
+	return encodeDescriptors(writer, e.ClassSpecific)
+}
+
+func writeExtra(writer io.Writer, extra []byte) error {
+	if len(extra) == 0 {
+		return nil
+	}
+	if _, err := writer.Write(extra); err != nil {
+		return fmt.Errorf("unable to write extra bytes of descriptor: %w", err)
+	}
+
+	return nil
+}
+
+func encodeDescriptors(writer io.Writer, descs []Descriptor) error {
+	for i, desc := range descs {
+		if err := desc.Encode(writer); err != nil {
+			return fmt.Errorf("unable to encode class-specific descriptor %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+// Interfaces returns alternate settings grouped by interface number, in order of first appearance
+func (c *Configuration) Interfaces() []Interface {
+	var interfaces []Interface
+	indexes := make(map[uint8]int)
+	for i := range c.AltSettings {
+		altSetting := &c.AltSettings[i]
+		number := altSetting.Descriptor.BInterfaceNumber
+		index, ok := indexes[number]
+		if !ok {
+			index = len(interfaces)
+			indexes[number] = index
+			interfaces = append(interfaces, Interface{Number: number})
+		}
+		interfaces[index].AltSettings = append(interfaces[index].AltSettings, altSetting)
+	}
+
+	return interfaces
+}
@@ -0,0 +1,264 @@
+package parser_test
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/ntchjb/usbip-virtual-device/usb/protocol"
+	"github.com/ntchjb/usbip-virtual-device/usb/protocol/descriptor"
+	"github.com/ntchjb/usbip-virtual-device/usb/protocol/hid"
+	"github.com/ntchjb/usbip-virtual-device/usb/protocol/parser"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func encode(t *testing.T, config *parser.Configuration) []byte {
+	buf := new(bytes.Buffer)
+	require.NoError(t, config.Encode(buf))
+
+	return buf.Bytes()
+}
+
+func TestParseConfigurationComposite(t *testing.T) {
+	tree := descriptor.Device{
+		Speed:          protocol.SPEED_USB2_HIGH,
+		BCDUSB:         0x0200,
+		BMaxPacketSize: 64,
+		Configurations: []descriptor.Configuration{
+			{
+				BMAttributes: 0b10000000,
+				Name:         "Composite",
+				Functions: []descriptor.Function{
+					{
+						Interfaces: []descriptor.Interface{
+							{
+								AltSettings: []descriptor.AltSetting{
+									{
+										BInterfaceClass: protocol.CLASS_HID,
+										ClassSpecific: []descriptor.ClassSpecificDescriptor{
+											&hid.HIDDescriptor{
+												BLength:              hid.HID_DESCRIPTOR_LENGTH,
+												BDescriptorType:      descriptor.DESCRIPTOR_TYPE_HID,
+												BCDHID:               0x0111,
+												BNumDescriptors:      1,
+												BClassDescriptorType: descriptor.DESCRIPTOR_TYPE_HID_REPORT,
+												WDescriptorLength:    0x0034,
+											},
+										},
+										Endpoints: []descriptor.Endpoint{
+											{BEndpointAddress: 0x80, BMAttributes: 0x03, WMaxPacketSize: 8, BInterval: 10},
+										},
+									},
+								},
+							},
+						},
+					},
+					{
+						BFunctionClass:    protocol.CLASS_CDC_CONTROL,
+						BFunctionSubClass: 0x02,
+						Interfaces: []descriptor.Interface{
+							{
+								AltSettings: []descriptor.AltSetting{
+									{
+										BInterfaceClass:    protocol.CLASS_CDC_CONTROL,
+										BInterfaceSubClass: 0x02,
+										ClassSpecific: []descriptor.ClassSpecificDescriptor{
+											descriptor.RawDescriptor{0x05, 0x24, 0x00, 0x10, 0x01},
+										},
+										Endpoints: []descriptor.Endpoint{
+											{BEndpointAddress: 0x80, BMAttributes: 0x03, WMaxPacketSize: 8, BInterval: 16},
+										},
+									},
+								},
+							},
+							{
+								AltSettings: []descriptor.AltSetting{
+									{BInterfaceClass: protocol.CLASS_CDC_DATA},
+									{
+										BInterfaceClass: protocol.CLASS_CDC_DATA,
+										Endpoints: []descriptor.Endpoint{
+											{BEndpointAddress: 0x80, BMAttributes: 0x02, WMaxPacketSize: 512},
+											{BEndpointAddress: 0x00, BMAttributes: 0x02, WMaxPacketSize: 512},
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	set, err := tree.Build()
+	require.NoError(t, err)
+	data, ok := set.Configuration(0)
+	require.True(t, ok)
+
+	config, err := parser.ParseConfiguration(data)
+	require.NoError(t, err)
+
+	assert.Equal(t, uint8(3), config.Descriptor.BNumInterfaces)
+	assert.Equal(t, uint8(1), config.Descriptor.IConfiguration)
+	require.Len(t, config.AltSettings, 4)
+
+	hidInterface := config.AltSettings[0]
+	assert.Nil(t, hidInterface.InterfaceAssociation)
+	require.Len(t, hidInterface.ClassSpecific, 1)
+	hidDesc, ok := hidInterface.ClassSpecific[0].(*hid.HIDDescriptor)
+	require.True(t, ok)
+	assert.Equal(t, uint16(0x0034), hidDesc.WDescriptorLength)
+	require.Len(t, hidInterface.Endpoints, 1)
+	assert.Equal(t, uint8(0x81), hidInterface.Endpoints[0].Descriptor.BEndpointAddress)
+
+	commInterface := config.AltSettings[1]
+	require.NotNil(t, commInterface.InterfaceAssociation)
+	assert.Equal(t, uint8(1), commInterface.InterfaceAssociation.BFirstInterface)
+	assert.Equal(t, uint8(2), commInterface.InterfaceAssociation.BInterfaceCount)
+	assert.Equal(t, []parser.Descriptor{descriptor.RawDescriptor{0x05, 0x24, 0x00, 0x10, 0x01}}, commInterface.ClassSpecific)
+
+	interfaces := config.Interfaces()
+	require.Len(t, interfaces, 3)
+	assert.Equal(t, uint8(2), interfaces[2].Number)
+	require.Len(t, interfaces[2].AltSettings, 2)
+	assert.Len(t, interfaces[2].AltSettings[1].Endpoints, 2)
+
+	assert.Equal(t, data, encode(t, config))
+}
+
+func TestParseConfigurationSuperSpeed(t *testing.T) {
+	data := []byte{
+		0x09, 0x02, 0x38, 0x00, 0x01, 0x01, 0x00, 0x80, 0x32, // Configuration
+		0x09, 0x04, 0x00, 0x00, 0x02, 0x08, 0x06, 0x62, 0x00, // UAS interface
+		0x07, 0x05, 0x81, 0x02, 0x00, 0x04, 0x00, // Bulk IN endpoint
+		0x06, 0x30, 0x0f, 0x05, 0x00, 0x00, // Endpoint companion with 32 streams
+		0x04, 0x24, 0x03, 0x00, // Pipe usage descriptor
+		0x07, 0x05, 0x82, 0x01, 0x00, 0x04, 0x01, // Isochronous IN endpoint
+		0x06, 0x30, 0x0f, 0x80, 0x01, 0x00, // Endpoint companion followed by SuperSpeedPlus companion
+		0x08, 0x31, 0x00, 0x00, 0x00, 0x20, 0x01, 0x00, // SuperSpeedPlus isochronous endpoint companion
+	}
+
+	config, err := parser.ParseConfiguration(data)
+	require.NoError(t, err)
+	require.Len(t, config.AltSettings, 1)
+	endpoints := config.AltSettings[0].Endpoints
+	require.Len(t, endpoints, 2)
+
+	require.NotNil(t, endpoints[0].SuperSpeedCompanion)
+	assert.Equal(t, uint8(0x05), endpoints[0].SuperSpeedCompanion.BMAttributes)
+	assert.Nil(t, endpoints[0].SuperSpeedPlusIsochronousCompanion)
+	assert.Equal(t, []parser.Descriptor{descriptor.RawDescriptor{0x04, 0x24, 0x03, 0x00}}, endpoints[0].ClassSpecific)
+
+	require.NotNil(t, endpoints[1].SuperSpeedPlusIsochronousCompanion)
+	assert.Equal(t, uint32(0x00012000), endpoints[1].SuperSpeedPlusIsochronousCompanion.DWBytesPerInterval)
+
+	assert.Equal(t, data, encode(t, config))
+}
+
+func TestParseConfigurationUnknownDescriptors(t *testing.T) {
+	data := []byte{
+		0x09, 0x02, 0x49, 0x00, 0x02, 0x01, 0x00, 0x80, 0x32, // Configuration
+		0x04, 0x41, 0x01, 0x02, // Unknown descriptor before interfaces
+		0x09, 0x04, 0x00, 0x00, 0x00, 0x01, 0x01, 0x00, 0x00, // Audio control interface
+		0x09, 0x24, 0x01, 0x00, 0x01, 0x09, 0x00, 0x01, 0x01, // Class-specific AC interface header
+		0x09, 0x04, 0x01, 0x00, 0x01, 0x01, 0x02, 0x00, 0x00, // Audio streaming interface
+		0x09, 0x05, 0x01, 0x09, 0xc0, 0x00, 0x01, 0x00, 0x00, // Audio 1.0 endpoint with bRefresh and bSynchAddress
+		0x07, 0x25, 0x01, 0x00, 0x00, 0x00, 0x00, // Class-specific isochronous endpoint
+		0x09, 0x21, 0x01, 0xff, 0x00, 0x00, 0x04, 0x10, 0x01, // Descriptor type 0x21 outside HID interface
+		0x08, 0x0b, 0x00, 0x02, 0x01, 0x00, 0x00, 0x00, // Interface association without interface
+	}
+
+	config, err := parser.ParseConfiguration(data)
+	require.NoError(t, err)
+	assert.Equal(t, []parser.Descriptor{descriptor.RawDescriptor{0x04, 0x41, 0x01, 0x02}}, config.ClassSpecific)
+	require.Len(t, config.AltSettings, 2)
+	assert.Len(t, config.AltSettings[0].ClassSpecific, 1)
+
+	require.Len(t, config.AltSettings[1].Endpoints, 1)
+	endpoint := config.AltSettings[1].Endpoints[0]
+	assert.Equal(t, uint16(192), endpoint.Descriptor.WMaxPacketSize)
+	assert.Equal(t, []byte{0x00, 0x00}, endpoint.Extra)
+	require.Len(t, endpoint.ClassSpecific, 3)
+	assert.IsType(t, descriptor.RawDescriptor{}, endpoint.ClassSpecific[1])
+	assert.IsType(t, descriptor.RawDescriptor{}, endpoint.ClassSpecific[2])
+
+	assert.Equal(t, data, encode(t, config))
+}
+
+func TestParseConfigurations(t *testing.T) {
+	data := []byte{
+		0x09, 0x02, 0x12, 0x00, 0x01, 0x01, 0x00, 0x80, 0x32,
+		0x09, 0x04, 0x00, 0x00, 0x00, 0xff, 0x00, 0x00, 0x00,
+		0x09, 0x07, 0x12, 0x00, 0x01, 0x02, 0x00, 0x80, 0x32,
+		0x09, 0x04, 0x00, 0x00, 0x00, 0xff, 0x00, 0x00, 0x00,
+	}
+
+	configs, err := parser.ParseConfigurations(data)
+	require.NoError(t, err)
+	require.Len(t, configs, 2)
+	assert.Equal(t, uint8(1), configs[0].Descriptor.BConfigurationValue)
+	assert.Equal(t, descriptor.DESCRIPTOR_TYPE_OTHER_SPEED_CONFIGURATION, configs[1].Descriptor.BDescriptorType)
+	assert.Equal(t, data[0x12:], encode(t, &configs[1]))
+
+	_, err = parser.ParseConfiguration(data)
+	assert.ErrorIs(t, err, parser.ErrInvalidDescriptor)
+}
+
+func TestParseConfigurationInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{
+			name: "Empty",
+			data: nil,
+		},
+		{
+			name: "Truncated configuration descriptor",
+			data: []byte{0x09, 0x02, 0x09, 0x00},
+		},
+		{
+			name: "wTotalLength exceeds data",
+			data: []byte{0x09, 0x02, 0x12, 0x00, 0x00, 0x01, 0x00, 0x80, 0x32},
+		},
+		{
+			name: "Zero wTotalLength",
+			data: []byte{0x09, 0x02, 0x00, 0x00, 0x01, 0x01, 0x00, 0x80, 0x32},
+		},
+		{
+			name: "wTotalLength shorter than bLength",
+			data: []byte{0x0a, 0x02, 0x09, 0x00, 0x01, 0x01, 0x00, 0x80, 0x32, 0x00},
+		},
+		{
+			name: "Not configuration descriptor",
+			data: []byte{0x09, 0x04, 0x09, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
+		},
+		{
+			name: "Zero bLength",
+			data: []byte{0x09, 0x02, 0x0b, 0x00, 0x00, 0x01, 0x00, 0x80, 0x32, 0x00, 0x04},
+		},
+		{
+			name: "Descriptor exceeds wTotalLength",
+			data: []byte{0x09, 0x02, 0x0b, 0x00, 0x00, 0x01, 0x00, 0x80, 0x32, 0x09, 0x04},
+		},
+	}
+
+	for wTotalLength := byte(1); wTotalLength < descriptor.STANDARD_CONFIGURATION_DESCRIPTOR_LENGTH; wTotalLength++ {
+		tests = append(tests, struct {
+			name string
+			data []byte
+		}{
+			name: fmt.Sprintf("wTotalLength %d", wTotalLength),
+			data: []byte{0x09, 0x02, wTotalLength, 0x00, 0x01, 0x01, 0x00, 0x80, 0x32},
+		})
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := parser.ParseConfiguration(test.data)
+			assert.ErrorIs(t, err, parser.ErrInvalidDescriptor)
+		})
+	}
+}
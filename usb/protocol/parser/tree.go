@@ -0,0 +1,104 @@
+package parser
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/ntchjb/usbip-virtual-device/usb/protocol/descriptor"
+)
+
+// Tree converts parsed configuration into descriptor tree, such as for descriptor.RawDevice.
+// Interfaces and alternate settings keep their numbers and are sorted by them, where numbers may have gaps but not duplicates.
+// Interface associations and extra bytes of descriptors are not part of the tree,
+// so building the tree does not always reproduce parsed bytes.
+func (c *Configuration) Tree() (descriptor.Configuration, error) {
+	tree := descriptor.Configuration{
+		BConfigurationValue: c.Descriptor.BConfigurationValue,
+		BMAttributes:        c.Descriptor.BMAttributes,
+		BMaxPower:           c.Descriptor.BMaxPower,
+		ClassSpecific:       classSpecificTree(c.ClassSpecific),
+	}
+
+	interfaces := c.Interfaces()
+	tree.Interfaces = make([]descriptor.Interface, len(interfaces))
+	for i, intf := range interfaces {
+		altSettings := make([]descriptor.AltSetting, len(intf.AltSettings))
+		for j, altSetting := range intf.AltSettings {
+			altSettings[j] = altSetting.tree()
+		}
+		sort.Slice(altSettings, func(a, b int) bool {
+			return altSettings[a].BAlternateSetting < altSettings[b].BAlternateSetting
+		})
+		for j := 1; j < len(altSettings); j++ {
+			if altSettings[j].BAlternateSetting == altSettings[j-1].BAlternateSetting {
+				return descriptor.Configuration{}, fmt.Errorf("%w: duplicated alternate setting %d of interface %d", ErrInvalidDescriptor, altSettings[j].BAlternateSetting, intf.Number)
+			}
+		}
+		tree.Interfaces[i] = descriptor.Interface{
+			BInterfaceNumber: intf.Number,
+			AltSettings:      altSettings,
+		}
+	}
+	// Interfaces are grouped by number, so their numbers are unique
+	sort.Slice(tree.Interfaces, func(a, b int) bool {
+		return tree.Interfaces[a].BInterfaceNumber < tree.Interfaces[b].BInterfaceNumber
+	})
+
+	return tree, nil
+}
+
+func (a *AltSetting) tree() descriptor.AltSetting {
+	tree := descriptor.AltSetting{
+		BAlternateSetting:  a.Descriptor.BAlternateSetting,
+		BInterfaceClass:    a.Descriptor.BInterfaceClass,
+		BInterfaceSubClass: a.Descriptor.BInterfaceSubClass,
+		BInterfaceProtocol: a.Descriptor.BInterfaceProtocol,
+		ClassSpecific:      classSpecificTree(a.ClassSpecific),
+		Endpoints:          make([]descriptor.Endpoint, len(a.Endpoints)),
+	}
+	for i, endpoint := range a.Endpoints {
+		tree.Endpoints[i] = endpoint.tree()
+	}
+
+	return tree
+}
+
+func (e *Endpoint) tree() descriptor.Endpoint {
+	tree := descriptor.Endpoint{
+		BEndpointAddress: e.Descriptor.BEndpointAddress,
+		BMAttributes:     e.Descriptor.BMAttributes,
+		WMaxPacketSize:   e.Descriptor.WMaxPacketSize,
+		BInterval:        e.Descriptor.BInterval,
+		ClassSpecific:    classSpecificTree(e.ClassSpecific),
+	}
+	if e.SuperSpeedCompanion != nil {
+		companion := &descriptor.SuperSpeedCompanion{
+			MaxBurst:         e.SuperSpeedCompanion.BMaxBurst,
+			BytesPerInterval: e.SuperSpeedCompanion.WBytesPerInterval,
+		}
+		switch e.Descriptor.BMAttributes & descriptor.ENDPOINT_TRANSFER_TYPE_MASK {
+		case descriptor.ENDPOINT_TRANSFER_TYPE_BULK:
+			companion.MaxStreams = e.SuperSpeedCompanion.BMAttributes & 0x1F
+		case descriptor.ENDPOINT_TRANSFER_TYPE_ISOCHRONOUS:
+			companion.Mult = e.SuperSpeedCompanion.BMAttributes & 0b11
+		}
+		if e.SuperSpeedPlusIsochronousCompanion != nil {
+			companion.SuperSpeedPlusBytesPerInterval = e.SuperSpeedPlusIsochronousCompanion.DWBytesPerInterval
+		}
+		tree.SuperSpeedCompanion = companion
+	}
+
+	return tree
+}
+
+func classSpecificTree(descs []Descriptor) []descriptor.ClassSpecificDescriptor {
+	if len(descs) == 0 {
+		return nil
+	}
+	tree := make([]descriptor.ClassSpecificDescriptor, len(descs))
+	for i, desc := range descs {
+		tree[i] = desc
+	}
+
+	return tree
+}
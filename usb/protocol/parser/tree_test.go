@@ -0,0 +1,104 @@
+package parser_test
+
+import (
+	"testing"
+
+	"github.com/ntchjb/usbip-virtual-device/usb/protocol/descriptor"
+	"github.com/ntchjb/usbip-virtual-device/usb/protocol/hid"
+	"github.com/ntchjb/usbip-virtual-device/usb/protocol/parser"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigurationTree(t *testing.T) {
+	data := []byte{
+		0x09, 0x02, 0x41, 0x00, 0x02, 0x01, 0x00, 0xa0, 0x32, // Configuration
+		0x09, 0x04, 0x00, 0x00, 0x01, 0x03, 0x01, 0x02, 0x00, // HID interface
+		0x09, 0x21, 0x11, 0x01, 0x00, 0x01, 0x22, 0x34, 0x00, // HID descriptor
+		0x07, 0x05, 0x81, 0x03, 0x08, 0x00, 0x0a, // Interrupt IN endpoint
+		0x09, 0x04, 0x01, 0x01, 0x01, 0xff, 0x00, 0x00, 0x00, // Vendor interface, alternate setting 1 before 0
+		0x07, 0x05, 0x82, 0x02, 0x00, 0x04, 0x00, // Bulk IN endpoint
+		0x06, 0x30, 0x0f, 0x04, 0x00, 0x00, // Endpoint companion with 16 streams
+		0x09, 0x04, 0x01, 0x00, 0x00, 0xff, 0x00, 0x00, 0x00, // Vendor interface, alternate setting 0
+	}
+	config, err := parser.ParseConfiguration(data)
+	require.NoError(t, err)
+
+	tree, err := config.Tree()
+	require.NoError(t, err)
+	assert.Equal(t, uint8(1), tree.BConfigurationValue)
+	assert.Equal(t, uint8(0xa0), tree.BMAttributes)
+	require.Len(t, tree.Interfaces, 2)
+
+	hidAltSetting := tree.Interfaces[0].AltSettings[0]
+	assert.Equal(t, uint8(0x03), hidAltSetting.BInterfaceClass)
+	require.Len(t, hidAltSetting.ClassSpecific, 1)
+	assert.IsType(t, &hid.HIDDescriptor{}, hidAltSetting.ClassSpecific[0])
+	assert.Equal(t, []descriptor.Endpoint{{BEndpointAddress: 0x81, BMAttributes: 0x03, WMaxPacketSize: 8, BInterval: 10}}, hidAltSetting.Endpoints)
+
+	require.Len(t, tree.Interfaces[1].AltSettings, 2)
+	assert.Equal(t, uint8(1), tree.Interfaces[1].BInterfaceNumber)
+	assert.Equal(t, uint8(0), tree.Interfaces[1].AltSettings[0].BAlternateSetting)
+	assert.Equal(t, uint8(1), tree.Interfaces[1].AltSettings[1].BAlternateSetting)
+	assert.Empty(t, tree.Interfaces[1].AltSettings[0].Endpoints)
+	endpoints := tree.Interfaces[1].AltSettings[1].Endpoints
+	require.Len(t, endpoints, 1)
+	assert.Equal(t, &descriptor.SuperSpeedCompanion{MaxBurst: 15, MaxStreams: 4}, endpoints[0].SuperSpeedCompanion)
+}
+
+func TestConfigurationTreeNumberGap(t *testing.T) {
+	data := []byte{
+		0x09, 0x02, 0x2b, 0x00, 0x02, 0x01, 0x00, 0x80, 0x32, // Configuration
+		0x09, 0x04, 0x03, 0x00, 0x00, 0xff, 0x00, 0x00, 0x00, // Interface 3
+		0x09, 0x04, 0x01, 0x02, 0x01, 0xff, 0x00, 0x00, 0x00, // Interface 1, alternate setting 2
+		0x07, 0x05, 0x81, 0x02, 0x00, 0x02, 0x00, // Bulk IN endpoint
+		0x09, 0x04, 0x01, 0x00, 0x00, 0xff, 0x00, 0x00, 0x00, // Interface 1, alternate setting 0
+	}
+	config, err := parser.ParseConfiguration(data)
+	require.NoError(t, err)
+
+	tree, err := config.Tree()
+	require.NoError(t, err)
+	require.Len(t, tree.Interfaces, 2)
+	assert.Equal(t, uint8(1), tree.Interfaces[0].BInterfaceNumber)
+	assert.Equal(t, uint8(3), tree.Interfaces[1].BInterfaceNumber)
+
+	intf, ok := tree.Interface(1)
+	require.True(t, ok)
+	require.Len(t, intf.AltSettings, 2)
+	altSetting, ok := intf.AltSetting(2)
+	require.True(t, ok)
+	assert.Equal(t, uint8(0x81), altSetting.Endpoints[0].BEndpointAddress)
+	_, ok = intf.AltSetting(1)
+	assert.False(t, ok)
+	_, ok = tree.Interface(0)
+	assert.False(t, ok)
+}
+
+func TestConfigurationTreeInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{
+			name: "Duplicated alternate setting",
+			data: []byte{
+				0x09, 0x02, 0x1b, 0x00, 0x01, 0x01, 0x00, 0x80, 0x32,
+				0x09, 0x04, 0x00, 0x00, 0x00, 0xff, 0x00, 0x00, 0x00,
+				0x09, 0x04, 0x00, 0x00, 0x00, 0xff, 0x00, 0x00, 0x00,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			config, err := parser.ParseConfiguration(test.data)
+			require.NoError(t, err)
+
+			_, err = config.Tree()
+			assert.ErrorIs(t, err, parser.ErrInvalidDescriptor)
+		})
+	}
+}
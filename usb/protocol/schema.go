@@ -54,12 +54,17 @@ const (
 	SUBCLASS_NONE uint8 = 0x00
 
 	SUBCLASS_HID_BOOT_INTERFACE uint8 = 0x01
+
+	SUBCLASS_MISCELLANEOUS_COMMON uint8 = 0x02
 )
 
 const (
 	PROTOCOL_NONE         uint8 = 0x00
 	PROTOCOL_HID_KEYBOARD uint8 = 0x01
 	PROTOCOL_HID_MOUSE    uint8 = 0x02
+
+	// Device protocol of composite device using interface association descriptors
+	PROTOCOL_MISCELLANEOUS_INTERFACE_ASSOCIATION uint8 = 0x01
 )
 
 type SetupRequest uint8
@@ -80,6 +85,20 @@ const (
 	REQUEST_SET_ISOCH_DELAY   SetupRequest = 49
 )
 
+type FeatureSelector uint16
+
+const (
+	FEATURE_ENDPOINT_HALT        FeatureSelector = 0
+	FEATURE_DEVICE_REMOTE_WAKEUP FeatureSelector = 1
+	FEATURE_TEST_MODE            FeatureSelector = 2
+	// Interface recipient of SuperSpeed device, wIndex high byte contains suspend options
+	FEATURE_FUNCTION_SUSPEND FeatureSelector = 0
+	// Device recipient of SuperSpeed device
+	FEATURE_U1_ENABLE  FeatureSelector = 48
+	FEATURE_U2_ENABLE  FeatureSelector = 49
+	FEATURE_LTM_ENABLE FeatureSelector = 50
+)
+
 const (
 	REQUEST_HID_GET_REPORT   SetupRequest = 0x01
 	REQUEST_HID_GET_IDLE     SetupRequest = 0x02
@@ -91,6 +110,8 @@ const (
 
 const (
 	SETUP_PACKET_LENGTH = 8
+	// Length of data stage of SET_SEL request
+	SYSTEM_EXIT_LATENCY_LENGTH = 6
 )
 
 type SetupDataDirection byte
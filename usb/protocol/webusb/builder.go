@@ -0,0 +1,122 @@
+package webusb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	usbprotocol "github.com/ntchjb/usbip-virtual-device/usb/protocol"
+	"github.com/ntchjb/usbip-virtual-device/usb/protocol/descriptor"
+)
+
+var (
+	ErrURLNotFound = errors.New("WebUSB URL not found")
+)
+
+// DescriptorSet is WebUSB configuration of a device, which is built into Descriptors by Build.
+// URL indexes are computed by Build, starting from 1.
+type DescriptorSet struct {
+	// bRequest of vendor request retrieving URL descriptors, chosen by device
+	VendorCode uint8
+	// URL suggested by browser when the device is connected, no landing page if empty
+	LandingPage string
+	// Other URLs retrievable by GET_URL request, indexed after landing page
+	URLs []string
+}
+
+// Descriptors is serialized WebUSB platform capability and URL descriptors, built from DescriptorSet
+type Descriptors struct {
+	capability descriptor.PlatformCapability
+	urls       [][]byte
+	vendorCode uint8
+}
+
+// Build serializes URL descriptors and WebUSB platform capability
+func (s *DescriptorSet) Build() (*Descriptors, error) {
+	urls := s.URLs
+	var landingPage uint8
+	if s.LandingPage != "" {
+		urls = append([]string{s.LandingPage}, urls...)
+		landingPage = 1
+	}
+	if len(urls) > 255 {
+		return nil, fmt.Errorf("%w: number of URLs exceeds 255", ErrInvalidURL)
+	}
+
+	descriptors := &Descriptors{
+		vendorCode: s.VendorCode,
+	}
+	for _, url := range urls {
+		urlDesc, err := NewURLDescriptor(url)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create URL descriptor of %q: %w", url, err)
+		}
+		buf := new(bytes.Buffer)
+		if err := urlDesc.Encode(buf); err != nil {
+			return nil, fmt.Errorf("unable to encode URL descriptor: %w", err)
+		}
+		descriptors.urls = append(descriptors.urls, buf.Bytes())
+	}
+
+	capabilityData := make([]byte, PLATFORM_CAPABILITY_DATA_LENGTH)
+	binary.LittleEndian.PutUint16(capabilityData[0:2], WEBUSB_VERSION)
+	capabilityData[2] = s.VendorCode
+	capabilityData[3] = landingPage
+	descriptors.capability = descriptor.NewPlatformCapability(PLATFORM_CAPABILITY_UUID, capabilityData)
+
+	return descriptors, nil
+}
+
+// Capability returns WebUSB platform capability, to be added to BOS descriptor of the device
+func (d *Descriptors) Capability() *descriptor.PlatformCapability {
+	capability := d.capability
+
+	return &capability
+}
+
+// URL returns serialized URL descriptor at given index, starting from 1
+func (d *Descriptors) URL(index uint8) ([]byte, bool) {
+	if index == 0 || int(index) > len(d.urls) {
+		return nil, false
+	}
+
+	return d.urls[index-1], true
+}
+
+// IsURLRequest returns whether given setup packet is device-to-host GET_URL request sent to the device
+func (d *Descriptors) IsURLRequest(setup usbprotocol.SetupPacket) bool {
+	// bit 7 of bmRequestType is set for device-to-host transfers
+	return setup.BMRequestType&0x80 != 0 &&
+		setup.BMRequestType.Type() == usbprotocol.SETUP_DATA_TYPE_VENDOR &&
+		setup.BMRequestType.Recipient() == usbprotocol.SETUP_RECIPIENT_DEVICE &&
+		setup.BRequest == usbprotocol.SetupRequest(d.vendorCode) &&
+		setup.WIndex == WEBUSB_REQUEST_GET_URL
+}
+
+// HandleURLRequest returns URL descriptor requested by GET_URL request, where wValue is URL index
+func (d *Descriptors) HandleURLRequest(setup usbprotocol.SetupPacket) ([]byte, error) {
+	url, ok := d.URL(uint8(setup.WValue))
+	if setup.WValue > 0xFF || !ok {
+		return nil, fmt.Errorf("%w: index %d", ErrURLNotFound, setup.WValue)
+	}
+
+	return url, nil
+}
+
+// IsProtectedClass returns whether interfaces of given class cannot be claimed through WebUSB by browsers,
+// as they're handled by browser or operating system, such as HID and mass storage
+func IsProtectedClass(class uint8) bool {
+	switch class {
+	case usbprotocol.CLASS_AUDIO,
+		usbprotocol.CLASS_HID,
+		usbprotocol.CLASS_MASS_STORAGE,
+		usbprotocol.CLASS_SMART_CARD,
+		usbprotocol.CLASS_VIDEO,
+		usbprotocol.CLASS_AUDIO_AND_VIDEO,
+		usbprotocol.CLASS_WIRELESS_CONTROLLER:
+		return true
+	default:
+		return false
+	}
+}
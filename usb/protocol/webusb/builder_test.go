@@ -0,0 +1,82 @@
+package webusb_test
+
+import (
+	"testing"
+
+	"github.com/ntchjb/usbip-virtual-device/usb/protocol"
+	"github.com/ntchjb/usbip-virtual-device/usb/protocol/descriptor"
+	"github.com/ntchjb/usbip-virtual-device/usb/protocol/webusb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDescriptorSetBuild(t *testing.T) {
+	set := webusb.DescriptorSet{
+		VendorCode:  0x21,
+		LandingPage: "https://ntch.dev",
+		URLs:        []string{"http://localhost"},
+	}
+	descriptors, err := set.Build()
+	require.NoError(t, err)
+
+	capability := descriptor.NewPlatformCapability(webusb.PLATFORM_CAPABILITY_UUID, []byte{0x00, 0x01, 0x21, 0x01})
+	assert.Equal(t, &capability, descriptors.Capability())
+
+	url, err := descriptors.HandleURLRequest(protocol.SetupPacket{
+		BMRequestType: 0xC0,
+		BRequest:      0x21,
+		WValue:        1,
+		WIndex:        webusb.WEBUSB_REQUEST_GET_URL,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0x0B, 0x03, 0x01, 'n', 't', 'c', 'h', '.', 'd', 'e', 'v'}, url)
+
+	url, ok := descriptors.URL(2)
+	assert.True(t, ok)
+	assert.Equal(t, []byte{0x0C, 0x03, 0x00, 'l', 'o', 'c', 'a', 'l', 'h', 'o', 's', 't'}, url)
+
+	_, err = descriptors.HandleURLRequest(protocol.SetupPacket{WValue: 3})
+	assert.ErrorIs(t, err, webusb.ErrURLNotFound)
+	_, err = descriptors.HandleURLRequest(protocol.SetupPacket{WValue: 0x0101})
+	assert.ErrorIs(t, err, webusb.ErrURLNotFound)
+
+	assert.True(t, descriptors.IsURLRequest(protocol.SetupPacket{
+		BMRequestType: 0xC0,
+		BRequest:      0x21,
+		WIndex:        webusb.WEBUSB_REQUEST_GET_URL,
+	}))
+	assert.False(t, descriptors.IsURLRequest(protocol.SetupPacket{
+		BMRequestType: 0x40,
+		BRequest:      0x20,
+		WIndex:        webusb.WEBUSB_REQUEST_GET_URL,
+	}))
+	assert.False(t, descriptors.IsURLRequest(protocol.SetupPacket{
+		BMRequestType: 0x40,
+		BRequest:      0x21,
+		WIndex:        webusb.WEBUSB_REQUEST_GET_URL,
+	}))
+	assert.False(t, descriptors.IsURLRequest(protocol.SetupPacket{
+		BMRequestType: 0xC1,
+		BRequest:      0x21,
+		WIndex:        webusb.WEBUSB_REQUEST_GET_URL,
+	}))
+}
+
+func TestDescriptorSetBuildWithoutLandingPage(t *testing.T) {
+	set := webusb.DescriptorSet{
+		VendorCode: 0x21,
+	}
+	descriptors, err := set.Build()
+	require.NoError(t, err)
+
+	assert.Equal(t, []byte{0x00, 0x01, 0x21, 0x00}, descriptors.Capability().CapabilityData)
+	_, ok := descriptors.URL(1)
+	assert.False(t, ok)
+}
+
+func TestIsProtectedClass(t *testing.T) {
+	assert.True(t, webusb.IsProtectedClass(protocol.CLASS_HID))
+	assert.True(t, webusb.IsProtectedClass(protocol.CLASS_MASS_STORAGE))
+	assert.False(t, webusb.IsProtectedClass(protocol.CLASS_VENDOR_SPECIFIC))
+	assert.False(t, webusb.IsProtectedClass(protocol.CLASS_CDC_DATA))
+}
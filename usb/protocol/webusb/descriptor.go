@@ -0,0 +1,122 @@
+package webusb
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ntchjb/usbip-virtual-device/usbip/stream"
+)
+
+var (
+	ErrInvalidURL = errors.New("invalid WebUSB URL")
+)
+
+// Platform capability UUID of WebUSB, {3408B638-09A9-47A0-8BFD-A0768815B665}
+var PLATFORM_CAPABILITY_UUID = [16]byte{
+	0x38, 0xB6, 0x08, 0x34, 0xA9, 0x09, 0xA0, 0x47,
+	0x8B, 0xFD, 0xA0, 0x76, 0x88, 0x15, 0xB6, 0x65,
+}
+
+const (
+	// Version of WebUSB specification, in BCD
+	WEBUSB_VERSION uint16 = 0x0100
+	// Length of WebUSB data in platform capability
+	PLATFORM_CAPABILITY_DATA_LENGTH = 4
+	// wIndex of vendor request retrieving URL descriptor
+	WEBUSB_REQUEST_GET_URL uint16 = 0x02
+	// Descriptor type of URL descriptor
+	DESCRIPTOR_TYPE_URL uint8 = 0x03
+	// Length of URL descriptor without URL
+	URL_DESCRIPTOR_MIN_LENGTH = 3
+	// Maximum length of URL, as bLength is 1 byte
+	MAX_URL_LENGTH = 255 - URL_DESCRIPTOR_MIN_LENGTH
+)
+
+type URLScheme uint8
+
+const (
+	URL_SCHEME_HTTP  URLScheme = 0
+	URL_SCHEME_HTTPS URLScheme = 1
+	// URL contains its scheme
+	URL_SCHEME_NONE URLScheme = 255
+)
+
+// URLDescriptor is a URL returned by GET_URL request, such as landing page of the device
+type URLDescriptor struct {
+	// Size of this descriptor in bytes.
+	BLength uint8
+	// URL descriptor type.
+	BDescriptorType uint8
+	// URL scheme prefix.
+	BScheme URLScheme
+	// UTF-8 encoded URL, without scheme prefix.
+	URL []byte
+}
+
+func (s *URLDescriptor) Decode(reader io.Reader) error {
+	buf, err := stream.Read(reader, URL_DESCRIPTOR_MIN_LENGTH)
+	if err != nil {
+		return fmt.Errorf("unable to read URL descriptor from stream: %w", err)
+	}
+	s.BLength = buf[0]
+	s.BDescriptorType = buf[1]
+	s.BScheme = URLScheme(buf[2])
+	if s.BLength < URL_DESCRIPTOR_MIN_LENGTH {
+		return fmt.Errorf("invalid URL descriptor bLength: %d", s.BLength)
+	}
+
+	if s.URL, err = stream.Read(reader, int(s.BLength)-URL_DESCRIPTOR_MIN_LENGTH); err != nil {
+		return fmt.Errorf("unable to read URL of URL descriptor from stream: %w", err)
+	}
+
+	return nil
+}
+
+func (s *URLDescriptor) Encode(writer io.Writer) error {
+	buf := make([]byte, URL_DESCRIPTOR_MIN_LENGTH+len(s.URL))
+
+	buf[0] = s.BLength
+	buf[1] = s.BDescriptorType
+	buf[2] = byte(s.BScheme)
+	copy(buf[3:], s.URL)
+
+	if err := stream.Write(writer, buf); err != nil {
+		return fmt.Errorf("unable to write URL descriptor to stream: %w", err)
+	}
+
+	return nil
+}
+
+// String returns URL with its scheme prefix
+func (s *URLDescriptor) String() string {
+	switch s.BScheme {
+	case URL_SCHEME_HTTP:
+		return "http://" + string(s.URL)
+	case URL_SCHEME_HTTPS:
+		return "https://" + string(s.URL)
+	default:
+		return string(s.URL)
+	}
+}
+
+// NewURLDescriptor returns URL descriptor of given URL, using scheme prefix for http:// and https:// URLs
+func NewURLDescriptor(url string) (URLDescriptor, error) {
+	scheme := URL_SCHEME_NONE
+	if rest, ok := strings.CutPrefix(url, "https://"); ok {
+		scheme, url = URL_SCHEME_HTTPS, rest
+	} else if rest, ok := strings.CutPrefix(url, "http://"); ok {
+		scheme, url = URL_SCHEME_HTTP, rest
+	}
+	if len(url) > MAX_URL_LENGTH {
+		return URLDescriptor{}, fmt.Errorf("%w: URL is longer than %d bytes", ErrInvalidURL, MAX_URL_LENGTH)
+	}
+
+	return URLDescriptor{
+		BLength:         uint8(URL_DESCRIPTOR_MIN_LENGTH + len(url)),
+		BDescriptorType: DESCRIPTOR_TYPE_URL,
+		BScheme:         scheme,
+		URL:             []byte(url),
+	}, nil
+}
@@ -0,0 +1,77 @@
+package webusb_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ntchjb/usbip-virtual-device/usb/protocol/webusb"
+	usbipprot "github.com/ntchjb/usbip-virtual-device/usbip/protocol"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestURLDescriptor(t *testing.T) {
+	tests := []struct {
+		name   string
+		obj    usbipprot.Serializer
+		bin    []byte
+		newObj func() usbipprot.Serializer
+		encErr error
+		decErr error
+	}{
+		{
+			name: "URLDescriptor",
+			obj: &webusb.URLDescriptor{
+				BLength:         0x0D,
+				BDescriptorType: webusb.DESCRIPTOR_TYPE_URL,
+				BScheme:         webusb.URL_SCHEME_HTTPS,
+				URL:             []byte("ntch.dev/a"),
+			},
+			bin: []byte{0x0D, 0x03, 0x01, 'n', 't', 'c', 'h', '.', 'd', 'e', 'v', '/', 'a'},
+			newObj: func() usbipprot.Serializer {
+				return &webusb.URLDescriptor{}
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			writer := new(bytes.Buffer)
+			err := test.obj.Encode(writer)
+
+			assert.ErrorIs(t, err, test.encErr)
+			assert.Equal(t, test.bin, writer.Bytes())
+
+			newObj := test.newObj()
+			err = newObj.Decode(writer)
+
+			assert.ErrorIs(t, err, test.decErr)
+			assert.Equal(t, test.obj, newObj)
+		})
+	}
+}
+
+func TestNewURLDescriptor(t *testing.T) {
+	tests := []struct {
+		url    string
+		scheme webusb.URLScheme
+		rest   string
+	}{
+		{url: "https://ntch.dev", scheme: webusb.URL_SCHEME_HTTPS, rest: "ntch.dev"},
+		{url: "http://localhost:8080", scheme: webusb.URL_SCHEME_HTTP, rest: "localhost:8080"},
+		{url: "file:///index.html", scheme: webusb.URL_SCHEME_NONE, rest: "file:///index.html"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.url, func(t *testing.T) {
+			urlDesc, err := webusb.NewURLDescriptor(test.url)
+			assert.NoError(t, err)
+			assert.Equal(t, test.scheme, urlDesc.BScheme)
+			assert.Equal(t, []byte(test.rest), urlDesc.URL)
+			assert.Equal(t, uint8(3+len(test.rest)), urlDesc.BLength)
+			assert.Equal(t, test.url, urlDesc.String())
+		})
+	}
+
+	_, err := webusb.NewURLDescriptor("https://" + string(bytes.Repeat([]byte{'a'}, 253)))
+	assert.ErrorIs(t, err, webusb.ErrInvalidURL)
+}
@@ -1,12 +1,19 @@
 package usb
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"time"
 
 	usbprotocol "github.com/ntchjb/usbip-virtual-device/usb/protocol"
 )
 
+const (
+	// Default maximum time Register spends on validating a device, see DeviceRegistrarConfig.ValidationTimeout
+	DEFAULT_VALIDATION_TIMEOUT = 5 * time.Second
+)
+
 var (
 	ErrDeviceNotFound            = errors.New("USB device not found")
 	ErrMaximumDeviceCountReached = errors.New("maximum number of registered device reached")
@@ -19,6 +26,8 @@ type DeviceRegistrar interface {
 	GetDevice(busID usbprotocol.BusID) (Device, error)
 	// Get all registered devices
 	GetAvailableDevices() []Device
+	// Clock returns clock of the bus, to be shared by devices registered to it
+	Clock() Clock
 	// Close all registered devices
 	Close() error
 }
@@ -27,6 +36,12 @@ type DeviceRegistrarConfig struct {
 	// BusNum is used for generating BusID
 	BusNum         uint
 	MaxDeviceCount int
+	// ValidateDevices rejects devices whose descriptors are not consistent with USB specification, see ValidateDevice
+	ValidateDevices bool
+	// ValidationTimeout is maximum time spent on validating a device, default is DEFAULT_VALIDATION_TIMEOUT
+	ValidationTimeout time.Duration
+	// Optional clock of the bus, such as FakeClock in tests. A clock started when registrar is created is used if it's nil.
+	Clock Clock
 }
 
 type deviceRegistrarImpl struct {
@@ -37,6 +52,12 @@ type deviceRegistrarImpl struct {
 }
 
 func NewDeviceRegistrar(config DeviceRegistrarConfig) DeviceRegistrar {
+	if config.ValidationTimeout <= 0 {
+		config.ValidationTimeout = DEFAULT_VALIDATION_TIMEOUT
+	}
+	if config.Clock == nil {
+		config.Clock = NewClock()
+	}
 	return &deviceRegistrarImpl{
 		devices: make(map[usbprotocol.BusID]Device),
 		config:  config,
@@ -53,6 +74,14 @@ func (r *deviceRegistrarImpl) Register(device Device) error {
 	if len(r.devices) >= r.config.MaxDeviceCount {
 		return ErrMaximumDeviceCountReached
 	}
+	if r.config.ValidateDevices {
+		ctx, cancel := context.WithTimeout(context.Background(), r.config.ValidationTimeout)
+		err := ValidateDevice(ctx, device)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("unable to register device: %w", err)
+		}
+	}
 	busNum, devNum := r.createNewBusID()
 	device.SetBusID(busNum, devNum)
 	r.devices[device.GetBusID()] = device
@@ -82,6 +111,10 @@ func (r *deviceRegistrarImpl) GetAvailableDevices() []Device {
 	return devices
 }
 
+func (r *deviceRegistrarImpl) Clock() Clock {
+	return r.config.Clock
+}
+
 func (r *deviceRegistrarImpl) Close() (err error) {
 	for _, device := range r.devices {
 		if deviceErr := device.Close(); deviceErr != nil {
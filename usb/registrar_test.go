@@ -1,11 +1,15 @@
 package usb_test
 
 import (
+	"io"
+	"log/slog"
 	"testing"
 
 	"github.com/ntchjb/usbip-virtual-device/usb"
 	"github.com/ntchjb/usbip-virtual-device/usb/protocol"
+	"github.com/ntchjb/usbip-virtual-device/usb/protocol/descriptor"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"go.uber.org/mock/gomock"
 )
 
@@ -54,3 +58,33 @@ func TestRegistrar(t *testing.T) {
 	err = registrar.Close()
 	assert.NoError(t, err)
 }
+
+func TestRegistrarClock(t *testing.T) {
+	clock := usb.NewFakeClock()
+	registrar := usb.NewDeviceRegistrar(usb.DeviceRegistrarConfig{
+		BusNum:         1,
+		MaxDeviceCount: 2,
+		Clock:          clock,
+	})
+	assert.Same(t, clock, registrar.Clock())
+
+	tree := descriptor.Device{
+		Speed:          protocol.SPEED_USB1_FULL,
+		BCDUSB:         0x0200,
+		BMaxPacketSize: 64,
+		Configurations: []descriptor.Configuration{{}},
+	}
+	set, err := tree.Build()
+	require.NoError(t, err)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	device1 := usb.NewStandardDevice(usb.StandardDeviceConfig{Descriptors: set, Clock: registrar.Clock()}, logger)
+	clock.Advance(5 * usb.FRAME_DURATION)
+	device2 := usb.NewStandardDevice(usb.StandardDeviceConfig{Descriptors: set, Clock: registrar.Clock()}, logger)
+	clock.Advance(usb.FRAME_DURATION)
+
+	assert.Equal(t, uint32(6), usb.FrameNumber(device1.Clock(), protocol.SPEED_USB1_FULL))
+	assert.Equal(t, uint32(6), usb.FrameNumber(device2.Clock(), protocol.SPEED_USB1_FULL))
+
+	assert.NotNil(t, usb.NewDeviceRegistrar(usb.DeviceRegistrarConfig{}).Clock())
+}
@@ -0,0 +1,787 @@
+package usb
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	usbprotocol "github.com/ntchjb/usbip-virtual-device/usb/protocol"
+	"github.com/ntchjb/usbip-virtual-device/usb/protocol/descriptor"
+	"github.com/ntchjb/usbip-virtual-device/usb/protocol/msos"
+	"github.com/ntchjb/usbip-virtual-device/usb/protocol/webusb"
+	"github.com/ntchjb/usbip-virtual-device/usbip/protocol/command"
+	"github.com/ntchjb/usbip-virtual-device/usbip/protocol/op"
+)
+
+// ControlHandler handles a control request that is not a standard request handled by StandardDevice.
+// data is data stage of OUT request. For IN request, returned data is sent to host.
+// Returning URBStatus as error replies with that status, other errors stall the request.
+type ControlHandler func(ctx context.Context, setup usbprotocol.SetupPacket, data []byte) ([]byte, error)
+
+// EndpointHandler processes a URB of non-control endpoint and returns its result
+type EndpointHandler func(ctx context.Context, data command.CmdSubmit) command.RetSubmit
+
+// AsyncEndpointHandler receives a URB of non-control endpoint, and completes it later by calling completer.
+// ctx is also cancelled with cause command.URB_STATUS_STALL when the endpoint is halted, after the URB is completed with stall.
+type AsyncEndpointHandler func(ctx context.Context, data command.CmdSubmit, completer URBCompleter)
+
+// ConfigurationHandler is called when host selects a configuration by SET_CONFIGURATION, before it becomes active.
+// configValue is 0 when device is unconfigured. Returning error rejects the request with stall.
+type ConfigurationHandler func(ctx context.Context, configValue uint8) error
+
+// InterfaceHandler is called when host selects an alternate setting of an interface by SET_INTERFACE,
+// before it becomes active. Returning error rejects the request with stall.
+type InterfaceHandler func(ctx context.Context, interfaceNumber, alternateSetting uint8) error
+
+// StandardDevice is a device handling standard requests (USB 2.0 Chapter 9) from its descriptors,
+// so that implementer only registers handlers for class, vendor and non-control endpoint traffic.
+// It can be embedded into device implementation to override methods such as Close.
+type StandardDevice interface {
+	AsyncDevice
+	// HandleClassRequest registers handler for class-specific control requests
+	HandleClassRequest(handler ControlHandler)
+	// HandleVendorRequest registers handler for vendor-specific control requests
+	HandleVendorRequest(handler ControlHandler)
+	// HandleDescriptor registers handler for GET_DESCRIPTOR request of descriptor type not in descriptor set,
+	// such as HID report descriptor
+	HandleDescriptor(descriptorType descriptor.DescriptorType, handler ControlHandler)
+	// HandleSetConfiguration registers handler called when active configuration changes
+	HandleSetConfiguration(handler ConfigurationHandler)
+	// HandleSetInterface registers handler called when active alternate setting of an interface changes
+	HandleSetInterface(handler InterfaceHandler)
+	// HandleEndpoint registers handler for URBs of given endpoint address, such as 0x81 for endpoint 1 IN.
+	// URBs are routed to the handler only if the endpoint exists in active configuration and alternate settings,
+	// otherwise they're replied with stall.
+	HandleEndpoint(endpointAddress uint8, handler EndpointHandler)
+	// HandleEndpointAsync registers handler for URBs of given endpoint address, which completes URBs later
+	HandleEndpointAsync(endpointAddress uint8, handler AsyncEndpointHandler)
+	// Descriptors returns descriptor set of this device
+	Descriptors() *descriptor.DescriptorSet
+	// GetConfiguration returns current configuration value, 0 if device is not configured
+	GetConfiguration() uint8
+	// GetAltSetting returns current alternate setting of given interface
+	GetAltSetting(interfaceNumber uint8) uint8
+	// SetEndpointHalt sets or clears halt state of given endpoint address.
+	// While an endpoint is halted, its URBs are replied with stall until host clears the halt by CLEAR_FEATURE(ENDPOINT_HALT).
+	// URBs pending in handler of the endpoint are completed with stall when it's halted.
+	SetEndpointHalt(endpointAddress uint8, halted bool)
+	// IsEndpointHalted returns whether given endpoint address is halted
+	IsEndpointHalted(endpointAddress uint8) bool
+	// GetSystemExitLatency returns exit latencies set by SET_SEL request of SuperSpeed device
+	GetSystemExitLatency() usbprotocol.SystemExitLatency
+	// GetIsochronousDelay returns delay from host transmitting a packet to device receiving it,
+	// set by SET_ISOCH_DELAY request of SuperSpeed device, in nanoseconds
+	GetIsochronousDelay() uint16
+	// Clock returns clock of the bus which the device is on
+	Clock() Clock
+	// FrameNumber returns current frame number of the bus at device speed, in frames or microframes by FrameDuration
+	FrameNumber() uint32
+}
+
+type StandardDeviceConfig struct {
+	Descriptors *descriptor.DescriptorSet
+	// Optional Microsoft OS 2.0 descriptors, answered to their vendor request before vendor handler is called.
+	// Their platform capability must be in Capabilities of descriptor tree.
+	MSOS20Descriptors *msos.Descriptors
+	// Optional WebUSB descriptors, answering GET_URL requests before vendor handler is called.
+	// Their platform capability must be in Capabilities of descriptor tree.
+	WebUSBDescriptors *webusb.Descriptors
+	// Reply workers are set to 1 if they're zero
+	WorkerPoolProfile WorkerPoolProfile
+	// Optional clock of the bus, such as DeviceRegistrar.Clock shared by devices of the same bus, or FakeClock in tests.
+	// A clock started when device is created is used if it's nil.
+	Clock Clock
+}
+
+// endpointHalt is cancelled with cause command.URB_STATUS_STALL when its endpoint is halted,
+// to complete URBs pending in handler of the endpoint
+type endpointHalt struct {
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+}
+
+type standardDeviceImpl struct {
+	descriptors       *descriptor.DescriptorSet
+	msos20Descriptors *msos.Descriptors
+	webUSBDescriptors *webusb.Descriptors
+	workerPoolProfile WorkerPoolProfile
+	clock             Clock
+	logger            *slog.Logger
+
+	deviceInfoLock sync.RWMutex
+	deviceInfo     op.DeviceInfo
+
+	handlersLock       sync.RWMutex
+	classHandler       ControlHandler
+	vendorHandler      ControlHandler
+	descriptorHandlers map[descriptor.DescriptorType]ControlHandler
+	endpointHandlers   map[uint8]AsyncEndpointHandler
+	configHandler      ConfigurationHandler
+	interfaceHandler   InterfaceHandler
+
+	stateLock           sync.Mutex
+	configuration       uint8
+	altSettings         map[uint8]uint8
+	haltedEndpoints     map[uint8]bool
+	endpointHalts       map[uint8]endpointHalt
+	remoteWakeupEnabled bool
+	u1Enabled           bool
+	u2Enabled           bool
+	ltmEnabled          bool
+	systemExitLatency   usbprotocol.SystemExitLatency
+	isochronousDelay    uint16
+}
+
+func NewStandardDevice(config StandardDeviceConfig, logger *slog.Logger) StandardDevice {
+	profile := config.WorkerPoolProfile
+	if profile.MaximumReplyWorkers < 1 {
+		profile.MaximumReplyWorkers = 1
+	}
+	if profile.MaximumUnlinkReplyWorkers < 1 {
+		profile.MaximumUnlinkReplyWorkers = 1
+	}
+	clock := config.Clock
+	if clock == nil {
+		clock = NewClock()
+	}
+
+	return &standardDeviceImpl{
+		descriptors:        config.Descriptors,
+		msos20Descriptors:  config.MSOS20Descriptors,
+		webUSBDescriptors:  config.WebUSBDescriptors,
+		workerPoolProfile:  profile,
+		clock:              clock,
+		logger:             logger,
+		deviceInfo:         config.Descriptors.DeviceInfo(),
+		descriptorHandlers: make(map[descriptor.DescriptorType]ControlHandler),
+		endpointHandlers:   make(map[uint8]AsyncEndpointHandler),
+		altSettings:        make(map[uint8]uint8),
+		haltedEndpoints:    make(map[uint8]bool),
+		endpointHalts:      make(map[uint8]endpointHalt),
+	}
+}
+
+func (d *standardDeviceImpl) SetBusID(busNum, devNum uint) {
+	busIDString := fmt.Sprintf("%d-%d", busNum, devNum)
+	var busID usbprotocol.BusID
+	var path [256]byte
+	copy(busID[:], []byte(busIDString))
+	copy(path[:], []byte("/sys/devices/pci0000:00/0000:00:1d.1/usb3/"+busIDString))
+
+	d.deviceInfoLock.Lock()
+	defer d.deviceInfoLock.Unlock()
+	d.deviceInfo.BusID = busID
+	d.deviceInfo.BusNum = uint32(busNum)
+	d.deviceInfo.DevNum = uint32(devNum)
+	d.deviceInfo.Path = path
+}
+
+func (d *standardDeviceImpl) GetBusID() usbprotocol.BusID {
+	d.deviceInfoLock.RLock()
+	defer d.deviceInfoLock.RUnlock()
+
+	return d.deviceInfo.BusID
+}
+
+// GetDeviceInfo returns device information of active configuration and alternate settings,
+// or of the first configuration if device is not configured
+func (d *standardDeviceImpl) GetDeviceInfo() op.DeviceInfo {
+	d.deviceInfoLock.RLock()
+	info := d.deviceInfo
+	d.deviceInfoLock.RUnlock()
+
+	d.stateLock.Lock()
+	defer d.stateLock.Unlock()
+	config, ok := d.descriptors.ConfigurationTree(d.configuration)
+	if !ok {
+		return info
+	}
+	info.BConfigurationValue = d.configuration
+	info.BNumInterfaces = uint8(len(config.Interfaces))
+	info.Interfaces = make([]op.DeviceInterface, len(config.Interfaces))
+	for i, intf := range config.Interfaces {
+		altSetting := d.currentAltSettingLocked(intf)
+		info.Interfaces[i] = op.DeviceInterface{
+			BInterfaceClass:    altSetting.BInterfaceClass,
+			BInterfaceSubclass: altSetting.BInterfaceSubClass,
+			BInterfaceProtocol: altSetting.BInterfaceProtocol,
+		}
+	}
+
+	return info
+}
+
+func (d *standardDeviceImpl) GetWorkerPoolProfile() WorkerPoolProfile {
+	return d.workerPoolProfile
+}
+
+func (d *standardDeviceImpl) Close() error {
+	return nil
+}
+
+func (d *standardDeviceImpl) Descriptors() *descriptor.DescriptorSet {
+	return d.descriptors
+}
+
+func (d *standardDeviceImpl) HandleClassRequest(handler ControlHandler) {
+	d.handlersLock.Lock()
+	defer d.handlersLock.Unlock()
+	d.classHandler = handler
+}
+
+func (d *standardDeviceImpl) HandleVendorRequest(handler ControlHandler) {
+	d.handlersLock.Lock()
+	defer d.handlersLock.Unlock()
+	d.vendorHandler = handler
+}
+
+func (d *standardDeviceImpl) HandleDescriptor(descriptorType descriptor.DescriptorType, handler ControlHandler) {
+	d.handlersLock.Lock()
+	defer d.handlersLock.Unlock()
+	d.descriptorHandlers[descriptorType] = handler
+}
+
+func (d *standardDeviceImpl) HandleSetConfiguration(handler ConfigurationHandler) {
+	d.handlersLock.Lock()
+	defer d.handlersLock.Unlock()
+	d.configHandler = handler
+}
+
+func (d *standardDeviceImpl) HandleSetInterface(handler InterfaceHandler) {
+	d.handlersLock.Lock()
+	defer d.handlersLock.Unlock()
+	d.interfaceHandler = handler
+}
+
+func (d *standardDeviceImpl) HandleEndpoint(endpointAddress uint8, handler EndpointHandler) {
+	d.HandleEndpointAsync(endpointAddress, func(ctx context.Context, data command.CmdSubmit, completer URBCompleter) {
+		completer(handler(ctx, data))
+	})
+}
+
+func (d *standardDeviceImpl) HandleEndpointAsync(endpointAddress uint8, handler AsyncEndpointHandler) {
+	d.handlersLock.Lock()
+	defer d.handlersLock.Unlock()
+	d.endpointHandlers[endpointAddress] = handler
+}
+
+func (d *standardDeviceImpl) GetConfiguration() uint8 {
+	d.stateLock.Lock()
+	defer d.stateLock.Unlock()
+
+	return d.configuration
+}
+
+func (d *standardDeviceImpl) GetAltSetting(interfaceNumber uint8) uint8 {
+	d.stateLock.Lock()
+	defer d.stateLock.Unlock()
+
+	return d.altSettings[interfaceNumber]
+}
+
+func (d *standardDeviceImpl) SetEndpointHalt(endpointAddress uint8, halted bool) {
+	d.stateLock.Lock()
+	defer d.stateLock.Unlock()
+
+	if halted {
+		d.haltEndpointLocked(endpointAddress)
+	} else {
+		delete(d.haltedEndpoints, endpointAddress)
+	}
+}
+
+func (d *standardDeviceImpl) IsEndpointHalted(endpointAddress uint8) bool {
+	d.stateLock.Lock()
+	defer d.stateLock.Unlock()
+
+	return d.haltedEndpoints[endpointAddress]
+}
+
+func (d *standardDeviceImpl) GetSystemExitLatency() usbprotocol.SystemExitLatency {
+	d.stateLock.Lock()
+	defer d.stateLock.Unlock()
+
+	return d.systemExitLatency
+}
+
+func (d *standardDeviceImpl) GetIsochronousDelay() uint16 {
+	d.stateLock.Lock()
+	defer d.stateLock.Unlock()
+
+	return d.isochronousDelay
+}
+
+func (d *standardDeviceImpl) Clock() Clock {
+	return d.clock
+}
+
+func (d *standardDeviceImpl) FrameNumber() uint32 {
+	d.deviceInfoLock.RLock()
+	speed := d.deviceInfo.Speed
+	d.deviceInfoLock.RUnlock()
+
+	return FrameNumber(d.clock, speed)
+}
+
+func (d *standardDeviceImpl) Process(ctx context.Context, data command.CmdSubmit) command.RetSubmit {
+	ret := make(chan command.RetSubmit, 1)
+	d.ProcessAsync(ctx, data, func(urbRet command.RetSubmit) {
+		select {
+		case ret <- urbRet:
+		default:
+		}
+	})
+
+	select {
+	case urbRet := <-ret:
+		return urbRet
+	case <-ctx.Done():
+		return command.NewErrorRetSubmit(data, ctx.Err())
+	}
+}
+
+func (d *standardDeviceImpl) ProcessAsync(ctx context.Context, data command.CmdSubmit, completer URBCompleter) {
+	if data.EndpointNumber == usbprotocol.ENDPOINT_CONTROL {
+		completer(d.processControl(ctx, data))
+		return
+	}
+
+	endpointAddress := uint8(data.EndpointNumber)
+	if data.Direction == command.DIR_IN {
+		endpointAddress |= 0x80
+	}
+
+	d.stateLock.Lock()
+	active := d.endpointExists(endpointAddress)
+	halted := d.haltedEndpoints[endpointAddress]
+	halt := d.endpointHaltLocked(endpointAddress)
+	d.stateLock.Unlock()
+	if !active {
+		d.logger.Error("endpoint is not in active configuration or alternate setting", "endpoint", endpointAddress)
+		completer(command.NewStallRetSubmit(data))
+		return
+	}
+	if halted {
+		completer(command.NewStallRetSubmit(data))
+		return
+	}
+
+	d.handlersLock.RLock()
+	handler, ok := d.endpointHandlers[endpointAddress]
+	d.handlersLock.RUnlock()
+	if !ok {
+		d.logger.Error("no handler for endpoint", "endpoint", endpointAddress)
+		completer(command.NewStallRetSubmit(data))
+		return
+	}
+
+	// The URB is completed with stall, then released by handler, once the endpoint is halted
+	urbCtx, cancel := context.WithCancelCause(ctx)
+	var once sync.Once
+	complete := func(ret command.RetSubmit) {
+		once.Do(func() {
+			completer(ret)
+		})
+	}
+	stop := context.AfterFunc(halt.ctx, func() {
+		complete(command.NewStallRetSubmit(data))
+		cancel(command.URB_STATUS_STALL)
+	})
+	handler(urbCtx, data, func(ret command.RetSubmit) {
+		stop()
+		complete(ret)
+		cancel(nil)
+	})
+}
+
+// endpointHaltLocked returns endpointHalt of endpoint address, creating one if the endpoint has none. stateLock must be held.
+func (d *standardDeviceImpl) endpointHaltLocked(endpointAddress uint8) endpointHalt {
+	halt, ok := d.endpointHalts[endpointAddress]
+	if !ok {
+		halt.ctx, halt.cancel = context.WithCancelCause(context.Background())
+		d.endpointHalts[endpointAddress] = halt
+	}
+
+	return halt
+}
+
+// haltEndpointLocked halts endpoint address, and completes URBs pending in its handler with stall. stateLock must be held.
+func (d *standardDeviceImpl) haltEndpointLocked(endpointAddress uint8) {
+	d.haltedEndpoints[endpointAddress] = true
+	if halt, ok := d.endpointHalts[endpointAddress]; ok {
+		halt.cancel(command.URB_STATUS_STALL)
+		delete(d.endpointHalts, endpointAddress)
+	}
+}
+
+func (d *standardDeviceImpl) processControl(ctx context.Context, data command.CmdSubmit) command.RetSubmit {
+	var setup usbprotocol.SetupPacket
+	if err := setup.Decode(bytes.NewBuffer(data.Setup[:])); err != nil {
+		d.logger.Error("unable to decode SetupPacket", "err", err)
+		return command.NewStallRetSubmit(data)
+	}
+	d.logger.Debug("Received control message SetupPacket", "setup", setup)
+
+	var retData []byte
+	var err error
+	switch setup.BMRequestType.Type() {
+	case usbprotocol.SETUP_DATA_TYPE_STANDARD:
+		retData, err = d.processStandardRequest(ctx, setup, data.TransferBuffer)
+	case usbprotocol.SETUP_DATA_TYPE_CLASS:
+		retData, err = d.callControlHandler(ctx, d.getClassHandler(), setup, data.TransferBuffer)
+	case usbprotocol.SETUP_DATA_TYPE_VENDOR:
+		if d.msos20Descriptors != nil && d.msos20Descriptors.IsDescriptorSetRequest(setup) {
+			retData = d.msos20Descriptors.DescriptorSet()
+			break
+		}
+		if d.webUSBDescriptors != nil && d.webUSBDescriptors.IsURLRequest(setup) {
+			retData, err = d.webUSBDescriptors.HandleURLRequest(setup)
+			break
+		}
+		retData, err = d.callControlHandler(ctx, d.getVendorHandler(), setup, data.TransferBuffer)
+	default:
+		err = fmt.Errorf("reserved request type: %x", setup.BMRequestType)
+	}
+	if err != nil {
+		d.logger.Error("unable to process control message", "setup", setup, "err", err)
+		return command.NewRetSubmit(data, controlStatusFromError(err), nil)
+	}
+
+	// Data longer than wLength is truncated, as host never reads more than requested
+	if len(retData) > int(setup.WLength) {
+		retData = retData[:setup.WLength]
+	}
+
+	return command.NewSuccessRetSubmit(data, retData)
+}
+
+// controlStatusFromError converts error of control request to URBStatus.
+// Unsupported or invalid requests are replied with stall, which is request error of USB 2.0 spec.
+func controlStatusFromError(err error) command.URBStatus {
+	var status command.URBStatus
+	if errors.As(err, &status) || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return command.StatusFromError(err)
+	}
+
+	return command.URB_STATUS_STALL
+}
+
+func (d *standardDeviceImpl) getClassHandler() ControlHandler {
+	d.handlersLock.RLock()
+	defer d.handlersLock.RUnlock()
+
+	return d.classHandler
+}
+
+func (d *standardDeviceImpl) getVendorHandler() ControlHandler {
+	d.handlersLock.RLock()
+	defer d.handlersLock.RUnlock()
+
+	return d.vendorHandler
+}
+
+func (d *standardDeviceImpl) callControlHandler(ctx context.Context, handler ControlHandler, setup usbprotocol.SetupPacket, data []byte) ([]byte, error) {
+	if handler == nil {
+		return nil, fmt.Errorf("no handler for request type %x, request %d", setup.BMRequestType, setup.BRequest)
+	}
+
+	return handler(ctx, setup, data)
+}
+
+func (d *standardDeviceImpl) processStandardRequest(ctx context.Context, setup usbprotocol.SetupPacket, data []byte) ([]byte, error) {
+	switch setup.BRequest {
+	case usbprotocol.REQUEST_GET_DESCRIPTOR:
+		return d.getDescriptor(ctx, setup)
+	case usbprotocol.REQUEST_GET_CONFIGURATION:
+		return []byte{d.GetConfiguration()}, nil
+	case usbprotocol.REQUEST_SET_CONFIGURATION:
+		return nil, d.setConfiguration(ctx, uint8(setup.WValue))
+	case usbprotocol.REQUEST_GET_INTERFACE:
+		return d.getInterface(uint8(setup.WIndex))
+	case usbprotocol.REQUEST_SET_INTERFACE:
+		return nil, d.setInterface(ctx, uint8(setup.WIndex), uint8(setup.WValue))
+	case usbprotocol.REQUEST_GET_STATUS:
+		return d.getStatus(setup)
+	case usbprotocol.REQUEST_SET_FEATURE:
+		return nil, d.setFeature(setup, true)
+	case usbprotocol.REQUEST_CLEAR_FEATURE:
+		return nil, d.setFeature(setup, false)
+	case usbprotocol.REQUEST_SET_ADDRESS:
+		// Device address is managed by host controller of USB/IP client, so no-op
+		return nil, nil
+	case usbprotocol.REQUEST_SET_SEL:
+		return nil, d.setSystemExitLatency(data)
+	case usbprotocol.REQUEST_SET_ISOCH_DELAY:
+		return nil, d.setIsochronousDelay(setup.WValue)
+	default:
+		return nil, fmt.Errorf("unknown or unimplemented standard request: %d", setup.BRequest)
+	}
+}
+
+func (d *standardDeviceImpl) getDescriptor(ctx context.Context, setup usbprotocol.SetupPacket) ([]byte, error) {
+	descriptorType, index := descriptor.GetDescriptorTypeAndIndex(setup.WValue)
+
+	d.handlersLock.RLock()
+	handler, ok := d.descriptorHandlers[descriptorType]
+	d.handlersLock.RUnlock()
+	if ok {
+		return handler(ctx, setup, nil)
+	}
+
+	return d.descriptors.GetDescriptor(descriptorType, index, descriptor.LangID(setup.WIndex))
+}
+
+func (d *standardDeviceImpl) setConfiguration(ctx context.Context, configValue uint8) error {
+	if configValue != 0 {
+		if _, ok := d.descriptors.ConfigurationTree(configValue); !ok {
+			return fmt.Errorf("configuration %d not found", configValue)
+		}
+	}
+
+	d.handlersLock.RLock()
+	handler := d.configHandler
+	d.handlersLock.RUnlock()
+	if handler != nil {
+		if err := handler(ctx, configValue); err != nil {
+			return fmt.Errorf("configuration %d is rejected by device: %w", configValue, err)
+		}
+	}
+
+	d.stateLock.Lock()
+	defer d.stateLock.Unlock()
+	d.configuration = configValue
+	// Alternate settings and halt state of endpoints are reset on configuration change
+	d.altSettings = make(map[uint8]uint8)
+	d.haltedEndpoints = make(map[uint8]bool)
+
+	return nil
+}
+
+func (d *standardDeviceImpl) getInterface(interfaceNumber uint8) ([]byte, error) {
+	d.stateLock.Lock()
+	defer d.stateLock.Unlock()
+
+	if _, ok := d.descriptors.Interface(d.configuration, interfaceNumber); !ok {
+		return nil, fmt.Errorf("interface %d not found in configuration %d", interfaceNumber, d.configuration)
+	}
+
+	return []byte{d.altSettings[interfaceNumber]}, nil
+}
+
+func (d *standardDeviceImpl) setInterface(ctx context.Context, interfaceNumber, alternateSetting uint8) error {
+	configValue := d.GetConfiguration()
+	altSetting, ok := d.descriptors.AltSetting(configValue, interfaceNumber, alternateSetting)
+	if !ok {
+		return fmt.Errorf("alternate setting %d of interface %d not found in configuration %d", alternateSetting, interfaceNumber, configValue)
+	}
+
+	d.handlersLock.RLock()
+	handler := d.interfaceHandler
+	d.handlersLock.RUnlock()
+	if handler != nil {
+		if err := handler(ctx, interfaceNumber, alternateSetting); err != nil {
+			return fmt.Errorf("alternate setting %d of interface %d is rejected by device: %w", alternateSetting, interfaceNumber, err)
+		}
+	}
+
+	d.stateLock.Lock()
+	defer d.stateLock.Unlock()
+	d.altSettings[interfaceNumber] = alternateSetting
+	// Halt state of endpoints in the interface is cleared on alternate setting change
+	for _, endpoint := range altSetting.Endpoints {
+		delete(d.haltedEndpoints, endpoint.BEndpointAddress)
+	}
+
+	return nil
+}
+
+// endpointExists returns whether endpoint address exists in current configuration and alternate settings.
+// Only endpoint 0 exists while device is not configured. stateLock must be held.
+func (d *standardDeviceImpl) endpointExists(endpointAddress uint8) bool {
+	if endpointAddress&0x0F == 0 {
+		return true
+	}
+	config, ok := d.descriptors.ConfigurationTree(d.configuration)
+	if !ok {
+		return false
+	}
+	for _, intf := range config.Interfaces {
+		altSetting := d.currentAltSettingLocked(intf)
+		for _, endpoint := range altSetting.Endpoints {
+			if endpoint.BEndpointAddress == endpointAddress {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// currentAltSettingLocked returns current alternate setting of an interface in current configuration.
+// Like Linux, the first alternate setting is used if the interface has no alternate setting 0. stateLock must be held.
+func (d *standardDeviceImpl) currentAltSettingLocked(intf descriptor.Interface) descriptor.AltSetting {
+	if altSetting, ok := intf.AltSetting(d.altSettings[intf.BInterfaceNumber]); ok {
+		return altSetting
+	}
+
+	return intf.AltSettings[0]
+}
+
+func (d *standardDeviceImpl) isSuperSpeed() bool {
+	speed := d.descriptors.DeviceInfo().Speed
+
+	return speed == usbprotocol.SPEED_USB3_SUPER || speed == usbprotocol.SPEED_USB3_SUPER_PLUS
+}
+
+func (d *standardDeviceImpl) setSystemExitLatency(data []byte) error {
+	if !d.isSuperSpeed() {
+		return fmt.Errorf("SET_SEL is supported by SuperSpeed device only")
+	}
+	var latency usbprotocol.SystemExitLatency
+	if err := latency.Decode(bytes.NewBuffer(data)); err != nil {
+		return fmt.Errorf("unable to decode SET_SEL data: %w", err)
+	}
+
+	d.stateLock.Lock()
+	defer d.stateLock.Unlock()
+	d.systemExitLatency = latency
+
+	return nil
+}
+
+func (d *standardDeviceImpl) setIsochronousDelay(delay uint16) error {
+	if !d.isSuperSpeed() {
+		return fmt.Errorf("SET_ISOCH_DELAY is supported by SuperSpeed device only")
+	}
+
+	d.stateLock.Lock()
+	defer d.stateLock.Unlock()
+	d.isochronousDelay = delay
+
+	return nil
+}
+
+func (d *standardDeviceImpl) getStatus(setup usbprotocol.SetupPacket) ([]byte, error) {
+	status := make([]byte, 2)
+
+	d.stateLock.Lock()
+	defer d.stateLock.Unlock()
+
+	switch setup.BMRequestType.Recipient() {
+	case usbprotocol.SETUP_RECIPIENT_DEVICE:
+		configValue := d.configuration
+		if configValue == 0 {
+			configValue = d.descriptors.DeviceInfo().BConfigurationValue
+		}
+		var value uint16
+		// D0: Self Powered, D1: Remote Wakeup
+		if config, ok := d.descriptors.ConfigurationTree(configValue); ok && config.BMAttributes&0b01000000 != 0 {
+			value |= 0b01
+		}
+		if d.remoteWakeupEnabled {
+			value |= 0b10
+		}
+		// D2: U1 Enable, D3: U2 Enable, D4: LTM Enable, for SuperSpeed device
+		if d.u1Enabled {
+			value |= 0b100
+		}
+		if d.u2Enabled {
+			value |= 0b1000
+		}
+		if d.ltmEnabled {
+			value |= 0b10000
+		}
+		binary.LittleEndian.PutUint16(status, value)
+	case usbprotocol.SETUP_RECIPIENT_INTERFACE:
+		// All bits are reserved for interface
+		if _, ok := d.descriptors.Interface(d.configuration, uint8(setup.WIndex)); !ok {
+			return nil, fmt.Errorf("interface %d not found in configuration %d", setup.WIndex, d.configuration)
+		}
+	case usbprotocol.SETUP_RECIPIENT_ENDPOINT:
+		endpointAddress := uint8(setup.WIndex)
+		if !d.endpointExists(endpointAddress) {
+			return nil, fmt.Errorf("endpoint 0x%02x not found", endpointAddress)
+		}
+		// D0: Halt
+		if d.haltedEndpoints[endpointAddress] {
+			binary.LittleEndian.PutUint16(status, 0b01)
+		}
+	default:
+		return nil, fmt.Errorf("unknown recipient of GET_STATUS: %x", setup.BMRequestType)
+	}
+
+	return status, nil
+}
+
+func (d *standardDeviceImpl) setFeature(setup usbprotocol.SetupPacket, enabled bool) error {
+	feature := usbprotocol.FeatureSelector(setup.WValue)
+
+	d.stateLock.Lock()
+	defer d.stateLock.Unlock()
+
+	switch setup.BMRequestType.Recipient() {
+	case usbprotocol.SETUP_RECIPIENT_DEVICE:
+		switch feature {
+		case usbprotocol.FEATURE_DEVICE_REMOTE_WAKEUP:
+			d.remoteWakeupEnabled = enabled
+			return nil
+		case usbprotocol.FEATURE_TEST_MODE:
+			// Test mode cannot be cleared, and it has no effect on virtual device
+			if !enabled {
+				return fmt.Errorf("test mode cannot be cleared")
+			}
+			return nil
+		case usbprotocol.FEATURE_U1_ENABLE, usbprotocol.FEATURE_U2_ENABLE, usbprotocol.FEATURE_LTM_ENABLE:
+			// Link power management of SuperSpeed device is only recorded, as there is no physical link
+			if !d.isSuperSpeed() || d.configuration == 0 {
+				return fmt.Errorf("feature %d requires configured SuperSpeed device", feature)
+			}
+			switch feature {
+			case usbprotocol.FEATURE_U1_ENABLE:
+				d.u1Enabled = enabled
+			case usbprotocol.FEATURE_U2_ENABLE:
+				d.u2Enabled = enabled
+			default:
+				d.ltmEnabled = enabled
+			}
+			return nil
+		}
+	case usbprotocol.SETUP_RECIPIENT_INTERFACE:
+		// Function suspend of SuperSpeed device has no effect on virtual device
+		if feature != usbprotocol.FEATURE_FUNCTION_SUSPEND || !d.isSuperSpeed() {
+			break
+		}
+		if _, ok := d.descriptors.Interface(d.configuration, uint8(setup.WIndex)); !ok {
+			return fmt.Errorf("interface %d not found in configuration %d", uint8(setup.WIndex), d.configuration)
+		}
+		return nil
+	case usbprotocol.SETUP_RECIPIENT_ENDPOINT:
+		endpointAddress := uint8(setup.WIndex)
+		if feature != usbprotocol.FEATURE_ENDPOINT_HALT {
+			break
+		}
+		if !d.endpointExists(endpointAddress) {
+			return fmt.Errorf("endpoint 0x%02x not found", endpointAddress)
+		}
+		if endpointAddress&0x0F == 0 {
+			// Halt feature is neither required nor recommended for default control pipe,
+			// so only clearing it is accepted
+			if enabled {
+				return fmt.Errorf("halt of default control pipe is not supported")
+			}
+			return nil
+		}
+		if enabled {
+			d.haltEndpointLocked(endpointAddress)
+		} else {
+			delete(d.haltedEndpoints, endpointAddress)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unsupported feature %d for request type %x", feature, setup.BMRequestType)
+}
@@ -0,0 +1,818 @@
+package usb_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/ntchjb/usbip-virtual-device/usb"
+	"github.com/ntchjb/usbip-virtual-device/usb/protocol"
+	"github.com/ntchjb/usbip-virtual-device/usb/protocol/descriptor"
+	"github.com/ntchjb/usbip-virtual-device/usbip/protocol/command"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestStandardDevice(t *testing.T) usb.StandardDevice {
+	tree := descriptor.Device{
+		Speed:          protocol.SPEED_USB2_HIGH,
+		BCDUSB:         0x0200,
+		BMaxPacketSize: 64,
+		IDVendor:       0x1234,
+		IDProduct:      0x5678,
+		Product:        "Test Device",
+		Configurations: []descriptor.Configuration{
+			{
+				BMAttributes: 0b11000000,
+				Interfaces: []descriptor.Interface{
+					{
+						AltSettings: []descriptor.AltSetting{
+							{
+								BInterfaceClass: protocol.CLASS_VENDOR_SPECIFIC,
+							},
+							{
+								BInterfaceClass: protocol.CLASS_VENDOR_SPECIFIC,
+								Endpoints: []descriptor.Endpoint{
+									{
+										BEndpointAddress: 0x81,
+										BMAttributes:     0x02,
+										WMaxPacketSize:   512,
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	set, err := tree.Build()
+	require.NoError(t, err)
+
+	return usb.NewStandardDevice(usb.StandardDeviceConfig{
+		Descriptors: set,
+	}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+}
+
+func newControlCmdSubmit(t *testing.T, setup protocol.SetupPacket, data []byte) command.CmdSubmit {
+	buf := new(bytes.Buffer)
+	require.NoError(t, setup.Encode(buf))
+	cmd := command.CmdSubmit{
+		CmdHeader: command.CmdHeader{
+			Command:        command.CMD_SUBMIT,
+			SeqNum:         1,
+			EndpointNumber: 0,
+		},
+		TransferBufferLength: uint32(setup.WLength),
+		NumberOfPackets:      0xffffffff,
+		TransferBuffer:       data,
+	}
+	if setup.BMRequestType.Direction() == protocol.SETUP_DATA_DIRECTION_IN {
+		cmd.Direction = command.DIR_IN
+	}
+	copy(cmd.Setup[:], buf.Bytes())
+
+	return cmd
+}
+
+func setTestStandardDeviceInterface(t *testing.T, device usb.StandardDevice, configValue, alternateSetting uint8) {
+	ret := device.Process(context.Background(), newControlCmdSubmit(t, protocol.SetupPacket{
+		BMRequestType: 0x00,
+		BRequest:      protocol.REQUEST_SET_CONFIGURATION,
+		WValue:        uint16(configValue),
+	}, nil))
+	require.Equal(t, command.URB_STATUS_OK, ret.Status)
+	ret = device.Process(context.Background(), newControlCmdSubmit(t, protocol.SetupPacket{
+		BMRequestType: 0x01,
+		BRequest:      protocol.REQUEST_SET_INTERFACE,
+		WValue:        uint16(alternateSetting),
+	}, nil))
+	require.Equal(t, command.URB_STATUS_OK, ret.Status)
+}
+
+func TestStandardDeviceGetDescriptor(t *testing.T) {
+	device := newTestStandardDevice(t)
+	device.HandleDescriptor(descriptor.DESCRIPTOR_TYPE_HID_REPORT, func(ctx context.Context, setup protocol.SetupPacket, data []byte) ([]byte, error) {
+		return []byte{0x05, 0x01, 0xc0}, nil
+	})
+
+	// Device descriptor is truncated to wLength
+	ret := device.Process(context.Background(), newControlCmdSubmit(t, protocol.SetupPacket{
+		BMRequestType: 0x80,
+		BRequest:      protocol.REQUEST_GET_DESCRIPTOR,
+		WValue:        0x0100,
+		WLength:       8,
+	}, nil))
+	assert.Equal(t, command.URB_STATUS_OK, ret.Status)
+	assert.Equal(t, []byte{0x12, 0x01, 0x00, 0x02, 0x00, 0x00, 0x00, 0x40}, ret.TransferBuffer)
+	assert.Equal(t, uint32(8), ret.ActualLength)
+
+	ret = device.Process(context.Background(), newControlCmdSubmit(t, protocol.SetupPacket{
+		BMRequestType: 0x81,
+		BRequest:      protocol.REQUEST_GET_DESCRIPTOR,
+		WValue:        0x2200,
+		WLength:       0xff,
+	}, nil))
+	assert.Equal(t, command.URB_STATUS_OK, ret.Status)
+	assert.Equal(t, []byte{0x05, 0x01, 0xc0}, ret.TransferBuffer)
+
+	ret = device.Process(context.Background(), newControlCmdSubmit(t, protocol.SetupPacket{
+		BMRequestType: 0x80,
+		BRequest:      protocol.REQUEST_GET_DESCRIPTOR,
+		WValue:        0x0305,
+		WIndex:        uint16(descriptor.LANGID_ENGLISH_UNITED_STATES),
+		WLength:       0xff,
+	}, nil))
+	assert.Equal(t, command.URB_STATUS_STALL, ret.Status)
+
+	// High-speed device describes itself operating at full speed
+	ret = device.Process(context.Background(), newControlCmdSubmit(t, protocol.SetupPacket{
+		BMRequestType: 0x80,
+		BRequest:      protocol.REQUEST_GET_DESCRIPTOR,
+		WValue:        0x0600,
+		WLength:       descriptor.DEVICE_QUALIFIER_DESCRIPTOR_LENGTH,
+	}, nil))
+	assert.Equal(t, command.URB_STATUS_OK, ret.Status)
+	assert.Equal(t, []byte{0x0a, 0x06, 0x00, 0x02, 0x00, 0x00, 0x00, 0x40, 0x01, 0x00}, ret.TransferBuffer)
+
+	ret = device.Process(context.Background(), newControlCmdSubmit(t, protocol.SetupPacket{
+		BMRequestType: 0x80,
+		BRequest:      protocol.REQUEST_GET_DESCRIPTOR,
+		WValue:        0x0700,
+		WLength:       0xff,
+	}, nil))
+	assert.Equal(t, command.URB_STATUS_OK, ret.Status)
+	assert.Equal(t, []byte{
+		0x09, 0x07, 0x22, 0x00, 0x01, 0x01, 0x00, 0b11000000, 0x00, // Other speed configuration
+		0x09, 0x04, 0x00, 0x00, 0x00, 0xff, 0x00, 0x00, 0x00, // Interface
+		0x09, 0x04, 0x00, 0x01, 0x01, 0xff, 0x00, 0x00, 0x00, // Interface alternate setting 1
+		0x07, 0x05, 0x81, 0x02, 0x40, 0x00, 0x00, // Full-speed bulk endpoint
+	}, ret.TransferBuffer)
+}
+
+func TestStandardDeviceConfiguration(t *testing.T) {
+	device := newTestStandardDevice(t)
+	ctx := context.Background()
+
+	ret := device.Process(ctx, newControlCmdSubmit(t, protocol.SetupPacket{
+		BMRequestType: 0x80,
+		BRequest:      protocol.REQUEST_GET_CONFIGURATION,
+		WLength:       1,
+	}, nil))
+	assert.Equal(t, []byte{0x00}, ret.TransferBuffer)
+
+	ret = device.Process(ctx, newControlCmdSubmit(t, protocol.SetupPacket{
+		BMRequestType: 0x00,
+		BRequest:      protocol.REQUEST_SET_CONFIGURATION,
+		WValue:        2,
+	}, nil))
+	assert.Equal(t, command.URB_STATUS_STALL, ret.Status)
+
+	ret = device.Process(ctx, newControlCmdSubmit(t, protocol.SetupPacket{
+		BMRequestType: 0x00,
+		BRequest:      protocol.REQUEST_SET_CONFIGURATION,
+		WValue:        1,
+	}, nil))
+	assert.Equal(t, command.URB_STATUS_OK, ret.Status)
+	assert.Equal(t, uint8(1), device.GetConfiguration())
+
+	ret = device.Process(ctx, newControlCmdSubmit(t, protocol.SetupPacket{
+		BMRequestType: 0x01,
+		BRequest:      protocol.REQUEST_SET_INTERFACE,
+		WValue:        1,
+		WIndex:        0,
+	}, nil))
+	assert.Equal(t, command.URB_STATUS_OK, ret.Status)
+	assert.Equal(t, uint8(1), device.GetAltSetting(0))
+
+	ret = device.Process(ctx, newControlCmdSubmit(t, protocol.SetupPacket{
+		BMRequestType: 0x81,
+		BRequest:      protocol.REQUEST_GET_INTERFACE,
+		WIndex:        0,
+		WLength:       1,
+	}, nil))
+	assert.Equal(t, []byte{0x01}, ret.TransferBuffer)
+
+	ret = device.Process(ctx, newControlCmdSubmit(t, protocol.SetupPacket{
+		BMRequestType: 0x01,
+		BRequest:      protocol.REQUEST_SET_INTERFACE,
+		WValue:        2,
+		WIndex:        0,
+	}, nil))
+	assert.Equal(t, command.URB_STATUS_STALL, ret.Status)
+	assert.Equal(t, uint8(1), device.GetAltSetting(0))
+}
+
+func TestStandardDeviceStatusAndFeature(t *testing.T) {
+	device := newTestStandardDevice(t)
+	ctx := context.Background()
+
+	getStatus := func() []byte {
+		return device.Process(ctx, newControlCmdSubmit(t, protocol.SetupPacket{
+			BMRequestType: 0x80,
+			BRequest:      protocol.REQUEST_GET_STATUS,
+			WLength:       2,
+		}, nil)).TransferBuffer
+	}
+
+	assert.Equal(t, []byte{0x01, 0x00}, getStatus())
+
+	ret := device.Process(ctx, newControlCmdSubmit(t, protocol.SetupPacket{
+		BMRequestType: 0x00,
+		BRequest:      protocol.REQUEST_SET_FEATURE,
+		WValue:        uint16(protocol.FEATURE_DEVICE_REMOTE_WAKEUP),
+	}, nil))
+	assert.Equal(t, command.URB_STATUS_OK, ret.Status)
+	assert.Equal(t, []byte{0x03, 0x00}, getStatus())
+
+	ret = device.Process(ctx, newControlCmdSubmit(t, protocol.SetupPacket{
+		BMRequestType: 0x00,
+		BRequest:      protocol.REQUEST_CLEAR_FEATURE,
+		WValue:        uint16(protocol.FEATURE_DEVICE_REMOTE_WAKEUP),
+	}, nil))
+	assert.Equal(t, command.URB_STATUS_OK, ret.Status)
+	assert.Equal(t, []byte{0x01, 0x00}, getStatus())
+
+	ret = device.Process(ctx, newControlCmdSubmit(t, protocol.SetupPacket{
+		BMRequestType: 0x00,
+		BRequest:      protocol.REQUEST_SET_ADDRESS,
+		WValue:        5,
+	}, nil))
+	assert.Equal(t, command.URB_STATUS_OK, ret.Status)
+}
+
+func TestStandardDeviceHandlers(t *testing.T) {
+	device := newTestStandardDevice(t)
+	ctx := context.Background()
+
+	device.HandleClassRequest(func(ctx context.Context, setup protocol.SetupPacket, data []byte) ([]byte, error) {
+		assert.Equal(t, []byte{0xaa, 0xbb}, data)
+		return nil, nil
+	})
+	device.HandleVendorRequest(func(ctx context.Context, setup protocol.SetupPacket, data []byte) ([]byte, error) {
+		return nil, command.URB_STATUS_TIMEOUT
+	})
+	device.HandleEndpoint(0x81, func(ctx context.Context, data command.CmdSubmit) command.RetSubmit {
+		return command.NewSuccessRetSubmit(data, []byte{0x01, 0x02})
+	})
+	setTestStandardDeviceInterface(t, device, 1, 1)
+
+	ret := device.Process(ctx, newControlCmdSubmit(t, protocol.SetupPacket{
+		BMRequestType: 0x21,
+		BRequest:      protocol.REQUEST_HID_SET_REPORT,
+		WLength:       2,
+	}, []byte{0xaa, 0xbb}))
+	assert.Equal(t, command.URB_STATUS_OK, ret.Status)
+
+	ret = device.Process(ctx, newControlCmdSubmit(t, protocol.SetupPacket{
+		BMRequestType: 0xc0,
+		BRequest:      0x01,
+		WLength:       2,
+	}, nil))
+	assert.Equal(t, command.URB_STATUS_TIMEOUT, ret.Status)
+
+	in := command.CmdSubmit{
+		CmdHeader: command.CmdHeader{
+			Command:        command.CMD_SUBMIT,
+			SeqNum:         2,
+			Direction:      command.DIR_IN,
+			EndpointNumber: 1,
+		},
+		TransferBufferLength: 64,
+		NumberOfPackets:      0xffffffff,
+	}
+	ret = device.Process(ctx, in)
+	assert.Equal(t, command.URB_STATUS_OK, ret.Status)
+	assert.Equal(t, []byte{0x01, 0x02}, ret.TransferBuffer)
+
+	// Endpoint without handler is stalled
+	in.EndpointNumber = 2
+	ret = device.Process(ctx, in)
+	assert.Equal(t, command.URB_STATUS_STALL, ret.Status)
+}
+
+func TestStandardDeviceBusID(t *testing.T) {
+	device := newTestStandardDevice(t)
+	device.SetBusID(1, 3)
+
+	info := device.GetDeviceInfo()
+	assert.Equal(t, protocol.BusID{'1', '-', '3'}, device.GetBusID())
+	assert.Equal(t, uint32(1), info.BusNum)
+	assert.Equal(t, uint32(3), info.DevNum)
+	assert.Equal(t, "/sys/devices/pci0000:00/0000:00:1d.1/usb3/1-3", string(bytes.TrimRight(info.Path[:], "\x00")))
+	assert.Equal(t, uint16(0x1234), info.IDVendor)
+	assert.Equal(t, protocol.SPEED_USB2_HIGH, info.Speed)
+}
+
+func TestStandardDeviceClock(t *testing.T) {
+	clock := usb.NewFakeClock()
+	device := usb.NewStandardDevice(usb.StandardDeviceConfig{
+		Descriptors: newTestStandardDevice(t).Descriptors(),
+		Clock:       clock,
+	}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	assert.Same(t, clock, device.Clock())
+	assert.Equal(t, uint32(0), device.FrameNumber())
+	clock.Advance(time.Millisecond + 250*time.Microsecond)
+	// High-speed device counts microframes
+	assert.Equal(t, uint32(10), device.FrameNumber())
+
+	assert.NotNil(t, newTestStandardDevice(t).Clock())
+}
+
+func TestStandardDeviceEndpointHalt(t *testing.T) {
+	device := newTestStandardDevice(t)
+	ctx := context.Background()
+	device.HandleEndpoint(0x81, func(ctx context.Context, data command.CmdSubmit) command.RetSubmit {
+		return command.NewSuccessRetSubmit(data, []byte{0x01})
+	})
+
+	endpointRequest := func(request protocol.SetupRequest, endpointAddress uint16) command.RetSubmit {
+		setup := protocol.SetupPacket{
+			BMRequestType: 0x02,
+			BRequest:      request,
+			WValue:        uint16(protocol.FEATURE_ENDPOINT_HALT),
+			WIndex:        endpointAddress,
+		}
+		if request == protocol.REQUEST_GET_STATUS {
+			setup.BMRequestType = 0x82
+			setup.WValue = 0
+			setup.WLength = 2
+		}
+		return device.Process(ctx, newControlCmdSubmit(t, setup, nil))
+	}
+	in := command.CmdSubmit{
+		CmdHeader: command.CmdHeader{
+			Command:        command.CMD_SUBMIT,
+			SeqNum:         2,
+			Direction:      command.DIR_IN,
+			EndpointNumber: 1,
+		},
+		TransferBufferLength: 64,
+		NumberOfPackets:      0xffffffff,
+	}
+
+	// Endpoint does not exist before configured
+	assert.Equal(t, command.URB_STATUS_STALL, endpointRequest(protocol.REQUEST_GET_STATUS, 0x81).Status)
+	assert.Equal(t, []byte{0x00, 0x00}, endpointRequest(protocol.REQUEST_GET_STATUS, 0x00).TransferBuffer)
+	assert.Equal(t, command.URB_STATUS_STALL, endpointRequest(protocol.REQUEST_SET_FEATURE, 0x00).Status)
+	assert.Equal(t, command.URB_STATUS_OK, endpointRequest(protocol.REQUEST_CLEAR_FEATURE, 0x00).Status)
+
+	setTestStandardDeviceInterface(t, device, 1, 1)
+
+	assert.Equal(t, []byte{0x00, 0x00}, endpointRequest(protocol.REQUEST_GET_STATUS, 0x81).TransferBuffer)
+	assert.Equal(t, command.URB_STATUS_STALL, endpointRequest(protocol.REQUEST_SET_FEATURE, 0x01).Status)
+
+	// Halted by host
+	assert.Equal(t, command.URB_STATUS_OK, endpointRequest(protocol.REQUEST_SET_FEATURE, 0x81).Status)
+	assert.True(t, device.IsEndpointHalted(0x81))
+	assert.Equal(t, []byte{0x01, 0x00}, endpointRequest(protocol.REQUEST_GET_STATUS, 0x81).TransferBuffer)
+	assert.Equal(t, command.URB_STATUS_STALL, device.Process(ctx, in).Status)
+
+	assert.Equal(t, command.URB_STATUS_OK, endpointRequest(protocol.REQUEST_CLEAR_FEATURE, 0x81).Status)
+	assert.False(t, device.IsEndpointHalted(0x81))
+	assert.Equal(t, command.URB_STATUS_OK, device.Process(ctx, in).Status)
+
+	// Halted by device
+	device.SetEndpointHalt(0x81, true)
+	assert.Equal(t, command.URB_STATUS_STALL, device.Process(ctx, in).Status)
+	assert.Equal(t, []byte{0x01, 0x00}, endpointRequest(protocol.REQUEST_GET_STATUS, 0x81).TransferBuffer)
+	assert.Equal(t, command.URB_STATUS_OK, endpointRequest(protocol.REQUEST_CLEAR_FEATURE, 0x81).Status)
+	assert.Equal(t, command.URB_STATUS_OK, device.Process(ctx, in).Status)
+
+	// Halt state is cleared by SET_INTERFACE
+	device.SetEndpointHalt(0x81, true)
+	device.Process(ctx, newControlCmdSubmit(t, protocol.SetupPacket{
+		BMRequestType: 0x01,
+		BRequest:      protocol.REQUEST_SET_INTERFACE,
+		WValue:        1,
+	}, nil))
+	assert.False(t, device.IsEndpointHalted(0x81))
+}
+
+func TestStandardDeviceEndpointHaltPendingURB(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	device := newTestStandardDevice(t)
+	endpoint, rets := newTestInterruptINEndpoint(t, usb.InterruptINEndpointConfig{
+		Clock:    usb.NewFakeClock(),
+		Interval: time.Millisecond,
+		Depth:    1,
+	})
+	device.HandleEndpointAsync(0x81, endpoint.Handle)
+	setTestStandardDeviceInterface(t, device, 1, 1)
+	submit := func(seqNum uint32) {
+		device.ProcessAsync(ctx, newInterruptINCmdSubmit(seqNum), func(ret command.RetSubmit) {
+			rets <- ret
+		})
+	}
+
+	// Halted by device
+	submit(1)
+	assertNotCompleted(t, rets)
+	device.SetEndpointHalt(0x81, true)
+	ret := receiveRetSubmit(t, rets)
+	assert.Equal(t, uint32(1), ret.SeqNum)
+	assert.Equal(t, command.URB_STATUS_STALL, ret.Status)
+	assertNotCompleted(t, rets)
+	device.SetEndpointHalt(0x81, false)
+
+	// Halted by host
+	submit(2)
+	assertNotCompleted(t, rets)
+	ret = device.Process(ctx, newControlCmdSubmit(t, protocol.SetupPacket{
+		BMRequestType: 0x02,
+		BRequest:      protocol.REQUEST_SET_FEATURE,
+		WValue:        uint16(protocol.FEATURE_ENDPOINT_HALT),
+		WIndex:        0x81,
+	}, nil))
+	require.Equal(t, command.URB_STATUS_OK, ret.Status)
+	ret = receiveRetSubmit(t, rets)
+	assert.Equal(t, uint32(2), ret.SeqNum)
+	assert.Equal(t, command.URB_STATUS_STALL, ret.Status)
+	assertNotCompleted(t, rets)
+	device.SetEndpointHalt(0x81, false)
+
+	// Stalled URBs are released by endpoint, so reports go to URBs submitted after halt is cleared
+	submit(3)
+	require.NoError(t, endpoint.Push(ctx, []byte{0x01}))
+	ret = receiveRetSubmit(t, rets)
+	assert.Equal(t, uint32(3), ret.SeqNum)
+	assert.Equal(t, command.URB_STATUS_OK, ret.Status)
+	assert.Equal(t, []byte{0x01}, ret.TransferBuffer)
+}
+
+func TestStandardDeviceAltSettingRouting(t *testing.T) {
+	tree := descriptor.Device{
+		BMaxPacketSize: 64,
+		Configurations: []descriptor.Configuration{
+			{
+				BConfigurationValue: 1,
+				Interfaces: []descriptor.Interface{
+					{
+						AltSettings: []descriptor.AltSetting{
+							// Zero-bandwidth alternate setting
+							{
+								BInterfaceClass:    protocol.CLASS_AUDIO,
+								BInterfaceSubClass: 0x02,
+							},
+							{
+								BInterfaceClass:    protocol.CLASS_AUDIO,
+								BInterfaceSubClass: 0x02,
+								Endpoints: []descriptor.Endpoint{
+									{
+										BEndpointAddress: 0x01,
+										BMAttributes:     0x01,
+										WMaxPacketSize:   192,
+										BInterval:        1,
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+			{
+				BConfigurationValue: 2,
+				Interfaces: []descriptor.Interface{
+					{
+						AltSettings: []descriptor.AltSetting{
+							{
+								BInterfaceClass: protocol.CLASS_VENDOR_SPECIFIC,
+								Endpoints: []descriptor.Endpoint{
+									{
+										BEndpointAddress: 0x01,
+										BMAttributes:     0x02,
+										WMaxPacketSize:   512,
+									},
+								},
+							},
+						},
+					},
+					{
+						AltSettings: []descriptor.AltSetting{
+							{
+								BInterfaceClass: protocol.CLASS_VENDOR_SPECIFIC,
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	set, err := tree.Build()
+	require.NoError(t, err)
+	device := usb.NewStandardDevice(usb.StandardDeviceConfig{
+		Descriptors: set,
+	}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	ctx := context.Background()
+
+	var configChanges []uint8
+	var interfaceChanges [][2]uint8
+	device.HandleSetConfiguration(func(ctx context.Context, configValue uint8) error {
+		configChanges = append(configChanges, configValue)
+		return nil
+	})
+	device.HandleSetInterface(func(ctx context.Context, interfaceNumber, alternateSetting uint8) error {
+		if alternateSetting == 1 && device.GetConfiguration() == 1 && len(interfaceChanges) > 0 {
+			return errors.New("streaming is not ready")
+		}
+		interfaceChanges = append(interfaceChanges, [2]uint8{interfaceNumber, alternateSetting})
+		return nil
+	})
+	device.HandleEndpoint(0x01, func(ctx context.Context, data command.CmdSubmit) command.RetSubmit {
+		return command.NewSuccessRetSubmit(data, nil)
+	})
+
+	out := command.CmdSubmit{
+		CmdHeader: command.CmdHeader{
+			Command:        command.CMD_SUBMIT,
+			SeqNum:         2,
+			Direction:      command.DIR_OUT,
+			EndpointNumber: 1,
+		},
+		TransferBufferLength: 4,
+		NumberOfPackets:      0xffffffff,
+		TransferBuffer:       []byte{0x01, 0x02, 0x03, 0x04},
+	}
+
+	// Endpoint is not active until device is configured
+	assert.Equal(t, command.URB_STATUS_STALL, device.Process(ctx, out).Status)
+
+	setTestStandardDeviceInterface(t, device, 1, 0)
+	assert.Equal(t, []uint8{1}, configChanges)
+	assert.Equal(t, command.URB_STATUS_STALL, device.Process(ctx, out).Status)
+	info := device.GetDeviceInfo()
+	assert.Equal(t, uint8(1), info.BConfigurationValue)
+	assert.Equal(t, uint8(1), info.BNumInterfaces)
+
+	// Alternate setting is rejected by device
+	ret := device.Process(ctx, newControlCmdSubmit(t, protocol.SetupPacket{
+		BMRequestType: 0x01,
+		BRequest:      protocol.REQUEST_SET_INTERFACE,
+		WValue:        1,
+	}, nil))
+	assert.Equal(t, command.URB_STATUS_STALL, ret.Status)
+	assert.Equal(t, uint8(0), device.GetAltSetting(0))
+	assert.Equal(t, [][2]uint8{{0, 0}}, interfaceChanges)
+
+	// Endpoint is active in configuration 2
+	ret = device.Process(ctx, newControlCmdSubmit(t, protocol.SetupPacket{
+		BMRequestType: 0x00,
+		BRequest:      protocol.REQUEST_SET_CONFIGURATION,
+		WValue:        2,
+	}, nil))
+	assert.Equal(t, command.URB_STATUS_OK, ret.Status)
+	assert.Equal(t, []uint8{1, 2}, configChanges)
+	assert.Equal(t, command.URB_STATUS_OK, device.Process(ctx, out).Status)
+	info = device.GetDeviceInfo()
+	assert.Equal(t, uint8(2), info.BConfigurationValue)
+	assert.Equal(t, uint8(2), info.BNumInterfaces)
+	assert.Len(t, info.Interfaces, 2)
+
+	configDesc, err := set.GetDescriptor(descriptor.DESCRIPTOR_TYPE_CONFIGURATION, 1, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, uint8(2), configDesc[5])
+}
+
+func TestStandardDeviceNumberGap(t *testing.T) {
+	// Captured device whose only interface is 2, having alternate settings 0 and 3
+	raw := descriptor.RawDevice{
+		Device: descriptor.StandardDeviceDescriptor{
+			BLength:            descriptor.STANDARD_DEVICE_DESCRIPTOR_LENGTH,
+			BDescriptorType:    descriptor.DESCRIPTOR_TYPE_DEVICE,
+			BCDUSB:             0x0200,
+			BMaxPacketSize:     64,
+			BNumConfigurations: 1,
+		},
+		Configurations: [][]byte{
+			{
+				0x09, 0x02, 0x2b, 0x00, 0x01, 0x01, 0x00, 0x80, 0x32,
+				0x09, 0x04, 0x02, 0x00, 0x00, 0xff, 0x00, 0x00, 0x00,
+				0x09, 0x04, 0x02, 0x03, 0x01, 0xff, 0x01, 0x00, 0x00,
+				0x07, 0x05, 0x81, 0x02, 0x00, 0x02, 0x00,
+			},
+		},
+		ConfigurationTrees: []descriptor.Configuration{
+			{
+				Interfaces: []descriptor.Interface{
+					{
+						BInterfaceNumber: 2,
+						AltSettings: []descriptor.AltSetting{
+							{BInterfaceClass: protocol.CLASS_VENDOR_SPECIFIC},
+							{
+								BAlternateSetting:  3,
+								BInterfaceClass:    protocol.CLASS_VENDOR_SPECIFIC,
+								BInterfaceSubClass: 0x01,
+								Endpoints:          []descriptor.Endpoint{{BEndpointAddress: 0x81, BMAttributes: 0x02, WMaxPacketSize: 512}},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	set, err := raw.Build()
+	require.NoError(t, err)
+	device := usb.NewStandardDevice(usb.StandardDeviceConfig{
+		Descriptors: set,
+	}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	ctx := context.Background()
+	device.HandleEndpoint(0x81, func(ctx context.Context, data command.CmdSubmit) command.RetSubmit {
+		return command.NewSuccessRetSubmit(data, []byte{0x01})
+	})
+	in := command.CmdSubmit{
+		CmdHeader: command.CmdHeader{
+			Command:        command.CMD_SUBMIT,
+			SeqNum:         2,
+			Direction:      command.DIR_IN,
+			EndpointNumber: 1,
+		},
+		TransferBufferLength: 1,
+		NumberOfPackets:      0xffffffff,
+	}
+
+	ret := device.Process(ctx, newControlCmdSubmit(t, protocol.SetupPacket{
+		BMRequestType: 0x00,
+		BRequest:      protocol.REQUEST_SET_CONFIGURATION,
+		WValue:        1,
+	}, nil))
+	require.Equal(t, command.URB_STATUS_OK, ret.Status)
+	assert.Equal(t, command.URB_STATUS_STALL, device.Process(ctx, in).Status)
+
+	// Interfaces and alternate settings are found by their numbers
+	for _, alternateSetting := range []uint16{1, 2} {
+		ret = device.Process(ctx, newControlCmdSubmit(t, protocol.SetupPacket{
+			BMRequestType: 0x01,
+			BRequest:      protocol.REQUEST_SET_INTERFACE,
+			WValue:        alternateSetting,
+			WIndex:        2,
+		}, nil))
+		assert.Equal(t, command.URB_STATUS_STALL, ret.Status)
+	}
+	ret = device.Process(ctx, newControlCmdSubmit(t, protocol.SetupPacket{
+		BMRequestType: 0x01,
+		BRequest:      protocol.REQUEST_SET_INTERFACE,
+		WValue:        3,
+		WIndex:        2,
+	}, nil))
+	require.Equal(t, command.URB_STATUS_OK, ret.Status)
+	assert.Equal(t, uint8(3), device.GetAltSetting(2))
+	assert.Equal(t, command.URB_STATUS_OK, device.Process(ctx, in).Status)
+
+	ret = device.Process(ctx, newControlCmdSubmit(t, protocol.SetupPacket{
+		BMRequestType: 0x81,
+		BRequest:      protocol.REQUEST_GET_INTERFACE,
+		WIndex:        2,
+		WLength:       1,
+	}, nil))
+	assert.Equal(t, []byte{0x03}, ret.TransferBuffer)
+	ret = device.Process(ctx, newControlCmdSubmit(t, protocol.SetupPacket{
+		BMRequestType: 0x81,
+		BRequest:      protocol.REQUEST_GET_INTERFACE,
+		WIndex:        0,
+		WLength:       1,
+	}, nil))
+	assert.Equal(t, command.URB_STATUS_STALL, ret.Status)
+
+	info := device.GetDeviceInfo()
+	require.Len(t, info.Interfaces, 1)
+	assert.Equal(t, uint8(0x01), info.Interfaces[0].BInterfaceSubclass)
+}
+
+func TestStandardDeviceSuperSpeed(t *testing.T) {
+	tree := descriptor.Device{
+		Speed:          protocol.SPEED_USB3_SUPER,
+		BCDUSB:         0x0320,
+		BMaxPacketSize: descriptor.SUPERSPEED_MAX_PACKET_SIZE_0,
+		IDVendor:       0x1234,
+		IDProduct:      0x5678,
+		Configurations: []descriptor.Configuration{
+			{
+				BMAttributes: 0b10000000,
+				Interfaces: []descriptor.Interface{
+					{
+						AltSettings: []descriptor.AltSetting{
+							{
+								BInterfaceClass: protocol.CLASS_MASS_STORAGE,
+								Endpoints: []descriptor.Endpoint{
+									{
+										BEndpointAddress:    0x81,
+										BMAttributes:        descriptor.ENDPOINT_TRANSFER_TYPE_BULK,
+										WMaxPacketSize:      1024,
+										SuperSpeedCompanion: &descriptor.SuperSpeedCompanion{MaxBurst: 15},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		Capabilities: []descriptor.DeviceCapability{
+			&descriptor.SuperSpeedUSBCapability{
+				BLength:            descriptor.SUPERSPEED_USB_CAPABILITY_LENGTH,
+				BDescriptorType:    descriptor.DESCRIPTOR_TYPE_DEVICE_CAPABILITY,
+				BDevCapabilityType: descriptor.DEVICE_CAPABILITY_TYPE_SUPERSPEED_USB,
+				WSpeedsSupported:   descriptor.SUPERSPEED_USB_SPEED_SUPER,
+			},
+		},
+	}
+	set, err := tree.Build()
+	require.NoError(t, err)
+	device := usb.NewStandardDevice(usb.StandardDeviceConfig{
+		Descriptors: set,
+	}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	ctx := context.Background()
+
+	ret := device.Process(ctx, newControlCmdSubmit(t, protocol.SetupPacket{
+		BMRequestType: 0x80,
+		BRequest:      protocol.REQUEST_GET_DESCRIPTOR,
+		WValue:        uint16(descriptor.DESCRIPTOR_TYPE_DEVICE) << 8,
+		WLength:       descriptor.STANDARD_DEVICE_DESCRIPTOR_LENGTH,
+	}, nil))
+	require.Equal(t, command.URB_STATUS_OK, ret.Status)
+	assert.Equal(t, uint8(0x09), ret.TransferBuffer[7])
+
+	ret = device.Process(ctx, newControlCmdSubmit(t, protocol.SetupPacket{
+		BMRequestType: 0x00,
+		BRequest:      protocol.REQUEST_SET_SEL,
+		WLength:       protocol.SYSTEM_EXIT_LATENCY_LENGTH,
+	}, []byte{0x0A, 0x0B, 0xFF, 0x07, 0x00, 0x08}))
+	assert.Equal(t, command.URB_STATUS_OK, ret.Status)
+	assert.Equal(t, protocol.SystemExitLatency{U1SEL: 0x0A, U1PEL: 0x0B, U2SEL: 0x07FF, U2PEL: 0x0800}, device.GetSystemExitLatency())
+
+	ret = device.Process(ctx, newControlCmdSubmit(t, protocol.SetupPacket{
+		BMRequestType: 0x00,
+		BRequest:      protocol.REQUEST_SET_SEL,
+		WLength:       2,
+	}, []byte{0x0A, 0x0B}))
+	assert.Equal(t, command.URB_STATUS_STALL, ret.Status)
+
+	ret = device.Process(ctx, newControlCmdSubmit(t, protocol.SetupPacket{
+		BMRequestType: 0x00,
+		BRequest:      protocol.REQUEST_SET_ISOCH_DELAY,
+		WValue:        40,
+	}, nil))
+	assert.Equal(t, command.URB_STATUS_OK, ret.Status)
+	assert.Equal(t, uint16(40), device.GetIsochronousDelay())
+
+	setFeature := func(recipient protocol.SetupRequestType, feature protocol.FeatureSelector, index uint16, enabled bool) command.RetSubmit {
+		request := protocol.REQUEST_CLEAR_FEATURE
+		if enabled {
+			request = protocol.REQUEST_SET_FEATURE
+		}
+		return device.Process(ctx, newControlCmdSubmit(t, protocol.SetupPacket{
+			BMRequestType: recipient,
+			BRequest:      request,
+			WValue:        uint16(feature),
+			WIndex:        index,
+		}, nil))
+	}
+	getStatus := func() []byte {
+		return device.Process(ctx, newControlCmdSubmit(t, protocol.SetupPacket{
+			BMRequestType: 0x80,
+			BRequest:      protocol.REQUEST_GET_STATUS,
+			WLength:       2,
+		}, nil)).TransferBuffer
+	}
+
+	// Link power management requires configured device
+	assert.Equal(t, command.URB_STATUS_STALL, setFeature(0x00, protocol.FEATURE_U1_ENABLE, 0, true).Status)
+
+	setTestStandardDeviceInterface(t, device, 1, 0)
+	assert.Equal(t, command.URB_STATUS_OK, setFeature(0x00, protocol.FEATURE_U1_ENABLE, 0, true).Status)
+	assert.Equal(t, command.URB_STATUS_OK, setFeature(0x00, protocol.FEATURE_U2_ENABLE, 0, true).Status)
+	assert.Equal(t, command.URB_STATUS_OK, setFeature(0x00, protocol.FEATURE_LTM_ENABLE, 0, true).Status)
+	assert.Equal(t, []byte{0b00011100, 0x00}, getStatus())
+	assert.Equal(t, command.URB_STATUS_OK, setFeature(0x00, protocol.FEATURE_U1_ENABLE, 0, false).Status)
+	assert.Equal(t, []byte{0b00011000, 0x00}, getStatus())
+
+	// Function suspend of interface 0, with suspend options in wIndex high byte
+	assert.Equal(t, command.URB_STATUS_OK, setFeature(0x01, protocol.FEATURE_FUNCTION_SUSPEND, 0x0100, true).Status)
+	assert.Equal(t, command.URB_STATUS_STALL, setFeature(0x01, protocol.FEATURE_FUNCTION_SUSPEND, 0x0001, true).Status)
+}
+
+func TestStandardDeviceSuperSpeedRequestsOnHighSpeedDevice(t *testing.T) {
+	device := newTestStandardDevice(t)
+	ctx := context.Background()
+
+	ret := device.Process(ctx, newControlCmdSubmit(t, protocol.SetupPacket{
+		BMRequestType: 0x00,
+		BRequest:      protocol.REQUEST_SET_ISOCH_DELAY,
+		WValue:        40,
+	}, nil))
+	assert.Equal(t, command.URB_STATUS_STALL, ret.Status)
+
+	setTestStandardDeviceInterface(t, device, 1, 0)
+	ret = device.Process(ctx, newControlCmdSubmit(t, protocol.SetupPacket{
+		BMRequestType: 0x00,
+		BRequest:      protocol.REQUEST_SET_FEATURE,
+		WValue:        uint16(protocol.FEATURE_U1_ENABLE),
+	}, nil))
+	assert.Equal(t, command.URB_STATUS_STALL, ret.Status)
+}
@@ -0,0 +1,390 @@
+package sysfs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ntchjb/usbip-virtual-device/usb"
+	usbprotocol "github.com/ntchjb/usbip-virtual-device/usb/protocol"
+	"github.com/ntchjb/usbip-virtual-device/usb/protocol/descriptor"
+	"github.com/ntchjb/usbip-virtual-device/usb/protocol/parser"
+	"github.com/ntchjb/usbip-virtual-device/usbip/protocol/op"
+)
+
+var (
+	ErrInvalidSysfsDevice = errors.New("invalid sysfs device")
+)
+
+// Names of attribute files in sysfs device directory
+const (
+	ATTRIBUTE_DESCRIPTORS         = "descriptors"
+	ATTRIBUTE_SPEED               = "speed"
+	ATTRIBUTE_ID_VENDOR           = "idVendor"
+	ATTRIBUTE_ID_PRODUCT          = "idProduct"
+	ATTRIBUTE_BCD_DEVICE          = "bcdDevice"
+	ATTRIBUTE_DEVICE_CLASS        = "bDeviceClass"
+	ATTRIBUTE_DEVICE_SUBCLASS     = "bDeviceSubClass"
+	ATTRIBUTE_DEVICE_PROTOCOL     = "bDeviceProtocol"
+	ATTRIBUTE_CONFIGURATION_VALUE = "bConfigurationValue"
+	ATTRIBUTE_NUM_CONFIGURATIONS  = "bNumConfigurations"
+	ATTRIBUTE_NUM_INTERFACES      = "bNumInterfaces"
+	ATTRIBUTE_MANUFACTURER        = "manufacturer"
+	ATTRIBUTE_PRODUCT             = "product"
+	ATTRIBUTE_SERIAL              = "serial"
+	ATTRIBUTE_CONFIGURATION       = "configuration"
+	ATTRIBUTE_INTERFACE_NUMBER    = "bInterfaceNumber"
+	ATTRIBUTE_ALTERNATE_SETTING   = "bAlternateSetting"
+	ATTRIBUTE_INTERFACE_CLASS     = "bInterfaceClass"
+	ATTRIBUTE_INTERFACE_SUBCLASS  = "bInterfaceSubClass"
+	ATTRIBUTE_INTERFACE_PROTOCOL  = "bInterfaceProtocol"
+	ATTRIBUTE_INTERFACE           = "interface"
+)
+
+// Values of speed attribute, in Mbps
+const (
+	SPEED_LOW                 = "1.5"
+	SPEED_FULL                = "12"
+	SPEED_HIGH                = "480"
+	SPEED_WIRELESS            = "53.3-480"
+	SPEED_SUPER               = "5000"
+	SPEED_SUPER_PLUS          = "10000"
+	SPEED_SUPER_PLUS_GEN2_BY2 = "20000"
+)
+
+// sysfsInterface is attributes of an interface directory, such as 1-1:1.0, of active configuration
+type sysfsInterface struct {
+	number           uint8
+	alternateSetting uint8
+	info             op.DeviceInterface
+	name             string
+}
+
+// Load reads a device directory captured from /sys/bus/usb/devices/<busid>/, such as os.DirFS("testdata/1-1"),
+// and builds its descriptors into DescriptorSet.
+//
+// Device and configuration descriptors come from binary descriptors file, as is.
+// Device information comes from attribute files, falling back to descriptors if an attribute file is missing.
+// String descriptors come from manufacturer, product, serial and configuration files, and interface files of
+// interface directories, so strings of inactive configurations and alternate settings have no string descriptor.
+// Interface directories are recognized by their bInterfaceNumber file rather than their name,
+// so that they can be renamed in a copied tree, where ':' is not allowed in file names of Go module and Windows.
+//
+// Sysfs does not capture BOS, device qualifier and other speed configuration descriptors, and LangIDs,
+// so the device has no such descriptors and supports only English (United States).
+func Load(fsys fs.FS) (*descriptor.DescriptorSet, error) {
+	data, err := fs.ReadFile(fsys, ATTRIBUTE_DESCRIPTORS)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read descriptors file: %w", err)
+	}
+	if len(data) < descriptor.STANDARD_DEVICE_DESCRIPTOR_LENGTH {
+		return nil, fmt.Errorf("%w: descriptors file is shorter than device descriptor", ErrInvalidSysfsDevice)
+	}
+	var deviceDesc descriptor.StandardDeviceDescriptor
+	if err := deviceDesc.Decode(bytes.NewBuffer(data)); err != nil {
+		return nil, fmt.Errorf("unable to decode device descriptor: %w", err)
+	}
+	configs, err := parser.ParseConfigurations(data[descriptor.STANDARD_DEVICE_DESCRIPTOR_LENGTH:])
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse configuration descriptors: %w", err)
+	}
+	if len(configs) == 0 {
+		return nil, fmt.Errorf("%w: descriptors file has no configuration descriptor", ErrInvalidSysfsDevice)
+	}
+
+	raw := descriptor.RawDevice{
+		Device:  deviceDesc,
+		Strings: make(map[uint8]string),
+	}
+	for i := range configs {
+		buf := new(bytes.Buffer)
+		if err := configs[i].Encode(buf); err != nil {
+			return nil, fmt.Errorf("unable to encode configuration %d: %w", i, err)
+		}
+		tree, err := configs[i].Tree()
+		if err != nil {
+			return nil, fmt.Errorf("unable to convert configuration %d into descriptor tree: %w", i, err)
+		}
+		raw.Configurations = append(raw.Configurations, buf.Bytes())
+		raw.ConfigurationTrees = append(raw.ConfigurationTrees, tree)
+	}
+
+	interfaces, err := readInterfaces(fsys)
+	if err != nil {
+		return nil, err
+	}
+	if raw.DeviceInfo, err = readDeviceInfo(fsys, &deviceDesc, configs, interfaces); err != nil {
+		return nil, err
+	}
+	if err := readStrings(fsys, &raw, configs, interfaces); err != nil {
+		return nil, err
+	}
+
+	set, err := raw.Build()
+	if err != nil {
+		return nil, fmt.Errorf("unable to build descriptors: %w", err)
+	}
+
+	return set, nil
+}
+
+// NewDevice reads a device directory captured from sysfs by Load, and creates StandardDevice replying
+// standard requests with the same descriptors as the real device.
+// Handlers of class, vendor and endpoint traffic can be registered to the returned device.
+func NewDevice(fsys fs.FS, logger *slog.Logger) (usb.StandardDevice, error) {
+	set, err := Load(fsys)
+	if err != nil {
+		return nil, err
+	}
+
+	return usb.NewStandardDevice(usb.StandardDeviceConfig{
+		Descriptors: set,
+	}, logger), nil
+}
+
+func readDeviceInfo(fsys fs.FS, deviceDesc *descriptor.StandardDeviceDescriptor, configs []parser.Configuration, interfaces []sysfsInterface) (op.DeviceInfo, error) {
+	var info op.DeviceInfo
+	speed, ok, err := readAttribute(fsys, ATTRIBUTE_SPEED)
+	if err != nil {
+		return op.DeviceInfo{}, err
+	}
+	if !ok {
+		return op.DeviceInfo{}, fmt.Errorf("%w: speed file is missing", ErrInvalidSysfsDevice)
+	}
+	if info.Speed, err = parseSpeed(speed); err != nil {
+		return op.DeviceInfo{}, err
+	}
+
+	if info.IDVendor, err = readUint16(fsys, ATTRIBUTE_ID_VENDOR, 16, deviceDesc.IDVendor); err != nil {
+		return op.DeviceInfo{}, err
+	}
+	if info.IDProduct, err = readUint16(fsys, ATTRIBUTE_ID_PRODUCT, 16, deviceDesc.IDProduct); err != nil {
+		return op.DeviceInfo{}, err
+	}
+	if info.BCDDevice, err = readUint16(fsys, ATTRIBUTE_BCD_DEVICE, 16, deviceDesc.BCDDevice); err != nil {
+		return op.DeviceInfo{}, err
+	}
+	if info.BDeviceClass, err = readUint8(fsys, ATTRIBUTE_DEVICE_CLASS, 16, deviceDesc.BDeviceClass); err != nil {
+		return op.DeviceInfo{}, err
+	}
+	if info.BDeviceSubclass, err = readUint8(fsys, ATTRIBUTE_DEVICE_SUBCLASS, 16, deviceDesc.BDeviceSubClass); err != nil {
+		return op.DeviceInfo{}, err
+	}
+	if info.BDeviceProtocol, err = readUint8(fsys, ATTRIBUTE_DEVICE_PROTOCOL, 16, deviceDesc.BDeviceProtocol); err != nil {
+		return op.DeviceInfo{}, err
+	}
+	if info.BNumConfigurations, err = readUint8(fsys, ATTRIBUTE_NUM_CONFIGURATIONS, 10, deviceDesc.BNumConfigurations); err != nil {
+		return op.DeviceInfo{}, err
+	}
+	// bConfigurationValue is empty if the device is not configured
+	if info.BConfigurationValue, err = readUint8(fsys, ATTRIBUTE_CONFIGURATION_VALUE, 10, configs[0].Descriptor.BConfigurationValue); err != nil {
+		return op.DeviceInfo{}, err
+	}
+
+	activeConfig := activeConfiguration(configs, info.BConfigurationValue)
+	var numInterfaces uint8
+	if activeConfig != nil {
+		numInterfaces = activeConfig.Descriptor.BNumInterfaces
+	}
+	if info.BNumInterfaces, err = readUint8(fsys, ATTRIBUTE_NUM_INTERFACES, 10, numInterfaces); err != nil {
+		return op.DeviceInfo{}, err
+	}
+
+	if len(interfaces) > 0 {
+		for _, intf := range interfaces {
+			info.Interfaces = append(info.Interfaces, intf.info)
+		}
+	} else if activeConfig != nil {
+		for _, intf := range activeConfig.Interfaces() {
+			altSetting := intf.AltSettings[0]
+			info.Interfaces = append(info.Interfaces, op.DeviceInterface{
+				BInterfaceClass:    altSetting.Descriptor.BInterfaceClass,
+				BInterfaceSubclass: altSetting.Descriptor.BInterfaceSubClass,
+				BInterfaceProtocol: altSetting.Descriptor.BInterfaceProtocol,
+			})
+		}
+	}
+
+	return info, nil
+}
+
+// activeConfiguration returns configuration having given bConfigurationValue, nil if device is not configured
+func activeConfiguration(configs []parser.Configuration, configValue uint8) *parser.Configuration {
+	for i := range configs {
+		if configs[i].Descriptor.BConfigurationValue == configValue {
+			return &configs[i]
+		}
+	}
+
+	return nil
+}
+
+// readInterfaces reads interface directories of active configuration, sorted by interface number
+func readInterfaces(fsys fs.FS) ([]sysfsInterface, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, fmt.Errorf("unable to read device directory: %w", err)
+	}
+
+	var interfaces []sysfsInterface
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		dir, err := fs.Sub(fsys, entry.Name())
+		if err != nil {
+			return nil, fmt.Errorf("unable to open interface directory %s: %w", entry.Name(), err)
+		}
+		if _, ok, err := readAttribute(dir, ATTRIBUTE_INTERFACE_NUMBER); err != nil || !ok {
+			// Not an interface directory, such as power or ep_00
+			continue
+		}
+
+		var intf sysfsInterface
+		if intf.number, err = readUint8(dir, ATTRIBUTE_INTERFACE_NUMBER, 16, 0); err != nil {
+			return nil, err
+		}
+		if intf.alternateSetting, err = readUint8(dir, ATTRIBUTE_ALTERNATE_SETTING, 10, 0); err != nil {
+			return nil, err
+		}
+		if intf.info.BInterfaceClass, err = readUint8(dir, ATTRIBUTE_INTERFACE_CLASS, 16, 0); err != nil {
+			return nil, err
+		}
+		if intf.info.BInterfaceSubclass, err = readUint8(dir, ATTRIBUTE_INTERFACE_SUBCLASS, 16, 0); err != nil {
+			return nil, err
+		}
+		if intf.info.BInterfaceProtocol, err = readUint8(dir, ATTRIBUTE_INTERFACE_PROTOCOL, 16, 0); err != nil {
+			return nil, err
+		}
+		if intf.name, _, err = readAttribute(dir, ATTRIBUTE_INTERFACE); err != nil {
+			return nil, err
+		}
+		interfaces = append(interfaces, intf)
+	}
+	sort.Slice(interfaces, func(i, j int) bool {
+		return interfaces[i].number < interfaces[j].number
+	})
+
+	return interfaces, nil
+}
+
+// readStrings maps text attributes to string descriptor indexes of device, active configuration and its interfaces
+func readStrings(fsys fs.FS, raw *descriptor.RawDevice, configs []parser.Configuration, interfaces []sysfsInterface) error {
+	deviceStrings := []struct {
+		name  string
+		index uint8
+	}{
+		{name: ATTRIBUTE_MANUFACTURER, index: raw.Device.IManufacturer},
+		{name: ATTRIBUTE_PRODUCT, index: raw.Device.IProduct},
+		{name: ATTRIBUTE_SERIAL, index: raw.Device.ISerialNumber},
+	}
+	for _, deviceString := range deviceStrings {
+		if err := setString(fsys, raw, deviceString.name, deviceString.index); err != nil {
+			return err
+		}
+	}
+
+	activeConfig := activeConfiguration(configs, raw.DeviceInfo.BConfigurationValue)
+	if activeConfig == nil {
+		return nil
+	}
+	if err := setString(fsys, raw, ATTRIBUTE_CONFIGURATION, activeConfig.Descriptor.IConfiguration); err != nil {
+		return err
+	}
+	for _, intf := range interfaces {
+		if intf.name == "" {
+			continue
+		}
+		for _, altSetting := range activeConfig.AltSettings {
+			if altSetting.Descriptor.BInterfaceNumber == intf.number && altSetting.Descriptor.BAlternateSetting == intf.alternateSetting && altSetting.Descriptor.IInterface != 0 {
+				raw.Strings[altSetting.Descriptor.IInterface] = intf.name
+			}
+		}
+	}
+
+	return nil
+}
+
+func setString(fsys fs.FS, raw *descriptor.RawDevice, name string, index uint8) error {
+	if index == 0 {
+		return nil
+	}
+	value, ok, err := readAttribute(fsys, name)
+	if err != nil {
+		return err
+	}
+	if ok {
+		raw.Strings[index] = value
+	}
+
+	return nil
+}
+
+// readAttribute reads an attribute file without its trailing newline, returning false if the file does not exist
+func readAttribute(fsys fs.FS, name string) (string, bool, error) {
+	data, err := fs.ReadFile(fsys, name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("unable to read attribute %s: %w", name, err)
+	}
+
+	return strings.TrimSuffix(string(data), "\n"), true, nil
+}
+
+func readUint(fsys fs.FS, name string, base int, bitSize int, defaultValue uint64) (uint64, error) {
+	value, ok, err := readAttribute(fsys, name)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return defaultValue, nil
+	}
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseUint(value, base, bitSize)
+	if err != nil {
+		return 0, fmt.Errorf("%w: attribute %s has invalid value %q", ErrInvalidSysfsDevice, name, value)
+	}
+
+	return n, nil
+}
+
+func readUint8(fsys fs.FS, name string, base int, defaultValue uint8) (uint8, error) {
+	n, err := readUint(fsys, name, base, 8, uint64(defaultValue))
+
+	return uint8(n), err
+}
+
+func readUint16(fsys fs.FS, name string, base int, defaultValue uint16) (uint16, error) {
+	n, err := readUint(fsys, name, base, 16, uint64(defaultValue))
+
+	return uint16(n), err
+}
+
+func parseSpeed(speed string) (uint32, error) {
+	switch strings.TrimSpace(speed) {
+	case SPEED_LOW:
+		return usbprotocol.SPEED_USB1_LOW, nil
+	case SPEED_FULL:
+		return usbprotocol.SPEED_USB1_FULL, nil
+	case SPEED_HIGH:
+		return usbprotocol.SPEED_USB2_HIGH, nil
+	case SPEED_WIRELESS:
+		return usbprotocol.SPEED_USB2_WIRELESS, nil
+	case SPEED_SUPER:
+		return usbprotocol.SPEED_USB3_SUPER, nil
+	case SPEED_SUPER_PLUS, SPEED_SUPER_PLUS_GEN2_BY2:
+		return usbprotocol.SPEED_USB3_SUPER_PLUS, nil
+	default:
+		return 0, fmt.Errorf("%w: unknown speed %q", ErrInvalidSysfsDevice, speed)
+	}
+}
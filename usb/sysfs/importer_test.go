@@ -0,0 +1,236 @@
+package sysfs_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/ntchjb/usbip-virtual-device/usb"
+	"github.com/ntchjb/usbip-virtual-device/usb/protocol"
+	"github.com/ntchjb/usbip-virtual-device/usb/protocol/descriptor"
+	"github.com/ntchjb/usbip-virtual-device/usb/sysfs"
+	"github.com/ntchjb/usbip-virtual-device/usbip/protocol/command"
+	"github.com/ntchjb/usbip-virtual-device/usbip/protocol/op"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Fixture is a full-speed keyboard captured from /sys/bus/usb/devices/2-1/,
+// where interface directories 2-1:1.0 and 2-1:1.1 are renamed to 2-1_1.0 and 2-1_1.1
+const fixtureDir = "testdata/2-1"
+
+func getDescriptor(t *testing.T, device usb.Device, descriptorType descriptor.DescriptorType, index uint8, langID uint16, length uint16) command.RetSubmit {
+	setup := protocol.SetupPacket{
+		BMRequestType: 0x80,
+		BRequest:      protocol.REQUEST_GET_DESCRIPTOR,
+		WValue:        uint16(descriptorType)<<8 | uint16(index),
+		WIndex:        langID,
+		WLength:       length,
+	}
+	buf := new(bytes.Buffer)
+	require.NoError(t, setup.Encode(buf))
+	cmd := command.CmdSubmit{
+		CmdHeader: command.CmdHeader{
+			Command:   command.CMD_SUBMIT,
+			SeqNum:    1,
+			Direction: command.DIR_IN,
+		},
+		TransferBufferLength: uint32(length),
+		NumberOfPackets:      0xffffffff,
+	}
+	copy(cmd.Setup[:], buf.Bytes())
+
+	return device.Process(context.Background(), cmd)
+}
+
+func encodeString(t *testing.T, s string) []byte {
+	buf := new(bytes.Buffer)
+	stringDesc := descriptor.NewStringDescriptor(s)
+	require.NoError(t, stringDesc.Encode(buf))
+
+	return buf.Bytes()
+}
+
+func TestNewDevice(t *testing.T) {
+	descriptors, err := os.ReadFile(fixtureDir + "/descriptors")
+	require.NoError(t, err)
+	device, err := sysfs.NewDevice(os.DirFS(fixtureDir), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	require.NoError(t, err)
+
+	info := device.GetDeviceInfo()
+	assert.Equal(t, protocol.SPEED_USB1_FULL, info.Speed)
+	assert.Equal(t, uint16(0x046d), info.IDVendor)
+	assert.Equal(t, uint16(0xc31c), info.IDProduct)
+	assert.Equal(t, uint16(0x4910), info.BCDDevice)
+	assert.Equal(t, uint8(1), info.BConfigurationValue)
+	assert.Equal(t, uint8(1), info.BNumConfigurations)
+	assert.Equal(t, uint8(2), info.BNumInterfaces)
+	assert.Equal(t, []op.DeviceInterface{
+		{BInterfaceClass: protocol.CLASS_HID, BInterfaceSubclass: 0x01, BInterfaceProtocol: 0x01},
+		{BInterfaceClass: protocol.CLASS_HID},
+	}, info.Interfaces)
+
+	ret := getDescriptor(t, device, descriptor.DESCRIPTOR_TYPE_DEVICE, 0, 0, 0x40)
+	require.Equal(t, command.URB_STATUS_OK, ret.Status)
+	assert.Equal(t, descriptors[:descriptor.STANDARD_DEVICE_DESCRIPTOR_LENGTH], ret.TransferBuffer)
+
+	ret = getDescriptor(t, device, descriptor.DESCRIPTOR_TYPE_CONFIGURATION, 0, 0, descriptor.STANDARD_CONFIGURATION_DESCRIPTOR_LENGTH)
+	require.Equal(t, command.URB_STATUS_OK, ret.Status)
+	assert.Equal(t, descriptors[18:27], ret.TransferBuffer)
+	ret = getDescriptor(t, device, descriptor.DESCRIPTOR_TYPE_CONFIGURATION, 0, 0, 0xFF)
+	require.Equal(t, command.URB_STATUS_OK, ret.Status)
+	assert.Equal(t, descriptors[18:], ret.TransferBuffer)
+
+	ret = getDescriptor(t, device, descriptor.DESCRIPTOR_TYPE_STRING, 0, 0, 0xFF)
+	require.Equal(t, command.URB_STATUS_OK, ret.Status)
+	assert.Equal(t, []byte{0x04, 0x03, 0x09, 0x04}, ret.TransferBuffer)
+	expectedStrings := map[uint8]string{
+		1: "Logitech",
+		2: "USB Keyboard",
+		3: "U0010",
+		4: "Consumer Control",
+	}
+	for index, s := range expectedStrings {
+		ret = getDescriptor(t, device, descriptor.DESCRIPTOR_TYPE_STRING, index, uint16(descriptor.LANGID_ENGLISH_UNITED_STATES), 0xFF)
+		require.Equal(t, command.URB_STATUS_OK, ret.Status, "string %d", index)
+		assert.Equal(t, encodeString(t, s), ret.TransferBuffer, "string %d", index)
+	}
+	ret = getDescriptor(t, device, descriptor.DESCRIPTOR_TYPE_STRING, 5, uint16(descriptor.LANGID_ENGLISH_UNITED_STATES), 0xFF)
+	assert.Equal(t, command.URB_STATUS_STALL, ret.Status)
+
+	assert.NoError(t, usb.ValidateDevice(context.Background(), device))
+}
+
+func newFixtureMapFS(t *testing.T) fstest.MapFS {
+	descriptors, err := os.ReadFile(fixtureDir + "/descriptors")
+	require.NoError(t, err)
+
+	return fstest.MapFS{
+		"descriptors":                    {Data: descriptors},
+		"speed":                          {Data: []byte("12\n")},
+		"bConfigurationValue":            {Data: []byte("1\n")},
+		"manufacturer":                   {Data: []byte("Logitech\n")},
+		"2-1:1.0/bInterfaceNumber":       {Data: []byte("00\n")},
+		"2-1:1.0/bAlternateSetting":      {Data: []byte(" 0\n")},
+		"2-1:1.0/bInterfaceClass":        {Data: []byte("03\n")},
+		"2-1:1.0/bInterfaceSubClass":     {Data: []byte("01\n")},
+		"2-1:1.0/bInterfaceProtocol":     {Data: []byte("01\n")},
+		"2-1:1.0/ep_81/bEndpointAddress": {Data: []byte("81\n")},
+	}
+}
+
+func TestLoadFallbackToDescriptors(t *testing.T) {
+	fsys := newFixtureMapFS(t)
+
+	set, err := sysfs.Load(fsys)
+	require.NoError(t, err)
+	info := set.DeviceInfo()
+	assert.Equal(t, uint16(0x046d), info.IDVendor)
+	assert.Equal(t, uint8(1), info.BNumConfigurations)
+	assert.Equal(t, uint8(2), info.BNumInterfaces)
+	// Only interface directory of interface 0 is captured
+	assert.Equal(t, []op.DeviceInterface{
+		{BInterfaceClass: protocol.CLASS_HID, BInterfaceSubclass: 0x01, BInterfaceProtocol: 0x01},
+	}, info.Interfaces)
+
+	manufacturer, ok := set.String(1)
+	assert.True(t, ok)
+	assert.Equal(t, "Logitech", manufacturer)
+	_, ok = set.String(2)
+	assert.False(t, ok)
+}
+
+func TestLoadUnconfigured(t *testing.T) {
+	fsys := newFixtureMapFS(t)
+	fsys["bConfigurationValue"] = &fstest.MapFile{Data: []byte("\n")}
+	fsys["bNumInterfaces"] = &fstest.MapFile{Data: []byte("  \n")}
+	fsys["configuration"] = &fstest.MapFile{Data: []byte("U0010\n")}
+	for name := range fsys {
+		if strings.HasPrefix(name, "2-1:1.0/") {
+			delete(fsys, name)
+		}
+	}
+
+	set, err := sysfs.Load(fsys)
+	require.NoError(t, err)
+	info := set.DeviceInfo()
+	assert.Equal(t, uint8(0), info.BConfigurationValue)
+	assert.Equal(t, uint8(0), info.BNumInterfaces)
+	assert.Empty(t, info.Interfaces)
+	// Configuration string is of active configuration only
+	_, ok := set.String(3)
+	assert.False(t, ok)
+}
+
+func TestLoadInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(fsys fstest.MapFS)
+	}{
+		{
+			name: "Missing descriptors",
+			modify: func(fsys fstest.MapFS) {
+				delete(fsys, "descriptors")
+			},
+		},
+		{
+			name: "Truncated device descriptor",
+			modify: func(fsys fstest.MapFS) {
+				fsys["descriptors"] = &fstest.MapFile{Data: fsys["descriptors"].Data[:10]}
+			},
+		},
+		{
+			name: "No configuration",
+			modify: func(fsys fstest.MapFS) {
+				fsys["descriptors"] = &fstest.MapFile{Data: fsys["descriptors"].Data[:18]}
+			},
+		},
+		{
+			name: "Truncated configuration",
+			modify: func(fsys fstest.MapFS) {
+				fsys["descriptors"] = &fstest.MapFile{Data: fsys["descriptors"].Data[:40]}
+			},
+		},
+		{
+			name: "Missing speed",
+			modify: func(fsys fstest.MapFS) {
+				delete(fsys, "speed")
+			},
+		},
+		{
+			name: "Unknown speed",
+			modify: func(fsys fstest.MapFS) {
+				fsys["speed"] = &fstest.MapFile{Data: []byte("24\n")}
+			},
+		},
+		{
+			name: "Invalid idVendor",
+			modify: func(fsys fstest.MapFS) {
+				fsys["idVendor"] = &fstest.MapFile{Data: []byte("xyz\n")}
+			},
+		},
+		{
+			name: "Invalid bInterfaceClass",
+			modify: func(fsys fstest.MapFS) {
+				fsys["2-1:1.0/bInterfaceClass"] = &fstest.MapFile{Data: []byte("100\n")}
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			fsys := newFixtureMapFS(t)
+			test.modify(fsys)
+
+			_, err := sysfs.Load(fsys)
+			assert.Error(t, err)
+		})
+	}
+}
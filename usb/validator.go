@@ -0,0 +1,418 @@
+package usb
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+
+	usbprotocol "github.com/ntchjb/usbip-virtual-device/usb/protocol"
+	"github.com/ntchjb/usbip-virtual-device/usb/protocol/descriptor"
+	"github.com/ntchjb/usbip-virtual-device/usb/protocol/parser"
+	"github.com/ntchjb/usbip-virtual-device/usbip/protocol/command"
+	"github.com/ntchjb/usbip-virtual-device/usbip/protocol/op"
+)
+
+var (
+	ErrInvalidDevice = errors.New("invalid device")
+)
+
+// ValidateDevice enumerates device as USB host does, by sending GET_DESCRIPTOR requests to its control endpoint,
+// then checks descriptors and device information against USB specification, for the speed in device information.
+// All problems found are joined into returned error, and each of them wraps ErrInvalidDevice.
+func ValidateDevice(ctx context.Context, device Device) error {
+	v := &deviceValidator{
+		device: device,
+		info:   device.GetDeviceInfo(),
+	}
+	v.validate(ctx)
+
+	return errors.Join(v.problems...)
+}
+
+type deviceValidator struct {
+	device   Device
+	info     op.DeviceInfo
+	problems []error
+	seqNum   uint32
+}
+
+func (v *deviceValidator) report(format string, args ...any) {
+	v.problems = append(v.problems, fmt.Errorf("%w: %s", ErrInvalidDevice, fmt.Sprintf(format, args...)))
+}
+
+// getDescriptor sends GET_DESCRIPTOR request to the device and returns data stage of its reply
+func (v *deviceValidator) getDescriptor(ctx context.Context, descriptorType descriptor.DescriptorType, index uint8, langID uint16, length uint16) ([]byte, error) {
+	setup := usbprotocol.SetupPacket{
+		BMRequestType: 0x80,
+		BRequest:      usbprotocol.REQUEST_GET_DESCRIPTOR,
+		WValue:        uint16(descriptorType)<<8 | uint16(index),
+		WIndex:        langID,
+		WLength:       length,
+	}
+	buf := new(bytes.Buffer)
+	if err := setup.Encode(buf); err != nil {
+		return nil, fmt.Errorf("unable to encode SetupPacket: %w", err)
+	}
+	v.seqNum++
+	cmd := command.CmdSubmit{
+		CmdHeader: command.CmdHeader{
+			Command:   command.CMD_SUBMIT,
+			SeqNum:    v.seqNum,
+			Direction: command.DIR_IN,
+		},
+		TransferBufferLength: uint32(length),
+		NumberOfPackets:      0xffffffff,
+	}
+	copy(cmd.Setup[:], buf.Bytes())
+
+	var ret command.RetSubmit
+	if asyncDevice, ok := v.device.(AsyncDevice); ok {
+		retChan := make(chan command.RetSubmit, 1)
+		asyncDevice.ProcessAsync(ctx, cmd, func(ret command.RetSubmit) {
+			select {
+			case retChan <- ret:
+			default:
+			}
+		})
+		select {
+		case ret = <-retChan:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	} else {
+		ret = v.device.Process(ctx, cmd)
+	}
+	if ret.Status != command.URB_STATUS_OK {
+		return nil, fmt.Errorf("GET_DESCRIPTOR of type %d index %d failed: %w", descriptorType, index, ret.Status)
+	}
+	data := ret.TransferBuffer
+	if int(ret.ActualLength) < len(data) {
+		data = data[:ret.ActualLength]
+	}
+	if len(data) > int(length) {
+		return nil, fmt.Errorf("GET_DESCRIPTOR of type %d index %d returned %d bytes, more than wLength %d", descriptorType, index, len(data), length)
+	}
+
+	return data, nil
+}
+
+func (v *deviceValidator) validate(ctx context.Context) {
+	data, err := v.getDescriptor(ctx, descriptor.DESCRIPTOR_TYPE_DEVICE, 0, 0, descriptor.STANDARD_DEVICE_DESCRIPTOR_LENGTH)
+	if err != nil {
+		v.report("unable to get device descriptor: %v", err)
+		return
+	}
+	if len(data) != descriptor.STANDARD_DEVICE_DESCRIPTOR_LENGTH {
+		v.report("device descriptor length is %d, expected %d", len(data), descriptor.STANDARD_DEVICE_DESCRIPTOR_LENGTH)
+		return
+	}
+	var deviceDesc descriptor.StandardDeviceDescriptor
+	if err := deviceDesc.Decode(bytes.NewBuffer(data)); err != nil {
+		v.report("unable to decode device descriptor: %v", err)
+		return
+	}
+	v.validateDeviceDescriptor(&deviceDesc)
+
+	stringIndexes := map[uint8]string{
+		deviceDesc.IManufacturer: "iManufacturer",
+		deviceDesc.IProduct:      "iProduct",
+		deviceDesc.ISerialNumber: "iSerialNumber",
+	}
+	var configs []*parser.Configuration
+	for i := uint8(0); i < deviceDesc.BNumConfigurations; i++ {
+		config := v.getConfiguration(ctx, i)
+		if config == nil {
+			continue
+		}
+		configs = append(configs, config)
+		v.validateConfiguration(i, config)
+
+		stringIndexes[config.Descriptor.IConfiguration] = fmt.Sprintf("iConfiguration of configuration %d", i)
+		for _, altSetting := range config.AltSettings {
+			stringIndexes[altSetting.Descriptor.IInterface] = fmt.Sprintf("iInterface of interface %d alternate setting %d", altSetting.Descriptor.BInterfaceNumber, altSetting.Descriptor.BAlternateSetting)
+			if altSetting.InterfaceAssociation != nil {
+				stringIndexes[altSetting.InterfaceAssociation.IFunction] = fmt.Sprintf("iFunction of interface association of interface %d", altSetting.InterfaceAssociation.BFirstInterface)
+			}
+		}
+	}
+	delete(stringIndexes, 0)
+	v.validateStrings(ctx, stringIndexes)
+	v.validateDeviceInfo(&deviceDesc, configs)
+}
+
+func (v *deviceValidator) validateDeviceDescriptor(deviceDesc *descriptor.StandardDeviceDescriptor) {
+	if deviceDesc.BLength != descriptor.STANDARD_DEVICE_DESCRIPTOR_LENGTH {
+		v.report("bLength of device descriptor is %d, expected %d", deviceDesc.BLength, descriptor.STANDARD_DEVICE_DESCRIPTOR_LENGTH)
+	}
+	if deviceDesc.BDescriptorType != descriptor.DESCRIPTOR_TYPE_DEVICE {
+		v.report("bDescriptorType of device descriptor is %d", deviceDesc.BDescriptorType)
+	}
+	if deviceDesc.BNumConfigurations == 0 {
+		v.report("device has no configuration")
+	}
+
+	maxPacketSize := deviceDesc.BMaxPacketSize
+	switch v.info.Speed {
+	case usbprotocol.SPEED_USB1_LOW:
+		if maxPacketSize != 8 {
+			v.report("bMaxPacketSize0 of low-speed device is %d, expected 8", maxPacketSize)
+		}
+	case usbprotocol.SPEED_USB1_FULL:
+		if maxPacketSize != 8 && maxPacketSize != 16 && maxPacketSize != 32 && maxPacketSize != 64 {
+			v.report("bMaxPacketSize0 of full-speed device is %d, expected 8, 16, 32 or 64", maxPacketSize)
+		}
+	case usbprotocol.SPEED_USB2_HIGH:
+		if maxPacketSize != 64 {
+			v.report("bMaxPacketSize0 of high-speed device is %d, expected 64", maxPacketSize)
+		}
+		if deviceDesc.BCDUSB < 0x0200 {
+			v.report("bcdUSB of high-speed device is 0x%04x, expected 0x0200 or higher", deviceDesc.BCDUSB)
+		}
+	case usbprotocol.SPEED_USB3_SUPER, usbprotocol.SPEED_USB3_SUPER_PLUS:
+		if maxPacketSize != descriptor.SUPERSPEED_MAX_PACKET_SIZE_0 {
+			v.report("bMaxPacketSize0 of SuperSpeed device is %d, expected %d", maxPacketSize, descriptor.SUPERSPEED_MAX_PACKET_SIZE_0)
+		}
+		if deviceDesc.BCDUSB < 0x0300 {
+			v.report("bcdUSB of SuperSpeed device is 0x%04x, expected 0x0300 or higher", deviceDesc.BCDUSB)
+		}
+	}
+}
+
+// getConfiguration reads configuration descriptor header, then the whole configuration by its wTotalLength
+func (v *deviceValidator) getConfiguration(ctx context.Context, index uint8) *parser.Configuration {
+	data, err := v.getDescriptor(ctx, descriptor.DESCRIPTOR_TYPE_CONFIGURATION, index, 0, descriptor.STANDARD_CONFIGURATION_DESCRIPTOR_LENGTH)
+	if err != nil {
+		v.report("unable to get configuration descriptor %d: %v", index, err)
+		return nil
+	}
+	var configDesc descriptor.StandardConfigurationDescriptor
+	if err := configDesc.Decode(bytes.NewBuffer(data)); err != nil {
+		v.report("unable to decode configuration descriptor %d: %v", index, err)
+		return nil
+	}
+	if configDesc.BLength != descriptor.STANDARD_CONFIGURATION_DESCRIPTOR_LENGTH {
+		v.report("bLength of configuration descriptor %d is %d, expected %d", index, configDesc.BLength, descriptor.STANDARD_CONFIGURATION_DESCRIPTOR_LENGTH)
+	}
+
+	data, err = v.getDescriptor(ctx, descriptor.DESCRIPTOR_TYPE_CONFIGURATION, index, 0, configDesc.WTotalLength)
+	if err != nil {
+		v.report("unable to get configuration %d: %v", index, err)
+		return nil
+	}
+	if len(data) != int(configDesc.WTotalLength) {
+		v.report("wTotalLength of configuration %d is %d, but %d bytes are returned", index, configDesc.WTotalLength, len(data))
+		return nil
+	}
+	config, err := parser.ParseConfiguration(data)
+	if err != nil {
+		v.report("unable to parse configuration %d: %v", index, err)
+		return nil
+	}
+
+	return config
+}
+
+func (v *deviceValidator) validateConfiguration(index uint8, config *parser.Configuration) {
+	interfaces := config.Interfaces()
+	if int(config.Descriptor.BNumInterfaces) != len(interfaces) {
+		v.report("bNumInterfaces of configuration %d is %d, but it has %d interfaces", index, config.Descriptor.BNumInterfaces, len(interfaces))
+	}
+
+	endpointOwners := make(map[uint8]uint8)
+	for _, intf := range interfaces {
+		if int(intf.Number) >= len(interfaces) {
+			v.report("interface number %d of configuration %d is not contiguous from 0", intf.Number, index)
+		}
+		altSettings := make(map[uint8]bool)
+		for _, altSetting := range intf.AltSettings {
+			altSettings[altSetting.Descriptor.BAlternateSetting] = true
+		}
+		if !altSettings[0] {
+			v.report("interface %d of configuration %d has no alternate setting 0", intf.Number, index)
+		}
+
+		for _, altSetting := range intf.AltSettings {
+			where := fmt.Sprintf("interface %d alternate setting %d of configuration %d", intf.Number, altSetting.Descriptor.BAlternateSetting, index)
+			if altSetting.Descriptor.BLength != descriptor.STANDARD_INTERFACE_DESCRIPTOR_LENGTH {
+				v.report("bLength of %s is %d, expected %d", where, altSetting.Descriptor.BLength, descriptor.STANDARD_INTERFACE_DESCRIPTOR_LENGTH)
+			}
+			if int(altSetting.Descriptor.BNumEndpoints) != len(altSetting.Endpoints) {
+				v.report("bNumEndpoints of %s is %d, but it has %d endpoints", where, altSetting.Descriptor.BNumEndpoints, len(altSetting.Endpoints))
+			}
+
+			endpointAddresses := make(map[uint8]bool)
+			for _, endpoint := range altSetting.Endpoints {
+				address := endpoint.Descriptor.BEndpointAddress
+				if endpointAddresses[address] {
+					v.report("duplicated endpoint address 0x%02x in %s", address, where)
+				}
+				endpointAddresses[address] = true
+				if owner, ok := endpointOwners[address]; ok && owner != intf.Number {
+					v.report("endpoint address 0x%02x is used by both interface %d and %d of configuration %d", address, owner, intf.Number, index)
+				}
+				endpointOwners[address] = intf.Number
+
+				v.validateEndpoint(fmt.Sprintf("endpoint 0x%02x of %s", address, where), &endpoint)
+			}
+		}
+	}
+}
+
+func (v *deviceValidator) validateEndpoint(where string, endpoint *parser.Endpoint) {
+	desc := &endpoint.Descriptor
+	// Audio 1.0 endpoint descriptor has 2 extra bytes
+	if desc.BLength != descriptor.STANDARD_ENDPOINT_DESCRIPTOR_LENGTH && desc.BLength != descriptor.STANDARD_ENDPOINT_DESCRIPTOR_LENGTH+2 {
+		v.report("bLength of %s is %d, expected %d", where, desc.BLength, descriptor.STANDARD_ENDPOINT_DESCRIPTOR_LENGTH)
+	}
+	if desc.BEndpointAddress&0x0F == 0 || desc.BEndpointAddress&0x70 != 0 {
+		v.report("%s has invalid endpoint address", where)
+	}
+
+	transferType := desc.BMAttributes & descriptor.ENDPOINT_TRANSFER_TYPE_MASK
+	if transferType == descriptor.ENDPOINT_TRANSFER_TYPE_CONTROL {
+		v.report("%s is control endpoint, which is not supported by USB/IP virtual device", where)
+		return
+	}
+	periodic := transferType == descriptor.ENDPOINT_TRANSFER_TYPE_ISOCHRONOUS || transferType == descriptor.ENDPOINT_TRANSFER_TYPE_INTERRUPT
+	maxPacketSize := desc.WMaxPacketSize & 0x07FF
+	additionalTransactions := desc.WMaxPacketSize >> 11 & 0b11
+	superSpeed := v.info.Speed == usbprotocol.SPEED_USB3_SUPER || v.info.Speed == usbprotocol.SPEED_USB3_SUPER_PLUS
+
+	switch v.info.Speed {
+	case usbprotocol.SPEED_USB1_LOW:
+		if transferType != descriptor.ENDPOINT_TRANSFER_TYPE_INTERRUPT {
+			v.report("%s of low-speed device must be interrupt endpoint", where)
+		}
+		if desc.WMaxPacketSize > 8 {
+			v.report("wMaxPacketSize of %s is %d, exceeding 8 of low-speed device", where, desc.WMaxPacketSize)
+		}
+	case usbprotocol.SPEED_USB1_FULL:
+		switch transferType {
+		case descriptor.ENDPOINT_TRANSFER_TYPE_BULK:
+			if desc.WMaxPacketSize != 8 && desc.WMaxPacketSize != 16 && desc.WMaxPacketSize != 32 && desc.WMaxPacketSize != 64 {
+				v.report("wMaxPacketSize of full-speed bulk %s is %d, expected 8, 16, 32 or 64", where, desc.WMaxPacketSize)
+			}
+		case descriptor.ENDPOINT_TRANSFER_TYPE_INTERRUPT:
+			if desc.WMaxPacketSize > descriptor.FULL_SPEED_MAX_PACKET_SIZE {
+				v.report("wMaxPacketSize of full-speed interrupt %s is %d, exceeding %d", where, desc.WMaxPacketSize, descriptor.FULL_SPEED_MAX_PACKET_SIZE)
+			}
+		case descriptor.ENDPOINT_TRANSFER_TYPE_ISOCHRONOUS:
+			if desc.WMaxPacketSize > descriptor.FULL_SPEED_MAX_ISOCHRONOUS_PACKET_SIZE {
+				v.report("wMaxPacketSize of full-speed isochronous %s is %d, exceeding %d", where, desc.WMaxPacketSize, descriptor.FULL_SPEED_MAX_ISOCHRONOUS_PACKET_SIZE)
+			}
+		}
+	case usbprotocol.SPEED_USB2_HIGH:
+		if transferType == descriptor.ENDPOINT_TRANSFER_TYPE_BULK && desc.WMaxPacketSize != 512 {
+			v.report("wMaxPacketSize of high-speed bulk %s is %d, expected 512", where, desc.WMaxPacketSize)
+		}
+		if periodic && (maxPacketSize > 1024 || additionalTransactions > 2) {
+			v.report("wMaxPacketSize of high-speed periodic %s is 0x%04x, exceeding 1024 bytes with 2 additional transactions", where, desc.WMaxPacketSize)
+		}
+	}
+	if superSpeed {
+		if transferType == descriptor.ENDPOINT_TRANSFER_TYPE_BULK && desc.WMaxPacketSize != descriptor.SUPERSPEED_MAX_PACKET_SIZE {
+			v.report("wMaxPacketSize of SuperSpeed bulk %s is %d, expected %d", where, desc.WMaxPacketSize, descriptor.SUPERSPEED_MAX_PACKET_SIZE)
+		}
+		if periodic && desc.WMaxPacketSize > descriptor.SUPERSPEED_MAX_PACKET_SIZE {
+			v.report("wMaxPacketSize of SuperSpeed periodic %s is %d, exceeding %d", where, desc.WMaxPacketSize, descriptor.SUPERSPEED_MAX_PACKET_SIZE)
+		}
+		if endpoint.SuperSpeedCompanion == nil {
+			v.report("%s of SuperSpeed device has no endpoint companion descriptor", where)
+		}
+	} else if endpoint.SuperSpeedCompanion != nil {
+		v.report("%s has endpoint companion descriptor, but device is not SuperSpeed device", where)
+	}
+
+	if !periodic {
+		return
+	}
+	// Interval of full-speed and low-speed interrupt endpoints is in frames, others are exponent of 2
+	if desc.BInterval == 0 {
+		v.report("bInterval of periodic %s must not be zero", where)
+	}
+	fullSpeedInterrupt := transferType == descriptor.ENDPOINT_TRANSFER_TYPE_INTERRUPT &&
+		(v.info.Speed == usbprotocol.SPEED_USB1_LOW || v.info.Speed == usbprotocol.SPEED_USB1_FULL)
+	if !fullSpeedInterrupt && desc.BInterval > 16 {
+		v.report("bInterval of %s is %d, exceeding 16", where, desc.BInterval)
+	}
+}
+
+func (v *deviceValidator) validateStrings(ctx context.Context, stringIndexes map[uint8]string) {
+	if len(stringIndexes) == 0 {
+		return
+	}
+	data, err := v.getDescriptor(ctx, descriptor.DESCRIPTOR_TYPE_STRING, 0, 0, 0xFF)
+	if err != nil {
+		v.report("device has string indexes, but unable to get LangIDs: %v", err)
+		return
+	}
+	if len(data) < 4 || int(data[0]) != len(data) || len(data)%2 != 0 || descriptor.DescriptorType(data[1]) != descriptor.DESCRIPTOR_TYPE_STRING {
+		v.report("LangIDs string descriptor is malformed: % x", data)
+		return
+	}
+	langID := uint16(data[2]) | uint16(data[3])<<8
+
+	for index, field := range stringIndexes {
+		data, err := v.getDescriptor(ctx, descriptor.DESCRIPTOR_TYPE_STRING, index, langID, 0xFF)
+		if err != nil {
+			v.report("string index %d of %s is not found: %v", index, field, err)
+			continue
+		}
+		if len(data) < 2 || int(data[0]) != len(data) || len(data)%2 != 0 || descriptor.DescriptorType(data[1]) != descriptor.DESCRIPTOR_TYPE_STRING {
+			v.report("string descriptor %d of %s is malformed", index, field)
+		}
+	}
+}
+
+func (v *deviceValidator) validateDeviceInfo(deviceDesc *descriptor.StandardDeviceDescriptor, configs []*parser.Configuration) {
+	info := &v.info
+	if info.IDVendor != deviceDesc.IDVendor || info.IDProduct != deviceDesc.IDProduct || info.BCDDevice != deviceDesc.BCDDevice {
+		v.report("device info vendor 0x%04x, product 0x%04x, bcdDevice 0x%04x do not match device descriptor 0x%04x, 0x%04x, 0x%04x",
+			info.IDVendor, info.IDProduct, info.BCDDevice, deviceDesc.IDVendor, deviceDesc.IDProduct, deviceDesc.BCDDevice)
+	}
+	if info.BDeviceClass != deviceDesc.BDeviceClass || info.BDeviceSubclass != deviceDesc.BDeviceSubClass || info.BDeviceProtocol != deviceDesc.BDeviceProtocol {
+		v.report("device info class %02x/%02x/%02x does not match device descriptor %02x/%02x/%02x",
+			info.BDeviceClass, info.BDeviceSubclass, info.BDeviceProtocol, deviceDesc.BDeviceClass, deviceDesc.BDeviceSubClass, deviceDesc.BDeviceProtocol)
+	}
+	if info.BNumConfigurations != deviceDesc.BNumConfigurations {
+		v.report("device info bNumConfigurations %d does not match device descriptor %d", info.BNumConfigurations, deviceDesc.BNumConfigurations)
+	}
+	if int(info.BNumInterfaces) != len(info.Interfaces) {
+		v.report("device info bNumInterfaces is %d, but it has %d interfaces", info.BNumInterfaces, len(info.Interfaces))
+	}
+
+	var config *parser.Configuration
+	for _, c := range configs {
+		if c.Descriptor.BConfigurationValue == info.BConfigurationValue {
+			config = c
+			break
+		}
+	}
+	if config == nil {
+		v.report("device info bConfigurationValue %d does not match any configuration", info.BConfigurationValue)
+		return
+	}
+	interfaces := config.Interfaces()
+	if len(interfaces) != len(info.Interfaces) {
+		v.report("device info has %d interfaces, but configuration %d has %d interfaces", len(info.Interfaces), info.BConfigurationValue, len(interfaces))
+		return
+	}
+	for i, intf := range interfaces {
+		altSetting := intf.AltSettings[0]
+		for _, a := range intf.AltSettings {
+			if a.Descriptor.BAlternateSetting == 0 {
+				altSetting = a
+				break
+			}
+		}
+		infoInterface := info.Interfaces[i]
+		if infoInterface.BInterfaceClass != altSetting.Descriptor.BInterfaceClass ||
+			infoInterface.BInterfaceSubclass != altSetting.Descriptor.BInterfaceSubClass ||
+			infoInterface.BInterfaceProtocol != altSetting.Descriptor.BInterfaceProtocol {
+			v.report("device info interface %d class %02x/%02x/%02x does not match interface descriptor %02x/%02x/%02x", i,
+				infoInterface.BInterfaceClass, infoInterface.BInterfaceSubclass, infoInterface.BInterfaceProtocol,
+				altSetting.Descriptor.BInterfaceClass, altSetting.Descriptor.BInterfaceSubClass, altSetting.Descriptor.BInterfaceProtocol)
+		}
+	}
+}
@@ -0,0 +1,353 @@
+package usb_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/ntchjb/usbip-virtual-device/usb"
+	"github.com/ntchjb/usbip-virtual-device/usb/protocol"
+	"github.com/ntchjb/usbip-virtual-device/usb/protocol/descriptor"
+	"github.com/ntchjb/usbip-virtual-device/usbip/protocol/command"
+	"github.com/ntchjb/usbip-virtual-device/usbip/protocol/op"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// rawDescriptorDevice replies GET_DESCRIPTOR requests with raw descriptors keyed by wValue
+type rawDescriptorDevice struct {
+	info        op.DeviceInfo
+	descriptors map[uint16][]byte
+}
+
+func (d *rawDescriptorDevice) SetBusID(busNum, devNum uint) {}
+
+func (d *rawDescriptorDevice) GetBusID() protocol.BusID {
+	return protocol.BusID{}
+}
+
+func (d *rawDescriptorDevice) GetDeviceInfo() op.DeviceInfo {
+	return d.info
+}
+
+func (d *rawDescriptorDevice) Process(ctx context.Context, data command.CmdSubmit) command.RetSubmit {
+	var setup protocol.SetupPacket
+	if err := setup.Decode(bytes.NewBuffer(data.Setup[:])); err != nil {
+		return command.NewStallRetSubmit(data)
+	}
+	desc, ok := d.descriptors[setup.WValue]
+	if setup.BRequest != protocol.REQUEST_GET_DESCRIPTOR || !ok {
+		return command.NewStallRetSubmit(data)
+	}
+
+	return command.NewSuccessRetSubmit(data, desc[:min(len(desc), int(setup.WLength))])
+}
+
+func (d *rawDescriptorDevice) GetWorkerPoolProfile() usb.WorkerPoolProfile {
+	return usb.WorkerPoolProfile{}
+}
+
+func (d *rawDescriptorDevice) Close() error {
+	return nil
+}
+
+func newRawDescriptorDevice() *rawDescriptorDevice {
+	info := op.DeviceInfo{
+		Interfaces: []op.DeviceInterface{
+			{BInterfaceClass: uint8(protocol.CLASS_HID)},
+		},
+	}
+	info.Speed = protocol.SPEED_USB1_FULL
+	info.IDVendor = 0x1234
+	info.IDProduct = 0x5678
+	info.BCDDevice = 0x0100
+	info.BConfigurationValue = 1
+	info.BNumConfigurations = 1
+	info.BNumInterfaces = 1
+
+	return &rawDescriptorDevice{
+		info: info,
+		descriptors: map[uint16][]byte{
+			0x0100: {0x12, 0x01, 0x00, 0x02, 0x00, 0x00, 0x00, 0x40, 0x34, 0x12, 0x78, 0x56, 0x00, 0x01, 0x00, 0x01, 0x00, 0x01},
+			0x0200: {
+				0x09, 0x02, 0x22, 0x00, 0x01, 0x01, 0x00, 0x80, 0x32, // Configuration
+				0x09, 0x04, 0x00, 0x00, 0x01, 0x03, 0x00, 0x00, 0x00, // HID interface
+				0x09, 0x21, 0x11, 0x01, 0x00, 0x01, 0x22, 0x34, 0x00, // HID descriptor
+				0x07, 0x05, 0x81, 0x03, 0x08, 0x00, 0x0a, // Interrupt IN endpoint
+			},
+			0x0300: {0x04, 0x03, 0x09, 0x04},
+			0x0301: {0x06, 0x03, 'H', 0x00, 'i', 0x00},
+		},
+	}
+}
+
+func TestValidateDevice(t *testing.T) {
+	superSpeedTree := newSuperSpeedTestTree()
+	superSpeedSet, err := superSpeedTree.Build()
+	require.NoError(t, err)
+	superSpeedDevice := usb.NewStandardDevice(usb.StandardDeviceConfig{
+		Descriptors: superSpeedSet,
+	}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	tests := []struct {
+		name   string
+		device usb.Device
+	}{
+		{
+			name:   "Raw full-speed device",
+			device: newRawDescriptorDevice(),
+		},
+		{
+			name:   "High-speed standard device",
+			device: newTestStandardDevice(t),
+		},
+		{
+			name:   "SuperSpeed standard device",
+			device: superSpeedDevice,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.NoError(t, usb.ValidateDevice(context.Background(), test.device))
+		})
+	}
+}
+
+func TestValidateDeviceInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(device *rawDescriptorDevice)
+		message string
+	}{
+		{
+			name: "Missing device descriptor",
+			modify: func(device *rawDescriptorDevice) {
+				delete(device.descriptors, 0x0100)
+			},
+			message: "unable to get device descriptor",
+		},
+		{
+			name: "Wrong device bLength",
+			modify: func(device *rawDescriptorDevice) {
+				device.descriptors[0x0100][0] = 0x10
+			},
+			message: "bLength of device descriptor is 16",
+		},
+		{
+			name: "Wrong bMaxPacketSize0",
+			modify: func(device *rawDescriptorDevice) {
+				device.descriptors[0x0100][7] = 9
+			},
+			message: "bMaxPacketSize0 of full-speed device is 9",
+		},
+		{
+			name: "wTotalLength mismatch",
+			modify: func(device *rawDescriptorDevice) {
+				device.descriptors[0x0200][2] = 0x30
+			},
+			message: "wTotalLength of configuration 0 is 48, but 34 bytes are returned",
+		},
+		{
+			name: "bNumInterfaces mismatch",
+			modify: func(device *rawDescriptorDevice) {
+				device.descriptors[0x0200][4] = 2
+			},
+			message: "bNumInterfaces of configuration 0 is 2, but it has 1 interfaces",
+		},
+		{
+			name: "bNumEndpoints mismatch",
+			modify: func(device *rawDescriptorDevice) {
+				device.descriptors[0x0200][13] = 2
+			},
+			message: "bNumEndpoints of interface 0 alternate setting 0 of configuration 0 is 2, but it has 1 endpoints",
+		},
+		{
+			name: "Duplicated endpoint address",
+			modify: func(device *rawDescriptorDevice) {
+				config := device.descriptors[0x0200]
+				config = append(config, 0x07, 0x05, 0x81, 0x03, 0x08, 0x00, 0x0a)
+				config[2] = byte(len(config))
+				config[13] = 2
+				device.descriptors[0x0200] = config
+			},
+			message: "duplicated endpoint address 0x81",
+		},
+		{
+			name: "Interrupt wMaxPacketSize exceeds full-speed limit",
+			modify: func(device *rawDescriptorDevice) {
+				device.descriptors[0x0200][31] = 0x80
+			},
+			message: "wMaxPacketSize of full-speed interrupt endpoint 0x81 of interface 0 alternate setting 0 of configuration 0 is 128, exceeding 64",
+		},
+		{
+			name: "Zero bInterval",
+			modify: func(device *rawDescriptorDevice) {
+				device.descriptors[0x0200][33] = 0
+			},
+			message: "bInterval of periodic endpoint 0x81",
+		},
+		{
+			name: "Missing string",
+			modify: func(device *rawDescriptorDevice) {
+				device.descriptors[0x0200][6] = 2
+			},
+			message: "string index 2 of iConfiguration of configuration 0 is not found",
+		},
+		{
+			name: "Missing LangIDs",
+			modify: func(device *rawDescriptorDevice) {
+				delete(device.descriptors, 0x0300)
+			},
+			message: "device has string indexes, but unable to get LangIDs",
+		},
+		{
+			name: "Device info vendor mismatch",
+			modify: func(device *rawDescriptorDevice) {
+				device.info.IDVendor = 0x4321
+			},
+			message: "device info vendor 0x4321",
+		},
+		{
+			name: "Device info configuration value mismatch",
+			modify: func(device *rawDescriptorDevice) {
+				device.info.BConfigurationValue = 2
+			},
+			message: "device info bConfigurationValue 2 does not match any configuration",
+		},
+		{
+			name: "Device info interface class mismatch",
+			modify: func(device *rawDescriptorDevice) {
+				device.info.Interfaces[0].BInterfaceClass = uint8(protocol.CLASS_VENDOR_SPECIFIC)
+			},
+			message: "device info interface 0 class ff/00/00 does not match interface descriptor 03/00/00",
+		},
+		{
+			name: "Interrupt wMaxPacketSize exceeds low-speed limit",
+			modify: func(device *rawDescriptorDevice) {
+				device.info.Speed = protocol.SPEED_USB1_LOW
+				device.descriptors[0x0100][7] = 8
+				device.descriptors[0x0200][31] = 0x40
+			},
+			message: "wMaxPacketSize of endpoint 0x81 of interface 0 alternate setting 0 of configuration 0 is 64, exceeding 8 of low-speed device",
+		},
+		{
+			name: "SuperSpeed endpoint without companion",
+			modify: func(device *rawDescriptorDevice) {
+				device.info.Speed = protocol.SPEED_USB3_SUPER
+				device.descriptors[0x0100][2] = 0x00
+				device.descriptors[0x0100][3] = 0x03
+				device.descriptors[0x0100][7] = 9
+			},
+			message: "of SuperSpeed device has no endpoint companion descriptor",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			device := newRawDescriptorDevice()
+			test.modify(device)
+
+			err := usb.ValidateDevice(context.Background(), device)
+			assert.ErrorIs(t, err, usb.ErrInvalidDevice)
+			assert.ErrorContains(t, err, test.message)
+		})
+	}
+}
+
+func TestRegistrarValidateDevices(t *testing.T) {
+	registrar := usb.NewDeviceRegistrar(usb.DeviceRegistrarConfig{
+		BusNum:          1,
+		MaxDeviceCount:  2,
+		ValidateDevices: true,
+	})
+
+	invalidDevice := newRawDescriptorDevice()
+	invalidDevice.info.IDProduct = 0x0000
+	err := registrar.Register(invalidDevice)
+	assert.ErrorIs(t, err, usb.ErrInvalidDevice)
+	assert.Empty(t, registrar.GetAvailableDevices())
+
+	validDevice := newTestStandardDevice(t)
+	require.NoError(t, registrar.Register(validDevice))
+	assert.Equal(t, []usb.Device{validDevice}, registrar.GetAvailableDevices())
+}
+
+// silentDevice never completes URBs submitted to it until their context is done
+type silentDevice struct {
+	*rawDescriptorDevice
+}
+
+func (d *silentDevice) ProcessAsync(ctx context.Context, data command.CmdSubmit, completer usb.URBCompleter) {
+	context.AfterFunc(ctx, func() {
+		completer(command.NewErrorRetSubmit(data, ctx.Err()))
+	})
+}
+
+func TestRegistrarValidateDevicesTimeout(t *testing.T) {
+	registrar := usb.NewDeviceRegistrar(usb.DeviceRegistrarConfig{
+		BusNum:            1,
+		MaxDeviceCount:    1,
+		ValidateDevices:   true,
+		ValidationTimeout: 10 * time.Millisecond,
+	})
+
+	err := registrar.Register(&silentDevice{rawDescriptorDevice: newRawDescriptorDevice()})
+	assert.ErrorIs(t, err, usb.ErrInvalidDevice)
+	assert.ErrorContains(t, err, context.DeadlineExceeded.Error())
+	assert.Empty(t, registrar.GetAvailableDevices())
+}
+
+// newSuperSpeedTestTree returns a SuperSpeed bulk device with its required BOS descriptor
+func newSuperSpeedTestTree() descriptor.Device {
+	return descriptor.Device{
+		Speed:          protocol.SPEED_USB3_SUPER,
+		BCDUSB:         0x0320,
+		BMaxPacketSize: descriptor.SUPERSPEED_MAX_PACKET_SIZE_0,
+		IDVendor:       0x1234,
+		IDProduct:      0x5678,
+		Manufacturer:   "Test",
+		Capabilities: []descriptor.DeviceCapability{
+			&descriptor.SuperSpeedUSBCapability{
+				BLength:            descriptor.SUPERSPEED_USB_CAPABILITY_LENGTH,
+				BDescriptorType:    descriptor.DESCRIPTOR_TYPE_DEVICE_CAPABILITY,
+				BDevCapabilityType: descriptor.DEVICE_CAPABILITY_TYPE_SUPERSPEED_USB,
+				WSpeedsSupported:   descriptor.SUPERSPEED_USB_SPEED_SUPER,
+			},
+		},
+		Configurations: []descriptor.Configuration{
+			{
+				BMAttributes: 0b10000000,
+				Interfaces: []descriptor.Interface{
+					{
+						AltSettings: []descriptor.AltSetting{
+							{
+								BInterfaceClass: protocol.CLASS_VENDOR_SPECIFIC,
+								Name:            "Bulk",
+								Endpoints: []descriptor.Endpoint{
+									{
+										BEndpointAddress:    0x81,
+										BMAttributes:        descriptor.ENDPOINT_TRANSFER_TYPE_BULK,
+										WMaxPacketSize:      descriptor.SUPERSPEED_MAX_PACKET_SIZE,
+										SuperSpeedCompanion: &descriptor.SuperSpeedCompanion{MaxBurst: 3},
+									},
+									{
+										BEndpointAddress:    0x01,
+										BMAttributes:        descriptor.ENDPOINT_TRANSFER_TYPE_BULK,
+										WMaxPacketSize:      descriptor.SUPERSPEED_MAX_PACKET_SIZE,
+										SuperSpeedCompanion: &descriptor.SuperSpeedCompanion{MaxBurst: 3},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
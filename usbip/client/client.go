@@ -0,0 +1,142 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+
+	usbprotocol "github.com/ntchjb/usbip-virtual-device/usb/protocol"
+	"github.com/ntchjb/usbip-virtual-device/usbip/protocol/op"
+	"github.com/ntchjb/usbip-virtual-device/usbip/stream"
+)
+
+var (
+	ErrImportFailed    = errors.New("USB/IP server rejected device import")
+	ErrUnexpectedReply = errors.New("unexpected reply from USB/IP server")
+)
+
+// USBIPClient is a client side of USB/IP protocol, which talks to USBIPServer directly via TCP,
+// without requiring vhci-hcd kernel module.
+type USBIPClient interface {
+	// GetDeviceList sends OP_REQ_DEVLIST and returns list of devices exported by the server
+	GetDeviceList() ([]op.DeviceInfo, error)
+	// Import sends OP_REQ_IMPORT to attach a device by given bus ID.
+	// The returned device holds the TCP connection until it is closed.
+	Import(busID usbprotocol.BusID) (Device, error)
+}
+
+type USBIPClientConfig struct {
+	// ServerAddress uses format of [ip:port] such as "127.0.0.1:3240"
+	ServerAddress string
+	// DialTimeout is maximum time waiting for TCP connection to be established, zero means no timeout
+	DialTimeout time.Duration
+}
+
+type usbIPClientImpl struct {
+	conf   USBIPClientConfig
+	logger *slog.Logger
+}
+
+// NewUSBIPClient returns an instance of USB/IP client.
+// Each operation opens its own TCP connection, as USB/IP server closes connection after OP_REP_DEVLIST.
+func NewUSBIPClient(config USBIPClientConfig, logger *slog.Logger) USBIPClient {
+	if logger == nil {
+		panic(fmt.Errorf("a logger instance required for USB/IP client"))
+	}
+	return &usbIPClientImpl{
+		conf:   config,
+		logger: logger,
+	}
+}
+
+func (c *usbIPClientImpl) dial() (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", c.conf.ServerAddress, c.conf.DialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to USB/IP server %s: %w", c.conf.ServerAddress, err)
+	}
+
+	return conn, nil
+}
+
+func (c *usbIPClientImpl) GetDeviceList() ([]op.DeviceInfo, error) {
+	conn, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	req := op.OpReqDevList{
+		OpHeader: op.OpHeader{
+			Version:            op.VERSION,
+			CommandOrReplyCode: op.OP_REQ_DEVLIST,
+			Status:             op.OP_STATUS_OK,
+		},
+	}
+	if err := req.OpHeader.Encode(conn); err != nil {
+		return nil, fmt.Errorf("unable to encode OpReqDevList: %w", err)
+	}
+
+	var reply op.OpRepDevList
+	reader := stream.NewBufferedReader(conn)
+	if err := reply.OpHeader.Decode(reader); err != nil {
+		return nil, fmt.Errorf("unable to decode OpHeader of OpRepDevList: %w", err)
+	}
+	if reply.CommandOrReplyCode != op.OP_REP_DEVLIST {
+		return nil, fmt.Errorf("%w: expected %x, got %x", ErrUnexpectedReply, op.OP_REP_DEVLIST, reply.CommandOrReplyCode)
+	}
+	if err := reply.Decode(reader); err != nil {
+		return nil, fmt.Errorf("unable to decode OpRepDevList: %w", err)
+	}
+
+	return reply.Devices, nil
+}
+
+func (c *usbIPClientImpl) Import(busID usbprotocol.BusID) (Device, error) {
+	conn, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+
+	req := op.OpReqImport{
+		OpHeader: op.OpHeader{
+			Version:            op.VERSION,
+			CommandOrReplyCode: op.OP_REQ_IMPORT,
+			Status:             op.OP_STATUS_OK,
+		},
+		BusID: busID,
+	}
+	if err := req.OpHeader.Encode(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("unable to encode OpHeader of OpReqImport: %w", err)
+	}
+	if err := req.Encode(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("unable to encode OpReqImport: %w", err)
+	}
+
+	// Read directly from connection, so that no data of URB replies is left in a read buffer
+	var reply op.OpRepImport
+	if err := reply.OpHeader.Decode(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("unable to decode OpHeader of OpRepImport: %w", err)
+	}
+	if reply.CommandOrReplyCode != op.OP_REP_IMPORT {
+		conn.Close()
+		return nil, fmt.Errorf("%w: expected %x, got %x", ErrUnexpectedReply, op.OP_REP_IMPORT, reply.CommandOrReplyCode)
+	}
+	// Server does not send device info when import failed
+	if reply.Status != op.OP_STATUS_OK {
+		conn.Close()
+		return nil, fmt.Errorf("%w: status %d", ErrImportFailed, reply.Status)
+	}
+	if err := reply.Decode(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("unable to decode OpRepImport: %w", err)
+	}
+
+	urbConn := NewURBConn(conn, reply.DeviceInfo, c.logger)
+
+	return NewDevice(urbConn, reply.DeviceInfo), nil
+}
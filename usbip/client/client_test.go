@@ -0,0 +1,354 @@
+package client_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ntchjb/usbip-virtual-device/usb"
+	usbprotocol "github.com/ntchjb/usbip-virtual-device/usb/protocol"
+	"github.com/ntchjb/usbip-virtual-device/usb/protocol/descriptor"
+	"github.com/ntchjb/usbip-virtual-device/usbip"
+	"github.com/ntchjb/usbip-virtual-device/usbip/client"
+	"github.com/ntchjb/usbip-virtual-device/usbip/protocol/command"
+	"github.com/ntchjb/usbip-virtual-device/usbip/protocol/op"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/mock/gomock"
+)
+
+var (
+	clientDeviceInfo = op.DeviceInfo{
+		DeviceInfoTruncated: op.DeviceInfoTruncated{
+			BusID:               usbprotocol.BusID{'1', '-', '1'},
+			BusNum:              1,
+			DevNum:              1,
+			Speed:               usbprotocol.SPEED_USB2_HIGH,
+			IDVendor:            0x1234,
+			IDProduct:           0x5678,
+			BCDDevice:           1,
+			BConfigurationValue: 1,
+			BNumConfigurations:  1,
+			BNumInterfaces:      1,
+		},
+		Interfaces: []op.DeviceInterface{
+			{
+				BInterfaceClass: usbprotocol.CLASS_VENDOR_SPECIFIC,
+			},
+		},
+	}
+	clientDeviceDescriptor = descriptor.StandardDeviceDescriptor{
+		BLength:            descriptor.STANDARD_DEVICE_DESCRIPTOR_LENGTH,
+		BDescriptorType:    descriptor.DESCRIPTOR_TYPE_DEVICE,
+		BCDUSB:             0x0200,
+		BMaxPacketSize:     64,
+		IDVendor:           0x1234,
+		IDProduct:          0x5678,
+		BCDDevice:          1,
+		BNumConfigurations: 1,
+	}
+	clientConfigurationDescriptor = []byte{
+		0x09, 0x02, 0x19, 0x00, 0x01, 0x01, 0x00, 0x80, 0x32,
+		0x09, 0x04, 0x00, 0x00, 0x01, 0xff, 0x00, 0x00, 0x00,
+		0x07, 0x05, 0x81, 0x02, 0x00, 0x02, 0x00,
+	}
+)
+
+// startServer starts USB/IP server at a free local port and returns its address
+func startServer(t *testing.T, device usb.Device) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	address := listener.Addr().String()
+	require.NoError(t, listener.Close())
+
+	registrar := usb.NewDeviceRegistrar(usb.DeviceRegistrarConfig{
+		BusNum:         1,
+		MaxDeviceCount: 1,
+	})
+	require.NoError(t, registrar.Register(device))
+
+	server := usbip.NewUSBIPServer(usbip.USBIPServerConfig{
+		ListenAddress:    address,
+		MaxTCPConnection: 2,
+	}, registrar, slog.Default())
+	require.NoError(t, server.Open())
+	t.Cleanup(func() {
+		server.Close()
+	})
+
+	return address
+}
+
+func newMockDevice(ctrl *gomock.Controller) *usb.MockDevice {
+	device := usb.NewMockDevice(ctrl)
+	device.EXPECT().SetBusID(uint(1), uint(1)).Return()
+	device.EXPECT().GetBusID().Return(clientDeviceInfo.BusID).AnyTimes()
+	device.EXPECT().GetDeviceInfo().Return(clientDeviceInfo).AnyTimes()
+	device.EXPECT().GetWorkerPoolProfile().Return(usb.WorkerPoolProfile{
+		MaximumProcWorkers:        2,
+		MaximumReplyWorkers:       1,
+		MaximumUnlinkReplyWorkers: 1,
+	}).AnyTimes()
+
+	return device
+}
+
+func TestClientDeviceList(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	device := newMockDevice(ctrl)
+	address := startServer(t, device)
+
+	c := client.NewUSBIPClient(client.USBIPClientConfig{
+		ServerAddress: address,
+		DialTimeout:   time.Second,
+	}, slog.Default())
+
+	devices, err := c.GetDeviceList()
+	assert.NoError(t, err)
+	assert.Equal(t, []op.DeviceInfo{clientDeviceInfo}, devices)
+
+	_, err = c.Import(usbprotocol.BusID{'9', '-', '9'})
+	assert.ErrorIs(t, err, client.ErrImportFailed)
+}
+
+func TestClientTransfers(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	device := newMockDevice(ctrl)
+	address := startServer(t, device)
+
+	device.EXPECT().Process(gomock.Any(), gomock.Any()).DoAndReturn(func(_ context.Context, cmd command.CmdSubmit) command.RetSubmit {
+		ret := command.RetSubmit{
+			CmdHeader: command.CmdHeader{
+				Command: command.RET_SUBMIT,
+				SeqNum:  cmd.SeqNum,
+			},
+		}
+		switch {
+		case cmd.EndpointNumber == 0:
+			var setup usbprotocol.SetupPacket
+			if err := setup.Decode(bytes.NewBuffer(cmd.Setup[:])); err != nil {
+				ret.Status = command.URB_STATUS_STALL
+				return ret
+			}
+			descriptorType, _ := descriptor.GetDescriptorTypeAndIndex(setup.WValue)
+			if setup.BRequest != usbprotocol.REQUEST_GET_DESCRIPTOR {
+				ret.Status = command.URB_STATUS_STALL
+				return ret
+			}
+			buf := new(bytes.Buffer)
+			switch descriptorType {
+			case descriptor.DESCRIPTOR_TYPE_DEVICE:
+				if err := clientDeviceDescriptor.Encode(buf); err != nil {
+					ret.Status = command.URB_STATUS_STALL
+					return ret
+				}
+			case descriptor.DESCRIPTOR_TYPE_CONFIGURATION:
+				buf.Write(clientConfigurationDescriptor)
+			default:
+				ret.Status = command.URB_STATUS_STALL
+				return ret
+			}
+			ret.TransferBuffer = buf.Bytes()[:min(int(cmd.TransferBufferLength), buf.Len())]
+		case cmd.Direction == command.DIR_IN:
+			ret.TransferBuffer = []byte("hello")
+		default:
+			// Bulk OUT accepts only 3 bytes
+			ret.ActualLength = 3
+			return ret
+		}
+		ret.ActualLength = uint32(len(ret.TransferBuffer))
+
+		return ret
+	}).AnyTimes()
+
+	c := client.NewUSBIPClient(client.USBIPClientConfig{
+		ServerAddress: address,
+		DialTimeout:   time.Second,
+	}, slog.Default())
+
+	dev, err := c.Import(clientDeviceInfo.BusID)
+	require.NoError(t, err)
+	defer dev.Close()
+	assert.Equal(t, clientDeviceInfo.DeviceInfoTruncated, dev.GetDeviceInfo())
+
+	ctx := context.Background()
+	deviceDescriptor, err := dev.GetDeviceDescriptor(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, clientDeviceDescriptor, deviceDescriptor)
+
+	config, err := dev.GetConfiguration(ctx, 0)
+	require.NoError(t, err)
+	require.Len(t, config.AltSettings, 1)
+	require.Len(t, config.AltSettings[0].Endpoints, 1)
+	assert.Equal(t, uint16(512), config.AltSettings[0].Endpoints[0].Descriptor.WMaxPacketSize)
+
+	_, err = dev.GetDescriptor(ctx, descriptor.DESCRIPTOR_TYPE_STRING, 0, 0, 255)
+	assert.ErrorIs(t, err, client.ErrURBFailed)
+	assert.ErrorIs(t, err, command.URB_STATUS_STALL)
+
+	data, err := dev.BulkIn(ctx, 1, 64)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("hello"), data)
+
+	n, err := dev.BulkOut(ctx, 2, []byte{0x01, 0x02, 0x03, 0x04})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+}
+
+func TestClientUnlink(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	device := newMockDevice(ctrl)
+	address := startServer(t, device)
+
+	// Device waits for data that never comes, until the URB is unlinked
+	device.EXPECT().Process(gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, cmd command.CmdSubmit) command.RetSubmit {
+		<-ctx.Done()
+		return command.RetSubmit{
+			CmdHeader: command.CmdHeader{
+				Command: command.RET_SUBMIT,
+				SeqNum:  cmd.SeqNum,
+			},
+		}
+	}).AnyTimes()
+
+	c := client.NewUSBIPClient(client.USBIPClientConfig{
+		ServerAddress: address,
+		DialTimeout:   time.Second,
+	}, slog.Default())
+
+	dev, err := c.Import(clientDeviceInfo.BusID)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = dev.InterruptIn(ctx, 1, 8, 10)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	urb, err := dev.GetURBConn().SubmitAsync(command.CmdSubmit{
+		CmdHeader: command.CmdHeader{
+			Direction:      command.DIR_IN,
+			EndpointNumber: 1,
+		},
+		TransferBufferLength: 8,
+		NumberOfPackets:      client.NON_ISO_NUMBER_OF_PACKETS,
+	})
+	require.NoError(t, err)
+
+	assert.NoError(t, dev.Close())
+	_, err = urb.Result()
+	assert.ErrorIs(t, err, client.ErrConnectionClosed)
+
+	_, err = dev.BulkIn(context.Background(), 1, 8)
+	assert.ErrorIs(t, err, client.ErrConnectionClosed)
+}
+
+// fakeURBServer receives commands sent by URBConn, which are replied by test
+type fakeURBServer struct {
+	conn    net.Conn
+	submits chan command.CmdSubmit
+	unlinks chan command.CmdUnlink
+}
+
+func newFakeURBServer(t *testing.T) (*fakeURBServer, client.URBConn) {
+	clientConn, serverConn := net.Pipe()
+	server := &fakeURBServer{
+		conn:    serverConn,
+		submits: make(chan command.CmdSubmit, 4),
+		unlinks: make(chan command.CmdUnlink, 4),
+	}
+	go func() {
+		for {
+			var header command.CmdHeader
+			if err := header.Decode(serverConn); err != nil {
+				return
+			}
+			switch header.Command {
+			case command.CMD_SUBMIT:
+				cmd := command.CmdSubmit{CmdHeader: header}
+				if err := cmd.Decode(serverConn); err != nil {
+					return
+				}
+				server.submits <- cmd
+			case command.CMD_UNLINK:
+				cmd := command.CmdUnlink{CmdHeader: header}
+				if err := cmd.Decode(serverConn); err != nil {
+					return
+				}
+				server.unlinks <- cmd
+			}
+		}
+	}()
+
+	conn := client.NewURBConn(clientConn, clientDeviceInfo.DeviceInfoTruncated, slog.Default())
+	t.Cleanup(func() {
+		conn.Close()
+		serverConn.Close()
+	})
+
+	return server, conn
+}
+
+func (s *fakeURBServer) reply(t *testing.T, header command.CmdHeader, body interface{ Encode(io.Writer) error }) {
+	buf := new(bytes.Buffer)
+	assert.NoError(t, header.Encode(buf))
+	assert.NoError(t, body.Encode(buf))
+	_, err := s.conn.Write(buf.Bytes())
+	assert.NoError(t, err)
+}
+
+func TestURBConnSubmitUnlinkTimeout(t *testing.T) {
+	server, conn := newFakeURBServer(t)
+	cmd := command.CmdSubmit{
+		CmdHeader: command.CmdHeader{
+			Direction:      command.DIR_IN,
+			EndpointNumber: 1,
+		},
+		TransferBufferLength: 8,
+		NumberOfPackets:      client.NON_ISO_NUMBER_OF_PACKETS,
+	}
+
+	// Server replies RetUnlink with status 0, but RetSubmit is not received in time
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	result := make(chan error, 1)
+	start := time.Now()
+	go func() {
+		_, err := conn.Submit(ctx, cmd)
+		result <- err
+	}()
+	submit := <-server.submits
+	unlink := <-server.unlinks
+	assert.Equal(t, submit.SeqNum, unlink.UnlinkSeqNum)
+	ret := command.RetUnlink{
+		CmdHeader: command.CmdHeader{
+			Command: command.RET_UNLINK,
+			SeqNum:  unlink.SeqNum,
+		},
+	}
+	server.reply(t, ret.CmdHeader, &ret)
+	select {
+	case err := <-result:
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.GreaterOrEqual(t, time.Since(start), client.UNLINK_TIMEOUT)
+	case <-time.After(client.UNLINK_TIMEOUT + 5*time.Second):
+		t.Fatal("Submit is not returned after unlink timeout")
+	}
+
+	// RetSubmit arriving later is dropped, without breaking the connection
+	lateRet := command.NewSuccessRetSubmit(submit, []byte{0x01})
+	server.reply(t, lateRet.CmdHeader, &lateRet)
+	go func() {
+		submit := <-server.submits
+		ret := command.NewSuccessRetSubmit(submit, []byte{0x02})
+		server.reply(t, ret.CmdHeader, &ret)
+	}()
+	submitCtx, submitCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer submitCancel()
+	urbRet, err := conn.Submit(submitCtx, cmd)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x02}, urbRet.TransferBuffer)
+}
@@ -0,0 +1,339 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"unicode/utf16"
+
+	usbprotocol "github.com/ntchjb/usbip-virtual-device/usb/protocol"
+	"github.com/ntchjb/usbip-virtual-device/usb/protocol/descriptor"
+	"github.com/ntchjb/usbip-virtual-device/usb/protocol/parser"
+	"github.com/ntchjb/usbip-virtual-device/usbip/protocol/command"
+	"github.com/ntchjb/usbip-virtual-device/usbip/protocol/op"
+)
+
+var (
+	ErrURBFailed = errors.New("URB completed with error status")
+)
+
+const (
+	// NumberOfPackets value used by non-ISO transfers
+	NON_ISO_NUMBER_OF_PACKETS uint32 = 0xffffffff
+)
+
+// Device is a handle of an imported USB device, used for sending transfers to the device
+type Device interface {
+	// GetDeviceInfo returns device information replied by OP_REP_IMPORT
+	GetDeviceInfo() op.DeviceInfoTruncated
+	// GetURBConn returns underlying URB connection for sending raw URBs
+	GetURBConn() URBConn
+	// Control sends a control transfer to endpoint 0.
+	// For OUT transfer, data length must equal to setup's wLength. For IN transfer, data is ignored.
+	Control(ctx context.Context, setup usbprotocol.SetupPacket, data []byte) ([]byte, error)
+	// BulkIn receives data from bulk IN endpoint, up to given length
+	BulkIn(ctx context.Context, endpoint uint8, length uint32) ([]byte, error)
+	// BulkOut sends data to bulk OUT endpoint and returns number of bytes transferred
+	BulkOut(ctx context.Context, endpoint uint8, data []byte) (int, error)
+	// InterruptIn receives data from interrupt IN endpoint, up to given length
+	InterruptIn(ctx context.Context, endpoint uint8, length uint32, interval uint32) ([]byte, error)
+	// InterruptOut sends data to interrupt OUT endpoint and returns number of bytes transferred
+	InterruptOut(ctx context.Context, endpoint uint8, data []byte, interval uint32) (int, error)
+	// ISOIn receives isochronous packets with given expected lengths. Returned RetSubmit contains
+	// the received data of all packets, with per-packet result in ISOPacketDescriptors.
+	ISOIn(ctx context.Context, endpoint uint8, packetLengths []uint32, interval uint32) (command.RetSubmit, error)
+	// ISOOut sends given packets to isochronous OUT endpoint.
+	ISOOut(ctx context.Context, endpoint uint8, packets [][]byte, interval uint32) (command.RetSubmit, error)
+	// GetDescriptor sends standard GET_DESCRIPTOR request to the device
+	GetDescriptor(ctx context.Context, descriptorType descriptor.DescriptorType, index uint8, langID uint16, length uint16) ([]byte, error)
+	// GetDeviceDescriptor returns standard device descriptor of the device
+	GetDeviceDescriptor(ctx context.Context) (descriptor.StandardDeviceDescriptor, error)
+	// GetConfigurationDescriptor returns whole configuration descriptor by given index,
+	// including all interface, endpoint, and class-specific descriptors.
+	GetConfigurationDescriptor(ctx context.Context, index uint8) ([]byte, error)
+	// GetConfiguration returns whole configuration descriptor by given index, parsed into descriptor tree
+	GetConfiguration(ctx context.Context, index uint8) (*parser.Configuration, error)
+	// GetStringDescriptor returns content of string descriptor by given index and language ID
+	GetStringDescriptor(ctx context.Context, index uint8, langID uint16) (string, error)
+	// Close detaches the device by closing its connection
+	Close() error
+}
+
+type deviceImpl struct {
+	conn       URBConn
+	deviceInfo op.DeviceInfoTruncated
+}
+
+// NewDevice returns a handle of imported device using given URB connection
+func NewDevice(conn URBConn, deviceInfo op.DeviceInfoTruncated) Device {
+	return &deviceImpl{
+		conn:       conn,
+		deviceInfo: deviceInfo,
+	}
+}
+
+func (d *deviceImpl) GetDeviceInfo() op.DeviceInfoTruncated {
+	return d.deviceInfo
+}
+
+func (d *deviceImpl) GetURBConn() URBConn {
+	return d.conn
+}
+
+// submit sends URB and converts non-zero status to error
+func (d *deviceImpl) submit(ctx context.Context, cmd command.CmdSubmit) (command.RetSubmit, error) {
+	ret, err := d.conn.Submit(ctx, cmd)
+	if err != nil {
+		return ret, err
+	}
+	if ret.Status != command.URB_STATUS_OK {
+		return ret, fmt.Errorf("%w: %w, seqNum %d", ErrURBFailed, ret.Status, ret.SeqNum)
+	}
+
+	return ret, nil
+}
+
+func (d *deviceImpl) Control(ctx context.Context, setup usbprotocol.SetupPacket, data []byte) ([]byte, error) {
+	cmd := command.CmdSubmit{
+		CmdHeader: command.CmdHeader{
+			EndpointNumber: 0,
+		},
+		TransferBufferLength: uint32(setup.WLength),
+		NumberOfPackets:      NON_ISO_NUMBER_OF_PACKETS,
+	}
+	if setup.BMRequestType.Direction() == usbprotocol.SETUP_DATA_DIRECTION_IN {
+		cmd.Direction = command.DIR_IN
+	} else {
+		if len(data) != int(setup.WLength) {
+			return nil, fmt.Errorf("data length does not match wLength, expected %d, actual %d", setup.WLength, len(data))
+		}
+		cmd.Direction = command.DIR_OUT
+		cmd.TransferBuffer = data
+	}
+
+	setupBuf := new(bytes.Buffer)
+	if err := setup.Encode(setupBuf); err != nil {
+		return nil, fmt.Errorf("unable to encode SetupPacket: %w", err)
+	}
+	copy(cmd.Setup[:], setupBuf.Bytes())
+
+	ret, err := d.submit(ctx, cmd)
+	if err != nil {
+		return nil, fmt.Errorf("unable to submit control transfer: %w", err)
+	}
+
+	return ret.TransferBuffer, nil
+}
+
+func (d *deviceImpl) transferIn(ctx context.Context, endpoint uint8, length uint32, interval uint32) ([]byte, error) {
+	ret, err := d.submit(ctx, command.CmdSubmit{
+		CmdHeader: command.CmdHeader{
+			Direction:      command.DIR_IN,
+			EndpointNumber: uint32(endpoint),
+		},
+		TransferBufferLength: length,
+		NumberOfPackets:      NON_ISO_NUMBER_OF_PACKETS,
+		Interval:             interval,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ret.TransferBuffer, nil
+}
+
+func (d *deviceImpl) transferOut(ctx context.Context, endpoint uint8, data []byte, interval uint32) (int, error) {
+	ret, err := d.submit(ctx, command.CmdSubmit{
+		CmdHeader: command.CmdHeader{
+			Direction:      command.DIR_OUT,
+			EndpointNumber: uint32(endpoint),
+		},
+		TransferBufferLength: uint32(len(data)),
+		NumberOfPackets:      NON_ISO_NUMBER_OF_PACKETS,
+		Interval:             interval,
+		TransferBuffer:       data,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return int(ret.ActualLength), nil
+}
+
+func (d *deviceImpl) BulkIn(ctx context.Context, endpoint uint8, length uint32) ([]byte, error) {
+	data, err := d.transferIn(ctx, endpoint, length, 0)
+	if err != nil {
+		return nil, fmt.Errorf("unable to submit bulk IN transfer: %w", err)
+	}
+
+	return data, nil
+}
+
+func (d *deviceImpl) BulkOut(ctx context.Context, endpoint uint8, data []byte) (int, error) {
+	n, err := d.transferOut(ctx, endpoint, data, 0)
+	if err != nil {
+		return n, fmt.Errorf("unable to submit bulk OUT transfer: %w", err)
+	}
+
+	return n, nil
+}
+
+func (d *deviceImpl) InterruptIn(ctx context.Context, endpoint uint8, length uint32, interval uint32) ([]byte, error) {
+	data, err := d.transferIn(ctx, endpoint, length, interval)
+	if err != nil {
+		return nil, fmt.Errorf("unable to submit interrupt IN transfer: %w", err)
+	}
+
+	return data, nil
+}
+
+func (d *deviceImpl) InterruptOut(ctx context.Context, endpoint uint8, data []byte, interval uint32) (int, error) {
+	n, err := d.transferOut(ctx, endpoint, data, interval)
+	if err != nil {
+		return n, fmt.Errorf("unable to submit interrupt OUT transfer: %w", err)
+	}
+
+	return n, nil
+}
+
+func (d *deviceImpl) ISOIn(ctx context.Context, endpoint uint8, packetLengths []uint32, interval uint32) (command.RetSubmit, error) {
+	cmd := command.CmdSubmit{
+		CmdHeader: command.CmdHeader{
+			Direction:      command.DIR_IN,
+			EndpointNumber: uint32(endpoint),
+		},
+		NumberOfPackets:      uint32(len(packetLengths)),
+		Interval:             interval,
+		ISOPacketDescriptors: make([]command.ISOPacketDescriptor, len(packetLengths)),
+	}
+	for i, length := range packetLengths {
+		cmd.ISOPacketDescriptors[i].Offset = cmd.TransferBufferLength
+		cmd.ISOPacketDescriptors[i].ExpectedLength = length
+		cmd.TransferBufferLength += length
+	}
+
+	ret, err := d.submit(ctx, cmd)
+	if err != nil {
+		return ret, fmt.Errorf("unable to submit ISO IN transfer: %w", err)
+	}
+
+	return ret, nil
+}
+
+func (d *deviceImpl) ISOOut(ctx context.Context, endpoint uint8, packets [][]byte, interval uint32) (command.RetSubmit, error) {
+	cmd := command.CmdSubmit{
+		CmdHeader: command.CmdHeader{
+			Direction:      command.DIR_OUT,
+			EndpointNumber: uint32(endpoint),
+		},
+		NumberOfPackets:      uint32(len(packets)),
+		Interval:             interval,
+		ISOPacketDescriptors: make([]command.ISOPacketDescriptor, len(packets)),
+	}
+	for i, packet := range packets {
+		cmd.ISOPacketDescriptors[i].Offset = cmd.TransferBufferLength
+		cmd.ISOPacketDescriptors[i].ExpectedLength = uint32(len(packet))
+		cmd.TransferBufferLength += uint32(len(packet))
+		cmd.TransferBuffer = append(cmd.TransferBuffer, packet...)
+	}
+
+	ret, err := d.submit(ctx, cmd)
+	if err != nil {
+		return ret, fmt.Errorf("unable to submit ISO OUT transfer: %w", err)
+	}
+
+	return ret, nil
+}
+
+func (d *deviceImpl) GetDescriptor(ctx context.Context, descriptorType descriptor.DescriptorType, index uint8, langID uint16, length uint16) ([]byte, error) {
+	var requestType usbprotocol.SetupRequestType
+	requestType.SetDirection(usbprotocol.SETUP_DATA_DIRECTION_IN)
+	requestType.SetType(usbprotocol.SETUP_DATA_TYPE_STANDARD)
+	requestType.SetRecipient(usbprotocol.SETUP_RECIPIENT_DEVICE)
+
+	data, err := d.Control(ctx, usbprotocol.SetupPacket{
+		BMRequestType: requestType,
+		BRequest:      usbprotocol.REQUEST_GET_DESCRIPTOR,
+		WValue:        uint16(descriptorType)<<8 | uint16(index),
+		WIndex:        langID,
+		WLength:       length,
+	}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get descriptor type %d, index %d: %w", descriptorType, index, err)
+	}
+
+	return data, nil
+}
+
+func (d *deviceImpl) GetDeviceDescriptor(ctx context.Context) (descriptor.StandardDeviceDescriptor, error) {
+	var desc descriptor.StandardDeviceDescriptor
+	data, err := d.GetDescriptor(ctx, descriptor.DESCRIPTOR_TYPE_DEVICE, 0, 0, descriptor.STANDARD_DEVICE_DESCRIPTOR_LENGTH)
+	if err != nil {
+		return desc, err
+	}
+	if err := desc.Decode(bytes.NewBuffer(data)); err != nil {
+		return desc, fmt.Errorf("unable to decode standard device descriptor: %w", err)
+	}
+
+	return desc, nil
+}
+
+func (d *deviceImpl) GetConfigurationDescriptor(ctx context.Context, index uint8) ([]byte, error) {
+	// Read configuration descriptor first to learn total length of the whole configuration
+	data, err := d.GetDescriptor(ctx, descriptor.DESCRIPTOR_TYPE_CONFIGURATION, index, 0, descriptor.STANDARD_CONFIGURATION_DESCRIPTOR_LENGTH)
+	if err != nil {
+		return nil, err
+	}
+	var desc descriptor.StandardConfigurationDescriptor
+	if err := desc.Decode(bytes.NewBuffer(data)); err != nil {
+		return nil, fmt.Errorf("unable to decode standard configuration descriptor: %w", err)
+	}
+
+	data, err = d.GetDescriptor(ctx, descriptor.DESCRIPTOR_TYPE_CONFIGURATION, index, 0, desc.WTotalLength)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != int(desc.WTotalLength) {
+		return nil, fmt.Errorf("configuration descriptor length does not match wTotalLength, expected %d, actual %d", desc.WTotalLength, len(data))
+	}
+
+	return data, nil
+}
+
+func (d *deviceImpl) GetConfiguration(ctx context.Context, index uint8) (*parser.Configuration, error) {
+	data, err := d.GetConfigurationDescriptor(ctx, index)
+	if err != nil {
+		return nil, err
+	}
+	config, err := parser.ParseConfiguration(data)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse configuration descriptor: %w", err)
+	}
+
+	return config, nil
+}
+
+func (d *deviceImpl) GetStringDescriptor(ctx context.Context, index uint8, langID uint16) (string, error) {
+	// Maximum length of a descriptor is 255 bytes, as bLength is a byte
+	data, err := d.GetDescriptor(ctx, descriptor.DESCRIPTOR_TYPE_STRING, index, langID, 255)
+	if err != nil {
+		return "", err
+	}
+	if len(data) < 2 || data[0] < 2 || int(data[0]) > len(data) {
+		return "", fmt.Errorf("invalid string descriptor: %x", data)
+	}
+	var desc descriptor.StringDescriptor
+	if err := desc.Decode(bytes.NewBuffer(data)); err != nil {
+		return "", fmt.Errorf("unable to decode string descriptor: %w", err)
+	}
+	if desc.BDescriptorType != descriptor.DESCRIPTOR_TYPE_STRING {
+		return "", fmt.Errorf("invalid string descriptor type: %d", desc.BDescriptorType)
+	}
+
+	return string(utf16.Decode(desc.Content)), nil
+}
+
+func (d *deviceImpl) Close() error {
+	return d.conn.Close()
+}
@@ -0,0 +1,354 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/ntchjb/usbip-virtual-device/usbip/protocol/command"
+	"github.com/ntchjb/usbip-virtual-device/usbip/protocol/op"
+	"github.com/ntchjb/usbip-virtual-device/usbip/stream"
+)
+
+const (
+	// Maximum time Submit waits for the URB to be unlinked after its context is done
+	UNLINK_TIMEOUT = time.Second
+)
+
+var (
+	ErrConnectionClosed = errors.New("USB/IP connection closed")
+	ErrURBUnlinked      = errors.New("URB is unlinked")
+)
+
+// URBConn sends URBs of an imported device to USB/IP server and receives their replies.
+type URBConn interface {
+	// Submit sends CmdSubmit and waits for RetSubmit.
+	// SeqNum and DevID are assigned by URBConn.
+	// If ctx is done before the reply is received, the URB is unlinked within UNLINK_TIMEOUT and ctx error is returned.
+	Submit(ctx context.Context, cmd command.CmdSubmit) (command.RetSubmit, error)
+	// SubmitAsync sends CmdSubmit and returns immediately with a pending URB.
+	SubmitAsync(cmd command.CmdSubmit) (*PendingURB, error)
+	// Unlink sends CmdUnlink for the URB with given sequence number and waits for RetUnlink.
+	Unlink(ctx context.Context, seqNum uint32) (command.RetUnlink, error)
+	// Close closes underlying connection. All pending URBs are failed with ErrConnectionClosed.
+	Close() error
+}
+
+// PendingURB is a submitted URB waiting for its RetSubmit
+type PendingURB struct {
+	cmd        command.CmdSubmit
+	done       chan struct{}
+	finishOnce sync.Once
+	ret        command.RetSubmit
+	err        error
+}
+
+// SeqNum returns sequence number assigned to this URB
+func (p *PendingURB) SeqNum() uint32 {
+	return p.cmd.SeqNum
+}
+
+// Done returns a channel that is closed when the URB is completed, unlinked, or connection is closed
+func (p *PendingURB) Done() <-chan struct{} {
+	return p.done
+}
+
+// Result returns RetSubmit of this URB. It should be called after Done is closed.
+func (p *PendingURB) Result() (command.RetSubmit, error) {
+	<-p.done
+	return p.ret, p.err
+}
+
+// finish sets result of the URB and wakes up its waiters, only the first call takes effect
+func (p *PendingURB) finish(ret command.RetSubmit, err error) {
+	p.finishOnce.Do(func() {
+		p.ret = ret
+		p.err = err
+		close(p.done)
+	})
+}
+
+type urbConnImpl struct {
+	conn io.ReadWriteCloser
+	// reader is a buffered reader of conn, all reads must be done via this reader
+	reader io.Reader
+	logger *slog.Logger
+	devID  uint32
+
+	writeLock sync.Mutex
+
+	lock       sync.Mutex
+	lastSeqNum uint32
+	pending    map[uint32]*PendingURB
+	unlinks    map[uint32]chan command.RetUnlink
+	closed     chan struct{}
+	closeErr   error
+	closeOnce  sync.Once
+	readerDone chan struct{}
+}
+
+// NewURBConn returns URBConn which uses given connection, which is already imported via OP_REQ_IMPORT.
+// A goroutine is started to receive replies from the connection until it is closed.
+func NewURBConn(conn io.ReadWriteCloser, deviceInfo op.DeviceInfoTruncated, logger *slog.Logger) URBConn {
+	c := &urbConnImpl{
+		conn:       conn,
+		reader:     stream.NewBufferedReader(conn),
+		logger:     logger,
+		devID:      deviceInfo.BusNum<<16 | deviceInfo.DevNum,
+		pending:    make(map[uint32]*PendingURB),
+		unlinks:    make(map[uint32]chan command.RetUnlink),
+		closed:     make(chan struct{}),
+		readerDone: make(chan struct{}),
+	}
+	go c.receive()
+
+	return c
+}
+
+func (c *urbConnImpl) nextSeqNum() uint32 {
+	c.lastSeqNum++
+	// Sequence number 0 is never used
+	if c.lastSeqNum == 0 {
+		c.lastSeqNum++
+	}
+
+	return c.lastSeqNum
+}
+
+// write encodes header and body to buffer first to make it atomic
+func (c *urbConnImpl) write(header command.CmdHeader, body interface{ Encode(io.Writer) error }) error {
+	buf := new(bytes.Buffer)
+	if err := header.Encode(buf); err != nil {
+		return fmt.Errorf("unable to encode CmdHeader: %w", err)
+	}
+	if err := body.Encode(buf); err != nil {
+		return fmt.Errorf("unable to encode command: %w", err)
+	}
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	if err := stream.Write(c.conn, buf.Bytes()); err != nil {
+		return fmt.Errorf("unable to write command to stream: %w", err)
+	}
+
+	return nil
+}
+
+func (c *urbConnImpl) SubmitAsync(cmd command.CmdSubmit) (*PendingURB, error) {
+	c.lock.Lock()
+	select {
+	case <-c.closed:
+		c.lock.Unlock()
+		return nil, ErrConnectionClosed
+	default:
+	}
+	cmd.Command = command.CMD_SUBMIT
+	cmd.SeqNum = c.nextSeqNum()
+	cmd.DevID = c.devID
+	urb := &PendingURB{
+		cmd:  cmd,
+		done: make(chan struct{}),
+	}
+	c.pending[cmd.SeqNum] = urb
+	c.lock.Unlock()
+
+	if err := c.write(cmd.CmdHeader, &cmd); err != nil {
+		c.complete(cmd.SeqNum, command.RetSubmit{}, err)
+		return nil, fmt.Errorf("unable to send CmdSubmit: %w", err)
+	}
+
+	return urb, nil
+}
+
+func (c *urbConnImpl) Submit(ctx context.Context, cmd command.CmdSubmit) (command.RetSubmit, error) {
+	urb, err := c.SubmitAsync(cmd)
+	if err != nil {
+		return command.RetSubmit{}, err
+	}
+
+	select {
+	case <-urb.Done():
+		return urb.Result()
+	case <-ctx.Done():
+	}
+
+	// The given context is already done, so unlinking has its own timeout
+	unlinkCtx, cancel := context.WithTimeout(context.Background(), UNLINK_TIMEOUT)
+	defer cancel()
+	ret, err := c.Unlink(unlinkCtx, urb.SeqNum())
+	if err != nil {
+		c.abandon(urb.SeqNum(), ctx.Err())
+		return command.RetSubmit{}, fmt.Errorf("unable to unlink URB after %w: %w", ctx.Err(), err)
+	}
+	// If the URB is already completed before unlinking, RetSubmit is still delivered.
+	if ret.Status != command.URB_STATUS_UNLINKED {
+		select {
+		case <-urb.Done():
+		case <-unlinkCtx.Done():
+			c.abandon(urb.SeqNum(), ctx.Err())
+		}
+	}
+	if ret, err := urb.Result(); err == nil {
+		return ret, nil
+	}
+
+	return command.RetSubmit{}, ctx.Err()
+}
+
+func (c *urbConnImpl) Unlink(ctx context.Context, seqNum uint32) (command.RetUnlink, error) {
+	cmd := command.CmdUnlink{
+		CmdHeader: command.CmdHeader{
+			Command: command.CMD_UNLINK,
+			DevID:   c.devID,
+		},
+		UnlinkSeqNum: seqNum,
+	}
+	reply := make(chan command.RetUnlink, 1)
+
+	c.lock.Lock()
+	select {
+	case <-c.closed:
+		c.lock.Unlock()
+		return command.RetUnlink{}, ErrConnectionClosed
+	default:
+	}
+	cmd.SeqNum = c.nextSeqNum()
+	c.unlinks[cmd.SeqNum] = reply
+	c.lock.Unlock()
+
+	if err := c.write(cmd.CmdHeader, &cmd); err != nil {
+		c.lock.Lock()
+		delete(c.unlinks, cmd.SeqNum)
+		c.lock.Unlock()
+		return command.RetUnlink{}, fmt.Errorf("unable to send CmdUnlink: %w", err)
+	}
+
+	select {
+	case ret := <-reply:
+		// Server does not send RetSubmit for the URB that is successfully unlinked
+		if ret.Status == command.URB_STATUS_UNLINKED {
+			c.complete(seqNum, command.RetSubmit{}, ErrURBUnlinked)
+		}
+		return ret, nil
+	case <-c.closed:
+		return command.RetUnlink{}, ErrConnectionClosed
+	case <-ctx.Done():
+		c.lock.Lock()
+		delete(c.unlinks, cmd.SeqNum)
+		c.lock.Unlock()
+		return command.RetUnlink{}, ctx.Err()
+	}
+}
+
+// complete removes URB from pending list and wakes up its waiters
+func (c *urbConnImpl) complete(seqNum uint32, ret command.RetSubmit, err error) {
+	c.lock.Lock()
+	urb, ok := c.pending[seqNum]
+	delete(c.pending, seqNum)
+	c.lock.Unlock()
+
+	if ok {
+		urb.finish(ret, err)
+	}
+}
+
+// abandon wakes up waiters of URB with err. The URB stays in pending list,
+// so that its RetSubmit arriving later is still decoded and dropped.
+func (c *urbConnImpl) abandon(seqNum uint32, err error) {
+	c.lock.Lock()
+	urb, ok := c.pending[seqNum]
+	c.lock.Unlock()
+
+	if ok {
+		urb.finish(command.RetSubmit{}, err)
+	}
+}
+
+func (c *urbConnImpl) receive() {
+	defer close(c.readerDone)
+
+	for {
+		var header command.CmdHeader
+		if err := header.Decode(c.reader); err != nil {
+			c.shutdown(fmt.Errorf("unable to decode CmdHeader: %w", err))
+			return
+		}
+
+		switch header.Command {
+		case command.RET_SUBMIT:
+			c.lock.Lock()
+			urb, ok := c.pending[header.SeqNum]
+			c.lock.Unlock()
+			if !ok {
+				// Without the original URB, the length of transfer buffer is unknown
+				c.shutdown(fmt.Errorf("%w: RetSubmit for unknown seqNum %d", ErrUnexpectedReply, header.SeqNum))
+				return
+			}
+
+			ret := command.RetSubmit{
+				CmdHeader: header,
+			}
+			// Server always replies with direction 0, so direction of the URB is used for decoding
+			ret.Direction = urb.cmd.Direction
+			if err := ret.Decode(c.reader); err != nil {
+				c.shutdown(fmt.Errorf("unable to decode RetSubmit: %w", err))
+				return
+			}
+			c.complete(header.SeqNum, ret, nil)
+		case command.RET_UNLINK:
+			ret := command.RetUnlink{
+				CmdHeader: header,
+			}
+			if err := ret.Decode(c.reader); err != nil {
+				c.shutdown(fmt.Errorf("unable to decode RetUnlink: %w", err))
+				return
+			}
+
+			c.lock.Lock()
+			reply, ok := c.unlinks[header.SeqNum]
+			delete(c.unlinks, header.SeqNum)
+			c.lock.Unlock()
+			if !ok {
+				c.logger.Debug("RetUnlink for unknown seqNum, ignoring", "seqNum", header.SeqNum)
+				continue
+			}
+			reply <- ret
+		default:
+			c.shutdown(fmt.Errorf("%w: unknown command %x", ErrUnexpectedReply, header.Command))
+			return
+		}
+	}
+}
+
+// shutdown closes connection and fails all pending URBs
+func (c *urbConnImpl) shutdown(reason error) {
+	c.closeOnce.Do(func() {
+		c.lock.Lock()
+		close(c.closed)
+		pending := c.pending
+		c.pending = make(map[uint32]*PendingURB)
+		c.lock.Unlock()
+
+		if reason != nil && !errors.Is(reason, io.EOF) {
+			c.logger.Error("USB/IP connection is broken", "err", reason)
+		}
+		c.closeErr = c.conn.Close()
+
+		for _, urb := range pending {
+			urb.finish(command.RetSubmit{}, ErrConnectionClosed)
+		}
+	})
+}
+
+func (c *urbConnImpl) Close() error {
+	c.shutdown(nil)
+	<-c.readerDone
+
+	return c.closeErr
+}
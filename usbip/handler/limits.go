@@ -0,0 +1,13 @@
+package handler
+
+import "github.com/ntchjb/usbip-virtual-device/usbip/protocol/command"
+
+// ConnectionLimits bounds resources that a single USB/IP connection can consume.
+// Zero value of each field means no limit.
+type ConnectionLimits struct {
+	// Limits applied when decoding CmdSubmit, violating them closes the connection
+	command.SubmitLimits
+	// MaxInFlightBytes is maximum total TransferBufferLength of URBs being processed or waiting for replies.
+	// CmdSubmit exceeding this budget is replied with -ENOMEM status, without being processed by device.
+	MaxInFlightBytes uint64
+}
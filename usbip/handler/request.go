@@ -10,6 +10,7 @@ import (
 	"github.com/ntchjb/usbip-virtual-device/usb"
 	"github.com/ntchjb/usbip-virtual-device/usbip/protocol/command"
 	operation "github.com/ntchjb/usbip-virtual-device/usbip/protocol/op"
+	"github.com/ntchjb/usbip-virtual-device/usbip/stream"
 )
 
 type HandlerLevel uint8
@@ -30,28 +31,33 @@ type RequestHandler interface {
 }
 
 type requestHandlerImpl struct {
-	conn      net.Conn
+	conn net.Conn
+	// reader is a buffered reader of conn, all reads must be done via this reader
+	reader    io.Reader
 	registrar usb.DeviceRegistrar
 	logger    *slog.Logger
 	worker    WorkerPool
+	limits    ConnectionLimits
 
 	level HandlerLevel
 }
 
-func NewRequestHandler(conn net.Conn, registrar usb.DeviceRegistrar, worker WorkerPool, logger *slog.Logger) RequestHandler {
+func NewRequestHandler(conn net.Conn, registrar usb.DeviceRegistrar, worker WorkerPool, limits ConnectionLimits, logger *slog.Logger) RequestHandler {
 	return &requestHandlerImpl{
 		conn:      conn,
+		reader:    stream.NewBufferedReader(conn),
 		registrar: registrar,
 		level:     HANDLER_LEVEL_OP,
 		logger:    logger,
 		worker:    worker,
+		limits:    limits,
 	}
 }
 
 func (op *requestHandlerImpl) HandleOpHeader() (operation.OpHeader, error) {
 	var opHeader operation.OpHeader
 	// When idle, logic will stuck here, waiting for new data
-	if err := opHeader.Decode(op.conn); err != nil {
+	if err := opHeader.Decode(op.reader); err != nil {
 		return opHeader, fmt.Errorf("unable to decode OpHeader: %w", err)
 	}
 	if opHeader.Version != operation.VERSION {
@@ -64,7 +70,7 @@ func (op *requestHandlerImpl) HandleOpHeader() (operation.OpHeader, error) {
 func (op *requestHandlerImpl) HandleCmdHeader() (command.CmdHeader, error) {
 	var cmdHeader command.CmdHeader
 	// When idle, logic will stuck here, waiting for new data
-	if err := cmdHeader.Decode(op.conn); err != nil {
+	if err := cmdHeader.Decode(op.reader); err != nil {
 		return cmdHeader, fmt.Errorf("unable to decode CmdHeader: %w", err)
 	}
 
@@ -109,7 +115,7 @@ func (op *requestHandlerImpl) HandleOpImport(opHeader operation.OpHeader) error
 	var reply operation.OpRepImport
 	var replyHeader operation.OpHeader
 
-	if err := opReqImport.Decode(op.conn); err != nil {
+	if err := opReqImport.Decode(op.reader); err != nil {
 		return fmt.Errorf("unable to decode OpReqImport: %w", err)
 	}
 
@@ -150,7 +156,8 @@ func (op *requestHandlerImpl) HandleCmdSubmit(cmdHeader command.CmdHeader) error
 		CmdHeader: cmdHeader,
 	}
 
-	if err := cmdSubmit.Decode(op.conn); err != nil {
+	// Stream cannot be recovered if limits are exceeded, as the rest of CmdSubmit is not read
+	if err := cmdSubmit.DecodeWithLimits(op.reader, op.limits.SubmitLimits); err != nil {
 		return fmt.Errorf("unable to decode CmdSubmit: %w", err)
 	}
 	op.worker.PublishCmdSubmit(cmdSubmit)
@@ -162,7 +169,7 @@ func (op *requestHandlerImpl) HandleCmdUnlink(cmdHeader command.CmdHeader) error
 	cmdUnlink := command.CmdUnlink{
 		CmdHeader: cmdHeader,
 	}
-	if err := cmdUnlink.Decode(op.conn); err != nil {
+	if err := cmdUnlink.Decode(op.reader); err != nil {
 		return fmt.Errorf("unable to decode CmdUnlink: %w", err)
 	}
 	if err := op.worker.Unlink(cmdUnlink); err != nil {
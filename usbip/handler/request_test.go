@@ -205,7 +205,7 @@ func TestRequestHandler(t *testing.T) {
 	worker := handler.NewMockWorkerPool(ctrl)
 	logger := slog.Default()
 	server, client := net.Pipe()
-	reqHandler := handler.NewRequestHandler(server, registrar, worker, logger)
+	reqHandler := handler.NewRequestHandler(server, registrar, worker, handler.ConnectionLimits{}, logger)
 
 	// DevList
 	registrar.EXPECT().GetAvailableDevices().Return([]usb.Device{
@@ -2,11 +2,12 @@ package handler
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"sync"
-	"syscall"
 
 	"github.com/ntchjb/usbip-virtual-device/usb"
 	"github.com/ntchjb/usbip-virtual-device/usbip/protocol/command"
@@ -21,6 +22,11 @@ const (
 	URB_STATUS_REPLYING   uint8 = 2
 )
 
+var (
+	ErrDuplicatedURB         = errors.New("URB with the same sequence number is being processed")
+	ErrInFlightBytesExceeded = errors.New("in-flight bytes budget exceeded")
+)
+
 // WorkerPool is a pool of workers processing CmdSubmit requests and reply with RetSubmit to client
 type WorkerPool interface {
 	// Start worker pool
@@ -43,67 +49,128 @@ type workerPoolImpl struct {
 	device      usb.Device
 	replyWriter io.Writer
 	conf        usb.WorkerPoolProfile
+	limits      ConnectionLimits
+	// ctx is parent of all URB contexts, it's cancelled when worker pool is stopped
+	ctx    context.Context
+	cancel context.CancelFunc
 
-	cmdQueue    chan command.CmdSubmit
-	retQueue    chan command.RetSubmit
-	unlinkQueue chan command.RetUnlink
+	// cmdQueues holds an ordered queue of each endpoint, keyed by endpoint address. They are created on first URB.
+	cmdQueues     map[uint8]chan command.CmdSubmit
+	cmdQueuesLock sync.Mutex
+	retQueue      chan command.RetSubmit
+	unlinkQueue   chan command.RetUnlink
+
+	// stopped indicates that retQueue is closed, so completion of async URBs is dropped
+	stopped     bool
+	stoppedLock sync.RWMutex
 
 	processingURBsLock sync.RWMutex
-	processingURBs     map[uint32]uint8
+	processingURBs     map[uint32]processingURB
+	// Total TransferBufferLength of URBs in processingURBs, guarded by processingURBsLock
+	inFlightBytes uint64
+}
+
+// processingURB is a state of URB tracked by worker pool until it's replied or unlinked
+type processingURB struct {
+	status uint8
+	// number of bytes counted in in-flight budget
+	size uint64
+	// ctx is passed to device, and cancelled when URB is unlinked or released
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
-func NewWorkerPool(replyWriter io.Writer, logger *slog.Logger) WorkerPool {
+func NewWorkerPool(replyWriter io.Writer, limits ConnectionLimits, logger *slog.Logger) WorkerPool {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &workerPoolImpl{
+		ctx:            ctx,
+		cancel:         cancel,
 		logger:         logger,
 		replyWriter:    replyWriter,
-		processingURBs: make(map[uint32]uint8),
-		cmdQueue:       make(chan command.CmdSubmit, URB_QUEUE_SIZE),
+		limits:         limits,
+		processingURBs: make(map[uint32]processingURB),
+		cmdQueues:      make(map[uint8]chan command.CmdSubmit),
 		retQueue:       make(chan command.RetSubmit, URB_QUEUE_SIZE),
 		unlinkQueue:    make(chan command.RetUnlink, URB_QUEUE_SIZE),
 	}
 }
 
-func (p *workerPoolImpl) markAsProcessing(seqNum uint32) bool {
+// release removes URB from processing list and returns its bytes to in-flight budget.
+// processingURBsLock must be held by caller.
+func (p *workerPoolImpl) release(seqNum uint32) {
+	if urb, ok := p.processingURBs[seqNum]; ok {
+		p.inFlightBytes -= urb.size
+		if urb.cancel != nil {
+			urb.cancel()
+		}
+		delete(p.processingURBs, seqNum)
+	}
+}
+
+// markAsProcessing adds URB to processing list and reserves its transfer buffer size from in-flight budget.
+//
+// - If URB with the same sequence number exists, ErrDuplicatedURB is returned
+// - If in-flight budget is exhausted, ErrInFlightBytesExceeded is returned. The URB is marked as REPLYING without reserving budget,
+// so that an error reply can be sent to client.
+func (p *workerPoolImpl) markAsProcessing(seqNum uint32, size uint64) error {
 	p.processingURBsLock.Lock()
 	defer p.processingURBsLock.Unlock()
 
-	if _, ok := p.processingURBs[seqNum]; !ok {
-		p.processingURBs[seqNum] = URB_STATUS_PROCESSING
-		return true
-	} else {
-		return false
+	if _, ok := p.processingURBs[seqNum]; ok {
+		return ErrDuplicatedURB
+	}
+	if p.limits.MaxInFlightBytes > 0 && p.inFlightBytes+size > p.limits.MaxInFlightBytes {
+		p.processingURBs[seqNum] = processingURB{
+			status: URB_STATUS_REPLYING,
+		}
+		return fmt.Errorf("%w: %d bytes in flight, %d bytes requested", ErrInFlightBytesExceeded, p.inFlightBytes, size)
 	}
+	ctx, cancel := context.WithCancel(p.ctx)
+	p.processingURBs[seqNum] = processingURB{
+		status: URB_STATUS_PROCESSING,
+		size:   size,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	p.inFlightBytes += size
+
+	return nil
 }
 
+// markAsUnlink marks URB as unlinked and cancels its context, so that device processing it can abort.
+// URB passed to device keeps its bytes in in-flight budget, as device may still hold its transfer buffer,
+// until device completes it and its reply is ignored.
 func (p *workerPoolImpl) markAsUnlink(seqNum uint32) bool {
 	p.processingURBsLock.Lock()
 	defer p.processingURBsLock.Unlock()
 
-	if _, ok := p.processingURBs[seqNum]; ok {
-		p.processingURBs[seqNum] = URB_STATUS_UNLINKING
+	if urb, ok := p.processingURBs[seqNum]; ok {
+		urb.status = URB_STATUS_UNLINKING
+		p.processingURBs[seqNum] = urb
+		if urb.cancel != nil {
+			urb.cancel()
+		}
 		return true
 	} else {
 		return false
 	}
 }
 
-// markAsReplying marks URB as processed, waiting for replies.
+// markAsReplying marks URB as processed, waiting for replies, and returns context of the URB.
 // This function deletes status only if its current status is not PROCESSING.
 // That means URBs that got unlinked before marking as REPLYING will be ignored
-func (p *workerPoolImpl) markAsReplying(seqNum uint32) bool {
-	var res bool
+func (p *workerPoolImpl) markAsReplying(seqNum uint32) (context.Context, bool) {
 	p.processingURBsLock.Lock()
 	defer p.processingURBsLock.Unlock()
 
-	if status, ok := p.processingURBs[seqNum]; ok && status == URB_STATUS_PROCESSING {
-		p.processingURBs[seqNum] = URB_STATUS_REPLYING
-		res = true
-	} else {
-		delete(p.processingURBs, seqNum)
-		res = false
+	if urb, ok := p.processingURBs[seqNum]; ok && urb.status == URB_STATUS_PROCESSING {
+		urb.status = URB_STATUS_REPLYING
+		p.processingURBs[seqNum] = urb
+		return urb.ctx, true
 	}
+	p.release(seqNum)
 
-	return res
+	return nil, false
 }
 
 // markAsReplying marks URB as processed, waiting for replies.
@@ -113,12 +180,12 @@ func (p *workerPoolImpl) markAsReplied(seqNum uint32) bool {
 	p.processingURBsLock.Lock()
 	defer p.processingURBsLock.Unlock()
 
-	if status, ok := p.processingURBs[seqNum]; ok && status == URB_STATUS_REPLYING {
+	if urb, ok := p.processingURBs[seqNum]; ok && urb.status == URB_STATUS_REPLYING {
 		res = true
 	} else {
 		res = false
 	}
-	delete(p.processingURBs, seqNum)
+	p.release(seqNum)
 
 	return res
 }
@@ -130,14 +197,14 @@ func (p *workerPoolImpl) Unlink(cmd command.CmdUnlink) error {
 			Command: command.RET_UNLINK,
 			SeqNum:  cmd.SeqNum,
 		},
-		Status: 0,
+		Status: command.URB_STATUS_OK,
 	}
 
 	// If given URB is currently processing by worker pool, then RetUnlink should
 	// return with status -ECONNRESET.
 	// Otherwise, return with status 0
 	if p.markAsUnlink(cmd.UnlinkSeqNum) {
-		retUnlink.Status = -int32(syscall.ECONNRESET)
+		retUnlink.Status = command.URB_STATUS_UNLINKED
 	} else {
 		p.logger.Debug("Unlink is ignored, does not receive CmdSubmit yet", "seqNum", cmd.SeqNum, "unlinkSeqNum", cmd.UnlinkSeqNum)
 	}
@@ -149,39 +216,110 @@ func (p *workerPoolImpl) Unlink(cmd command.CmdUnlink) error {
 
 func (p *workerPoolImpl) PublishCmdSubmit(urb command.CmdSubmit) {
 	p.logger.Debug("Received CmdSubmit", "data", urb)
-	if !p.markAsProcessing(urb.SeqNum) {
+	if err := p.markAsProcessing(urb.SeqNum, uint64(urb.TransferBufferLength)); err != nil {
+		if errors.Is(err, ErrInFlightBytesExceeded) {
+			p.logger.Error("Rejecting URB", "seqNum", urb.SeqNum, "err", err)
+			p.retQueue <- command.NewRetSubmit(urb, command.URB_STATUS_NO_MEMORY, nil)
+			return
+		}
 		p.logger.Error("Found duplicated URB, ignoring", "urb", urb)
 		return
 	}
-	p.cmdQueue <- urb
+	p.getCmdQueue(urb) <- urb
 }
 
-func (p *workerPoolImpl) SetDevice(device usb.Device) {
-	p.device = device
+// newCompleter returns completer of an async URB, which publishes RetSubmit to reply workers.
+// The URB stays in processing list until it's completed or unlinked.
+func (p *workerPoolImpl) newCompleter(urb command.CmdSubmit) usb.URBCompleter {
+	var once sync.Once
+	seqNum := urb.SeqNum
+
+	return func(ret command.RetSubmit) {
+		once.Do(func() {
+			p.stoppedLock.RLock()
+			defer p.stoppedLock.RUnlock()
+
+			if p.stopped {
+				p.logger.Debug("Worker pool is stopped, dropping completed URB", "urbSeqNum", seqNum)
+				return
+			}
+			if ret.SeqNum != seqNum {
+				p.logger.Warn("SeqNum of completed URB mismatched, overriding", "expected", seqNum, "actual", ret.SeqNum)
+				ret.SeqNum = seqNum
+			}
+			p.retQueue <- command.NormalizeRetSubmit(urb, ret)
+		})
+	}
 }
 
-func (p *workerPoolImpl) Start() error {
-	if p.device == nil {
-		return fmt.Errorf("device does not exist in this worker pool")
+// getEndpointAddress returns endpoint address of given URB, which is endpoint number with direction bit.
+// Control endpoint 0 uses address 0 for both directions, as its transfers must be processed in order.
+func getEndpointAddress(urb command.CmdSubmit) uint8 {
+	if urb.EndpointNumber == 0 {
+		return 0
 	}
-	p.conf = p.device.GetWorkerPoolProfile()
-	// Initiate worker pool for processing CmdSubmit from queue
-	for i := 0; i < p.conf.MaximumProcWorkers; i++ {
+	address := uint8(urb.EndpointNumber & 0x0f)
+	if urb.Direction == command.DIR_IN {
+		address |= 0x80
+	}
+
+	return address
+}
+
+// getCmdQueue returns queue of the endpoint of given URB.
+// If it does not exist, a new queue is created with workers specified by WorkerPoolProfile.
+func (p *workerPoolImpl) getCmdQueue(urb command.CmdSubmit) chan command.CmdSubmit {
+	address := getEndpointAddress(urb)
+
+	p.cmdQueuesLock.Lock()
+	defer p.cmdQueuesLock.Unlock()
+
+	if queue, ok := p.cmdQueues[address]; ok {
+		return queue
+	}
+	queue := make(chan command.CmdSubmit, URB_QUEUE_SIZE)
+	p.cmdQueues[address] = queue
+	workers := p.conf.GetEndpointProcWorkers(address)
+	p.logger.Debug("Starting endpoint workers", "endpoint", fmt.Sprintf("%02x", address), "workers", workers)
+	for i := 0; i < workers; i++ {
 		p.wgCmdSubmit.Add(1)
 		go func() {
 			defer p.wgCmdSubmit.Done()
+			p.processCmdQueue(queue)
+		}()
+	}
 
-			for urbSubmit := range p.cmdQueue {
-				if !p.markAsReplying(urbSubmit.SeqNum) {
-					p.logger.Debug("Unlinked URB detected before processing it, ignoring", "urbSeqNum", urbSubmit.SeqNum)
-					continue
-				}
+	return queue
+}
 
-				urbRet := p.device.Process(urbSubmit)
-				p.retQueue <- urbRet
-			}
-		}()
+// processCmdQueue processes URBs from given queue until it's closed
+func (p *workerPoolImpl) processCmdQueue(queue chan command.CmdSubmit) {
+	for urbSubmit := range queue {
+		ctx, ok := p.markAsReplying(urbSubmit.SeqNum)
+		if !ok {
+			p.logger.Debug("Unlinked URB detected before processing it, ignoring", "urbSeqNum", urbSubmit.SeqNum)
+			continue
+		}
+
+		if asyncDevice, ok := p.device.(usb.AsyncDevice); ok {
+			asyncDevice.ProcessAsync(ctx, urbSubmit, p.newCompleter(urbSubmit))
+			continue
+		}
+		urbRet := p.device.Process(ctx, urbSubmit)
+		p.retQueue <- command.NormalizeRetSubmit(urbSubmit, urbRet)
 	}
+}
+
+func (p *workerPoolImpl) SetDevice(device usb.Device) {
+	p.device = device
+}
+
+func (p *workerPoolImpl) Start() error {
+	if p.device == nil {
+		return fmt.Errorf("device does not exist in this worker pool")
+	}
+	p.conf = p.device.GetWorkerPoolProfile()
+	// Workers processing CmdSubmit are started per endpoint, when the first URB of the endpoint arrives
 
 	// Initiate worker pool for sending RetSubmit to io.Writer (which should be net.Conn)
 	for i := 0; i < p.conf.MaximumReplyWorkers; i++ {
@@ -238,9 +376,21 @@ func (p *workerPoolImpl) Start() error {
 }
 
 func (p *workerPoolImpl) Stop() error {
-	close(p.cmdQueue)
+	// Cancel all URBs, so that devices waiting for external events return immediately.
+	// URBs left in queue are still passed to device, with cancelled context.
+	p.cancel()
+	p.cmdQueuesLock.Lock()
+	for _, queue := range p.cmdQueues {
+		close(queue)
+	}
+	p.cmdQueues = make(map[uint8]chan command.CmdSubmit)
+	p.cmdQueuesLock.Unlock()
 	p.wgCmdSubmit.Wait()
+	// Async URBs may be completed by device later, so stop accepting them before closing queue
+	p.stoppedLock.Lock()
+	p.stopped = true
 	close(p.retQueue)
+	p.stoppedLock.Unlock()
 	close(p.unlinkQueue)
 	p.wgRetSubmit.Wait()
 
@@ -2,9 +2,12 @@ package handler_test
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
 	"log/slog"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/ntchjb/usbip-virtual-device/usb"
 	"github.com/ntchjb/usbip-virtual-device/usbip/handler"
@@ -141,7 +144,7 @@ func TestWorkerPool(t *testing.T) {
 
 	replies := new(Buffer)
 	logger := slog.Default()
-	wp := handler.NewWorkerPool(replies, logger)
+	wp := handler.NewWorkerPool(replies, handler.ConnectionLimits{}, logger)
 	device := usb.NewMockDevice(ctrl)
 
 	device.EXPECT().GetWorkerPoolProfile().Return(usb.WorkerPoolProfile{
@@ -149,9 +152,15 @@ func TestWorkerPool(t *testing.T) {
 		MaximumReplyWorkers:       1,
 		MaximumUnlinkReplyWorkers: 1,
 	})
-	device.EXPECT().Process(urbQueueCmdSubmits[0]).Return(urbQueueRetSubmits[0]).Times(1)
-	device.EXPECT().Process(urbQueueCmdSubmits[1]).Return(urbQueueRetSubmits[1]).AnyTimes()
-	device.EXPECT().Process(urbQueueCmdSubmits[2]).Return(urbQueueRetSubmits[2]).Times(1)
+	device.EXPECT().Process(gomock.Any(), urbQueueCmdSubmits[0]).DoAndReturn(func(_ context.Context, _ command.CmdSubmit) command.RetSubmit {
+		// Workers of an endpoint are started on its first URB, so wait for RetUnlink to make order of replies deterministic
+		assert.Eventually(t, func() bool {
+			return len(replies.Bytes()) == 48
+		}, time.Second, time.Millisecond)
+		return urbQueueRetSubmits[0]
+	}).Times(1)
+	device.EXPECT().Process(gomock.Any(), urbQueueCmdSubmits[1]).Return(urbQueueRetSubmits[1]).AnyTimes()
+	device.EXPECT().Process(gomock.Any(), urbQueueCmdSubmits[2]).Return(urbQueueRetSubmits[2]).Times(1)
 
 	wp.SetDevice(device)
 	startErr := wp.Start()
@@ -201,9 +210,9 @@ func TestWorkerPool(t *testing.T) {
 		0xff, 0xff, 0xff, 0xff, // NumberOfPackets
 		0x00, 0x00, 0x00, 0x00, // ErrorCount
 		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // Padding
-		0x01, 0x02, 0x03, 0x04, 0x05, // TransferBuffer
 
 		// protocol.RetSubmit for SeqNum 2 should not be here because it's unlinked
+		// TransferBuffer of DIR_OUT RetSubmit is not sent back to client
 
 		// protocol.RetSubmit
 		0x00, 0x00, 0x00, 0x01, // Command
@@ -218,6 +227,437 @@ func TestWorkerPool(t *testing.T) {
 		0xff, 0xff, 0xff, 0xff, // NumberOfPackets
 		0x00, 0x00, 0x00, 0x00, // ErrorCount
 		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // Padding
-		0x01, 0x02, 0x03, 0x04, 0x05, // TransferBuffer
+	}, replies.Bytes())
+}
+
+func TestWorkerPoolInFlightBudget(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	replies := new(Buffer)
+	logger := slog.Default()
+	wp := handler.NewWorkerPool(replies, handler.ConnectionLimits{
+		MaxInFlightBytes: 8,
+	}, logger)
+	device := usb.NewMockDevice(ctrl)
+
+	release := make(chan struct{})
+	device.EXPECT().GetWorkerPoolProfile().Return(usb.WorkerPoolProfile{
+		MaximumProcWorkers:        1,
+		MaximumReplyWorkers:       1,
+		MaximumUnlinkReplyWorkers: 1,
+	})
+	device.EXPECT().Process(gomock.Any(), urbQueueCmdSubmits[0]).DoAndReturn(func(_ context.Context, urb command.CmdSubmit) command.RetSubmit {
+		<-release
+		return urbQueueRetSubmits[0]
+	}).Times(1)
+	device.EXPECT().Process(gomock.Any(), urbQueueCmdSubmits[2]).Return(urbQueueRetSubmits[2]).Times(1)
+
+	wp.SetDevice(device)
+	assert.NoError(t, wp.Start())
+
+	// The second URB exceeds budget while the first one is being processed
+	wp.PublishCmdSubmit(urbQueueCmdSubmits[0])
+	wp.PublishCmdSubmit(urbQueueCmdSubmits[1])
+	assert.Eventually(t, func() bool {
+		return len(replies.Bytes()) == 48
+	}, time.Second, time.Millisecond)
+
+	// Budget is returned after the first URB is replied
+	close(release)
+	assert.Eventually(t, func() bool {
+		return len(replies.Bytes()) == 48+48
+	}, time.Second, time.Millisecond)
+	wp.PublishCmdSubmit(urbQueueCmdSubmits[2])
+
+	wp.Stop()
+
+	assert.Equal(t, []byte{
+		// protocol.RetSubmit rejected by in-flight budget
+		0x00, 0x00, 0x00, 0x03, // Command
+		0x00, 0x00, 0x00, 0x02, // SeqNum
+		0x00, 0x00, 0x00, 0x00, // DevID
+		0x00, 0x00, 0x00, 0x00, // Direction
+		0x00, 0x00, 0x00, 0x00, // EndpointNumber
+
+		0xff, 0xff, 0xff, 0xf4, // Status -ENOMEM
+		0x00, 0x00, 0x00, 0x00, // ActualLength
+		0x00, 0x00, 0x00, 0x00, // StartFrame
+		0xff, 0xff, 0xff, 0xff, // NumberOfPackets
+		0x00, 0x00, 0x00, 0x00, // ErrorCount
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // Padding
+
+		// protocol.RetSubmit
+		0x00, 0x00, 0x00, 0x01, // Command
+		0x00, 0x00, 0x00, 0x01, // SeqNum
+		0x00, 0x01, 0x00, 0x01, // DevID
+		0x00, 0x00, 0x00, 0x00, // Direction
+		0x00, 0x00, 0x00, 0x01, // EndpointNumber
+
+		0x00, 0x00, 0x00, 0x01, // Status
+		0x00, 0x00, 0x00, 0x05, // ActualLength
+		0x00, 0x00, 0x00, 0x00, // StartFrame
+		0xff, 0xff, 0xff, 0xff, // NumberOfPackets
+		0x00, 0x00, 0x00, 0x00, // ErrorCount
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // Padding
+
+		// protocol.RetSubmit
+		0x00, 0x00, 0x00, 0x01, // Command
+		0x00, 0x00, 0x00, 0x03, // SeqNum
+		0x00, 0x01, 0x00, 0x01, // DevID
+		0x00, 0x00, 0x00, 0x00, // Direction
+		0x00, 0x00, 0x00, 0x01, // EndpointNumber
+
+		0x00, 0x00, 0x00, 0x01, // Status
+		0x00, 0x00, 0x00, 0x05, // ActualLength
+		0x00, 0x00, 0x00, 0x00, // StartFrame
+		0xff, 0xff, 0xff, 0xff, // NumberOfPackets
+		0x00, 0x00, 0x00, 0x00, // ErrorCount
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // Padding
+	}, replies.Bytes())
+}
+
+func TestWorkerPoolAsyncDevice(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	replies := new(Buffer)
+	logger := slog.Default()
+	wp := handler.NewWorkerPool(replies, handler.ConnectionLimits{}, logger)
+	device := usb.NewMockAsyncDevice(ctrl)
+
+	completers := make(chan usb.URBCompleter, 3)
+	device.EXPECT().GetWorkerPoolProfile().Return(usb.WorkerPoolProfile{
+		MaximumProcWorkers:        1,
+		MaximumReplyWorkers:       1,
+		MaximumUnlinkReplyWorkers: 1,
+	})
+	device.EXPECT().ProcessAsync(gomock.Any(), gomock.Any(), gomock.Any()).Do(func(_ context.Context, urb command.CmdSubmit, completer usb.URBCompleter) {
+		completers <- completer
+	}).Times(3)
+
+	wp.SetDevice(device)
+	assert.NoError(t, wp.Start())
+
+	// All URBs are pending at the same time, even though there is only one processing worker
+	wp.PublishCmdSubmit(urbQueueCmdSubmits[0])
+	wp.PublishCmdSubmit(urbQueueCmdSubmits[1])
+	wp.PublishCmdSubmit(urbQueueCmdSubmits[2])
+	completer1 := <-completers
+	completer2 := <-completers
+	completer3 := <-completers
+
+	// Pending URB is unlinked, so its completion is dropped
+	assert.NoError(t, wp.Unlink(command.CmdUnlink{
+		CmdHeader: command.CmdHeader{
+			Command: command.CMD_UNLINK,
+			SeqNum:  4,
+			DevID:   0x00010001,
+		},
+		UnlinkSeqNum: 2,
+	}))
+	assert.Eventually(t, func() bool {
+		return len(replies.Bytes()) == 48
+	}, time.Second, time.Millisecond)
+	completer2(urbQueueRetSubmits[1])
+
+	// URBs can be completed in any order, only the first completion takes effect
+	completer3(urbQueueRetSubmits[2])
+	assert.Eventually(t, func() bool {
+		return len(replies.Bytes()) == 48+48
+	}, time.Second, time.Millisecond)
+	completer3(urbQueueRetSubmits[2])
+
+	wp.Stop()
+	// Completion after worker pool is stopped is dropped
+	completer1(urbQueueRetSubmits[0])
+
+	assert.Equal(t, []byte{
+		// protocol.RetUnlink
+		0x00, 0x00, 0x00, 0x04,
+		0x00, 0x00, 0x00, 0x04,
+		0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00,
+		0xff, 0xff, 0xff, 0x98, // ECONNRESET
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+
+		// protocol.RetSubmit
+		0x00, 0x00, 0x00, 0x01, // Command
+		0x00, 0x00, 0x00, 0x03, // SeqNum
+		0x00, 0x01, 0x00, 0x01, // DevID
+		0x00, 0x00, 0x00, 0x00, // Direction
+		0x00, 0x00, 0x00, 0x01, // EndpointNumber
+
+		0x00, 0x00, 0x00, 0x01, // Status
+		0x00, 0x00, 0x00, 0x05, // ActualLength
+		0x00, 0x00, 0x00, 0x00, // StartFrame
+		0xff, 0xff, 0xff, 0xff, // NumberOfPackets
+		0x00, 0x00, 0x00, 0x00, // ErrorCount
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // Padding
+	}, replies.Bytes())
+}
+
+func TestWorkerPoolUnlinkCancelsContext(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	replies := new(Buffer)
+	logger := slog.Default()
+	wp := handler.NewWorkerPool(replies, handler.ConnectionLimits{}, logger)
+	device := usb.NewMockDevice(ctrl)
+
+	processing := make(chan struct{})
+	cancelled := make(chan struct{})
+	device.EXPECT().GetWorkerPoolProfile().Return(usb.WorkerPoolProfile{
+		MaximumProcWorkers:        2,
+		MaximumReplyWorkers:       1,
+		MaximumUnlinkReplyWorkers: 1,
+	})
+	// Both URBs wait for external events, which never come
+	device.EXPECT().Process(gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, urb command.CmdSubmit) command.RetSubmit {
+		processing <- struct{}{}
+		<-ctx.Done()
+		cancelled <- struct{}{}
+		return urbQueueRetSubmits[urb.SeqNum-1]
+	}).Times(2)
+
+	wp.SetDevice(device)
+	assert.NoError(t, wp.Start())
+
+	wp.PublishCmdSubmit(urbQueueCmdSubmits[0])
+	wp.PublishCmdSubmit(urbQueueCmdSubmits[1])
+	<-processing
+	<-processing
+
+	// Unlinking URB cancels its context
+	assert.NoError(t, wp.Unlink(command.CmdUnlink{
+		CmdHeader: command.CmdHeader{
+			Command: command.CMD_UNLINK,
+			SeqNum:  4,
+			DevID:   0x00010001,
+		},
+		UnlinkSeqNum: 1,
+	}))
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("context of unlinked URB is not cancelled")
+	}
+
+	// Stopping worker pool cancels the rest
+	go func() {
+		<-cancelled
+	}()
+	wp.Stop()
+
+	assert.Equal(t, []byte{
+		// protocol.RetUnlink
+		0x00, 0x00, 0x00, 0x04,
+		0x00, 0x00, 0x00, 0x04,
+		0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00,
+		0xff, 0xff, 0xff, 0x98, // ECONNRESET
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+
+		// protocol.RetSubmit for SeqNum 1 should not be here because it's unlinked
+
+		// protocol.RetSubmit returned by device after its context is cancelled by Stop
+		0x00, 0x00, 0x00, 0x01, // Command
+		0x00, 0x00, 0x00, 0x02, // SeqNum
+		0x00, 0x01, 0x00, 0x01, // DevID
+		0x00, 0x00, 0x00, 0x00, // Direction
+		0x00, 0x00, 0x00, 0x01, // EndpointNumber
+
+		0x00, 0x00, 0x00, 0x01, // Status
+		0x00, 0x00, 0x00, 0x05, // ActualLength
+		0x00, 0x00, 0x00, 0x00, // StartFrame
+		0xff, 0xff, 0xff, 0xff, // NumberOfPackets
+		0x00, 0x00, 0x00, 0x00, // ErrorCount
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // Padding
+	}, replies.Bytes())
+}
+
+func TestWorkerPoolInFlightBudgetUnlinkedAsyncURB(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	replies := new(Buffer)
+	logger := slog.Default()
+	wp := handler.NewWorkerPool(replies, handler.ConnectionLimits{
+		MaxInFlightBytes: 8,
+	}, logger)
+	device := usb.NewMockAsyncDevice(ctrl)
+
+	completers := make(chan usb.URBCompleter, 2)
+	device.EXPECT().GetWorkerPoolProfile().Return(usb.WorkerPoolProfile{
+		MaximumProcWorkers:        1,
+		MaximumReplyWorkers:       1,
+		MaximumUnlinkReplyWorkers: 1,
+	})
+	// Device holds URBs, even after they're unlinked
+	device.EXPECT().ProcessAsync(gomock.Any(), gomock.Any(), gomock.Any()).Do(func(_ context.Context, urb command.CmdSubmit, completer usb.URBCompleter) {
+		completers <- completer
+	}).Times(2)
+
+	wp.SetDevice(device)
+	assert.NoError(t, wp.Start())
+
+	// Unlinked URB held by device is still counted in budget, so repeating submit and unlink can't exceed it
+	var completer usb.URBCompleter
+	for i := 0; i < 4; i++ {
+		urb := urbQueueCmdSubmits[0]
+		urb.SeqNum = uint32(i*2 + 1)
+		wp.PublishCmdSubmit(urb)
+		if i == 0 {
+			completer = <-completers
+		} else {
+			assert.Eventually(t, func() bool {
+				return len(replies.Bytes()) == 48*(i*2)
+			}, time.Second, time.Millisecond)
+		}
+		assert.NoError(t, wp.Unlink(command.CmdUnlink{
+			CmdHeader: command.CmdHeader{
+				Command: command.CMD_UNLINK,
+				SeqNum:  urb.SeqNum + 1,
+				DevID:   0x00010001,
+			},
+			UnlinkSeqNum: urb.SeqNum,
+		}))
+		assert.Eventually(t, func() bool {
+			return len(replies.Bytes()) == 48*(i*2+1)
+		}, time.Second, time.Millisecond)
+	}
+	assert.Empty(t, completers)
+
+	statuses := make([]int32, len(replies.Bytes())/48)
+	for i := range statuses {
+		statuses[i] = int32(binary.BigEndian.Uint32(replies.Bytes()[i*48+20:]))
+	}
+	assert.Equal(t, []int32{
+		int32(command.URB_STATUS_UNLINKED),
+		int32(command.URB_STATUS_NO_MEMORY), int32(command.URB_STATUS_OK),
+		int32(command.URB_STATUS_NO_MEMORY), int32(command.URB_STATUS_OK),
+		int32(command.URB_STATUS_NO_MEMORY), int32(command.URB_STATUS_OK),
+	}, statuses)
+
+	// Budget is released once device completes the unlinked URB, and its reply is dropped
+	completer(urbQueueRetSubmits[0])
+	accepted := false
+	for seqNum := uint32(9); seqNum < 100 && !accepted; seqNum += 2 {
+		urb := urbQueueCmdSubmits[0]
+		urb.SeqNum = seqNum
+		repliesLength := len(replies.Bytes())
+		wp.PublishCmdSubmit(urb)
+		// URB is either passed to device, or rejected until the reply is dropped
+		assert.Eventually(t, func() bool {
+			return len(completers) > 0 || len(replies.Bytes()) > repliesLength
+		}, time.Second, time.Millisecond)
+		accepted = len(completers) > 0
+	}
+	assert.True(t, accepted)
+
+	wp.Stop()
+}
+
+func TestWorkerPoolEndpointQueues(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	replies := new(Buffer)
+	logger := slog.Default()
+	wp := handler.NewWorkerPool(replies, handler.ConnectionLimits{}, logger)
+	device := usb.NewMockDevice(ctrl)
+
+	interruptIn := command.CmdSubmit{
+		CmdHeader: command.CmdHeader{
+			Command:        command.CMD_SUBMIT,
+			SeqNum:         1,
+			DevID:          0x00010001,
+			Direction:      command.DIR_IN,
+			EndpointNumber: 1,
+		},
+		TransferBufferLength: 8,
+		NumberOfPackets:      0xffffffff,
+	}
+	controlIn := command.CmdSubmit{
+		CmdHeader: command.CmdHeader{
+			Command:        command.CMD_SUBMIT,
+			SeqNum:         2,
+			DevID:          0x00010001,
+			Direction:      command.DIR_IN,
+			EndpointNumber: 0,
+		},
+		TransferBufferLength: 2,
+		NumberOfPackets:      0xffffffff,
+	}
+
+	device.EXPECT().GetWorkerPoolProfile().Return(usb.WorkerPoolProfile{
+		MaximumProcWorkers:        1,
+		MaximumReplyWorkers:       1,
+		MaximumUnlinkReplyWorkers: 1,
+	})
+	// Interrupt IN URB waits for data until connection is closed
+	device.EXPECT().Process(gomock.Any(), interruptIn).DoAndReturn(func(ctx context.Context, urb command.CmdSubmit) command.RetSubmit {
+		<-ctx.Done()
+		return command.RetSubmit{
+			CmdHeader: command.CmdHeader{
+				Command: command.RET_SUBMIT,
+				SeqNum:  urb.SeqNum,
+			},
+			Status: 1,
+		}
+	}).Times(1)
+	device.EXPECT().Process(gomock.Any(), controlIn).Return(command.RetSubmit{
+		CmdHeader: command.CmdHeader{
+			Command: command.RET_SUBMIT,
+			SeqNum:  2,
+		},
+		ActualLength:   2,
+		TransferBuffer: []byte{0x01, 0x00},
+	}).Times(1)
+
+	wp.SetDevice(device)
+	assert.NoError(t, wp.Start())
+
+	wp.PublishCmdSubmit(interruptIn)
+	wp.PublishCmdSubmit(controlIn)
+
+	// Control transfer is replied even though the only worker of endpoint 1 is blocked
+	assert.Eventually(t, func() bool {
+		return len(replies.Bytes()) == 50
+	}, time.Second, time.Millisecond)
+
+	wp.Stop()
+
+	assert.Equal(t, []byte{
+		// protocol.RetSubmit of control transfer
+		0x00, 0x00, 0x00, 0x03, // Command
+		0x00, 0x00, 0x00, 0x02, // SeqNum
+		0x00, 0x00, 0x00, 0x00, // DevID
+		0x00, 0x00, 0x00, 0x00, // Direction
+		0x00, 0x00, 0x00, 0x00, // EndpointNumber
+
+		0x00, 0x00, 0x00, 0x00, // Status
+		0x00, 0x00, 0x00, 0x02, // ActualLength
+		0x00, 0x00, 0x00, 0x00, // StartFrame
+		0x00, 0x00, 0x00, 0x00, // NumberOfPackets
+		0x00, 0x00, 0x00, 0x00, // ErrorCount
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // Padding
+		0x01, 0x00, // TransferBuffer
+
+		// protocol.RetSubmit of interrupt transfer, cancelled by Stop
+		0x00, 0x00, 0x00, 0x03, // Command
+		0x00, 0x00, 0x00, 0x01, // SeqNum
+		0x00, 0x00, 0x00, 0x00, // DevID
+		0x00, 0x00, 0x00, 0x00, // Direction
+		0x00, 0x00, 0x00, 0x00, // EndpointNumber
+
+		0x00, 0x00, 0x00, 0x01, // Status
+		0x00, 0x00, 0x00, 0x00, // ActualLength
+		0x00, 0x00, 0x00, 0x00, // StartFrame
+		0x00, 0x00, 0x00, 0x00, // NumberOfPackets
+		0x00, 0x00, 0x00, 0x00, // ErrorCount
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // Padding
 	}, replies.Bytes())
 }
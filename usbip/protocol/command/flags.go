@@ -0,0 +1,64 @@
+package command
+
+// TransferFlags is transfer_flags of URB in CmdSubmit, as defined in include/uapi/linux/usbip.h
+type TransferFlags uint32
+
+const (
+	// Short IN transfer is treated as an error, with status -EREMOTEIO
+	URB_SHORT_NOT_OK TransferFlags = 0x0001
+	// ISO transfer is started as soon as possible, ignoring StartFrame
+	URB_ISO_ASAP            TransferFlags = 0x0002
+	URB_NO_TRANSFER_DMA_MAP TransferFlags = 0x0004
+	// OUT transfer, which is a multiple of maximum packet size, is terminated by a zero-length packet
+	URB_ZERO_PACKET  TransferFlags = 0x0040
+	URB_NO_INTERRUPT TransferFlags = 0x0080
+	URB_FREE_BUFFER  TransferFlags = 0x0100
+	// Transfer direction is IN
+	URB_DIR_IN TransferFlags = 0x0200
+)
+
+// ShortNotOK returns true if URB_SHORT_NOT_OK is set
+func (f TransferFlags) ShortNotOK() bool {
+	return f&URB_SHORT_NOT_OK != 0
+}
+
+// ISOASAP returns true if URB_ISO_ASAP is set
+func (f TransferFlags) ISOASAP() bool {
+	return f&URB_ISO_ASAP != 0
+}
+
+// NoTransferDMAMap returns true if URB_NO_TRANSFER_DMA_MAP is set
+func (f TransferFlags) NoTransferDMAMap() bool {
+	return f&URB_NO_TRANSFER_DMA_MAP != 0
+}
+
+// ZeroPacket returns true if URB_ZERO_PACKET is set
+func (f TransferFlags) ZeroPacket() bool {
+	return f&URB_ZERO_PACKET != 0
+}
+
+// NoInterrupt returns true if URB_NO_INTERRUPT is set
+func (f TransferFlags) NoInterrupt() bool {
+	return f&URB_NO_INTERRUPT != 0
+}
+
+// FreeBuffer returns true if URB_FREE_BUFFER is set
+func (f TransferFlags) FreeBuffer() bool {
+	return f&URB_FREE_BUFFER != 0
+}
+
+// DirIn returns true if URB_DIR_IN is set
+func (f TransferFlags) DirIn() bool {
+	return f&URB_DIR_IN != 0
+}
+
+// EndsWithZeroLengthPacket returns true if this OUT transfer is terminated by a zero-length packet on the bus,
+// which is when URB_ZERO_PACKET is set and TransferBufferLength is a multiple of given maximum packet size of the endpoint.
+// Devices parsing data as a stream of packets can use it to detect end of transfer.
+func (c *CmdSubmit) EndsWithZeroLengthPacket(maxPacketSize uint16) bool {
+	if c.Direction != DIR_OUT || !c.TransferFlags.ZeroPacket() || maxPacketSize == 0 {
+		return false
+	}
+
+	return c.TransferBufferLength%uint32(maxPacketSize) == 0
+}
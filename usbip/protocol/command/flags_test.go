@@ -0,0 +1,85 @@
+package command_test
+
+import (
+	"testing"
+
+	"github.com/ntchjb/usbip-virtual-device/usbip/protocol/command"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransferFlags(t *testing.T) {
+	flags := command.URB_SHORT_NOT_OK | command.URB_ZERO_PACKET | command.URB_DIR_IN
+
+	assert.True(t, flags.ShortNotOK())
+	assert.True(t, flags.ZeroPacket())
+	assert.True(t, flags.DirIn())
+	assert.False(t, flags.ISOASAP())
+	assert.False(t, flags.NoTransferDMAMap())
+	assert.False(t, flags.NoInterrupt())
+	assert.False(t, flags.FreeBuffer())
+}
+
+func TestEndsWithZeroLengthPacket(t *testing.T) {
+	tests := []struct {
+		name          string
+		cmd           command.CmdSubmit
+		maxPacketSize uint16
+		expected      bool
+	}{
+		{
+			name: "Multiple of maximum packet size",
+			cmd: command.CmdSubmit{
+				CmdHeader: command.CmdHeader{
+					Direction: command.DIR_OUT,
+				},
+				TransferFlags:        command.URB_ZERO_PACKET,
+				TransferBufferLength: 128,
+			},
+			maxPacketSize: 64,
+			expected:      true,
+		},
+		{
+			name: "Ends with short packet",
+			cmd: command.CmdSubmit{
+				CmdHeader: command.CmdHeader{
+					Direction: command.DIR_OUT,
+				},
+				TransferFlags:        command.URB_ZERO_PACKET,
+				TransferBufferLength: 100,
+			},
+			maxPacketSize: 64,
+			expected:      false,
+		},
+		{
+			name: "Without URB_ZERO_PACKET",
+			cmd: command.CmdSubmit{
+				CmdHeader: command.CmdHeader{
+					Direction: command.DIR_OUT,
+				},
+				TransferBufferLength: 128,
+			},
+			maxPacketSize: 64,
+			expected:      false,
+		},
+		{
+			name: "IN transfer",
+			cmd: command.CmdSubmit{
+				CmdHeader: command.CmdHeader{
+					Direction: command.DIR_IN,
+				},
+				TransferFlags:        command.URB_ZERO_PACKET,
+				TransferBufferLength: 128,
+			},
+			maxPacketSize: 64,
+			expected:      false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			assert.Equal(t, test.expected, test.cmd.EndsWithZeroLengthPacket(test.maxPacketSize))
+		})
+	}
+}
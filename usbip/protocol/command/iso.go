@@ -19,7 +19,7 @@ func (c *ISOPacketDescriptor) Decode(reader io.Reader) error {
 	c.Offset = binary.BigEndian.Uint32(buf[:4])
 	c.ExpectedLength = binary.BigEndian.Uint32(buf[4:8])
 	c.ActualLength = binary.BigEndian.Uint32(buf[8:12])
-	c.Status = binary.BigEndian.Uint32(buf[12:16])
+	c.Status = URBStatus(binary.BigEndian.Uint32(buf[12:16]))
 
 	return nil
 }
@@ -32,7 +32,7 @@ func (c *ISOPacketDescriptor) Encode(writer io.Writer) error {
 	binary.BigEndian.PutUint32(buf[:4], c.Offset)
 	binary.BigEndian.PutUint32(buf[4:8], c.ExpectedLength)
 	binary.BigEndian.PutUint32(buf[8:12], c.ActualLength)
-	binary.BigEndian.PutUint32(buf[12:16], c.Status)
+	binary.BigEndian.PutUint32(buf[12:16], uint32(c.Status))
 
 	if err := stream.Write(writer, buf); err != nil {
 		return fmt.Errorf("unable to write ISOPacketDescriptor to stream: %w", err)
@@ -0,0 +1,128 @@
+package command
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrNotISOTransfer     = errors.New("URB is not ISO transfer")
+	ErrInvalidISOPacket   = errors.New("invalid ISO packet descriptor")
+	ErrISOBufferMalformed = errors.New("ISO transfer buffer does not match its packets")
+)
+
+// ISOPacketResult is result of an ISO packet processed by device, used by NewISORetSubmit
+type ISOPacketResult struct {
+	// Data of IN packet. Data longer than ExpectedLength of the packet is truncated, and the packet status becomes URB_STATUS_OVERFLOW.
+	Data []byte
+	// Number of bytes of OUT packet consumed by device. It's ExpectedLength of the packet if zero with success status.
+	ActualLength uint32
+	Status       URBStatus
+}
+
+// ISOPackets returns data of each ISO packet of OUT transfer, as views into TransferBuffer.
+//
+// Linux vhci-hcd sends whole transfer buffer of OUT transfer, where packets are at their Offset,
+// while USB/IP protocol describes that padding between packets is not transmitted.
+// Both layouts are accepted: packets are taken at their Offset if TransferBuffer has TransferBufferLength bytes,
+// otherwise they're taken back-to-back if TransferBuffer has total ExpectedLength of packets.
+//
+// For IN transfer, returned slices are nil, as IN transfer has no data from host.
+func (c *CmdSubmit) ISOPackets() ([][]byte, error) {
+	if !c.IsISO() {
+		return nil, ErrNotISOTransfer
+	}
+	if int(c.NumberOfPackets) != len(c.ISOPacketDescriptors) {
+		return nil, fmt.Errorf("%w: NumberOfPackets is %d, but there are %d ISO packet descriptors", ErrInvalidISOPacket, c.NumberOfPackets, len(c.ISOPacketDescriptors))
+	}
+
+	var totalLength uint64
+	for i, packet := range c.ISOPacketDescriptors {
+		if uint64(packet.Offset)+uint64(packet.ExpectedLength) > uint64(c.TransferBufferLength) {
+			return nil, fmt.Errorf("%w: packet %d at offset %d with length %d exceeds TransferBufferLength %d", ErrInvalidISOPacket, i, packet.Offset, packet.ExpectedLength, c.TransferBufferLength)
+		}
+		totalLength += uint64(packet.ExpectedLength)
+	}
+
+	packets := make([][]byte, len(c.ISOPacketDescriptors))
+	if c.Direction == DIR_IN {
+		return packets, nil
+	}
+
+	switch {
+	case len(c.TransferBuffer) == int(c.TransferBufferLength):
+		for i, packet := range c.ISOPacketDescriptors {
+			packets[i] = c.TransferBuffer[packet.Offset : packet.Offset+packet.ExpectedLength]
+		}
+	case uint64(len(c.TransferBuffer)) == totalLength:
+		var offset uint32
+		for i, packet := range c.ISOPacketDescriptors {
+			packets[i] = c.TransferBuffer[offset : offset+packet.ExpectedLength]
+			offset += packet.ExpectedLength
+		}
+	default:
+		return nil, fmt.Errorf("%w: buffer length is %d, expected %d or %d", ErrISOBufferMalformed, len(c.TransferBuffer), c.TransferBufferLength, totalLength)
+	}
+
+	return packets, nil
+}
+
+// NewISORetSubmit returns RetSubmit of ISO transfer from results of its packets, in order of ISO packet descriptors.
+//
+// Data of IN packets are placed back-to-back without padding, as expected by vhci-hcd.
+// Packets without result are not transferred, their status is URB_STATUS_PARTIAL.
+// Status of the URB is URB_STATUS_OK, as errors are reported per packet and counted in ErrorCount.
+// If cmd is not ISO transfer, the reply has URB_STATUS_PROTOCOL_ERROR.
+func NewISORetSubmit(cmd CmdSubmit, startFrame uint32, results []ISOPacketResult) RetSubmit {
+	if !cmd.IsISO() {
+		return NewRetSubmit(cmd, URB_STATUS_PROTOCOL_ERROR, nil)
+	}
+
+	ret := RetSubmit{
+		CmdHeader: CmdHeader{
+			Command: RET_SUBMIT,
+			SeqNum:  cmd.SeqNum,
+		},
+		Status:               URB_STATUS_OK,
+		StartFrame:           startFrame,
+		NumberOfPackets:      cmd.NumberOfPackets,
+		ISOPacketDescriptors: make([]ISOPacketDescriptor, len(cmd.ISOPacketDescriptors)),
+	}
+	for i, packet := range cmd.ISOPacketDescriptors {
+		result := ISOPacketResult{
+			Status: URB_STATUS_PARTIAL,
+		}
+		if i < len(results) {
+			result = results[i]
+		}
+
+		actualLength := result.ActualLength
+		if cmd.Direction == DIR_IN {
+			actualLength = uint32(len(result.Data))
+		} else if actualLength == 0 && result.Status == URB_STATUS_OK {
+			actualLength = packet.ExpectedLength
+		}
+		if actualLength > packet.ExpectedLength {
+			actualLength = packet.ExpectedLength
+			if result.Status == URB_STATUS_OK && cmd.Direction == DIR_IN {
+				result.Status = URB_STATUS_OVERFLOW
+			}
+		}
+		if cmd.Direction == DIR_IN {
+			ret.TransferBuffer = append(ret.TransferBuffer, result.Data[:actualLength]...)
+		}
+
+		ret.ISOPacketDescriptors[i] = ISOPacketDescriptor{
+			Offset:         packet.Offset,
+			ExpectedLength: packet.ExpectedLength,
+			ActualLength:   actualLength,
+			Status:         result.Status,
+		}
+		ret.ActualLength += actualLength
+		if result.Status != URB_STATUS_OK {
+			ret.ErrorCount++
+		}
+	}
+
+	return ret
+}
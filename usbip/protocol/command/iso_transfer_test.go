@@ -0,0 +1,143 @@
+package command_test
+
+import (
+	"testing"
+
+	"github.com/ntchjb/usbip-virtual-device/usbip/protocol/command"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newISOCmdSubmit(direction command.Direction, buffer []byte) command.CmdSubmit {
+	return command.CmdSubmit{
+		CmdHeader: command.CmdHeader{
+			Command:        command.CMD_SUBMIT,
+			SeqNum:         7,
+			Direction:      direction,
+			EndpointNumber: 1,
+		},
+		TransferFlags:        command.URB_ISO_ASAP,
+		TransferBufferLength: 12,
+		NumberOfPackets:      3,
+		TransferBuffer:       buffer,
+		ISOPacketDescriptors: []command.ISOPacketDescriptor{
+			{Offset: 0, ExpectedLength: 3},
+			{Offset: 4, ExpectedLength: 4},
+			{Offset: 8, ExpectedLength: 2},
+		},
+	}
+}
+
+func TestCmdSubmitISOPackets(t *testing.T) {
+	tests := []struct {
+		name            string
+		cmd             command.CmdSubmit
+		expectedPackets [][]byte
+		expectedErr     error
+	}{
+		{
+			name:            "OUT packets at their offsets",
+			cmd:             newISOCmdSubmit(command.DIR_OUT, []byte{0x01, 0x02, 0x03, 0x00, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x00, 0x00}),
+			expectedPackets: [][]byte{{0x01, 0x02, 0x03}, {0x04, 0x05, 0x06, 0x07}, {0x08, 0x09}},
+		},
+		{
+			name:            "OUT packets back-to-back",
+			cmd:             newISOCmdSubmit(command.DIR_OUT, []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09}),
+			expectedPackets: [][]byte{{0x01, 0x02, 0x03}, {0x04, 0x05, 0x06, 0x07}, {0x08, 0x09}},
+		},
+		{
+			name:            "IN packets have no data",
+			cmd:             newISOCmdSubmit(command.DIR_IN, nil),
+			expectedPackets: [][]byte{nil, nil, nil},
+		},
+		{
+			name: "Not ISO transfer",
+			cmd: command.CmdSubmit{
+				NumberOfPackets: 0xffffffff,
+			},
+			expectedErr: command.ErrNotISOTransfer,
+		},
+		{
+			name: "Packet exceeds TransferBufferLength",
+			cmd: func() command.CmdSubmit {
+				cmd := newISOCmdSubmit(command.DIR_IN, nil)
+				cmd.ISOPacketDescriptors[2].ExpectedLength = 5
+				return cmd
+			}(),
+			expectedErr: command.ErrInvalidISOPacket,
+		},
+		{
+			name: "NumberOfPackets mismatch",
+			cmd: func() command.CmdSubmit {
+				cmd := newISOCmdSubmit(command.DIR_IN, nil)
+				cmd.NumberOfPackets = 2
+				return cmd
+			}(),
+			expectedErr: command.ErrInvalidISOPacket,
+		},
+		{
+			name:        "OUT buffer matches neither layout",
+			cmd:         newISOCmdSubmit(command.DIR_OUT, []byte{0x01, 0x02}),
+			expectedErr: command.ErrISOBufferMalformed,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			packets, err := test.cmd.ISOPackets()
+			if test.expectedErr != nil {
+				assert.ErrorIs(t, err, test.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedPackets, packets)
+		})
+	}
+}
+
+func TestNewISORetSubmitIN(t *testing.T) {
+	cmd := newISOCmdSubmit(command.DIR_IN, nil)
+
+	ret := command.NewISORetSubmit(cmd, 42, []command.ISOPacketResult{
+		{Data: []byte{0x01, 0x02}},
+		{Data: []byte{0x03, 0x04, 0x05, 0x06, 0x07}},
+	})
+
+	assert.Equal(t, command.RET_SUBMIT, ret.Command)
+	assert.Equal(t, uint32(7), ret.SeqNum)
+	assert.Equal(t, command.URB_STATUS_OK, ret.Status)
+	assert.Equal(t, uint32(42), ret.StartFrame)
+	assert.Equal(t, uint32(3), ret.NumberOfPackets)
+	assert.Equal(t, uint32(2), ret.ErrorCount)
+	assert.Equal(t, uint32(6), ret.ActualLength)
+	assert.Equal(t, []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06}, ret.TransferBuffer)
+	assert.Equal(t, []command.ISOPacketDescriptor{
+		{Offset: 0, ExpectedLength: 3, ActualLength: 2, Status: command.URB_STATUS_OK},
+		{Offset: 4, ExpectedLength: 4, ActualLength: 4, Status: command.URB_STATUS_OVERFLOW},
+		{Offset: 8, ExpectedLength: 2, ActualLength: 0, Status: command.URB_STATUS_PARTIAL},
+	}, ret.ISOPacketDescriptors)
+}
+
+func TestNewISORetSubmitOUT(t *testing.T) {
+	cmd := newISOCmdSubmit(command.DIR_OUT, make([]byte, 12))
+
+	ret := command.NewISORetSubmit(cmd, 3, []command.ISOPacketResult{
+		{},
+		{ActualLength: 1},
+		{Status: command.URB_STATUS_PROTOCOL_ERROR},
+	})
+
+	assert.Nil(t, ret.TransferBuffer)
+	assert.Equal(t, uint32(1), ret.ErrorCount)
+	assert.Equal(t, uint32(4), ret.ActualLength)
+	assert.Equal(t, []command.ISOPacketDescriptor{
+		{Offset: 0, ExpectedLength: 3, ActualLength: 3, Status: command.URB_STATUS_OK},
+		{Offset: 4, ExpectedLength: 4, ActualLength: 1, Status: command.URB_STATUS_OK},
+		{Offset: 8, ExpectedLength: 2, ActualLength: 0, Status: command.URB_STATUS_PROTOCOL_ERROR},
+	}, ret.ISOPacketDescriptors)
+
+	ret = command.NewISORetSubmit(command.CmdSubmit{NumberOfPackets: 0xffffffff}, 0, nil)
+	assert.Equal(t, command.URB_STATUS_PROTOCOL_ERROR, ret.Status)
+}
@@ -0,0 +1,81 @@
+package command
+
+// NormalizeRetSubmit enforces USB/IP semantics on RetSubmit returned by device for given CmdSubmit,
+// so that device logic does not need to size reply buffers by hand.
+//
+// For IN transfers:
+//
+// - Data longer than TransferBufferLength is truncated. For non-control endpoints, the status becomes URB_STATUS_OVERFLOW,
+// as device sent more data than requested. Control transfers are truncated silently, as descriptors are commonly read partially.
+// - ActualLength is set to length of the data.
+// - If URB_SHORT_NOT_OK is set and the data is shorter than TransferBufferLength, the status becomes URB_STATUS_SHORT_PACKET.
+//
+// For OUT transfers:
+//
+// - TransferBuffer is removed, as it's not sent back to client.
+// - If ActualLength is zero with success status, all data is considered as consumed by device, so it's set to TransferBufferLength.
+// - ActualLength never exceeds TransferBufferLength.
+// - URB_ZERO_PACKET does not change ActualLength, as the terminating zero-length packet carries no data.
+//
+// For ISO transfers, packets are rebuilt by NewISORetSubmit, as vhci-hcd drops the connection if they're inconsistent:
+//
+// - Packet descriptors are taken from CmdSubmit. If the device replied a different number of packets,
+// its data is assigned to packets in order based on their ExpectedLength, as NewRetSubmit does.
+// - IN data is consumed back-to-back by ActualLength of packets. Packet longer than its ExpectedLength is truncated with URB_STATUS_OVERFLOW.
+// - OUT packet with zero ActualLength and success status is considered as consumed completely.
+// - ActualLength and ErrorCount are recomputed from the packets, StartFrame and Status of the reply are kept.
+func NormalizeRetSubmit(cmd CmdSubmit, ret RetSubmit) RetSubmit {
+	if cmd.IsISO() {
+		return normalizeISORetSubmit(cmd, ret)
+	}
+
+	if cmd.Direction == DIR_OUT {
+		ret.TransferBuffer = nil
+		if ret.ActualLength == 0 && ret.Status == URB_STATUS_OK {
+			ret.ActualLength = cmd.TransferBufferLength
+		}
+		ret.ActualLength = min(ret.ActualLength, cmd.TransferBufferLength)
+
+		return ret
+	}
+
+	if len(ret.TransferBuffer) > int(cmd.TransferBufferLength) {
+		ret.TransferBuffer = ret.TransferBuffer[:cmd.TransferBufferLength]
+		if cmd.EndpointNumber != 0 && ret.Status == URB_STATUS_OK {
+			ret.Status = URB_STATUS_OVERFLOW
+		}
+	}
+	ret.ActualLength = uint32(len(ret.TransferBuffer))
+	if cmd.TransferFlags.ShortNotOK() && ret.ActualLength < cmd.TransferBufferLength && ret.Status == URB_STATUS_OK {
+		ret.Status = URB_STATUS_SHORT_PACKET
+	}
+
+	return ret
+}
+
+func normalizeISORetSubmit(cmd CmdSubmit, ret RetSubmit) RetSubmit {
+	packets := ret.ISOPacketDescriptors
+	if len(packets) != len(cmd.ISOPacketDescriptors) {
+		packets = NewRetSubmit(cmd, ret.Status, ret.TransferBuffer).ISOPacketDescriptors
+	}
+
+	results := make([]ISOPacketResult, len(packets))
+	data := ret.TransferBuffer
+	for i, packet := range packets {
+		results[i] = ISOPacketResult{
+			ActualLength: packet.ActualLength,
+			Status:       packet.Status,
+		}
+		if cmd.Direction == DIR_IN {
+			length := min(packet.ActualLength, uint32(len(data)))
+			results[i].Data = data[:length]
+			data = data[length:]
+		}
+	}
+
+	normalized := NewISORetSubmit(cmd, ret.StartFrame, results)
+	normalized.CmdHeader = ret.CmdHeader
+	normalized.Status = ret.Status
+
+	return normalized
+}
@@ -0,0 +1,280 @@
+package command_test
+
+import (
+	"testing"
+
+	"github.com/ntchjb/usbip-virtual-device/usbip/protocol/command"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeRetSubmit(t *testing.T) {
+	tests := []struct {
+		name        string
+		cmd         command.CmdSubmit
+		ret         command.RetSubmit
+		expectedRet command.RetSubmit
+	}{
+		{
+			name: "IN data is truncated silently for control endpoint",
+			cmd: command.CmdSubmit{
+				CmdHeader: command.CmdHeader{
+					Direction:      command.DIR_IN,
+					EndpointNumber: 0,
+				},
+				TransferBufferLength: 2,
+				NumberOfPackets:      0xffffffff,
+			},
+			ret: command.RetSubmit{
+				Status:         command.URB_STATUS_OK,
+				ActualLength:   64,
+				TransferBuffer: []byte{0x01, 0x02, 0x03, 0x04},
+			},
+			expectedRet: command.RetSubmit{
+				Status:         command.URB_STATUS_OK,
+				ActualLength:   2,
+				TransferBuffer: []byte{0x01, 0x02},
+			},
+		},
+		{
+			name: "IN data overflows on non-control endpoint",
+			cmd: command.CmdSubmit{
+				CmdHeader: command.CmdHeader{
+					Direction:      command.DIR_IN,
+					EndpointNumber: 1,
+				},
+				TransferBufferLength: 2,
+				NumberOfPackets:      0xffffffff,
+			},
+			ret: command.RetSubmit{
+				TransferBuffer: []byte{0x01, 0x02, 0x03},
+			},
+			expectedRet: command.RetSubmit{
+				Status:         command.URB_STATUS_OVERFLOW,
+				ActualLength:   2,
+				TransferBuffer: []byte{0x01, 0x02},
+			},
+		},
+		{
+			name: "Short IN data is allowed by default",
+			cmd: command.CmdSubmit{
+				CmdHeader: command.CmdHeader{
+					Direction:      command.DIR_IN,
+					EndpointNumber: 1,
+				},
+				TransferBufferLength: 8,
+				NumberOfPackets:      0xffffffff,
+			},
+			ret: command.RetSubmit{
+				TransferBuffer: []byte{0x01, 0x02, 0x03},
+			},
+			expectedRet: command.RetSubmit{
+				Status:         command.URB_STATUS_OK,
+				ActualLength:   3,
+				TransferBuffer: []byte{0x01, 0x02, 0x03},
+			},
+		},
+		{
+			name: "Short IN data with URB_SHORT_NOT_OK",
+			cmd: command.CmdSubmit{
+				CmdHeader: command.CmdHeader{
+					Direction:      command.DIR_IN,
+					EndpointNumber: 1,
+				},
+				TransferFlags:        command.URB_SHORT_NOT_OK | command.URB_DIR_IN,
+				TransferBufferLength: 8,
+				NumberOfPackets:      0xffffffff,
+			},
+			ret: command.RetSubmit{
+				TransferBuffer: []byte{0x01, 0x02, 0x03},
+			},
+			expectedRet: command.RetSubmit{
+				Status:         command.URB_STATUS_SHORT_PACKET,
+				ActualLength:   3,
+				TransferBuffer: []byte{0x01, 0x02, 0x03},
+			},
+		},
+		{
+			name: "Error status of IN is kept",
+			cmd: command.CmdSubmit{
+				CmdHeader: command.CmdHeader{
+					Direction:      command.DIR_IN,
+					EndpointNumber: 1,
+				},
+				TransferFlags:        command.URB_SHORT_NOT_OK,
+				TransferBufferLength: 8,
+				NumberOfPackets:      0xffffffff,
+			},
+			ret: command.RetSubmit{
+				Status: command.URB_STATUS_STALL,
+			},
+			expectedRet: command.RetSubmit{
+				Status: command.URB_STATUS_STALL,
+			},
+		},
+		{
+			name: "OUT data is consumed completely by default",
+			cmd: command.CmdSubmit{
+				CmdHeader: command.CmdHeader{
+					Direction:      command.DIR_OUT,
+					EndpointNumber: 1,
+				},
+				TransferFlags:        command.URB_ZERO_PACKET,
+				TransferBufferLength: 4,
+				NumberOfPackets:      0xffffffff,
+				TransferBuffer:       []byte{0x01, 0x02, 0x03, 0x04},
+			},
+			ret: command.RetSubmit{
+				TransferBuffer: []byte{0x01, 0x02, 0x03, 0x04},
+			},
+			expectedRet: command.RetSubmit{
+				Status:       command.URB_STATUS_OK,
+				ActualLength: 4,
+			},
+		},
+		{
+			name: "OUT data is consumed partially",
+			cmd: command.CmdSubmit{
+				CmdHeader: command.CmdHeader{
+					Direction:      command.DIR_OUT,
+					EndpointNumber: 1,
+				},
+				TransferBufferLength: 4,
+				NumberOfPackets:      0xffffffff,
+				TransferBuffer:       []byte{0x01, 0x02, 0x03, 0x04},
+			},
+			ret: command.RetSubmit{
+				ActualLength: 3,
+			},
+			expectedRet: command.RetSubmit{
+				Status:       command.URB_STATUS_OK,
+				ActualLength: 3,
+			},
+		},
+		{
+			name: "OUT ActualLength never exceeds TransferBufferLength",
+			cmd: command.CmdSubmit{
+				CmdHeader: command.CmdHeader{
+					Direction:      command.DIR_OUT,
+					EndpointNumber: 1,
+				},
+				TransferBufferLength: 4,
+				NumberOfPackets:      0xffffffff,
+				TransferBuffer:       []byte{0x01, 0x02, 0x03, 0x04},
+			},
+			ret: command.RetSubmit{
+				Status:       command.URB_STATUS_STALL,
+				ActualLength: 10,
+			},
+			expectedRet: command.RetSubmit{
+				Status:       command.URB_STATUS_STALL,
+				ActualLength: 4,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			assert.Equal(t, test.expectedRet, command.NormalizeRetSubmit(test.cmd, test.ret))
+		})
+	}
+}
+
+func TestNormalizeRetSubmitISO(t *testing.T) {
+	tests := []struct {
+		name        string
+		cmd         command.CmdSubmit
+		ret         command.RetSubmit
+		expectedRet command.RetSubmit
+	}{
+		{
+			name: "IN data without packets is assigned to packets in order",
+			cmd:  newISOCmdSubmit(command.DIR_IN, nil),
+			ret: command.RetSubmit{
+				CmdHeader:      command.CmdHeader{Command: command.RET_SUBMIT, SeqNum: 7},
+				StartFrame:     5,
+				TransferBuffer: []byte{0x01, 0x02, 0x03, 0x04, 0x05},
+			},
+			expectedRet: command.RetSubmit{
+				CmdHeader:       command.CmdHeader{Command: command.RET_SUBMIT, SeqNum: 7},
+				ActualLength:    5,
+				StartFrame:      5,
+				NumberOfPackets: 3,
+				TransferBuffer:  []byte{0x01, 0x02, 0x03, 0x04, 0x05},
+				ISOPacketDescriptors: []command.ISOPacketDescriptor{
+					{Offset: 0, ExpectedLength: 3, ActualLength: 3},
+					{Offset: 4, ExpectedLength: 4, ActualLength: 2},
+					{Offset: 8, ExpectedLength: 2, ActualLength: 0},
+				},
+			},
+		},
+		{
+			name: "IN packets are limited to ExpectedLength and data",
+			cmd:  newISOCmdSubmit(command.DIR_IN, nil),
+			ret: command.RetSubmit{
+				ActualLength:    100,
+				NumberOfPackets: 3,
+				ErrorCount:      0,
+				TransferBuffer:  []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07},
+				ISOPacketDescriptors: []command.ISOPacketDescriptor{
+					{ActualLength: 1},
+					{ActualLength: 5},
+					{ActualLength: 2},
+				},
+			},
+			expectedRet: command.RetSubmit{
+				ActualLength:    6,
+				NumberOfPackets: 3,
+				ErrorCount:      1,
+				TransferBuffer:  []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x07},
+				ISOPacketDescriptors: []command.ISOPacketDescriptor{
+					{Offset: 0, ExpectedLength: 3, ActualLength: 1},
+					{Offset: 4, ExpectedLength: 4, ActualLength: 4, Status: command.URB_STATUS_OVERFLOW},
+					{Offset: 8, ExpectedLength: 2, ActualLength: 1},
+				},
+			},
+		},
+		{
+			name: "OUT data is consumed completely by default",
+			cmd:  newISOCmdSubmit(command.DIR_OUT, make([]byte, 12)),
+			ret: command.RetSubmit{
+				TransferBuffer: make([]byte, 12),
+			},
+			expectedRet: command.RetSubmit{
+				ActualLength:    9,
+				NumberOfPackets: 3,
+				ISOPacketDescriptors: []command.ISOPacketDescriptor{
+					{Offset: 0, ExpectedLength: 3, ActualLength: 3},
+					{Offset: 4, ExpectedLength: 4, ActualLength: 4},
+					{Offset: 8, ExpectedLength: 2, ActualLength: 2},
+				},
+			},
+		},
+		{
+			name: "Error status is kept",
+			cmd:  newISOCmdSubmit(command.DIR_OUT, make([]byte, 12)),
+			ret: command.RetSubmit{
+				Status: command.URB_STATUS_STALL,
+			},
+			expectedRet: command.RetSubmit{
+				Status:          command.URB_STATUS_STALL,
+				NumberOfPackets: 3,
+				ErrorCount:      3,
+				ISOPacketDescriptors: []command.ISOPacketDescriptor{
+					{Offset: 0, ExpectedLength: 3, Status: command.URB_STATUS_STALL},
+					{Offset: 4, ExpectedLength: 4, Status: command.URB_STATUS_STALL},
+					{Offset: 8, ExpectedLength: 2, Status: command.URB_STATUS_STALL},
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			assert.Equal(t, test.expectedRet, command.NormalizeRetSubmit(test.cmd, test.ret))
+		})
+	}
+}
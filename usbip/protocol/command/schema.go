@@ -38,7 +38,7 @@ type ISOPacketDescriptor struct {
 	Offset         uint32
 	ExpectedLength uint32
 	ActualLength   uint32
-	Status         uint32
+	Status         URBStatus
 }
 
 // Submit an URB
@@ -47,7 +47,7 @@ type ISOPacketDescriptor struct {
 type CmdSubmit struct {
 	CmdHeader
 	// possible values depend on the USBIP_URB transfer_flags. Refer to include/uapi/linux/usbip.h and USB Request Block (URB). Refer to usbip_pack_cmd_submit() and tweak_transfer_flags() in drivers/usb/usbip/ usbip_common.c.
-	TransferFlags uint32
+	TransferFlags TransferFlags
 	// use URB transfer_buffer_length
 	TransferBufferLength uint32
 	// use URB start_frame; initial frame for ISO transfer; shall be set to 0 if not ISO transfer
@@ -72,7 +72,7 @@ type CmdSubmit struct {
 type RetSubmit struct {
 	CmdHeader
 	// zero for successful URB transaction, otherwise some kind of error happened.
-	Status uint32
+	Status URBStatus
 	// number of URB data bytes; use URB actual_length
 	ActualLength uint32
 	// use URB start_frame; initial frame for ISO transfer; shall be set to 0 if not ISO transfer
@@ -108,7 +108,7 @@ type CmdUnlink struct {
 type RetUnlink struct {
 	CmdHeader
 	// This is similar to the status of USBIP_RET_SUBMIT (share the same memory offset). When UNLINK is successful, status is -ECONNRESET; when USBIP_CMD_UNLINK is after USBIP_RET_SUBMIT status is 0
-	Status int32
+	Status URBStatus
 	// padding, shall be set to 0
 	Padding [24]byte
 }
@@ -121,3 +121,12 @@ const (
 	CMD_UNLINK_STATIC_FIELDS_LENGTH = 28
 	RET_UNLINK_STATIC_FIELDS_LENGTH = 28
 )
+
+// SubmitLimits bounds memory allocated when decoding CmdSubmit from an untrusted stream.
+// Zero value of each field means no limit.
+type SubmitLimits struct {
+	// maximum TransferBufferLength, for both directions
+	MaxTransferBufferLength uint32
+	// maximum NumberOfPackets of ISO transfer
+	MaxISOPackets uint32
+}
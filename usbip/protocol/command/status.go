@@ -0,0 +1,155 @@
+package command
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// URBStatus is status of URB used in RetSubmit, RetUnlink and ISOPacketDescriptor.
+// It's zero for success, otherwise it's negative errno value of Linux, as expected by vhci-hcd driver.
+//
+// URBStatus implements error, so that device logic can return it as an error, see StatusFromError.
+type URBStatus int32
+
+// Errno values are of Linux, not of the platform running the server
+const (
+	URB_STATUS_OK URBStatus = 0
+	// Endpoint stalled, or control request is not supported (-EPIPE)
+	URB_STATUS_STALL URBStatus = -32
+	// URB is unlinked synchronously (-ENOENT)
+	URB_STATUS_NOT_FOUND URBStatus = -2
+	// URB is unlinked asynchronously (-ECONNRESET)
+	URB_STATUS_UNLINKED URBStatus = -104
+	// Device returned more data than TransferBufferLength (-EOVERFLOW)
+	URB_STATUS_OVERFLOW URBStatus = -75
+	// Device returned less data than TransferBufferLength while URB_SHORT_NOT_OK is set (-EREMOTEIO)
+	URB_STATUS_SHORT_PACKET URBStatus = -121
+	// Transfer is timed out (-ETIMEDOUT)
+	URB_STATUS_TIMEOUT URBStatus = -110
+	// Protocol error, such as bitstuff error or no response (-EPROTO)
+	URB_STATUS_PROTOCOL_ERROR URBStatus = -71
+	// Server has no resources to process URB (-ENOMEM)
+	URB_STATUS_NO_MEMORY URBStatus = -12
+	// URB is still being processed (-EINPROGRESS)
+	URB_STATUS_IN_PROGRESS URBStatus = -115
+	// Device is disconnected (-ESHUTDOWN)
+	URB_STATUS_SHUTDOWN URBStatus = -108
+	// ISO transfer is partially completed (-EXDEV)
+	URB_STATUS_PARTIAL URBStatus = -18
+)
+
+var urbStatusNames = map[URBStatus]string{
+	URB_STATUS_OK:             "OK",
+	URB_STATUS_STALL:          "EPIPE",
+	URB_STATUS_NOT_FOUND:      "ENOENT",
+	URB_STATUS_UNLINKED:       "ECONNRESET",
+	URB_STATUS_OVERFLOW:       "EOVERFLOW",
+	URB_STATUS_SHORT_PACKET:   "EREMOTEIO",
+	URB_STATUS_TIMEOUT:        "ETIMEDOUT",
+	URB_STATUS_PROTOCOL_ERROR: "EPROTO",
+	URB_STATUS_NO_MEMORY:      "ENOMEM",
+	URB_STATUS_IN_PROGRESS:    "EINPROGRESS",
+	URB_STATUS_SHUTDOWN:       "ESHUTDOWN",
+	URB_STATUS_PARTIAL:        "EXDEV",
+}
+
+func (s URBStatus) String() string {
+	if name, ok := urbStatusNames[s]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("%d", int32(s))
+}
+
+func (s URBStatus) Error() string {
+	return fmt.Sprintf("URB status %d (%s)", int32(s), s.String())
+}
+
+// StatusFromError converts error returned by device logic to URBStatus
+//
+// - nil is URB_STATUS_OK
+// - URBStatus, or error wrapping it, is the status itself
+// - context.Canceled is URB_STATUS_UNLINKED, as URB context is cancelled by unlinking
+// - context.DeadlineExceeded is URB_STATUS_TIMEOUT
+// - Other errors are URB_STATUS_PROTOCOL_ERROR
+func StatusFromError(err error) URBStatus {
+	var status URBStatus
+
+	switch {
+	case err == nil:
+		return URB_STATUS_OK
+	case errors.As(err, &status):
+		return status
+	case errors.Is(err, context.Canceled):
+		return URB_STATUS_UNLINKED
+	case errors.Is(err, context.DeadlineExceeded):
+		return URB_STATUS_TIMEOUT
+	default:
+		return URB_STATUS_PROTOCOL_ERROR
+	}
+}
+
+// NewRetSubmit returns RetSubmit replying given CmdSubmit with given status and data.
+//
+// For ISO transfer, data of packets should be placed back-to-back without padding,
+// and it's assigned to packets in order based on their ExpectedLength.
+func NewRetSubmit(cmd CmdSubmit, status URBStatus, data []byte) RetSubmit {
+	ret := RetSubmit{
+		CmdHeader: CmdHeader{
+			Command: RET_SUBMIT,
+			SeqNum:  cmd.SeqNum,
+		},
+		Status:          status,
+		ActualLength:    uint32(len(data)),
+		NumberOfPackets: 0xffffffff,
+		TransferBuffer:  data,
+	}
+
+	if cmd.IsISO() {
+		ret.StartFrame = cmd.StartFrame
+		ret.NumberOfPackets = cmd.NumberOfPackets
+		ret.ISOPacketDescriptors = make([]ISOPacketDescriptor, len(cmd.ISOPacketDescriptors))
+		remaining := uint32(len(data))
+		for i, packet := range cmd.ISOPacketDescriptors {
+			actualLength := min(packet.ExpectedLength, remaining)
+			remaining -= actualLength
+			ret.ISOPacketDescriptors[i] = ISOPacketDescriptor{
+				Offset:         packet.Offset,
+				ExpectedLength: packet.ExpectedLength,
+				ActualLength:   actualLength,
+				Status:         status,
+			}
+			if status != URB_STATUS_OK {
+				ret.ErrorCount++
+			}
+		}
+	}
+
+	return ret
+}
+
+// NewSuccessRetSubmit returns successful RetSubmit with given data
+func NewSuccessRetSubmit(cmd CmdSubmit, data []byte) RetSubmit {
+	return NewRetSubmit(cmd, URB_STATUS_OK, data)
+}
+
+// NewStallRetSubmit returns RetSubmit indicating that endpoint is stalled, or control request is not supported
+func NewStallRetSubmit(cmd CmdSubmit) RetSubmit {
+	return NewRetSubmit(cmd, URB_STATUS_STALL, nil)
+}
+
+// NewShortPacketRetSubmit returns RetSubmit with data shorter than expected, for URB with URB_SHORT_NOT_OK flag
+func NewShortPacketRetSubmit(cmd CmdSubmit, data []byte) RetSubmit {
+	return NewRetSubmit(cmd, URB_STATUS_SHORT_PACKET, data)
+}
+
+// NewTimeoutRetSubmit returns RetSubmit indicating that transfer is timed out
+func NewTimeoutRetSubmit(cmd CmdSubmit) RetSubmit {
+	return NewRetSubmit(cmd, URB_STATUS_TIMEOUT, nil)
+}
+
+// NewErrorRetSubmit returns RetSubmit with status converted from given error by StatusFromError
+func NewErrorRetSubmit(cmd CmdSubmit, err error) RetSubmit {
+	return NewRetSubmit(cmd, StatusFromError(err), nil)
+}
@@ -0,0 +1,140 @@
+package command_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/ntchjb/usbip-virtual-device/usbip/protocol/command"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatusFromError(t *testing.T) {
+	tests := []struct {
+		name           string
+		err            error
+		expectedStatus command.URBStatus
+	}{
+		{
+			name:           "nil",
+			err:            nil,
+			expectedStatus: command.URB_STATUS_OK,
+		},
+		{
+			name:           "URBStatus",
+			err:            command.URB_STATUS_STALL,
+			expectedStatus: command.URB_STATUS_STALL,
+		},
+		{
+			name:           "Wrapped URBStatus",
+			err:            fmt.Errorf("unsupported request: %w", command.URB_STATUS_OVERFLOW),
+			expectedStatus: command.URB_STATUS_OVERFLOW,
+		},
+		{
+			name:           "Context cancelled",
+			err:            fmt.Errorf("waiting for data: %w", context.Canceled),
+			expectedStatus: command.URB_STATUS_UNLINKED,
+		},
+		{
+			name:           "Context deadline exceeded",
+			err:            context.DeadlineExceeded,
+			expectedStatus: command.URB_STATUS_TIMEOUT,
+		},
+		{
+			name:           "Generic error",
+			err:            errors.New("something went wrong"),
+			expectedStatus: command.URB_STATUS_PROTOCOL_ERROR,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			assert.Equal(t, test.expectedStatus, command.StatusFromError(test.err))
+		})
+	}
+}
+
+func TestURBStatusError(t *testing.T) {
+	assert.Equal(t, "URB status -32 (EPIPE)", command.URB_STATUS_STALL.Error())
+	assert.Equal(t, "URB status -1 (-1)", command.URBStatus(-1).Error())
+}
+
+func TestNewRetSubmit(t *testing.T) {
+	cmd := command.CmdSubmit{
+		CmdHeader: command.CmdHeader{
+			Command:        command.CMD_SUBMIT,
+			SeqNum:         10,
+			DevID:          0x00010001,
+			Direction:      command.DIR_IN,
+			EndpointNumber: 1,
+		},
+		TransferBufferLength: 64,
+		NumberOfPackets:      0xffffffff,
+	}
+
+	ret := command.NewStallRetSubmit(cmd)
+	buf := new(bytes.Buffer)
+	assert.NoError(t, ret.CmdHeader.Encode(buf))
+	assert.NoError(t, ret.Encode(buf))
+	assert.Equal(t, []byte{
+		0x00, 0x00, 0x00, 0x03, // Command
+		0x00, 0x00, 0x00, 0x0a, // SeqNum
+		0x00, 0x00, 0x00, 0x00, // DevID
+		0x00, 0x00, 0x00, 0x00, // Direction
+		0x00, 0x00, 0x00, 0x00, // EndpointNumber
+
+		0xff, 0xff, 0xff, 0xe0, // Status -EPIPE
+		0x00, 0x00, 0x00, 0x00, // ActualLength
+		0x00, 0x00, 0x00, 0x00, // StartFrame
+		0xff, 0xff, 0xff, 0xff, // NumberOfPackets
+		0x00, 0x00, 0x00, 0x00, // ErrorCount
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // Padding
+	}, buf.Bytes())
+
+	ret = command.NewSuccessRetSubmit(cmd, []byte{0x01, 0x02})
+	assert.Equal(t, command.URB_STATUS_OK, ret.Status)
+	assert.Equal(t, uint32(2), ret.ActualLength)
+	assert.Equal(t, []byte{0x01, 0x02}, ret.TransferBuffer)
+
+	ret = command.NewErrorRetSubmit(cmd, context.Canceled)
+	assert.Equal(t, command.URB_STATUS_UNLINKED, ret.Status)
+}
+
+func TestNewRetSubmitISO(t *testing.T) {
+	cmd := command.CmdSubmit{
+		CmdHeader: command.CmdHeader{
+			Command:        command.CMD_SUBMIT,
+			SeqNum:         10,
+			Direction:      command.DIR_IN,
+			EndpointNumber: 2,
+		},
+		TransferBufferLength: 12,
+		StartFrame:           100,
+		NumberOfPackets:      3,
+		ISOPacketDescriptors: []command.ISOPacketDescriptor{
+			{Offset: 0, ExpectedLength: 4},
+			{Offset: 4, ExpectedLength: 4},
+			{Offset: 8, ExpectedLength: 4},
+		},
+	}
+
+	ret := command.NewSuccessRetSubmit(cmd, []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06})
+	assert.Equal(t, uint32(3), ret.NumberOfPackets)
+	assert.Equal(t, uint32(100), ret.StartFrame)
+	assert.Equal(t, uint32(0), ret.ErrorCount)
+	assert.Equal(t, []command.ISOPacketDescriptor{
+		{Offset: 0, ExpectedLength: 4, ActualLength: 4},
+		{Offset: 4, ExpectedLength: 4, ActualLength: 2},
+		{Offset: 8, ExpectedLength: 4, ActualLength: 0},
+	}, ret.ISOPacketDescriptors)
+
+	ret = command.NewTimeoutRetSubmit(cmd)
+	assert.Equal(t, uint32(3), ret.ErrorCount)
+	for _, packet := range ret.ISOPacketDescriptors {
+		assert.Equal(t, command.URB_STATUS_TIMEOUT, packet.Status)
+	}
+}
@@ -2,27 +2,54 @@ package command
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 
 	"github.com/ntchjb/usbip-virtual-device/usbip/stream"
 )
 
+var (
+	ErrTransferBufferTooLarge = errors.New("TransferBufferLength exceeds limit")
+	ErrTooManyISOPackets      = errors.New("NumberOfPackets exceeds limit")
+)
+
+// IsISO returns true if this URB is ISO transfer, which has ISO packet descriptors
+func (c *CmdSubmit) IsISO() bool {
+	return c.NumberOfPackets != 0x00000000 && c.NumberOfPackets != 0xffffffff
+}
+
 // Decode read data from stream and store in struct.
 // Note that this function does not decode CmdHeader, which should be done already during connection handling
 func (c *CmdSubmit) Decode(reader io.Reader) error {
+	return c.DecodeWithLimits(reader, SubmitLimits{})
+}
+
+// DecodeWithLimits is similar to Decode, but it validates TransferBufferLength and NumberOfPackets against given limits
+// before allocating memory for them, so that a malicious header cannot make it allocate huge buffer.
+//
+// If limit is exceeded, ErrTransferBufferTooLarge or ErrTooManyISOPackets is returned,
+// and the rest of CmdSubmit is left unread in the stream.
+func (c *CmdSubmit) DecodeWithLimits(reader io.Reader, limits SubmitLimits) error {
 	staticFieldBuf, err := stream.Read(reader, CMD_SUBMIT_STATIC_FIELDS_LENGTH)
 	if err != nil {
 		return fmt.Errorf("unable to read CmdSubmit static fields from stream: %w", err)
 	}
 
-	c.TransferFlags = binary.BigEndian.Uint32(staticFieldBuf[:4])
+	c.TransferFlags = TransferFlags(binary.BigEndian.Uint32(staticFieldBuf[:4]))
 	c.TransferBufferLength = binary.BigEndian.Uint32(staticFieldBuf[4:8])
 	c.StartFrame = binary.BigEndian.Uint32(staticFieldBuf[8:12])
 	c.NumberOfPackets = binary.BigEndian.Uint32(staticFieldBuf[12:16])
 	c.Interval = binary.BigEndian.Uint32(staticFieldBuf[16:20])
 	copy(c.Setup[:], staticFieldBuf[20:28])
 
+	if limits.MaxTransferBufferLength > 0 && c.TransferBufferLength > limits.MaxTransferBufferLength {
+		return fmt.Errorf("%w: %d > %d", ErrTransferBufferTooLarge, c.TransferBufferLength, limits.MaxTransferBufferLength)
+	}
+	if limits.MaxISOPackets > 0 && c.NumberOfPackets != 0xffffffff && c.NumberOfPackets > limits.MaxISOPackets {
+		return fmt.Errorf("%w: %d > %d", ErrTooManyISOPackets, c.NumberOfPackets, limits.MaxISOPackets)
+	}
+
 	if c.TransferBufferLength > 0 && c.Direction == DIR_OUT {
 		transferBuf, err := stream.Read(reader, int(c.TransferBufferLength))
 		if err != nil {
@@ -56,7 +83,7 @@ func (c *CmdSubmit) Encode(writer io.Writer) error {
 	}
 
 	buf := make([]byte, CMD_SUBMIT_STATIC_FIELDS_LENGTH)
-	binary.BigEndian.PutUint32(buf[:4], c.TransferFlags)
+	binary.BigEndian.PutUint32(buf[:4], uint32(c.TransferFlags))
 	binary.BigEndian.PutUint32(buf[4:8], c.TransferBufferLength)
 	binary.BigEndian.PutUint32(buf[8:12], c.StartFrame)
 	binary.BigEndian.PutUint32(buf[12:16], c.NumberOfPackets)
@@ -90,7 +117,7 @@ func (c *RetSubmit) Decode(reader io.Reader) error {
 		return fmt.Errorf("unable to read RetSubmit from stream: %w", err)
 	}
 
-	c.Status = binary.BigEndian.Uint32(buf[:4])
+	c.Status = URBStatus(binary.BigEndian.Uint32(buf[:4]))
 	c.ActualLength = binary.BigEndian.Uint32(buf[4:8])
 	c.StartFrame = binary.BigEndian.Uint32(buf[8:12])
 	c.NumberOfPackets = binary.BigEndian.Uint32(buf[12:16])
@@ -131,7 +158,7 @@ func (c *RetSubmit) Encode(writer io.Writer) error {
 
 	buf := make([]byte, RET_SUBMIT_STATIC_FIELDS_LENGTH)
 
-	binary.BigEndian.PutUint32(buf[:4], c.Status)
+	binary.BigEndian.PutUint32(buf[:4], uint32(c.Status))
 	binary.BigEndian.PutUint32(buf[4:8], c.ActualLength)
 	binary.BigEndian.PutUint32(buf[8:12], c.StartFrame)
 	binary.BigEndian.PutUint32(buf[12:16], c.NumberOfPackets)
@@ -372,3 +372,77 @@ func TestCmdSubmit(t *testing.T) {
 		})
 	}
 }
+
+func TestCmdSubmitDecodeWithLimits(t *testing.T) {
+	limits := command.SubmitLimits{
+		MaxTransferBufferLength: 4,
+		MaxISOPackets:           2,
+	}
+	tests := []struct {
+		name          string
+		direction     command.Direction
+		staticFields  []byte
+		expectedError error
+	}{
+		{
+			name:      "Within limits",
+			direction: command.DIR_OUT,
+			staticFields: []byte{
+				0x00, 0x00, 0x00, 0x00,
+				0x00, 0x00, 0x00, 0x04,
+				0x00, 0x00, 0x00, 0x00,
+				0xff, 0xff, 0xff, 0xff,
+				0x00, 0x00, 0x00, 0x00,
+				0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+				0x01, 0x02, 0x03, 0x04,
+			},
+		},
+		{
+			name:      "TransferBufferLength too large for DIR_IN",
+			direction: command.DIR_IN,
+			staticFields: []byte{
+				0x00, 0x00, 0x00, 0x00,
+				0xff, 0xff, 0xff, 0xff,
+				0x00, 0x00, 0x00, 0x00,
+				0xff, 0xff, 0xff, 0xff,
+				0x00, 0x00, 0x00, 0x00,
+				0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			},
+			expectedError: command.ErrTransferBufferTooLarge,
+		},
+		{
+			name:      "Too many ISO packets",
+			direction: command.DIR_IN,
+			staticFields: []byte{
+				0x00, 0x00, 0x00, 0x00,
+				0x00, 0x00, 0x00, 0x00,
+				0x00, 0x00, 0x00, 0x00,
+				0x7f, 0xff, 0xff, 0xff,
+				0x00, 0x00, 0x00, 0x00,
+				0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			},
+			expectedError: command.ErrTooManyISOPackets,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			cmd := command.CmdSubmit{
+				CmdHeader: command.CmdHeader{
+					Direction: test.direction,
+				},
+			}
+			err := cmd.DecodeWithLimits(bytes.NewBuffer(test.staticFields), limits)
+
+			if test.expectedError != nil {
+				assert.ErrorIs(t, err, test.expectedError)
+				assert.Nil(t, cmd.TransferBuffer)
+				assert.Nil(t, cmd.ISOPacketDescriptors)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
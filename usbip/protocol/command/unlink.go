@@ -45,7 +45,7 @@ func (c *RetUnlink) Decode(reader io.Reader) error {
 		return fmt.Errorf("unable to read RetUnlink from stream: %w", err)
 	}
 
-	c.Status = int32(binary.BigEndian.Uint32(buf[:4]))
+	c.Status = URBStatus(binary.BigEndian.Uint32(buf[:4]))
 	copy(c.Padding[:], buf[4:28])
 
 	return nil
@@ -21,10 +21,26 @@ type USBIPServer interface {
 	Close() error
 }
 
+const (
+	DEFAULT_MAX_TRANSFER_BUFFER_LENGTH = 16 * 1024 * 1024
+	// Same as USBIP_MAX_ISO_PACKETS of Linux USB/IP stub driver
+	DEFAULT_MAX_ISO_PACKETS     = 1024
+	DEFAULT_MAX_IN_FLIGHT_BYTES = 64 * 1024 * 1024
+)
+
 type USBIPServerConfig struct {
 	ListenAddress        string
 	TCPConnectionTimeout time.Duration
 	MaxTCPConnection     uint
+	// MaxTransferBufferLength is maximum TransferBufferLength of a CmdSubmit.
+	// Connection sending larger CmdSubmit is closed. Zero means DEFAULT_MAX_TRANSFER_BUFFER_LENGTH
+	MaxTransferBufferLength uint32
+	// MaxISOPackets is maximum number of ISO packets of a CmdSubmit.
+	// Connection sending more packets is closed. Zero means DEFAULT_MAX_ISO_PACKETS
+	MaxISOPackets uint32
+	// MaxInFlightBytes is maximum total TransferBufferLength of URBs being processed per connection.
+	// URBs exceeding this budget are replied with -ENOMEM status. Zero means DEFAULT_MAX_IN_FLIGHT_BYTES
+	MaxInFlightBytes uint64
 }
 
 type usbIPServerImpl struct {
@@ -45,6 +61,15 @@ func NewUSBIPServer(config USBIPServerConfig, registrar usb.DeviceRegistrar, log
 	if logger == nil {
 		panic(fmt.Errorf("a logger instance required for USB/IP server"))
 	}
+	if config.MaxTransferBufferLength == 0 {
+		config.MaxTransferBufferLength = DEFAULT_MAX_TRANSFER_BUFFER_LENGTH
+	}
+	if config.MaxISOPackets == 0 {
+		config.MaxISOPackets = DEFAULT_MAX_ISO_PACKETS
+	}
+	if config.MaxInFlightBytes == 0 {
+		config.MaxInFlightBytes = DEFAULT_MAX_IN_FLIGHT_BYTES
+	}
 	return &usbIPServerImpl{
 		conf:      config,
 		logger:    logger,
@@ -120,8 +145,15 @@ func (s *usbIPServerImpl) Close() error {
 }
 
 func (s *usbIPServerImpl) handleConnection(conn net.Conn) {
-	worker := handler.NewWorkerPool(conn, s.logger)
-	reqHandler := handler.NewRequestHandler(conn, s.registrar, worker, s.logger)
+	limits := handler.ConnectionLimits{
+		SubmitLimits: command.SubmitLimits{
+			MaxTransferBufferLength: s.conf.MaxTransferBufferLength,
+			MaxISOPackets:           s.conf.MaxISOPackets,
+		},
+		MaxInFlightBytes: s.conf.MaxInFlightBytes,
+	}
+	worker := handler.NewWorkerPool(conn, limits, s.logger)
+	reqHandler := handler.NewRequestHandler(conn, s.registrar, worker, limits, s.logger)
 
 	defer conn.Close()
 	defer worker.Stop()
@@ -137,7 +169,9 @@ func (s *usbIPServerImpl) handleConnection(conn net.Conn) {
 			}
 		case handler.HANDLER_LEVEL_CMD:
 			if err := s.handleCmd(reqHandler); err != nil {
-				if !errors.Is(err, io.EOF) {
+				if errors.Is(err, command.ErrTransferBufferTooLarge) || errors.Is(err, command.ErrTooManyISOPackets) {
+					s.logger.Error("CmdSubmit exceeds limits, closing connection", "addr", conn.RemoteAddr(), "err", err)
+				} else if !errors.Is(err, io.EOF) {
 					s.logger.Error("unable to handle Cmd request", "err", err)
 				}
 				return
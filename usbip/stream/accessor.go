@@ -1,38 +1,58 @@
 package stream
 
 import (
+	"bufio"
 	"errors"
 	"fmt"
 	"io"
 )
 
+const (
+	// Size of read buffer used by NewBufferedReader, which is large enough
+	// to hold a CmdSubmit header with a few packets of bulk transfer
+	READ_BUFFER_SIZE = 64 * 1024
+)
+
 var (
 	ErrIncompleteReadData  error = errors.New("incomplete data read from stream")
 	ErrIncompleteWriteData error = errors.New("incomplete data write to stream")
+	ErrInvalidReadLength   error = errors.New("invalid length of data to be read from stream")
 )
 
-// Read reads data from `reader` and use following conditions
+// Read reads exactly `bufferLength` bytes from `reader`, calling `reader.Read` as many times as needed,
+// so that a frame split into multiple TCP segments is read completely.
 //
-// - If data is read partially (not fully filled `buf` array), then ErrIncompleteReadData is returned
-// - If data is read but no data left, then io.EOF is returned
+// - If no data is read before the stream ends, then io.EOF is returned
+// - If the stream ends after data is read partially (not fully filled `buf` array), then ErrIncompleteReadData is returned
 // - If error occurred, return wrapped error
 // - Else, return buffer
 func Read(reader io.Reader, bufferLength int) ([]byte, error) {
+	if bufferLength < 0 {
+		return nil, fmt.Errorf("%w: %d", ErrInvalidReadLength, bufferLength)
+	}
 	buf := make([]byte, bufferLength)
-	n, err := reader.Read(buf)
-	if err != nil && err != io.EOF {
+	if _, err := io.ReadFull(reader, buf); err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		if err == io.ErrUnexpectedEOF {
+			return nil, ErrIncompleteReadData
+		}
 		return nil, fmt.Errorf("unable to read data from stream: %w", err)
 	}
-	if n == 0 {
-		return nil, io.EOF
-	}
-	if n != len(buf) {
-		return nil, ErrIncompleteReadData
-	}
 
 	return buf, nil
 }
 
+// NewBufferedReader wraps given reader, which should be net.Conn, with a read buffer,
+// so that decoding small fields of a frame does not cost one syscall per field.
+//
+// Once wrapped, all reads from the connection must be done via returned reader,
+// as data may already be buffered in it.
+func NewBufferedReader(reader io.Reader) io.Reader {
+	return bufio.NewReaderSize(reader, READ_BUFFER_SIZE)
+}
+
 // Write writes data to given stream.
 //
 // - If error occurred, return wrapped error
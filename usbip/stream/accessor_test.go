@@ -5,6 +5,7 @@ import (
 	"errors"
 	"io"
 	"testing"
+	"testing/iotest"
 
 	"github.com/ntchjb/usbip-virtual-device/usbip/stream"
 	"github.com/stretchr/testify/assert"
@@ -53,6 +54,38 @@ func TestRead(t *testing.T) {
 			out:          nil,
 			err:          errCranky,
 		},
+		{
+			name: "Successfully read data split into multiple chunks",
+			reader: iotest.OneByteReader(bytes.NewBuffer([]byte{
+				0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0A,
+			})),
+			bufferLength: 5,
+			out:          []byte{0x01, 0x02, 0x03, 0x04, 0x05},
+			err:          nil,
+		},
+		{
+			name: "Successfully read data from buffered reader",
+			reader: stream.NewBufferedReader(iotest.HalfReader(bytes.NewBuffer([]byte{
+				0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0A,
+			}))),
+			bufferLength: 10,
+			out:          []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0A},
+			err:          nil,
+		},
+		{
+			name:         "Zero length read",
+			reader:       bytes.NewBuffer([]byte{}),
+			bufferLength: 0,
+			out:          []byte{},
+			err:          nil,
+		},
+		{
+			name:         "Negative length read",
+			reader:       bytes.NewBuffer([]byte{0x00}),
+			bufferLength: -1,
+			out:          nil,
+			err:          stream.ErrInvalidReadLength,
+		},
 		{
 			name:         "Incomplete data read",
 			reader:       bytes.NewBuffer([]byte{0x00, 0x01, 0x02}),